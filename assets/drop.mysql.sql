@@ -1,4 +1,7 @@
 START TRANSACTION;
 DROP TABLE IF EXISTS `token_requests`;
 DROP TABLE IF EXISTS `oauth_tokens`;
+DROP TABLE IF EXISTS `jwks_key_sets`;
+DROP TABLE IF EXISTS `oauth_client_auth_styles`;
+DROP TABLE IF EXISTS `oauth_data_keys`;
 COMMIT;
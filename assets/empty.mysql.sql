@@ -6,7 +6,7 @@ CREATE TABLE `oauth_tokens`
     `type`                             varchar(16) COLLATE utf8mb4_general_ci                       NOT NULL,
     `grant_type`                       varchar(24) CHARACTER SET latin1 COLLATE latin1_swedish_ci   NOT NULL DEFAULT 'authorization_code',
     `client_id`                        varchar(64) CHARACTER SET latin1 COLLATE latin1_swedish_ci   NOT NULL,
-    `client_secret`                    varchar(256) CHARACTER SET latin1 COLLATE latin1_swedish_ci  NOT NULL,
+    `client_secret`                    text CHARACTER SET latin1 COLLATE latin1_swedish_ci          NOT NULL,
     `client_secret_hash`               varchar(64) CHARACTER SET latin1 COLLATE latin1_swedish_ci   NOT NULL DEFAULT '',
     `username`                         varchar(256) CHARACTER SET latin1 COLLATE latin1_swedish_ci  NOT NULL DEFAULT '',
     `original_refresh_token`           varchar(2048) CHARACTER SET latin1 COLLATE latin1_swedish_ci NOT NULL,
@@ -22,11 +22,52 @@ CREATE TABLE `oauth_tokens`
     `code_verifier`                    varchar(128) COLLATE utf8mb4_general_ci                      NOT NULL DEFAULT '',
     `refresh_token_expires_at`         datetime(6) DEFAULT NULL,
     `nr_of_subsequent_provider_errors` int                                                          NOT NULL DEFAULT '0',
+    `dpop_key`                         text COLLATE utf8mb4_general_ci,
+    `scope`                            varchar(1024) CHARACTER SET latin1 COLLATE latin1_swedish_ci NOT NULL DEFAULT '',
+    `audience`                         varchar(512) CHARACTER SET latin1 COLLATE latin1_swedish_ci  NOT NULL DEFAULT '',
+    `resource`                         varchar(1024) CHARACTER SET latin1 COLLATE latin1_swedish_ci NOT NULL DEFAULT '',
+    `granted_scope`                    varchar(1024) CHARACTER SET latin1 COLLATE latin1_swedish_ci NOT NULL DEFAULT '',
+    `id_token_claims`                  text COLLATE utf8mb4_general_ci,
+    `userinfo`                         text COLLATE utf8mb4_general_ci,
+    `userinfo_fetched_at`              datetime(6) DEFAULT NULL,
+    `exchange_context`                 text COLLATE utf8mb4_general_ci,
+    `last_response_body`               text COLLATE utf8mb4_general_ci,
+    `namespace`                        varchar(64) CHARACTER SET latin1 COLLATE latin1_swedish_ci   NOT NULL DEFAULT '',
     PRIMARY KEY (`id`),
-    UNIQUE KEY `ot_app_client_id_client_secret_refresh_token` (`app`,`client_id`,`client_secret_hash`,`refresh_token_hash`) USING BTREE,
-    KEY                                `ot_app_client_id_client_secret` (`app`,`client_id`,`client_secret`) USING BTREE,
-    KEY                                `ot_app_client_id_client_secret_hash` (`app`,`client_id`,`client_secret_hash`) USING BTREE,
-    KEY                                `ot_app_original_refresh_token` (`app`,`original_refresh_token_hash`) USING BTREE,
-    KEY                                `ot_app_refresh_token` (`app`,`refresh_token_hash`) USING BTREE
+    UNIQUE KEY `ot_app_client_id_client_secret_refresh_token` (`app`,`namespace`,`client_id`,`client_secret_hash`,`refresh_token_hash`,`scope`,`audience`,`resource`) USING BTREE,
+    KEY                                `ot_app_client_id_client_secret_hash` (`app`,`namespace`,`client_id`,`client_secret_hash`) USING BTREE,
+    KEY                                `ot_app_original_refresh_token` (`app`,`namespace`,`original_refresh_token_hash`) USING BTREE,
+    KEY                                `ot_app_refresh_token` (`app`,`namespace`,`refresh_token_hash`) USING BTREE,
+    KEY                                `ot_refresh_token_expires_at` (`refresh_token_expires_at`) USING BTREE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+CREATE TABLE `jwks_key_sets`
+(
+    `jwks_url`   varchar(512) CHARACTER SET latin1 COLLATE latin1_swedish_ci NOT NULL,
+    `key_set`    mediumtext COLLATE utf8mb4_general_ci                       NOT NULL,
+    `fetched_at` datetime(6)                                                 NOT NULL,
+    PRIMARY KEY (`jwks_url`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+CREATE TABLE `oauth_client_auth_styles`
+(
+    `app`        varchar(32) CHARACTER SET latin1 COLLATE latin1_swedish_ci NOT NULL,
+    `client_id`  varchar(64) CHARACTER SET latin1 COLLATE latin1_swedish_ci NOT NULL,
+    `auth_style` varchar(16) CHARACTER SET latin1 COLLATE latin1_swedish_ci NOT NULL,
+    `source`     varchar(16) CHARACTER SET latin1 COLLATE latin1_swedish_ci NOT NULL DEFAULT 'detected',
+    `created_at` datetime(6)                                                NOT NULL,
+    `updated_at` datetime(6)                                                NOT NULL,
+    PRIMARY KEY (`app`,`client_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+CREATE TABLE `oauth_data_keys`
+(
+    `id`          int                                                          NOT NULL AUTO_INCREMENT,
+    `app`         varchar(32) CHARACTER SET latin1 COLLATE latin1_swedish_ci   NOT NULL,
+    `namespace`   varchar(64) CHARACTER SET latin1 COLLATE latin1_swedish_ci   NOT NULL DEFAULT '',
+    `client_id`   varchar(64) CHARACTER SET latin1 COLLATE latin1_swedish_ci   NOT NULL,
+    `key_id`      varchar(255) CHARACTER SET latin1 COLLATE latin1_swedish_ci  NOT NULL,
+    `wrapped_key` text CHARACTER SET latin1 COLLATE latin1_swedish_ci          NOT NULL,
+    `created_at`  datetime(6)                                                  NOT NULL,
+    `updated_at`  datetime(6)                                                  NOT NULL,
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `odk_app_namespace_client_id` (`app`,`namespace`,`client_id`) USING BTREE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
 COMMIT;
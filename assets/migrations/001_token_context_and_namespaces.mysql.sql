@@ -0,0 +1,41 @@
+-- Migrates a database created with an earlier empty.mysql.sql: adds the DPoP
+-- key, the scope, audience and resource of a token, the id token claims and
+-- userinfo, the exchange context, the last response body and the namespace.
+ALTER TABLE `oauth_tokens`
+    ADD COLUMN `dpop_key`            text COLLATE utf8mb4_general_ci AFTER `nr_of_subsequent_provider_errors`,
+    ADD COLUMN `scope`               varchar(1024) CHARACTER SET latin1 COLLATE latin1_swedish_ci NOT NULL DEFAULT '' AFTER `dpop_key`,
+    ADD COLUMN `audience`            varchar(512) CHARACTER SET latin1 COLLATE latin1_swedish_ci  NOT NULL DEFAULT '' AFTER `scope`,
+    ADD COLUMN `resource`            varchar(1024) CHARACTER SET latin1 COLLATE latin1_swedish_ci NOT NULL DEFAULT '' AFTER `audience`,
+    ADD COLUMN `granted_scope`       varchar(1024) CHARACTER SET latin1 COLLATE latin1_swedish_ci NOT NULL DEFAULT '' AFTER `resource`,
+    ADD COLUMN `id_token_claims`     text COLLATE utf8mb4_general_ci AFTER `granted_scope`,
+    ADD COLUMN `userinfo`            text COLLATE utf8mb4_general_ci AFTER `id_token_claims`,
+    ADD COLUMN `userinfo_fetched_at` datetime(6) DEFAULT NULL AFTER `userinfo`,
+    ADD COLUMN `exchange_context`    text COLLATE utf8mb4_general_ci AFTER `userinfo_fetched_at`,
+    ADD COLUMN `last_response_body`  text COLLATE utf8mb4_general_ci AFTER `exchange_context`,
+    ADD COLUMN `namespace`           varchar(64) CHARACTER SET latin1 COLLATE latin1_swedish_ci   NOT NULL DEFAULT '' AFTER `last_response_body`,
+    DROP INDEX `ot_app_client_id_client_secret_refresh_token`,
+    ADD UNIQUE KEY `ot_app_client_id_client_secret_refresh_token` (`app`,`namespace`,`client_id`,`client_secret_hash`,`refresh_token_hash`,`scope`,`audience`,`resource`) USING BTREE,
+    DROP INDEX `ot_app_client_id_client_secret_hash`,
+    ADD KEY `ot_app_client_id_client_secret_hash` (`app`,`namespace`,`client_id`,`client_secret_hash`) USING BTREE,
+    DROP INDEX `ot_app_original_refresh_token`,
+    ADD KEY `ot_app_original_refresh_token` (`app`,`namespace`,`original_refresh_token_hash`) USING BTREE,
+    DROP INDEX `ot_app_refresh_token`,
+    ADD KEY `ot_app_refresh_token` (`app`,`namespace`,`refresh_token_hash`) USING BTREE,
+    ADD KEY `ot_refresh_token_expires_at` (`refresh_token_expires_at`) USING BTREE;
+CREATE TABLE `jwks_key_sets`
+(
+    `jwks_url`   varchar(512) CHARACTER SET latin1 COLLATE latin1_swedish_ci NOT NULL,
+    `key_set`    mediumtext COLLATE utf8mb4_general_ci                       NOT NULL,
+    `fetched_at` datetime(6)                                                 NOT NULL,
+    PRIMARY KEY (`jwks_url`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+CREATE TABLE `oauth_client_auth_styles`
+(
+    `app`        varchar(32) CHARACTER SET latin1 COLLATE latin1_swedish_ci NOT NULL,
+    `client_id`  varchar(64) CHARACTER SET latin1 COLLATE latin1_swedish_ci NOT NULL,
+    `auth_style` varchar(16) CHARACTER SET latin1 COLLATE latin1_swedish_ci NOT NULL,
+    `source`     varchar(16) CHARACTER SET latin1 COLLATE latin1_swedish_ci NOT NULL DEFAULT 'detected',
+    `created_at` datetime(6)                                                NOT NULL,
+    `updated_at` datetime(6)                                                NOT NULL,
+    PRIMARY KEY (`app`,`client_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
@@ -0,0 +1,5 @@
+-- Envelope encrypted client secrets don't fit in varchar(256). Lookups use
+-- client_secret_hash, so the index on the encrypted client_secret is dropped.
+ALTER TABLE `oauth_tokens`
+    DROP INDEX `ot_app_client_id_client_secret`,
+    MODIFY COLUMN `client_secret` text CHARACTER SET latin1 COLLATE latin1_swedish_ci NOT NULL;
@@ -0,0 +1,15 @@
+-- The data keys of envelope encryption (KEY_PROVIDER), one per client of a
+-- provider in a namespace.
+CREATE TABLE `oauth_data_keys`
+(
+    `id`          int                                                          NOT NULL AUTO_INCREMENT,
+    `app`         varchar(32) CHARACTER SET latin1 COLLATE latin1_swedish_ci   NOT NULL,
+    `namespace`   varchar(64) CHARACTER SET latin1 COLLATE latin1_swedish_ci   NOT NULL DEFAULT '',
+    `client_id`   varchar(64) CHARACTER SET latin1 COLLATE latin1_swedish_ci   NOT NULL,
+    `key_id`      varchar(255) CHARACTER SET latin1 COLLATE latin1_swedish_ci  NOT NULL,
+    `wrapped_key` text CHARACTER SET latin1 COLLATE latin1_swedish_ci          NOT NULL,
+    `created_at`  datetime(6)                                                  NOT NULL,
+    `updated_at`  datetime(6)                                                  NOT NULL,
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `odk_app_namespace_client_id` (`app`,`namespace`,`client_id`) USING BTREE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
@@ -0,0 +1,89 @@
+package oauthproxy
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/omniboost/oauth-proxy/mysql"
+	"github.com/pkg/errors"
+)
+
+// Batch is the progress of a command that processes the tokens in batches
+type Batch struct {
+	// LastID is the id of the last token that was processed, pass it as
+	// afterID to resume
+	LastID int `json:"last_id"`
+	Rows   int `json:"rows"`
+}
+
+// batchJob processes the tokens in batches of rows of type T and counts them
+// in a result R that embeds Batch. Every batch is a transaction, the counts
+// of a batch are only added to the result once it's committed
+type batchJob[R, T any] struct {
+	// load retrieves the next limit tokens after afterID and locks them
+	load func(ctx context.Context, db mysql.DB, afterID, limit int) ([]T, error)
+	// id returns the id of a token
+	id func(row T) int
+	// process does the work for a token in trx and counts it
+	process func(ctx context.Context, trx *sql.Tx, counts *R, row T) error
+	// batch returns the Batch of a result
+	batch func(result *R) *Batch
+}
+
+// run processes the tokens after the LastID of result until a batch isn't
+// full. progress is called after every batch. With dryRun the transactions
+// are rolled back
+func (j batchJob[R, T]) run(ctx context.Context, db *sql.DB, result *R, batchSize int, dryRun bool, progress func(R)) error {
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+
+	for {
+		n, err := j.runBatch(ctx, db, result, batchSize, dryRun)
+		if err != nil {
+			return err
+		}
+		if progress != nil && n > 0 {
+			progress(*result)
+		}
+		if n < batchSize {
+			return nil
+		}
+	}
+}
+
+func (j batchJob[R, T]) runBatch(ctx context.Context, db *sql.DB, result *R, batchSize int, dryRun bool) (int, error) {
+	trx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer trx.Rollback()
+
+	afterID := j.batch(result).LastID
+	rows, err := j.load(ctx, trx, afterID, batchSize)
+	if err != nil {
+		return 0, errors.Wrapf(err, "tokens after %d", afterID)
+	}
+
+	counts := *result
+	for _, row := range rows {
+		err = j.process(ctx, trx, &counts, row)
+		if err != nil {
+			return 0, err
+		}
+		b := j.batch(&counts)
+		b.Rows++
+		b.LastID = j.id(row)
+	}
+
+	if !dryRun {
+		err = trx.Commit()
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+	}
+
+	// only count the batch once it's committed
+	*result = counts
+	return len(rows), nil
+}
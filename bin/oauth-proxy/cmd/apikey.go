@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	oauthproxy "github.com/omniboost/oauth-proxy"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// apikeyCmd represents the apikey command
+var apikeyCmd = &cobra.Command{
+	Use:   "apikey [key]",
+	Short: "Generates an api key for a caller",
+	Long: `Generates a random api key, or takes the given one, and prints it with the
+hash to add to the api_keys of the caller in the configuration file. Only the
+hash is stored, the key is shown once.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key := ""
+		if len(args) > 0 {
+			key = args[0]
+		} else {
+			b := make([]byte, 32)
+			_, err := rand.Read(b)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			key = base64.RawURLEncoding.EncodeToString(b)
+		}
+
+		out := cmd.OutOrStdout()
+		fmt.Fprintf(out, "key:  %s\n", key)
+		fmt.Fprintf(out, "hash: %s\n", oauthproxy.HashAPIKey(key))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(apikeyCmd)
+}
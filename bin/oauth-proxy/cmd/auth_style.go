@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"context"
+	"os"
+
+	oauthproxy "github.com/omniboost/oauth-proxy"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/xo/dburl"
+)
+
+// authStyleCmd represents the auth-style command
+var authStyleCmd = &cobra.Command{
+	Use:   "auth-style <provider> <client_id> <header|params|auto>",
+	Short: "Overrides the client authentication style of a client",
+	Long: `Overrides how the client credentials are sent to the provider's token endpoint:
+in the authorization header or in the form body. With auto the override is
+removed and the style is detected (and remembered) again.`,
+	Args: cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db, err := dburl.Open(os.Getenv("DATABASE_URL"))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer db.Close()
+
+		return oauthproxy.SetClientAuthStyle(context.Background(), db, args[0], args[1], args[2])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(authStyleCmd)
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	oauthproxy "github.com/omniboost/oauth-proxy"
+	"github.com/omniboost/oauth-proxy/types"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/xo/dburl"
+)
+
+// expiringCmd represents the expiring command
+var expiringCmd = &cobra.Command{
+	Use:   "expiring",
+	Short: "Lists the connections of which the refresh token expires soon",
+	Long: `Lists the token lineages of which the refresh token expires within the
+given number of days. These customers have to reconnect before then.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		days, err := cmd.Flags().GetInt("days")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		db, err := dburl.Open(os.Getenv("DATABASE_URL"))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer db.Close()
+		types.SetDataKeyStore(oauthproxy.NewDBDataKeyStore(db))
+
+		expiring, err := oauthproxy.ExpiringTokens(context.Background(), db, days)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tAPP\tCLIENT ID\tUSERNAME\tEXPIRES AT\tLAST REFRESH")
+		for _, t := range expiring {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", t.ID, t.App, t.ClientID, t.Username,
+				t.RefreshTokenExpiresAt.Format(time.RFC3339), t.UpdatedAt.Format(time.RFC3339))
+		}
+		return w.Flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(expiringCmd)
+	expiringCmd.Flags().Int("days", 7, "report refresh tokens that expire within this many days")
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	oauthproxy "github.com/omniboost/oauth-proxy"
+	"github.com/omniboost/oauth-proxy/types"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/xo/dburl"
+)
+
+// rehashCmd represents the rehash command
+var rehashCmd = &cobra.Command{
+	Use:   "rehash",
+	Short: "Recomputes the lookup hashes of the stored tokens with HASH_KEY",
+	Long: `Recomputes the client_secret_hash, original_refresh_token_hash,
+refresh_token_hash and access_token_hash columns of all tokens as HMAC with
+HASH_KEY. Until every token is rehashed the lookups also try the plain SHA-256
+hashes, disable that with HASH_LEGACY_LOOKUPS=false afterwards. The tokens are
+processed in batches, use --after with the last id that was reported to resume.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		after, err := cmd.Flags().GetInt("after")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		batchSize, err := cmd.Flags().GetInt("batch-size")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		db, err := dburl.Open(os.Getenv("DATABASE_URL"))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer db.Close()
+		types.SetDataKeyStore(oauthproxy.NewDBDataKeyStore(db))
+
+		out := cmd.OutOrStdout()
+		result, err := oauthproxy.Rehash(context.Background(), db, after, batchSize, dryRun, func(r oauthproxy.RehashResult) {
+			fmt.Fprintf(out, "processed %d rows up to id %d\n", r.Rows, r.LastID)
+		})
+		if err != nil {
+			fmt.Fprintf(out, "stopped after id %d, resume with --after %d\n", result.LastID, result.LastID)
+			return err
+		}
+
+		fmt.Fprintf(out, "rows: %d, already current: %d, rehashed: %d\n", result.Rows, result.Current, result.Rehashed)
+		if dryRun {
+			fmt.Fprintln(out, "dry run, nothing was changed")
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rehashCmd)
+	rehashCmd.Flags().Int("after", 0, "only process tokens with an id after this one")
+	rehashCmd.Flags().Int("batch-size", 500, "number of tokens per transaction")
+	rehashCmd.Flags().Bool("dry-run", false, "only report the tokens with legacy hashes")
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	oauthproxy "github.com/omniboost/oauth-proxy"
+	"github.com/omniboost/oauth-proxy/types"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/xo/dburl"
+)
+
+// rekeyCmd represents the rekey command
+var rekeyCmd = &cobra.Command{
+	Use:   "rekey",
+	Short: "Re-encrypts the stored tokens with the current APP_KEY",
+	Long: `Re-encrypts the encrypted columns of all tokens with the current APP_KEY and
+APP_CIPHER, or with the data key of their client when KEY_PROVIDER is set.
+Values encrypted with one of the APP_PREVIOUS_KEYS or another cipher and values
+that are still stored in plaintext are re-encrypted. Data keys wrapped with an
+old key-encryption key are wrapped again, their values don't change. The tokens are processed in batches, use
+--after with the last id that was reported to resume.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		after, err := cmd.Flags().GetInt("after")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		batchSize, err := cmd.Flags().GetInt("batch-size")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		db, err := dburl.Open(os.Getenv("DATABASE_URL"))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer db.Close()
+		types.SetDataKeyStore(oauthproxy.NewDBDataKeyStore(db))
+
+		out := cmd.OutOrStdout()
+		result, err := oauthproxy.Rekey(context.Background(), db, after, batchSize, dryRun, func(r oauthproxy.RekeyResult) {
+			fmt.Fprintf(out, "processed %d rows up to id %d\n", r.Rows, r.LastID)
+		})
+		if err != nil {
+			fmt.Fprintf(out, "stopped after id %d, resume with --after %d\n", result.LastID, result.LastID)
+			return err
+		}
+
+		fmt.Fprintf(out, "rows: %d, values on current key: %d, previous keys: %d, other cipher: %d, plaintext: %d, unknown key: %d, re-encrypted: %d\n",
+			result.Rows, result.Current, result.Previous, result.OtherCipher, result.Plaintext, result.Unknown, result.Rekeyed)
+		if dryRun {
+			fmt.Fprintln(out, "dry run, nothing was changed")
+		}
+		if result.Unknown > 0 {
+			return errors.Errorf("%d values are encrypted with an unknown key", result.Unknown)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rekeyCmd)
+	rekeyCmd.Flags().Int("after", 0, "only process tokens with an id after this one")
+	rekeyCmd.Flags().Int("batch-size", 500, "number of tokens per transaction")
+	rekeyCmd.Flags().Bool("dry-run", false, "only report the values on old keys and in plaintext")
+}
@@ -1,9 +1,9 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"net/http"
-	"net/http/httputil"
 	"os"
 	"strings"
 	"time"
@@ -13,6 +13,8 @@ import (
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/motemen/go-loghttp"
 	"github.com/omniboost/oauth-proxy/mysql"
+	"github.com/omniboost/oauth-proxy/redact"
+	"github.com/omniboost/oauth-proxy/tracing"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -20,6 +22,9 @@ import (
 
 var cfgFile string
 
+// shutdownTracing flushes the spans that haven't been exported yet
+var shutdownTracing = func(context.Context) error { return nil }
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:              "cmd",
@@ -43,6 +48,7 @@ var rootCmd = &cobra.Command{
 func Execute() {
 	// Flush buffered events before the program terminates.
 	defer sentry.Flush(2 * time.Second)
+	defer flushTracing()
 
 	if len(os.Args) == 1 {
 		os.Args = append([]string{os.Args[0], "server"}, os.Args[1:]...)
@@ -67,7 +73,7 @@ func init() {
 
 	rootCmd.PersistentFlags().CountP("verbose", "v", "Verbosity (repeat for more verbose)")
 
-	cobra.OnInitialize(initLogger, initSentry)
+	cobra.OnInitialize(initLogger, initSentry, initTracing)
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -125,28 +131,25 @@ func initLogger() {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
+	// LOG_FORMAT=json logs one json object per line
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "json") {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	}
+
 	if verbosity > 2 {
-		// log http outgoing requests + responses
+		// log http outgoing requests + responses, without secrets
 		http.DefaultTransport = loghttp.DefaultTransport
 		loghttp.DefaultTransport.LogRequest = func(req *http.Request) {
-			b, _ := httputil.DumpRequestOut(req, true)
-			logrus.Debug("Client outgoing request:")
-			for _, s := range strings.Split(string(b), "\r\n") {
-				logrus.Debug(s)
-			}
+			logrus.WithFields(redact.Request(req)).Debug("Client outgoing request")
 		}
 		loghttp.DefaultTransport.LogResponse = func(res *http.Response) {
-			b, _ := httputil.DumpResponse(res, true)
-			logrus.Debug("Client incoming response:")
-			for _, s := range strings.Split(string(b), "\r\n") {
-				logrus.Debug(s)
-			}
+			logrus.WithFields(redact.Response(res)).Debug("Client incoming response")
 		}
 	}
 
 	// Init logging of queries
 	mysql.XOLog = func(s string, p ...interface{}) {
-		logrus.Debugf("> SQL: %s -- params: %v\n", s, p)
+		logrus.Debugf("> SQL: %s -- params: %v\n", s, redact.Args(p))
 	}
 }
 
@@ -157,10 +160,28 @@ func initSentry() {
 	}
 
 	sentry.Init(sentry.ClientOptions{
-		Dsn: dsn,
+		Dsn:        dsn,
+		BeforeSend: redact.SentryEvent,
 	})
 }
 
+func initTracing() {
+	shutdown, err := tracing.Init(context.Background())
+	if err != nil {
+		logErrorAndExit(err)
+	}
+	shutdownTracing = shutdown
+}
+
+func flushTracing() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := shutdownTracing(ctx)
+	if err != nil {
+		logrus.Errorf("couldn't flush traces: %s", err)
+	}
+}
+
 func logErrorAndExit(err error) {
 	logrus.Error(err)
 	os.Exit(1)
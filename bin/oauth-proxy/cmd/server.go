@@ -29,6 +29,7 @@ var serverCmd = &cobra.Command{
 		port := viper.GetInt("port")
 		s.SetPort(port)
 		err = s.Start()
+		flushTracing()
 		log.Fatal(err)
 		return nil
 	},
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	oauthproxy "github.com/omniboost/oauth-proxy"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/xo/dburl"
+)
+
+// shredCmd represents the shred command
+var shredCmd = &cobra.Command{
+	Use:   "shred <provider> <client_id>",
+	Short: "Deletes the tokens of a client and its data key",
+	Long: `Deletes the tokens of a client of a provider and, when KEY_PROVIDER is set,
+the data key its tokens are encrypted with. Copies of the tokens, like
+database backups, can't be decrypted anymore once the backups of the data key
+have expired as well. Running processes forget the data key when they restart.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		namespace, err := cmd.Flags().GetString("namespace")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		db, err := dburl.Open(os.Getenv("DATABASE_URL"))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer db.Close()
+
+		n, err := oauthproxy.Shred(context.Background(), db, args[0], namespace, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "deleted %d tokens\n", n)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(shredCmd)
+	shredCmd.Flags().String("namespace", oauthproxy.DEFAULT_NAMESPACE, "namespace of the client")
+}
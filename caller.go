@@ -0,0 +1,290 @@
+package oauthproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const (
+	// APIKeyHeader carries the api key of a caller
+	APIKeyHeader = "X-Api-Key"
+
+	// CallerHeader, TimestampHeader and SignatureHeader carry a signed
+	// request. The signature is the hex HMAC-SHA256 with the secret of the
+	// caller of:
+	//
+	//	timestamp + "\n" + method + "\n" + request uri + "\n" + hex(sha256(body))
+	CallerHeader    = "X-Oauth-Proxy-Caller"
+	TimestampHeader = "X-Oauth-Proxy-Timestamp"
+	SignatureHeader = "X-Oauth-Proxy-Signature"
+
+	// maxSignatureAge is how far the timestamp of a signed request may be off
+	maxSignatureAge = 5 * time.Minute
+
+	// maxSignedBodySize limits the body that is read to verify a signature,
+	// before the caller is authenticated
+	maxSignedBodySize = 1 << 20
+)
+
+// Caller is an internal service that is allowed to use the proxy, from the
+// configuration file:
+//
+//	callers:
+//	  - name: billing
+//	    api_keys: [<hex sha256 of the key>]
+//	    providers: [exactonline]
+//	    client_ids: [b81cc4de-d192-400e-bcb4-09254394c52a]
+//	  - name: sync
+//	    certificates: [<hex sha256 fingerprint>, CN=sync.internal]
+//	    hmac_secret: ...
+//	    providers: ["*"]
+//	    namespace: staging
+//	  - name: ops
+//	    api_keys: [...]
+//	    providers: []
+//	    admin: true
+//
+// A caller authenticates with one of its api keys (X-Api-Key), a client
+// certificate or a signed request. Certificates match by fingerprint or, when
+// the certificate is verified against TLS_CLIENT_CA_FILE, by subject (CN=).
+// Without client_ids the caller can use every client of its providers. A
+// caller with a namespace can only use the tokens of that namespace
+type Caller struct {
+	Name         string   `mapstructure:"name" json:"name"`
+	APIKeys      []string `mapstructure:"api_keys" json:"api_keys"`
+	Certificates []string `mapstructure:"certificates" json:"certificates"`
+	HMACSecret   string   `mapstructure:"hmac_secret" json:"-"`
+	Providers    []string `mapstructure:"providers" json:"providers"`
+	ClientIDs    []string `mapstructure:"client_ids" json:"client_ids"`
+	Namespace    string   `mapstructure:"namespace" json:"namespace"`
+	Admin        bool     `mapstructure:"admin" json:"admin"`
+}
+
+// Callers are the configured callers. Without callers the proxy doesn't
+// authenticate its callers
+type Callers []Caller
+
+// CallerError is returned when a caller isn't authenticated or isn't allowed
+// to make the request
+type CallerError struct {
+	Status int
+	Msg    string
+}
+
+func (e CallerError) Error() string {
+	return e.Msg
+}
+
+// HashAPIKey returns the hash of an api key as it's configured in api_keys
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewCallers reads the callers from the configuration file (callers key)
+func (s *Server) NewCallers() (Callers, error) {
+	cc := Callers{}
+	err := viper.UnmarshalKey("callers", &cc)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid caller configuration")
+	}
+	return cc, cc.Validate()
+}
+
+func (s *Server) SetCallers(cc Callers) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.callers = cc
+}
+
+// Validate checks the caller definitions
+func (cc Callers) Validate() error {
+	names := map[string]bool{}
+	for _, c := range cc {
+		if c.Name == "" {
+			return errors.New("caller without name")
+		}
+		if names[c.Name] {
+			return errors.Errorf("duplicate caller %s", c.Name)
+		}
+		names[c.Name] = true
+
+		if len(c.APIKeys) == 0 && len(c.Certificates) == 0 && c.HMACSecret == "" {
+			return errors.Errorf("caller %s needs api_keys, certificates or an hmac_secret", c.Name)
+		}
+		for _, k := range c.APIKeys {
+			if b, err := hex.DecodeString(k); err != nil || len(b) != sha256.Size {
+				return errors.Errorf("caller %s: api keys have to be configured as hex sha256 hashes", c.Name)
+			}
+		}
+		if c.Namespace != "" && !namespacePattern.MatchString(c.Namespace) {
+			return errors.Errorf("caller %s: invalid namespace %q", c.Name, c.Namespace)
+		}
+		for _, crt := range c.Certificates {
+			if strings.HasPrefix(crt, "CN=") {
+				continue
+			}
+			if b, err := hex.DecodeString(normalizeFingerprint(crt)); err != nil || len(b) != sha256.Size {
+				return errors.Errorf("caller %s: invalid certificate %q, use a sha256 fingerprint or CN=", c.Name, crt)
+			}
+		}
+	}
+	return nil
+}
+
+// Authenticate identifies the caller of the request. It returns nil when no
+// callers are configured
+func (cc Callers) Authenticate(r *http.Request) (*Caller, error) {
+	if len(cc) == 0 {
+		return nil, nil
+	}
+
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		hash := HashAPIKey(key)
+		for i, c := range cc {
+			for _, k := range c.APIKeys {
+				if subtle.ConstantTimeCompare([]byte(hash), []byte(strings.ToLower(k))) == 1 {
+					return &cc[i], nil
+				}
+			}
+		}
+		return nil, CallerError{Status: http.StatusUnauthorized, Msg: "invalid api key"}
+	}
+
+	if name := r.Header.Get(CallerHeader); name != "" {
+		for i, c := range cc {
+			if c.Name != name || c.HMACSecret == "" {
+				continue
+			}
+			err := verifySignature(r, c.HMACSecret)
+			if err != nil {
+				return nil, err
+			}
+			return &cc[i], nil
+		}
+		return nil, CallerError{Status: http.StatusUnauthorized, Msg: "invalid signature"}
+	}
+
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert := r.TLS.PeerCertificates[0]
+		sum := sha256.Sum256(cert.Raw)
+		fingerprint := hex.EncodeToString(sum[:])
+		verified := len(r.TLS.VerifiedChains) > 0
+		for i, c := range cc {
+			for _, crt := range c.Certificates {
+				if normalizeFingerprint(crt) == fingerprint {
+					return &cc[i], nil
+				}
+				if verified && crt == "CN="+cert.Subject.CommonName {
+					return &cc[i], nil
+				}
+			}
+		}
+		return nil, CallerError{Status: http.StatusUnauthorized, Msg: "unknown client certificate"}
+	}
+
+	return nil, CallerError{Status: http.StatusUnauthorized, Msg: "caller authentication required"}
+}
+
+// Allows checks the policy of the caller. A nil caller (no callers
+// configured) is allowed everything
+func (c *Caller) Allows(provider, clientID string) bool {
+	if c == nil {
+		return true
+	}
+	if !slices.Contains(c.Providers, "*") && !slices.Contains(c.Providers, provider) {
+		return false
+	}
+	if len(c.ClientIDs) == 0 || slices.Contains(c.ClientIDs, "*") {
+		return true
+	}
+	return clientID != "" && slices.Contains(c.ClientIDs, clientID)
+}
+
+// authenticate identifies the caller of the request with the current callers
+func (s *Server) authenticate(r *http.Request) (*Caller, error) {
+	s.mu.RLock()
+	cc := s.callers
+	s.mu.RUnlock()
+	return cc.Authenticate(r)
+}
+
+// authorize checks that the caller is allowed to use the client of the
+// provider
+func authorize(caller *Caller, provider, clientID string) error {
+	if caller.Allows(provider, clientID) {
+		return nil
+	}
+	return CallerError{
+		Status: http.StatusForbidden,
+		Msg:    fmt.Sprintf("caller %s isn't allowed to use client %q of %s", caller.Name, clientID, provider),
+	}
+}
+
+// callerName is used in the logs
+func callerName(caller *Caller) string {
+	if caller == nil {
+		return "-"
+	}
+	return caller.Name
+}
+
+func verifySignature(r *http.Request, secret string) error {
+	ts, err := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return CallerError{Status: http.StatusUnauthorized, Msg: "invalid signature timestamp"}
+	}
+	age := time.Since(time.Unix(ts, 0))
+	if age > maxSignatureAge || age < -maxSignatureAge {
+		return CallerError{Status: http.StatusUnauthorized, Msg: "signature expired"}
+	}
+
+	signature, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+	if err != nil {
+		return CallerError{Status: http.StatusUnauthorized, Msg: "invalid signature"}
+	}
+
+	// the body is read again by the handler
+	body := []byte{}
+	if r.Body != nil {
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxSignedBodySize+1))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		r.Body.Close()
+		if len(body) > maxSignedBodySize {
+			return CallerError{Status: http.StatusRequestEntityTooLarge, Msg: "request body too large"}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	if !hmac.Equal(signature, SignRequest(secret, ts, r.Method, r.URL.RequestURI(), body)) {
+		return CallerError{Status: http.StatusUnauthorized, Msg: "invalid signature"}
+	}
+	return nil
+}
+
+// SignRequest returns the signature of a request for SignatureHeader
+func SignRequest(secret string, timestamp int64, method, requestURI string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d\n%s\n%s\n%s", timestamp, method, requestURI, hex.EncodeToString(sum[:]))
+	return mac.Sum(nil)
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+}
@@ -0,0 +1,234 @@
+package oauthproxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCallers() Callers {
+	raw := []byte("billing certificate")
+	sum := sha256.Sum256(raw)
+	return Callers{
+		{Name: "billing", APIKeys: []string{HashAPIKey("billing-key")}, Providers: []string{"exactonline"}, ClientIDs: []string{"client-1"}},
+		{Name: "sync", HMACSecret: "sync-secret", Providers: []string{"*"}, Namespace: "staging"},
+		{Name: "mtls", Certificates: []string{hex.EncodeToString(sum[:]), "CN=mtls.internal"}, Providers: []string{"*"}},
+	}
+}
+
+func signedRequest(secret string, ts time.Time, method, uri, body string) *http.Request {
+	r := httptest.NewRequest(method, uri, strings.NewReader(body))
+	r.Header.Set(CallerHeader, "sync")
+	r.Header.Set(TimestampHeader, strconv.FormatInt(ts.Unix(), 10))
+	r.Header.Set(SignatureHeader, hex.EncodeToString(SignRequest(secret, ts.Unix(), method, uri, []byte(body))))
+	return r
+}
+
+func tlsRequest(raw []byte, cn string, verified bool) *http.Request {
+	r := httptest.NewRequest("POST", "/exactonline/oauth2/token", nil)
+	cert := &x509.Certificate{Raw: raw, Subject: pkix.Name{CommonName: cn}}
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if verified {
+		r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	}
+	return r
+}
+
+func TestCallersAuthenticate(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		caller  string
+		status  int
+	}{
+		{
+			name: "api key",
+			request: func() *http.Request {
+				r := httptest.NewRequest("POST", "/exactonline/oauth2/token", nil)
+				r.Header.Set(APIKeyHeader, "billing-key")
+				return r
+			},
+			caller: "billing",
+		},
+		{
+			name: "wrong api key",
+			request: func() *http.Request {
+				r := httptest.NewRequest("POST", "/exactonline/oauth2/token", nil)
+				r.Header.Set(APIKeyHeader, "other-key")
+				return r
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "signed request",
+			request: func() *http.Request {
+				return signedRequest("sync-secret", now, "POST", "/exactonline/oauth2/token?a=b", "grant_type=refresh_token")
+			},
+			caller: "sync",
+		},
+		{
+			name: "wrong hmac secret",
+			request: func() *http.Request {
+				return signedRequest("other-secret", now, "POST", "/exactonline/oauth2/token", "grant_type=refresh_token")
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "unknown signing caller",
+			request: func() *http.Request {
+				r := signedRequest("sync-secret", now, "POST", "/exactonline/oauth2/token", "")
+				r.Header.Set(CallerHeader, "billing")
+				return r
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "expired timestamp",
+			request: func() *http.Request {
+				return signedRequest("sync-secret", now.Add(-maxSignatureAge-time.Minute), "POST", "/exactonline/oauth2/token", "")
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "future timestamp",
+			request: func() *http.Request {
+				return signedRequest("sync-secret", now.Add(maxSignatureAge+time.Minute), "POST", "/exactonline/oauth2/token", "")
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "tampered body",
+			request: func() *http.Request {
+				r := signedRequest("sync-secret", now, "POST", "/exactonline/oauth2/token", "grant_type=refresh_token")
+				r.Body = io.NopCloser(strings.NewReader("grant_type=authorization_code"))
+				return r
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "tampered uri",
+			request: func() *http.Request {
+				r := signedRequest("sync-secret", now, "POST", "/exactonline/oauth2/token", "")
+				r.URL.Path = "/ns/production/exactonline/oauth2/token"
+				return r
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "body too large",
+			request: func() *http.Request {
+				return signedRequest("sync-secret", now, "POST", "/exactonline/oauth2/token", strings.Repeat("a", maxSignedBodySize+1))
+			},
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "certificate fingerprint",
+			request: func() *http.Request {
+				return tlsRequest([]byte("billing certificate"), "other", false)
+			},
+			caller: "mtls",
+		},
+		{
+			name: "verified certificate subject",
+			request: func() *http.Request {
+				return tlsRequest([]byte("other certificate"), "mtls.internal", true)
+			},
+			caller: "mtls",
+		},
+		{
+			name: "unverified certificate subject",
+			request: func() *http.Request {
+				return tlsRequest([]byte("other certificate"), "mtls.internal", false)
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "no credentials",
+			request: func() *http.Request {
+				return httptest.NewRequest("POST", "/exactonline/oauth2/token", nil)
+			},
+			status: http.StatusUnauthorized,
+		},
+	}
+
+	cc := testCallers()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caller, err := cc.Authenticate(tt.request())
+			if tt.status != 0 {
+				ce := CallerError{}
+				if !errors.As(err, &ce) {
+					t.Fatalf("expected caller error, got %v", err)
+				}
+				if ce.Status != tt.status {
+					t.Errorf("expected status %d, got %d", tt.status, ce.Status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if caller == nil || caller.Name != tt.caller {
+				t.Errorf("expected caller %s, got %v", tt.caller, caller)
+			}
+		})
+	}
+}
+
+func TestCallersAuthenticateWithoutCallers(t *testing.T) {
+	caller, err := Callers{}.Authenticate(httptest.NewRequest("POST", "/exactonline/oauth2/token", nil))
+	if err != nil || caller != nil {
+		t.Errorf("expected no caller and no error, got %v and %v", caller, err)
+	}
+}
+
+func TestVerifySignatureKeepsBody(t *testing.T) {
+	r := signedRequest("sync-secret", time.Now(), "POST", "/exactonline/oauth2/token", "grant_type=refresh_token")
+	err := verifySignature(r, "sync-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r.Body)
+	if string(b) != "grant_type=refresh_token" {
+		t.Errorf("expected the body to be readable again, got %q", b)
+	}
+}
+
+func TestCallerAllows(t *testing.T) {
+	cc := testCallers()
+	tests := []struct {
+		name     string
+		caller   *Caller
+		provider string
+		clientID string
+		allowed  bool
+	}{
+		{"no callers", nil, "exactonline", "", true},
+		{"allowed client", &cc[0], "exactonline", "client-1", true},
+		{"other client", &cc[0], "exactonline", "client-2", false},
+		{"empty client_id", &cc[0], "exactonline", "", false},
+		{"other provider", &cc[0], "xero", "client-1", false},
+		{"all providers", &cc[1], "xero", "", true},
+		{"no providers", &Caller{Name: "ops"}, "xero", "", false},
+		{"all clients", &Caller{Name: "any", Providers: []string{"xero"}, ClientIDs: []string{"*"}}, "xero", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if allowed := tt.caller.Allows(tt.provider, tt.clientID); allowed != tt.allowed {
+				t.Errorf("expected %v, got %v", tt.allowed, allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package oauthproxy
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lytics/logrus"
+	"github.com/omniboost/oauth-proxy/mysql"
+	"github.com/omniboost/oauth-proxy/providers"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+var (
+	// AUTH_STYLES overrides the client authentication style per provider:
+	// "datev=header,chronogolf=params". With "auto" the style is detected and
+	// remembered per client
+	AUTH_STYLES = os.Getenv("AUTH_STYLES")
+
+	// authStyleReload is how long a client's auth style is cached before it's
+	// read from the database again (picks up overrides set with the cli)
+	authStyleReload = 5 * time.Minute
+)
+
+const (
+	AuthStyleSourceOverride = "override"
+	AuthStyleSourceDetected = "detected"
+)
+
+// clientAuthStyles caches the auth style rows of a provider. The token
+// endpoint is called within a transaction, so the styles can't be read from
+// the database at that point
+type clientAuthStyles struct {
+	mu     sync.Mutex
+	styles map[string]*clientAuthStyle
+}
+
+type clientAuthStyle struct {
+	row      *mysql.OauthClientAuthStyle
+	loadedAt time.Time
+	// dirty is set when the row has to be saved, or deleted when row is
+	// nil
+	dirty bool
+}
+
+// loadAuthStyle reads the auth style of the client from the database when it
+// isn't cached (or the cache is stale)
+func (tr *TokenRequester) loadAuthStyle(clientID string) {
+	if clientID == "" {
+		return
+	}
+
+	tr.authStyles.mu.Lock()
+	cached, ok := tr.authStyles.styles[clientID]
+	tr.authStyles.mu.Unlock()
+	if ok && (cached.dirty || time.Since(cached.loadedAt) < authStyleReload) {
+		return
+	}
+
+	row, err := mysql.OauthClientAuthStyleByAppClientID(context.Background(), observeDB(tr.db), tr.provider.Name(), clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		row, err = nil, nil
+	}
+	if err != nil {
+		// try again with the next request
+		logrus.Warnf("couldn't load auth style of %s client %s: %s", tr.provider.Name(), clientID, err)
+		return
+	}
+
+	tr.authStyles.mu.Lock()
+	defer tr.authStyles.mu.Unlock()
+	if tr.authStyles.styles == nil {
+		tr.authStyles.styles = map[string]*clientAuthStyle{}
+	}
+	tr.authStyles.styles[clientID] = &clientAuthStyle{row: row, loadedAt: time.Now()}
+}
+
+// authStyle returns the auth style to use for the client and whether the
+// style should be detected. In order: the client override, the provider
+// override (AUTH_STYLES) and the detected style. Without any of those the
+// provider's own auth style is used and the result is remembered
+func (tr *TokenRequester) authStyle(clientID string) (oauth2.AuthStyle, bool) {
+	tr.authStyles.mu.Lock()
+	defer tr.authStyles.mu.Unlock()
+
+	var row *mysql.OauthClientAuthStyle
+	if cached, ok := tr.authStyles.styles[clientID]; ok {
+		row = cached.row
+	}
+
+	if row != nil && row.Source == AuthStyleSourceOverride {
+		style, err := providers.ParseAuthStyle(row.AuthStyle)
+		if err == nil && style != oauth2.AuthStyleAutoDetect {
+			return style, false
+		}
+	}
+
+	if style := providerAuthStyles()[tr.provider.Name()]; style != oauth2.AuthStyleAutoDetect {
+		return style, false
+	}
+
+	if row != nil && row.Source == AuthStyleSourceDetected {
+		style, err := providers.ParseAuthStyle(row.AuthStyle)
+		if err == nil {
+			return style, true
+		}
+	}
+
+	return oauth2.AuthStyleAutoDetect, true
+}
+
+// detectedAuthStyle remembers the auth style that was accepted by the
+// provider. It's persisted by saveAuthStyle
+func (tr *TokenRequester) detectedAuthStyle(clientID string, style oauth2.AuthStyle) {
+	tr.authStyles.mu.Lock()
+	defer tr.authStyles.mu.Unlock()
+
+	if tr.authStyles.styles == nil {
+		tr.authStyles.styles = map[string]*clientAuthStyle{}
+	}
+	cached, ok := tr.authStyles.styles[clientID]
+	if !ok {
+		cached = &clientAuthStyle{loadedAt: time.Now()}
+		tr.authStyles.styles[clientID] = cached
+	}
+
+	s := providers.FormatAuthStyle(style)
+	if cached.row != nil && cached.row.AuthStyle == s {
+		return
+	}
+	if cached.row != nil && cached.row.Source == AuthStyleSourceOverride {
+		return
+	}
+
+	now := time.Now()
+	cached.row = &mysql.OauthClientAuthStyle{
+		App:       tr.provider.Name(),
+		ClientID:  clientID,
+		AuthStyle: s,
+		Source:    AuthStyleSourceDetected,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	cached.dirty = true
+}
+
+// staleAuthStyle forgets the detected auth style of the client after the
+// provider rejected the client with it. The stored style is deleted by
+// saveAuthStyle
+func (tr *TokenRequester) staleAuthStyle(clientID string, style oauth2.AuthStyle) {
+	tr.authStyles.mu.Lock()
+	defer tr.authStyles.mu.Unlock()
+
+	cached, ok := tr.authStyles.styles[clientID]
+	if !ok || cached.row == nil || cached.row.Source != AuthStyleSourceDetected ||
+		cached.row.AuthStyle != providers.FormatAuthStyle(style) {
+		return
+	}
+	cached.row = nil
+	cached.dirty = true
+}
+
+// saveAuthStyle persists a newly detected auth style of the client, or
+// deletes a stale one
+func (tr *TokenRequester) saveAuthStyle(clientID string) {
+	tr.authStyles.mu.Lock()
+	cached, ok := tr.authStyles.styles[clientID]
+	if !ok || !cached.dirty {
+		tr.authStyles.mu.Unlock()
+		return
+	}
+	cached.dirty = false
+	if cached.row == nil {
+		tr.authStyles.mu.Unlock()
+		tr.deleteAuthStyle(clientID)
+		return
+	}
+	row := *cached.row
+	tr.authStyles.mu.Unlock()
+
+	err := row.Upsert(context.Background(), observeDB(tr.db))
+	if err != nil {
+		logrus.Warnf("couldn't save auth style of %s client %s: %s", row.App, row.ClientID, err)
+	}
+}
+
+// deleteAuthStyle deletes the stored detected auth style of the client,
+// overrides are kept
+func (tr *TokenRequester) deleteAuthStyle(clientID string) {
+	ctx := context.Background()
+	row, err := mysql.OauthClientAuthStyleByAppClientID(ctx, observeDB(tr.db), tr.provider.Name(), clientID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && row.Source != AuthStyleSourceDetected) {
+		return
+	}
+	if err == nil {
+		err = row.Delete(ctx, observeDB(tr.db))
+	}
+	if err != nil {
+		logrus.Warnf("couldn't delete auth style of %s client %s: %s", tr.provider.Name(), clientID, err)
+	}
+}
+
+// clientAuthRoundTripper wraps the round tripper so the client credentials
+// are sent with the configured or detected auth style
+func (tr *TokenRequester) clientAuthRoundTripper(params providers.TokenRequestParams, rtp http.RoundTripper) http.RoundTripper {
+	if params.ClientID == "" {
+		return rtp
+	}
+
+	style, detect := tr.authStyle(params.ClientID)
+	rt := providers.NewClientAuthRoundTripper(rtp)
+	rt.Style = style
+	if detect {
+		// the detected style could be stale, a retry is left to the
+		// provider's auth style
+		rt.Detected = true
+		rt.OnSuccess = func(style oauth2.AuthStyle) {
+			tr.detectedAuthStyle(params.ClientID, style)
+		}
+		rt.OnInvalidClient = func(style oauth2.AuthStyle) {
+			tr.staleAuthStyle(params.ClientID, style)
+		}
+	}
+	return rt
+}
+
+// providerAuthStyles parses AUTH_STYLES
+func providerAuthStyles() map[string]oauth2.AuthStyle {
+	styles := map[string]oauth2.AuthStyle{}
+	for _, v := range strings.Split(AUTH_STYLES, ",") {
+		name, s, ok := strings.Cut(strings.TrimSpace(v), "=")
+		if !ok {
+			continue
+		}
+
+		style, err := providers.ParseAuthStyle(strings.TrimSpace(s))
+		if err != nil {
+			logrus.Warnf("AUTH_STYLES: %s", err)
+			continue
+		}
+		styles[strings.TrimSpace(name)] = style
+	}
+	return styles
+}
+
+// SetClientAuthStyle overrides the auth style of a client. With "auto" the
+// override is removed and the style is detected again
+func SetClientAuthStyle(ctx context.Context, db mysql.DB, app, clientID, style string) error {
+	authStyle, err := providers.ParseAuthStyle(style)
+	if err != nil {
+		return err
+	}
+
+	row, err := mysql.OauthClientAuthStyleByAppClientID(ctx, db, app, clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		row, err = nil, nil
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if authStyle == oauth2.AuthStyleAutoDetect {
+		if row == nil {
+			return nil
+		}
+		return errors.WithStack(row.Delete(ctx, db))
+	}
+
+	now := time.Now()
+	if row == nil {
+		row = &mysql.OauthClientAuthStyle{
+			App:       app,
+			ClientID:  clientID,
+			CreatedAt: now,
+		}
+	}
+	row.AuthStyle = providers.FormatAuthStyle(authStyle)
+	row.Source = AuthStyleSourceOverride
+	row.UpdatedAt = now
+	return errors.WithStack(row.Save(ctx, db))
+}
@@ -0,0 +1,58 @@
+package oauthproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/omniboost/oauth-proxy/mysql"
+	"github.com/omniboost/oauth-proxy/providers"
+	"golang.org/x/oauth2"
+)
+
+type namedProvider string
+
+func (p namedProvider) Name() string  { return string(p) }
+func (p namedProvider) Route() string { return "/" + string(p) + "/oauth2/token" }
+
+func TestStaleAuthStyle(t *testing.T) {
+	tr := &TokenRequester{provider: namedProvider("stale")}
+	tr.authStyles.styles = map[string]*clientAuthStyle{
+		"client": {
+			row:      &mysql.OauthClientAuthStyle{App: "stale", ClientID: "client", AuthStyle: "header", Source: AuthStyleSourceDetected},
+			loadedAt: time.Now(),
+		},
+		"override": {
+			row:      &mysql.OauthClientAuthStyle{App: "stale", ClientID: "override", AuthStyle: "header", Source: AuthStyleSourceOverride},
+			loadedAt: time.Now(),
+		},
+	}
+
+	style, detect := tr.authStyle("client")
+	if style != oauth2.AuthStyleInHeader || !detect {
+		t.Fatalf("expected the detected header style, got %s, %v", providers.FormatAuthStyle(style), detect)
+	}
+
+	// rejected with another style than the detected one
+	tr.staleAuthStyle("client", oauth2.AuthStyleInParams)
+	if cached := tr.authStyles.styles["client"]; cached.row == nil || cached.dirty {
+		t.Errorf("expected the detected style to be kept, got %+v", cached)
+	}
+
+	tr.staleAuthStyle("client", oauth2.AuthStyleInHeader)
+	if cached := tr.authStyles.styles["client"]; cached.row != nil || !cached.dirty {
+		t.Errorf("expected the detected style to be dropped and deleted, got %+v", cached)
+	}
+	if style, detect := tr.authStyle("client"); style != oauth2.AuthStyleAutoDetect || !detect {
+		t.Errorf("expected the style to be detected again, got %s, %v", providers.FormatAuthStyle(style), detect)
+	}
+
+	tr.detectedAuthStyle("client", oauth2.AuthStyleInParams)
+	if cached := tr.authStyles.styles["client"]; cached.row == nil || cached.row.AuthStyle != "params" || !cached.dirty {
+		t.Errorf("expected the new style to be saved, got %+v", cached)
+	}
+
+	tr.staleAuthStyle("override", oauth2.AuthStyleInHeader)
+	if cached := tr.authStyles.styles["override"]; cached.row == nil || cached.dirty {
+		t.Errorf("expected an override to be kept, got %+v", cached)
+	}
+}
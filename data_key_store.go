@@ -0,0 +1,124 @@
+package oauthproxy
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"time"
+
+	"github.com/omniboost/oauth-proxy/mysql"
+	"github.com/omniboost/oauth-proxy/types"
+	"github.com/pkg/errors"
+)
+
+// DBDataKeyStore keeps the wrapped data keys of envelope encryption in the
+// database, apart from the tokens. Data keys are loaded while a token
+// transaction holds a connection, so db needs a connection of its own
+type DBDataKeyStore struct {
+	db *sql.DB
+}
+
+func NewDBDataKeyStore(db *sql.DB) *DBDataKeyStore {
+	return &DBDataKeyStore{db: db}
+}
+
+func (s *DBDataKeyStore) DataKey(ctx context.Context, id int) (types.StoredDataKey, error) {
+	odk, err := mysql.OauthDataKeyByID(ctx, s.db, id)
+	return storedDataKey(odk, err)
+}
+
+func (s *DBDataKeyStore) DataKeyByScope(ctx context.Context, scope types.DataKeyScope) (types.StoredDataKey, error) {
+	odk, err := mysql.OauthDataKeyByAppNamespaceClientID(ctx, s.db, scope.App, scope.Namespace, scope.ClientID)
+	return storedDataKey(odk, err)
+}
+
+func (s *DBDataKeyStore) CreateDataKey(ctx context.Context, scope types.DataKeyScope, keyID string, wrapped []byte) (types.StoredDataKey, error) {
+	now := time.Now()
+	odk := &mysql.OauthDataKey{
+		App:        scope.App,
+		Namespace:  scope.Namespace,
+		ClientID:   scope.ClientID,
+		KeyID:      keyID,
+		WrappedKey: base64.StdEncoding.EncodeToString(wrapped),
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	err := odk.InsertIgnore(ctx, s.db)
+	if err != nil {
+		return types.StoredDataKey{}, errors.WithStack(err)
+	}
+	// another process could have been first
+	return s.DataKeyByScope(ctx, scope)
+}
+
+func (s *DBDataKeyStore) UpdateDataKey(ctx context.Context, dk types.StoredDataKey) error {
+	odk, err := mysql.OauthDataKeyByID(ctx, s.db, dk.ID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	odk.KeyID = dk.KeyID
+	odk.WrappedKey = base64.StdEncoding.EncodeToString(dk.Wrapped)
+	odk.UpdatedAt = time.Now()
+	return errors.WithStack(odk.Update(ctx, s.db))
+}
+
+func storedDataKey(odk *mysql.OauthDataKey, err error) (types.StoredDataKey, error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		return types.StoredDataKey{}, types.ErrNoDataKey
+	}
+	if err != nil {
+		return types.StoredDataKey{}, errors.WithStack(err)
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(odk.WrappedKey)
+	if err != nil {
+		return types.StoredDataKey{}, errors.Wrapf(err, "data key %d", odk.ID)
+	}
+	return types.StoredDataKey{
+		ID:      odk.ID,
+		Scope:   types.DataKeyScope{App: odk.App, Namespace: odk.Namespace, ClientID: odk.ClientID},
+		KeyID:   odk.KeyID,
+		Wrapped: wrapped,
+	}, nil
+}
+
+// Shred deletes the tokens of a client of a provider in a namespace and its
+// data key. Copies of its values elsewhere, like backups, can't be decrypted
+// anymore once no copy of the data key is left: backups of oauth_data_keys
+// have to expire as well. Other processes keep the unwrapped data key in
+// memory until they restart
+func Shred(ctx context.Context, db *sql.DB, app, namespace, clientID string) (int64, error) {
+	scope := types.DataKeyScope{App: app, Namespace: namespace, ClientID: clientID}
+
+	trx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer trx.Rollback()
+
+	n, err := mysql.DeleteOauthTokensByAppNamespaceClientID(ctx, trx, app, namespace, clientID)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	odk, err := mysql.OauthDataKeyByAppNamespaceClientID(ctx, trx, app, namespace, clientID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		// not envelope encrypted
+	case err != nil:
+		return 0, errors.WithStack(err)
+	default:
+		err = odk.Delete(ctx, trx)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+	}
+
+	err = trx.Commit()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	types.ForgetDataKey(scope)
+	return n, nil
+}
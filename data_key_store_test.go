@@ -0,0 +1,87 @@
+package oauthproxy_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	oauthproxy "github.com/omniboost/oauth-proxy"
+	"github.com/omniboost/oauth-proxy/mysql"
+	"github.com/omniboost/oauth-proxy/types"
+	"github.com/pkg/errors"
+)
+
+func TestShred(t *testing.T) {
+	b, _ := json.Marshal(map[string]any{"current": "k", "keys": map[string]string{"k": strings.Repeat("k", 32)}})
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	kp, err := types.NewFileKeyProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types.SetKeyProvider(kp)
+	types.SetDataKeyStore(oauthproxy.NewDBDataKeyStore(dbh))
+	t.Cleanup(func() { types.SetKeyProvider(nil) })
+
+	ctx := context.Background()
+	for _, clientID := range []string{"shredded", "kept"} {
+		ot := &mysql.OauthToken{
+			App:          "SHRED",
+			Type:         "Bearer",
+			GrantType:    "client_credentials",
+			ClientID:     clientID,
+			ClientSecret: "secret",
+			AccessToken:  "ACCESS",
+			CreatedAt:    time.Now(),
+			UpdatedAt:    time.Now(),
+		}
+		if err := ot.Insert(ctx, dbh); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the values refer to the data key of their client
+	var stored string
+	err = dbh.QueryRow("SELECT client_secret FROM oauth_tokens WHERE app = 'SHRED' AND client_id = 'shredded'").Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _ := base64.StdEncoding.DecodeString(stored)
+	if !strings.Contains(string(decoded), `"dkid":`) {
+		t.Errorf("expected the id of the data key in the payload, got %s", decoded)
+	}
+
+	n, err := oauthproxy.Shred(ctx, dbh, "SHRED", "", "shredded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 deleted token, got %d", n)
+	}
+	_, err = mysql.OauthDataKeyByAppNamespaceClientID(ctx, dbh, "SHRED", "", "shredded")
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected the data key to be deleted, got %v", err)
+	}
+
+	// the stored copy can't be decrypted anymore
+	var oes types.OptionallyEncryptedString
+	if err := oes.Scan(stored); !errors.Is(err, types.ErrNoDataKey) {
+		t.Errorf("expected ErrNoDataKey, got %v", err)
+	}
+
+	kept, err := mysql.OauthDataKeyByAppNamespaceClientID(ctx, dbh, "SHRED", "", "kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept.KeyID != "k" {
+		t.Errorf("expected the data key of the other client to be kept, got %+v", kept)
+	}
+}
@@ -0,0 +1,87 @@
+package oauthproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/omniboost/oauth-proxy/mysql"
+	"github.com/pkg/errors"
+)
+
+const ExpiringRoute = "/admin/expiring"
+
+// ExpiringToken is a token lineage that loses its refresh token soon. The
+// customer has to reconnect before RefreshTokenExpiresAt
+type ExpiringToken struct {
+	ID                    int       `json:"id"`
+	App                   string    `json:"app"`
+	Namespace             string    `json:"namespace,omitempty"`
+	GrantType             string    `json:"grant_type"`
+	ClientID              string    `json:"client_id"`
+	Username              string    `json:"username,omitempty"`
+	Scope                 string    `json:"scope,omitempty"`
+	RefreshTokenExpiresAt time.Time `json:"refresh_token_expires_at"`
+	UpdatedAt             time.Time `json:"updated_at"`
+}
+
+// ExpiringTokens returns the token lineages of which the refresh token
+// expires within the next days
+func ExpiringTokens(ctx context.Context, db mysql.DB, days int) ([]ExpiringToken, error) {
+	now := time.Now()
+	tokens, err := mysql.OauthTokensByRefreshTokenExpiresAt(ctx, db, now, now.AddDate(0, 0, days))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	expiring := make([]ExpiringToken, len(tokens))
+	for i, t := range tokens {
+		expiring[i] = ExpiringToken{
+			ID:                    t.ID,
+			App:                   t.App,
+			Namespace:             t.Namespace,
+			GrantType:             t.GrantType,
+			ClientID:              t.ClientID,
+			Username:              t.Username,
+			Scope:                 t.GrantedScope,
+			RefreshTokenExpiresAt: t.RefreshTokenExpiresAt.Time,
+			UpdatedAt:             t.UpdatedAt,
+		}
+	}
+	return expiring, nil
+}
+
+// NewExpiringHandler lists the lineages that expire within ?days=N (7 by
+// default)
+func (s *Server) NewExpiringHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.isAdmin(r) {
+			http.NotFound(w, r)
+			return
+		}
+
+		days := 7
+		if v := r.URL.Query().Get("days"); v != "" {
+			var err error
+			days, err = strconv.Atoi(v)
+			if err != nil || days < 0 {
+				http.Error(w, "invalid days", http.StatusBadRequest)
+				return
+			}
+		}
+
+		expiring, err := ExpiringTokens(r.Context(), s.db, days)
+		if err != nil {
+			sentry.CaptureException(err)
+			s.ErrorResponse(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		encoder := json.NewEncoder(w)
+		encoder.Encode(expiring)
+	}
+}
@@ -0,0 +1,66 @@
+package oauthproxy_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	oauthproxy "github.com/omniboost/oauth-proxy"
+	"github.com/omniboost/oauth-proxy/mysql"
+)
+
+func TestExpiringTokens(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	for clientID, expiresAt := range map[string]time.Time{
+		"expired":  now.Add(-time.Hour),
+		"tomorrow": now.Add(24 * time.Hour),
+		"in_3":     now.AddDate(0, 0, 3),
+		"in_20":    now.AddDate(0, 0, 20),
+	} {
+		ot := &mysql.OauthToken{
+			App:                   "EXPIRING",
+			Type:                  "Bearer",
+			GrantType:             "authorization_code",
+			ClientID:              clientID,
+			RefreshToken:          "REFRESH",
+			RefreshTokenExpiresAt: sql.NullTime{Time: expiresAt, Valid: true},
+			CreatedAt:             now,
+			UpdatedAt:             now,
+		}
+		if err := ot.Insert(ctx, dbh); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expiring, err := oauthproxy.ExpiringTokens(ctx, dbh, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var clientIDs []string
+	for _, e := range expiring {
+		if e.App == "EXPIRING" {
+			clientIDs = append(clientIDs, e.ClientID)
+		}
+	}
+	// the first to expire first, expired and later ones left out
+	if len(clientIDs) != 2 || clientIDs[0] != "tomorrow" || clientIDs[1] != "in_3" {
+		t.Errorf("expected tomorrow and in_3, got %v", clientIDs)
+	}
+
+	expiring, err = oauthproxy.ExpiringTokens(ctx, dbh, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, e := range expiring {
+		if e.App == "EXPIRING" {
+			n++
+		}
+	}
+	if n != 3 {
+		t.Errorf("expected 3 lineages expiring within 30 days, got %d", n)
+	}
+}
@@ -2,9 +2,12 @@ package oauthproxy
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/felixge/httpsnoop"
@@ -12,6 +15,8 @@ import (
 	"github.com/golang/snappy"
 	"github.com/grafana/loki/v3/pkg/logproto"
 	"github.com/lytics/logrus"
+	"github.com/omniboost/oauth-proxy/redact"
+	"github.com/omniboost/oauth-proxy/tracing"
 	"github.com/pkg/errors"
 )
 
@@ -19,84 +24,333 @@ var (
 	GRAFANA_LOKI_URL   = os.Getenv("GRAFANA_LOKI_URL")
 	GRAFANA_LOKI_USER  = os.Getenv("GRAFANA_LOKI_USER")
 	GRAFANA_LOKI_TOKEN = os.Getenv("GRAFANA_LOKI_TOKEN")
+
+	// GRAFANA_LOKI_BATCH_SIZE and GRAFANA_LOKI_BATCH_WAIT control when a batch
+	// is pushed: when it's full (100 entries) or when the oldest entry waited
+	// long enough (1s)
+	GRAFANA_LOKI_BATCH_SIZE = os.Getenv("GRAFANA_LOKI_BATCH_SIZE")
+	GRAFANA_LOKI_BATCH_WAIT = os.Getenv("GRAFANA_LOKI_BATCH_WAIT")
+
+	// GRAFANA_LOKI_BUFFER is the number of entries that are kept while Loki
+	// is slow or down (10000). When the buffer is full entries are dropped
+	GRAFANA_LOKI_BUFFER = os.Getenv("GRAFANA_LOKI_BUFFER")
 )
 
-func (s *Server) PushRequestResponseToGrafana(r *http.Request, w http.ResponseWriter, metrics httpsnoop.Metrics) error {
-	if GRAFANA_LOKI_URL == "" {
-		return nil
+const (
+	// lokiMaxAttempts and lokiBackoff limit the retries of a push
+	lokiMaxAttempts = 5
+	lokiBackoff     = 250 * time.Millisecond
+)
+
+// LokiShipper pushes the request logs to Loki in the background so a slow
+// Loki doesn't slow down the requests. Entries are batched and a failed push
+// is retried with backoff, entries that can't be buffered or pushed are
+// dropped and counted (oauth_proxy_loki_dropped_entries_total)
+type LokiShipper struct {
+	url       string
+	client    *http.Client
+	entries   chan logproto.Entry
+	batchSize int
+	batchWait time.Duration
+
+	// mu guards stopped: entries are only buffered while the shipper is
+	// running
+	mu      sync.RWMutex
+	stopped bool
+	done    chan struct{}
+}
+
+func NewLokiShipper(client *http.Client) *LokiShipper {
+	return &LokiShipper{
+		url:       GRAFANA_LOKI_URL,
+		client:    client,
+		entries:   make(chan logproto.Entry, envInt(GRAFANA_LOKI_BUFFER, 10000)),
+		batchSize: envInt(GRAFANA_LOKI_BATCH_SIZE, 100),
+		batchWait: envDuration(GRAFANA_LOKI_BATCH_WAIT, time.Second),
+		done:      make(chan struct{}),
 	}
+}
 
-	// create data to send
-	logLevel := "info"
-	if metrics.Code >= 400 {
-		logLevel = "error"
+func (ls *LokiShipper) Start() {
+	go func() {
+		defer close(ls.done)
+		ls.run()
+	}()
+}
+
+// Stop stops accepting entries and blocks until the buffered entries are
+// pushed
+func (ls *LokiShipper) Stop() {
+	ls.mu.Lock()
+	if ls.stopped {
+		ls.mu.Unlock()
+		return
+	}
+	ls.stopped = true
+	close(ls.entries)
+	ls.mu.Unlock()
+
+	<-ls.done
+}
+
+// Push buffers an entry, it never blocks
+func (ls *LokiShipper) Push(entry logproto.Entry) {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	if ls.stopped {
+		lokiDropped.WithLabelValues("stopped").Inc()
+		return
+	}
+
+	select {
+	case ls.entries <- entry:
+	default:
+		lokiDropped.WithLabelValues("buffer_full").Inc()
+	}
+}
+
+func (ls *LokiShipper) run() {
+	batch := []logproto.Entry{}
+	timer := time.NewTimer(ls.batchWait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case entry, ok := <-ls.entries:
+			if !ok {
+				ls.push(batch)
+				return
+			}
+			if len(batch) == 0 {
+				timer.Reset(ls.batchWait)
+			}
+			batch = append(batch, entry)
+			if len(batch) >= ls.batchSize {
+				ls.push(batch)
+				batch = []logproto.Entry{}
+			}
+		case <-timer.C:
+			if len(batch) > 0 {
+				ls.push(batch)
+				batch = []logproto.Entry{}
+			}
+		}
+	}
+}
+
+// push sends a batch, retrying with backoff when Loki is unavailable
+func (ls *LokiShipper) push(batch []logproto.Entry) {
+	if len(batch) == 0 {
+		return
+	}
+
+	buf, err := lokiPushRequest(batch)
+	if err != nil {
+		logrus.Errorf("couldn't create loki push request: %s", err)
+		lokiDropped.WithLabelValues("push_failed").Add(float64(len(batch)))
+		return
+	}
+
+	backoff := lokiBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := ls.send(buf)
+		if err == nil {
+			lokiPushed.Add(float64(len(batch)))
+			return
+		}
+		if !retry || attempt == lokiMaxAttempts {
+			logrus.Warnf("couldn't push %d entries to loki: %s", len(batch), err)
+			lokiDropped.WithLabelValues("push_failed").Add(float64(len(batch)))
+			return
+		}
+
+		logrus.Debugf("loki push failed, retrying in %s: %s", backoff, err)
+		lokiRetries.Inc()
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// send does one push, retry reports whether a failed push can be retried
+func (ls *LokiShipper) send(buf []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", ls.url, bytes.NewReader(buf))
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	req.SetBasicAuth(GRAFANA_LOKI_USER, GRAFANA_LOKI_TOKEN)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+
+	resp, err := ls.client.Do(req)
+	if err != nil {
+		return true, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return true, errors.Errorf("loki responded with %s", resp.Status)
+	}
+	if resp.StatusCode >= 300 {
+		return false, errors.Errorf("loki responded with %s", resp.Status)
 	}
+	return false, nil
+}
+
+// lokiPushRequest creates the snappy compressed protobuf push request
+func lokiPushRequest(entries []logproto.Entry) ([]byte, error) {
 	push := &logproto.PushRequest{
 		Streams: []logproto.Stream{
 			{
-				Labels: `{service="oauth-proxy"}`,
-				Entries: []logproto.Entry{
-					{
-						Timestamp: time.Now(),
-						Line:      r.URL.Path,
-						StructuredMetadata: []logproto.LabelAdapter{
-							{
-								Name:  "level",
-								Value: logLevel,
-							},
-							{
-								Name:  "path",
-								Value: r.URL.Path,
-							},
-							{
-								Name:  "status_code",
-								Value: strconv.Itoa(metrics.Code),
-							},
-							{
-								Name:  "duration",
-								Value: strconv.FormatFloat(float64(metrics.Duration.Microseconds())/1000.0, 'f', -1, 64) + "ms",
-							},
-						},
-					},
-				},
+				Labels:  `{service="oauth-proxy"}`,
+				Entries: entries,
 			},
 		},
 	}
 
-	// convert data to protobuf
 	buf, err := proto.Marshal(push)
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
+	return snappy.Encode(nil, buf), nil
+}
 
-	// convert protobuf to snappy
-	buf = snappy.Encode(nil, buf)
+// requestLog collects the fields of the Loki entry of a request. The
+// handlers, the token requester and the provider transport fill it in through
+// the context of the request
+type requestLog struct {
+	mu            sync.Mutex
+	handler       string
+	provider      string
+	grantType     string
+	clientID      string
+	outcome       string
+	providerError string
+}
 
-	// create actual http request to grafana
-	grafanaReq, err := http.NewRequest("POST", GRAFANA_LOKI_URL, bytes.NewBuffer(buf))
-	if err != nil {
-		return errors.WithStack(err)
+type requestLogKey struct{}
+
+// logRequest changes the request log of the context, if any
+func logRequest(ctx context.Context, f func(l *requestLog)) {
+	l, ok := ctx.Value(requestLogKey{}).(*requestLog)
+	if !ok {
+		return
 	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f(l)
+}
 
-	grafanaReq.SetBasicAuth(GRAFANA_LOKI_USER, GRAFANA_LOKI_TOKEN)
-	grafanaReq.Header.Set("Content-Type", "application/x-protobuf")
+// lokiEntry creates the entry of a request. Everything but the path is
+// structured metadata
+func lokiEntry(r *http.Request, w http.ResponseWriter, l *requestLog, metrics httpsnoop.Metrics, errorCode string) logproto.Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-	// make request
-	grafanaResp, err := s.client.Do(grafanaReq)
-	if err != nil {
-		return errors.WithStack(err)
+	level, outcome := "info", l.outcome
+	if metrics.Code >= 400 {
+		level = "error"
+	}
+	if outcome == "" {
+		outcome = "success"
+		if metrics.Code >= 400 {
+			outcome = "error"
+		}
+	}
+
+	metadata := []logproto.LabelAdapter{
+		{Name: "level", Value: level},
+		{Name: "path", Value: r.URL.Path},
+		{Name: "status_code", Value: strconv.Itoa(metrics.Code)},
+		{Name: "duration", Value: strconv.FormatFloat(float64(metrics.Duration.Microseconds())/1000.0, 'f', -1, 64) + "ms"},
+		{Name: "handler", Value: l.handler},
+		{Name: "outcome", Value: outcome},
+	}
+	optional := []logproto.LabelAdapter{
+		{Name: "provider", Value: l.provider},
+		{Name: "grant_type", Value: l.grantType},
+		{Name: "error_code", Value: errorCode},
+		{Name: "provider_error_code", Value: l.providerError},
+		{Name: "correlation_id", Value: w.Header().Get(tracing.CorrelationIDHeader)},
+	}
+	if l.clientID != "" {
+		optional = append(optional, logproto.LabelAdapter{Name: "client_id_hash", Value: redact.Hash(l.clientID)})
+	}
+	for _, m := range optional {
+		if m.Value != "" {
+			metadata = append(metadata, m)
+		}
+	}
+
+	return logproto.Entry{
+		Timestamp:          time.Now(),
+		Line:               r.URL.Path,
+		StructuredMetadata: metadata,
 	}
-	return grafanaResp.Body.Close()
 }
 
-func (s *Server) logToGrafana(h http.Handler) http.Handler {
+// logToGrafana ships a log entry of every request to Loki
+func (s *Server) logToGrafana(handler, provider string, h http.Handler) http.Handler {
+	if s.loki == nil {
+		return h
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		func() {
-			metrics := httpsnoop.CaptureMetrics(h, w, r)
-			err := s.PushRequestResponseToGrafana(r, w, metrics)
-			if err != nil {
-				logrus.Debug("PushRequestResponseToGrafana error: ", err)
-			}
-		}()
+		l := &requestLog{handler: handler, provider: provider}
+		r = r.WithContext(context.WithValue(r.Context(), requestLogKey{}, l))
+
+		// keep the start of error responses for the error code
+		var body bytes.Buffer
+		status := 0
+		hooked := httpsnoop.Wrap(w, httpsnoop.Hooks{
+			WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+				return func(code int) {
+					if status == 0 {
+						status = code
+					}
+					next(code)
+				}
+			},
+			Write: func(next httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+				return func(b []byte) (int, error) {
+					if status >= 400 && body.Len() < 4096 {
+						body.Write(b)
+					}
+					return next(b)
+				}
+			},
+		})
+
+		metrics := httpsnoop.CaptureMetrics(h, hooked, r)
+		s.loki.Push(lokiEntry(r, w, l, metrics, responseErrorCode(body.Bytes())))
 	})
 }
+
+// responseErrorCode returns the error code of an error response
+func responseErrorCode(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	e := struct {
+		Error string `json:"error"`
+	}{}
+	_ = json.Unmarshal(b, &e)
+	if len(e.Error) > 64 {
+		return "other"
+	}
+	return e.Error
+}
+
+func envInt(v string, def int) int {
+	i, err := strconv.Atoi(v)
+	if err != nil || i <= 0 {
+		return def
+	}
+	return i
+}
+
+func envDuration(v string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return def
+	}
+	return d
+}
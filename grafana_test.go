@@ -0,0 +1,219 @@
+package oauthproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	proto "github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// lokiStandIn records the pushes it receives and responds with the queued
+// status codes, 204 once they're used up
+type lokiStandIn struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	pushes   [][]logproto.Entry
+	attempts int
+	received chan struct{}
+}
+
+func newLokiStandIn(t *testing.T, statuses ...int) *lokiStandIn {
+	l := &lokiStandIn{statuses: statuses, received: make(chan struct{}, 100)}
+	l.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.mu.Lock()
+		defer func() {
+			l.mu.Unlock()
+			l.received <- struct{}{}
+		}()
+
+		l.attempts++
+		if len(l.statuses) > 0 {
+			status := l.statuses[0]
+			l.statuses = l.statuses[1:]
+			if status >= 300 {
+				w.WriteHeader(status)
+				return
+			}
+		}
+
+		b, _ := io.ReadAll(r.Body)
+		b, err := snappy.Decode(nil, b)
+		if err != nil {
+			t.Errorf("invalid snappy body: %s", err)
+		}
+		push := &logproto.PushRequest{}
+		if err := proto.Unmarshal(b, push); err != nil {
+			t.Errorf("invalid push request: %s", err)
+		}
+		for _, s := range push.Streams {
+			l.pushes = append(l.pushes, s.Entries)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(l.Close)
+	return l
+}
+
+// wait blocks until n requests are received
+func (l *lokiStandIn) wait(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-l.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %d requests, got %d", n, i)
+		}
+	}
+}
+
+func (l *lokiStandIn) batches() [][]logproto.Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.pushes
+}
+
+func (l *lokiStandIn) requests() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.attempts
+}
+
+func newTestShipper(url string, buffer, batchSize int, batchWait time.Duration) *LokiShipper {
+	return &LokiShipper{
+		url:       url,
+		client:    http.DefaultClient,
+		entries:   make(chan logproto.Entry, buffer),
+		batchSize: batchSize,
+		batchWait: batchWait,
+		done:      make(chan struct{}),
+	}
+}
+
+func testEntry(line string) logproto.Entry {
+	return logproto.Entry{Timestamp: time.Now(), Line: line}
+}
+
+func TestLokiShipperBatchSize(t *testing.T) {
+	loki := newLokiStandIn(t)
+	ls := newTestShipper(loki.URL, 10, 2, time.Hour)
+	ls.Start()
+	defer ls.Stop()
+
+	for _, line := range []string{"a", "b", "c", "d"} {
+		ls.Push(testEntry(line))
+	}
+	loki.wait(t, 2)
+
+	batches := loki.batches()
+	if len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 2 {
+		t.Fatalf("expected 2 batches of 2 entries, got %v", batches)
+	}
+	if batches[0][0].Line != "a" || batches[1][1].Line != "d" {
+		t.Errorf("expected the entries in order, got %v", batches)
+	}
+}
+
+func TestLokiShipperBatchWait(t *testing.T) {
+	loki := newLokiStandIn(t)
+	ls := newTestShipper(loki.URL, 10, 100, 50*time.Millisecond)
+	ls.Start()
+	defer ls.Stop()
+
+	ls.Push(testEntry("a"))
+	loki.wait(t, 1)
+
+	if batches := loki.batches(); len(batches) != 1 || len(batches[0]) != 1 {
+		t.Errorf("expected 1 batch of 1 entry, got %v", batches)
+	}
+}
+
+func TestLokiShipperRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		attempts int
+		pushed   bool
+	}{
+		{"server error", []int{http.StatusServiceUnavailable}, 2, true},
+		{"too many requests", []int{http.StatusTooManyRequests}, 2, true},
+		{"bad request", []int{http.StatusBadRequest}, 1, false},
+		{"unauthorized", []int{http.StatusUnauthorized}, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loki := newLokiStandIn(t, tt.statuses...)
+			ls := newTestShipper(loki.URL, 10, 1, time.Hour)
+
+			pushed := testutil.ToFloat64(lokiPushed)
+			retries := testutil.ToFloat64(lokiRetries)
+			failed := testutil.ToFloat64(lokiDropped.WithLabelValues("push_failed"))
+
+			ls.Start()
+			ls.Push(testEntry("a"))
+			ls.Stop()
+
+			if n := loki.requests(); n != tt.attempts {
+				t.Errorf("expected %d attempts, got %d", tt.attempts, n)
+			}
+			if d := testutil.ToFloat64(lokiRetries) - retries; d != float64(tt.attempts-1) {
+				t.Errorf("expected %d retries, got %v", tt.attempts-1, d)
+			}
+
+			wantPushed, wantFailed := 0.0, 1.0
+			if tt.pushed {
+				wantPushed, wantFailed = 1, 0
+			}
+			if d := testutil.ToFloat64(lokiPushed) - pushed; d != wantPushed {
+				t.Errorf("expected %v pushed entries, got %v", wantPushed, d)
+			}
+			if d := testutil.ToFloat64(lokiDropped.WithLabelValues("push_failed")) - failed; d != wantFailed {
+				t.Errorf("expected %v failed entries, got %v", wantFailed, d)
+			}
+		})
+	}
+}
+
+func TestLokiShipperDrops(t *testing.T) {
+	loki := newLokiStandIn(t)
+
+	// not started: the buffer isn't drained
+	ls := newTestShipper(loki.URL, 1, 100, time.Hour)
+	full := testutil.ToFloat64(lokiDropped.WithLabelValues("buffer_full"))
+	ls.Push(testEntry("a"))
+	ls.Push(testEntry("b"))
+	if d := testutil.ToFloat64(lokiDropped.WithLabelValues("buffer_full")) - full; d != 1 {
+		t.Errorf("expected 1 buffer_full drop, got %v", d)
+	}
+
+	ls.Start()
+	ls.Stop()
+	stopped := testutil.ToFloat64(lokiDropped.WithLabelValues("stopped"))
+	ls.Push(testEntry("c"))
+	if d := testutil.ToFloat64(lokiDropped.WithLabelValues("stopped")) - stopped; d != 1 {
+		t.Errorf("expected 1 stopped drop, got %v", d)
+	}
+}
+
+func TestLokiShipperStopFlushes(t *testing.T) {
+	loki := newLokiStandIn(t)
+	ls := newTestShipper(loki.URL, 10, 100, time.Hour)
+	ls.Start()
+
+	for _, line := range []string{"a", "b", "c"} {
+		ls.Push(testEntry(line))
+	}
+	ls.Stop()
+
+	if batches := loki.batches(); len(batches) != 1 || len(batches[0]) != 3 {
+		t.Errorf("expected the pending batch of 3 entries to be pushed, got %v", batches)
+	}
+}
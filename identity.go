@@ -0,0 +1,123 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/lytics/logrus"
+	"github.com/omniboost/oauth-proxy/mysql"
+	"github.com/omniboost/oauth-proxy/providers"
+	"github.com/omniboost/oauth-proxy/types"
+	"github.com/pkg/errors"
+)
+
+var (
+	USERINFO_CACHE_TTL = os.Getenv("USERINFO_CACHE_TTL")
+)
+
+// Identity is the connected user/tenant of a token lineage
+type Identity struct {
+	Subject           string          `json:"sub,omitempty"`
+	Claims            json.RawMessage `json:"claims,omitempty"`
+	UserInfo          json.RawMessage `json:"userinfo,omitempty"`
+	UserInfoFetchedAt *time.Time      `json:"userinfo_fetched_at,omitempty"`
+}
+
+// Identity returns the verified id_token claims of the lineage the token
+// belongs to. If the provider has a userinfo endpoint the (cached) userinfo
+// is added
+func (tr *TokenRequester) Identity(token *Token, params providers.TokenRequestParams) (Identity, error) {
+	identity := Identity{}
+
+	dbTokens, err := mysql.OauthTokensByAppClientIDAccessToken(tr.requestContext(params), observeDB(tr.db), tr.provider.Name(), params.Namespace, params.ClientID, token.AccessToken)
+	if err != nil {
+		return identity, errors.WithStack(err)
+	}
+	if len(dbTokens) == 0 {
+		return identity, errors.New("couldn't find token in database")
+	}
+	dbToken := dbTokens[0]
+
+	if dbToken.IDTokenClaims != "" {
+		identity.Claims = json.RawMessage(dbToken.IDTokenClaims)
+	}
+
+	if p, ok := tr.provider.(providers.UserInfoProvider); ok {
+		if !dbToken.UserinfoFetchedAt.Valid || time.Since(dbToken.UserinfoFetchedAt.Time) > userInfoCacheTTL() {
+			b, err := tr.FetchUserInfo(p, token, params)
+			if err != nil {
+				// stale userinfo is better than none
+				logrus.Warnf("couldn't fetch userinfo: %s", err)
+			} else {
+				dbToken.Userinfo = types.OptionallyEncryptedString(b)
+				dbToken.UserinfoFetchedAt.Time = time.Now()
+				dbToken.UserinfoFetchedAt.Valid = true
+				err = dbToken.SaveUserinfo(tr.requestContext(params), observeDB(tr.db))
+				if err != nil {
+					return identity, errors.WithStack(err)
+				}
+			}
+		}
+
+		if dbToken.Userinfo != "" {
+			identity.UserInfo = json.RawMessage(dbToken.Userinfo)
+			identity.UserInfoFetchedAt = &dbToken.UserinfoFetchedAt.Time
+		}
+	}
+
+	// the id_token is leading, userinfo only when there's no id_token
+	for _, b := range []json.RawMessage{identity.Claims, identity.UserInfo} {
+		if identity.Subject != "" || len(b) == 0 {
+			continue
+		}
+		claims := struct {
+			Sub string `json:"sub"`
+		}{}
+		_ = json.Unmarshal(b, &claims)
+		identity.Subject = claims.Sub
+	}
+
+	return identity, nil
+}
+
+func (tr *TokenRequester) FetchUserInfo(provider providers.UserInfoProvider, token *Token, params providers.TokenRequestParams) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, provider.UserInfoURL(params), nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	token.SetAuthHeader(req)
+
+	params.DPoPKey = token.DPoPKey
+	resp, err := tr.providerClient(params, http.DefaultTransport).Do(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("userinfo endpoint returned status %d: %s", resp.StatusCode, b)
+	}
+
+	if !json.Valid(b) {
+		return nil, errors.New("userinfo endpoint didn't return json")
+	}
+
+	return b, nil
+}
+
+func userInfoCacheTTL() time.Duration {
+	ttl, err := time.ParseDuration(USERINFO_CACHE_TTL)
+	if err != nil || ttl <= 0 {
+		return time.Hour
+	}
+	return ttl
+}
@@ -0,0 +1,143 @@
+package oauthproxy_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	oauthproxy "github.com/omniboost/oauth-proxy"
+	"github.com/omniboost/oauth-proxy/mysql"
+	"github.com/omniboost/oauth-proxy/providers"
+	"github.com/omniboost/oauth-proxy/types"
+	"golang.org/x/oauth2"
+)
+
+type IdentityProvider struct {
+	MockProvider
+	name string
+}
+
+func (v IdentityProvider) Name() string {
+	return v.name
+}
+
+type UserInfoProvider struct {
+	IdentityProvider
+	userInfoURL string
+}
+
+func (v UserInfoProvider) UserInfoURL(params providers.TokenRequestParams) string {
+	return v.userInfoURL
+}
+
+func insertIdentityToken(t *testing.T, app, clientID, accessToken, claims string) {
+	t.Helper()
+	ot := &mysql.OauthToken{
+		App:             app,
+		Type:            "Bearer",
+		GrantType:       "authorization_code",
+		ClientID:        clientID,
+		AccessToken:     types.OptionallyEncryptedString(accessToken),
+		AccessTokenHash: mysql.NewAccessTokenHash(clientID, accessToken),
+		IDTokenClaims:   types.OptionallyEncryptedString(claims),
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+	}
+	if err := ot.Insert(context.Background(), dbh); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func identityToken(accessToken string) *oauthproxy.Token {
+	return &oauthproxy.Token{Token: &oauth2.Token{AccessToken: accessToken, TokenType: "Bearer"}}
+}
+
+func TestIdentityStoredClaims(t *testing.T) {
+	tr := oauthproxy.NewTokenRequester(dbh, IdentityProvider{name: "IDENTITY"})
+	insertIdentityToken(t, "IDENTITY", "claims", "CLAIMS", `{"sub":"user-1","email":"user@example.com"}`)
+
+	// the provider has no userinfo endpoint
+	identity, err := tr.Identity(identityToken("CLAIMS"), providers.TokenRequestParams{ClientID: "claims"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Subject != "user-1" {
+		t.Errorf("expected subject user-1, got %q", identity.Subject)
+	}
+	if string(identity.Claims) != `{"sub":"user-1","email":"user@example.com"}` {
+		t.Errorf("expected the stored claims, got %s", identity.Claims)
+	}
+	if identity.UserInfo != nil || identity.UserInfoFetchedAt != nil {
+		t.Errorf("expected no userinfo, got %s", identity.UserInfo)
+	}
+
+	_, err = tr.Identity(identityToken("UNKNOWN"), providers.TokenRequestParams{ClientID: "claims"})
+	if err == nil {
+		t.Error("expected an error for an unknown token")
+	}
+}
+
+func TestIdentityUserInfoCache(t *testing.T) {
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer USERINFO" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fetches.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"sub":"user-2","name":"User"}`))
+	}))
+	defer srv.Close()
+
+	ttl := oauthproxy.USERINFO_CACHE_TTL
+	t.Cleanup(func() { oauthproxy.USERINFO_CACHE_TTL = ttl })
+	oauthproxy.USERINFO_CACHE_TTL = "1h"
+
+	provider := UserInfoProvider{IdentityProvider: IdentityProvider{name: "USERINFO"}, userInfoURL: srv.URL}
+	tr := oauthproxy.NewTokenRequester(dbh, provider)
+	insertIdentityToken(t, "USERINFO", "userinfo", "USERINFO", "")
+	params := providers.TokenRequestParams{ClientID: "userinfo"}
+
+	// miss: fetched and stored
+	identity, err := tr.Identity(identityToken("USERINFO"), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetches.Load() != 1 {
+		t.Errorf("expected the userinfo to be fetched, got %d fetches", fetches.Load())
+	}
+	if string(identity.UserInfo) != `{"sub":"user-2","name":"User"}` || identity.UserInfoFetchedAt == nil {
+		t.Errorf("expected the userinfo, got %s", identity.UserInfo)
+	}
+	// without an id_token the subject of the userinfo is used
+	if identity.Subject != "user-2" {
+		t.Errorf("expected subject user-2, got %q", identity.Subject)
+	}
+
+	// hit: the stored userinfo is used
+	identity, err = tr.Identity(identityToken("USERINFO"), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetches.Load() != 1 {
+		t.Errorf("expected the cached userinfo, got %d fetches", fetches.Load())
+	}
+	if string(identity.UserInfo) != `{"sub":"user-2","name":"User"}` {
+		t.Errorf("expected the cached userinfo, got %s", identity.UserInfo)
+	}
+
+	// expired: fetched again
+	oauthproxy.USERINFO_CACHE_TTL = "1ms"
+	time.Sleep(10 * time.Millisecond)
+	_, err = tr.Identity(identityToken("USERINFO"), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetches.Load() != 2 {
+		t.Errorf("expected the expired userinfo to be fetched again, got %d fetches", fetches.Load())
+	}
+}
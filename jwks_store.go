@@ -0,0 +1,36 @@
+package oauthproxy
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/omniboost/oauth-proxy/mysql"
+	"github.com/pkg/errors"
+)
+
+// DBKeySetStore persists the last known good JWKS key sets in the database
+type DBKeySetStore struct {
+	db *sql.DB
+}
+
+func NewDBKeySetStore(db *sql.DB) *DBKeySetStore {
+	return &DBKeySetStore{db: db}
+}
+
+func (s *DBKeySetStore) LoadKeySet(ctx context.Context, jwksURL string) ([]byte, error) {
+	ks, err := mysql.JwksKeySetByJwksURL(ctx, s.db, jwksURL)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return []byte(ks.KeySet), nil
+}
+
+func (s *DBKeySetStore) SaveKeySet(ctx context.Context, jwksURL string, keySet []byte) error {
+	ks := &mysql.JwksKeySet{
+		JwksURL:   jwksURL,
+		KeySet:    string(keySet),
+		FetchedAt: time.Now(),
+	}
+	return errors.WithStack(ks.Upsert(ctx, s.db))
+}
@@ -0,0 +1,260 @@
+package oauthproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/omniboost/oauth-proxy/mysql"
+	"github.com/omniboost/oauth-proxy/tracing"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+var (
+	// METRICS_TOKEN protects the metrics endpoint. When it's set scrapes have
+	// to send it as a bearer token
+	METRICS_TOKEN = os.Getenv("METRICS_TOKEN")
+)
+
+const MetricsRoute = "/metrics"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "oauth_proxy_http_requests_total",
+		Help: "Requests handled by the proxy by provider, handler and status code",
+	}, []string{"provider", "handler", "code"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "oauth_proxy_http_request_duration_seconds",
+		Help:    "Duration of the requests handled by the proxy",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"provider", "handler"})
+
+	tokenRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "oauth_proxy_token_requests_total",
+		Help: "Token requests handled by the token requesters by provider, grant type and outcome (cached, refreshed, exchanged or error)",
+	}, []string{"provider", "grant_type", "outcome"})
+	tokenDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "oauth_proxy_token_request_duration_seconds",
+		Help:    "Duration of the token requests, without the time spent in the queue",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"provider", "grant_type"})
+
+	revocations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "oauth_proxy_revocations_total",
+		Help: "Revocations by provider, token type hint and outcome (success or error)",
+	}, []string{"provider", "token_type_hint", "outcome"})
+
+	providerRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "oauth_proxy_provider_requests_total",
+		Help: "Calls to the token and revoke endpoints of the providers by status code and oauth error code",
+	}, []string{"provider", "endpoint", "code", "error"})
+	providerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "oauth_proxy_provider_request_duration_seconds",
+		Help:    "Duration of the calls to the providers",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"provider", "endpoint"})
+
+	queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "oauth_proxy_requester_queue_depth",
+		Help: "Requests waiting for a token requester or revoker",
+	}, []string{"provider", "requester"})
+	queueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "oauth_proxy_requester_wait_seconds",
+		Help:    "Time requests wait for a token requester or revoker",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"provider", "requester"})
+
+	dbDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "oauth_proxy_db_query_duration_seconds",
+		Help:    "Duration of the database queries by statement (select, insert, update or delete)",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"statement"})
+
+	lokiPushed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "oauth_proxy_loki_pushed_entries_total",
+		Help: "Log entries pushed to Loki",
+	})
+	lokiDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "oauth_proxy_loki_dropped_entries_total",
+		Help: "Log entries that weren't pushed to Loki by reason (buffer_full, push_failed or stopped)",
+	}, []string{"reason"})
+	lokiRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "oauth_proxy_loki_push_retries_total",
+		Help: "Retried pushes to Loki",
+	})
+)
+
+// oauthErrors are the error codes of the providers that are used as label,
+// other codes are counted as "other"
+var oauthErrors = map[string]bool{
+	"invalid_request":         true,
+	"invalid_client":          true,
+	"invalid_grant":           true,
+	"unauthorized_client":     true,
+	"unsupported_grant_type":  true,
+	"invalid_scope":           true,
+	"unsupported_token_type":  true,
+	"invalid_dpop_proof":      true,
+	"use_dpop_nonce":          true,
+	"server_error":            true,
+	"temporarily_unavailable": true,
+}
+
+// NewMetricsHandler exposes the metrics in the prometheus format
+func (s *Server) NewMetricsHandler() http.HandlerFunc {
+	h := promhttp.Handler()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if METRICS_TOKEN != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(METRICS_TOKEN)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	}
+}
+
+// instrument traces the requests of a handler and counts them by status code
+func instrument(provider, handler string, h http.Handler) http.Handler {
+	counted := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := httpsnoop.CaptureMetrics(h, w, r)
+		httpRequests.WithLabelValues(provider, handler, strconv.Itoa(m.Code)).Inc()
+		httpDuration.WithLabelValues(provider, handler).Observe(m.Duration.Seconds())
+	})
+	return tracing.Handler(handler, counted, attribute.String("oauth_proxy.provider", provider))
+}
+
+// providerRoundTripper counts, times and traces the calls to a provider
+// endpoint
+type providerRoundTripper struct {
+	rtp       http.RoundTripper
+	provider  string
+	endpoint  string
+	grantType string
+}
+
+// newProviderTransport returns the transport for the calls to the endpoint
+// (token or revoke) of the provider
+func newProviderTransport(provider, endpoint, grantType string) http.RoundTripper {
+	return &providerRoundTripper{rtp: http.DefaultTransport, provider: provider, endpoint: endpoint, grantType: grantType}
+}
+
+func (rt *providerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracing.Start(req.Context(), "provider "+rt.endpoint,
+		attribute.String("oauth_proxy.provider", rt.provider),
+		attribute.String("http.request.method", req.Method),
+		attribute.String("server.address", req.URL.Hostname()),
+	)
+	if rt.grantType != "" {
+		span.SetAttributes(attribute.String("oauth_proxy.grant_type", rt.grantType))
+	}
+
+	start := time.Now()
+	resp, err := rt.rtp.RoundTrip(req.WithContext(ctx))
+	providerDuration.WithLabelValues(rt.provider, rt.endpoint).Observe(time.Since(start).Seconds())
+	if err != nil {
+		providerRequests.WithLabelValues(rt.provider, rt.endpoint, "error", "").Inc()
+		tracing.End(span, err)
+		return resp, err
+	}
+
+	code := ""
+	if resp.StatusCode >= 400 {
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(b))
+		if err != nil {
+			tracing.End(span, err)
+			return resp, err
+		}
+		code = oauthErrorCode(b)
+	}
+	providerRequests.WithLabelValues(rt.provider, rt.endpoint, strconv.Itoa(resp.StatusCode), code).Inc()
+
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if code != "" {
+		span.SetAttributes(attribute.String("oauth_proxy.error", code))
+		span.SetStatus(codes.Error, code)
+		logRequest(ctx, func(l *requestLog) { l.providerError = code })
+	}
+	span.End()
+	return resp, nil
+}
+
+// oauthErrorCode returns the error code of an error response
+func oauthErrorCode(b []byte) string {
+	e := struct {
+		Error string `json:"error"`
+	}{}
+	if json.Unmarshal(b, &e) != nil || e.Error == "" {
+		return "other"
+	}
+	if !oauthErrors[e.Error] {
+		return "other"
+	}
+	return e.Error
+}
+
+// observedDB times and traces the queries run on the database
+type observedDB struct {
+	db mysql.DB
+}
+
+func observeDB(db mysql.DB) mysql.DB {
+	return observedDB{db: db}
+}
+
+func (db observedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, done := observeQuery(ctx, query)
+	res, err := db.db.ExecContext(ctx, query, args...)
+	done(err)
+	return res, err
+}
+
+func (db observedDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, done := observeQuery(ctx, query)
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	done(err)
+	return rows, err
+}
+
+func (db observedDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	ctx, done := observeQuery(ctx, query)
+	row := db.db.QueryRowContext(ctx, query, args...)
+	done(row.Err())
+	return row
+}
+
+// observeQuery starts the span of a query, done records its duration
+func observeQuery(ctx context.Context, query string) (context.Context, func(error)) {
+	statement, _, _ := strings.Cut(strings.TrimSpace(query), " ")
+	statement = strings.ToLower(statement)
+
+	ctx, span := tracing.Start(ctx, "db "+statement,
+		attribute.String("db.system", "mysql"),
+		attribute.String("db.query.text", query),
+	)
+	start := time.Now()
+	return ctx, func(err error) {
+		dbDuration.WithLabelValues(statement).Observe(time.Since(start).Seconds())
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+		}
+		tracing.End(span, err)
+	}
+}
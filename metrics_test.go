@@ -0,0 +1,127 @@
+package oauthproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestOauthErrorCode(t *testing.T) {
+	tests := map[string]string{
+		`{"error":"invalid_grant"}`:                              "invalid_grant",
+		`{"error":"use_dpop_nonce","error_description":"nonce"}`: "use_dpop_nonce",
+		`{"error":"access_denied_by_policy"}`:                    "other",
+		`{"error":""}`:                                           "other",
+		`{"message":"invalid_grant"}`:                            "other",
+		`{"error":{"code":"invalid_grant"}}`:                     "other",
+		`<html><body>Internal Server Error</body></html>`:        "other",
+		``: "other",
+	}
+
+	for b, expected := range tests {
+		if code := oauthErrorCode([]byte(b)); code != expected {
+			t.Errorf("%s: expected %s, got %s", b, expected, code)
+		}
+	}
+}
+
+func TestProviderRoundTripper(t *testing.T) {
+	responses := map[string]struct {
+		status int
+		body   string
+	}{
+		"/ok":      {http.StatusOK, `{"access_token":"TOKEN"}`},
+		"/grant":   {http.StatusBadRequest, `{"error":"invalid_grant"}`},
+		"/unknown": {http.StatusUnauthorized, `{"error":"not_an_oauth_error"}`},
+		"/html":    {http.StatusBadGateway, `<html>Bad Gateway</html>`},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rsp := responses[r.URL.Path]
+		w.WriteHeader(rsp.status)
+		w.Write([]byte(rsp.body))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		path  string
+		code  string
+		error string
+	}{
+		{"/ok", "200", ""},
+		{"/grant", "400", "invalid_grant"},
+		{"/unknown", "401", "other"},
+		{"/html", "502", "other"},
+	}
+
+	rt := newProviderTransport("METRICS", "token", "refresh_token")
+	for _, tt := range tests {
+		counter := providerRequests.WithLabelValues("METRICS", "token", tt.code, tt.error)
+		before := testutil.ToFloat64(counter)
+
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+tt.path, nil)
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the body can still be read by the oauth2 package
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != responses[tt.path].body {
+			t.Errorf("%s: expected the body %s, got %s", tt.path, responses[tt.path].body, b)
+		}
+
+		if after := testutil.ToFloat64(counter); after != before+1 {
+			t.Errorf("%s: expected code %s and error %q to be counted, got %v -> %v", tt.path, tt.code, tt.error, before, after)
+		}
+	}
+
+	// the provider couldn't be reached
+	counter := providerRequests.WithLabelValues("METRICS", "token", "error", "")
+	before := testutil.ToFloat64(counter)
+	srv.Close()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/ok", nil)
+	if _, err := rt.RoundTrip(req); err == nil {
+		t.Error("expected an error for a closed server")
+	}
+	if after := testutil.ToFloat64(counter); after != before+1 {
+		t.Errorf("expected the failed call to be counted as error, got %v -> %v", before, after)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	token := METRICS_TOKEN
+	t.Cleanup(func() { METRICS_TOKEN = token })
+
+	tests := []struct {
+		token         string
+		authorization string
+		expected      int
+	}{
+		{"", "", http.StatusOK},
+		{"METRICS", "", http.StatusUnauthorized},
+		{"METRICS", "Bearer OTHER", http.StatusUnauthorized},
+		{"METRICS", "METRICS", http.StatusOK},
+		{"METRICS", "Bearer METRICS", http.StatusOK},
+	}
+
+	s := &Server{}
+	for _, tt := range tests {
+		METRICS_TOKEN = tt.token
+		r := httptest.NewRequest(http.MethodGet, MetricsRoute, nil)
+		if tt.authorization != "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+		w := httptest.NewRecorder()
+		s.NewMetricsHandler()(w, r)
+		if w.Code != tt.expected {
+			t.Errorf("METRICS_TOKEN=%q, Authorization %q: expected %d, got %d", tt.token, tt.authorization, tt.expected, w.Code)
+		}
+	}
+}
@@ -35,17 +35,26 @@ func NewClientSecretHash(clientID, clientSecret string) types.HashedString {
 	return types.NewHashedString("CS", clientID, clientSecret)
 }
 
-func OauthTokensByAppClientIDAccessToken(ctx context.Context, db DB, app, clientID, accessToken string) ([]*OauthToken, error) {
-	accessTokenHash := NewAccessTokenHash(clientID, accessToken)
+// lookupHashes returns the current and the legacy hash of a value, so rows
+// that weren't rehashed with HASH_KEY yet are still found
+func lookupHashes(prefix, clientID, value string) [2]types.HashedString {
+	if value == "" {
+		return [2]types.HashedString{}
+	}
+	return types.NewLookupHashedStrings(prefix, clientID, value)
+}
+
+func OauthTokensByAppClientIDAccessToken(ctx context.Context, db DB, app, namespace, clientID, accessToken string) ([]*OauthToken, error) {
+	accessTokenHash := lookupHashes("AT", clientID, accessToken)
 	// query
 	const sqlstr = `SELECT ` +
-		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors ` +
+		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors, dpop_key, scope, audience, resource, granted_scope, id_token_claims, userinfo, userinfo_fetched_at, exchange_context, last_response_body, namespace ` +
 		`FROM oauth_proxy.oauth_tokens ` +
-		`WHERE app = ? AND access_token_hash = ? AND (refresh_token_expires_at IS NULL OR refresh_token_expires_at > ?)`
+		`WHERE app = ? AND namespace = ? AND access_token_hash IN (?, ?) AND (refresh_token_expires_at IS NULL OR refresh_token_expires_at > ?)`
 	// run
-	logf(sqlstr, app, accessTokenHash)
+	logf(sqlstr, app, namespace, accessTokenHash[0], accessTokenHash[1])
 	refreshTokenExpiresAt := time.Now()
-	rows, err := db.QueryContext(ctx, sqlstr, app, accessTokenHash, refreshTokenExpiresAt)
+	rows, err := db.QueryContext(ctx, schema(sqlstr), app, namespace, accessTokenHash[0], accessTokenHash[1], refreshTokenExpiresAt)
 	if err != nil {
 		return nil, logerror(err)
 	}
@@ -79,6 +88,17 @@ func OauthTokensByAppClientIDAccessToken(ctx context.Context, db DB, app, client
 			&ot.CodeVerifier,
 			&ot.RefreshTokenExpiresAt,
 			&ot.NrOfSubsequentProviderErrors,
+			&ot.DPoPKey,
+			&ot.Scope,
+			&ot.Audience,
+			&ot.Resource,
+			&ot.GrantedScope,
+			&ot.IDTokenClaims,
+			&ot.Userinfo,
+			&ot.UserinfoFetchedAt,
+			&ot.ExchangeContext,
+			&ot.LastResponseBody,
+			&ot.Namespace,
 		); err != nil {
 			return nil, logerror(err)
 		}
@@ -90,28 +110,95 @@ func OauthTokensByAppClientIDAccessToken(ctx context.Context, db DB, app, client
 	return res, nil
 }
 
-func OauthTokenByAppClientIDClientSecretRefreshTokenOrOriginalRefreshToken(ctx context.Context, db DB, app, clientID, clientSecret, refreshToken string) (*OauthToken, error) {
-	clientSecretHash := NewClientSecretHash(clientID, clientSecret)
-	refreshTokenHash := NewRefreshTokenHash(clientID, refreshToken)
-	originalRefreshTokenHash := NewOriginalRefreshTokenHash(clientID, refreshToken)
+// OauthTokensByRefreshTokenExpiresAt retrieves the tokens of which the refresh
+// token expires between from and to, the first to expire first.
+func OauthTokensByRefreshTokenExpiresAt(ctx context.Context, db DB, from, to time.Time) ([]*OauthToken, error) {
+	// query
+	const sqlstr = `SELECT ` +
+		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors, dpop_key, scope, audience, resource, granted_scope, id_token_claims, userinfo, userinfo_fetched_at, exchange_context, last_response_body, namespace ` +
+		`FROM oauth_proxy.oauth_tokens ` +
+		`WHERE refresh_token_expires_at > ? AND refresh_token_expires_at <= ? ` +
+		`ORDER BY refresh_token_expires_at`
+	// run
+	logf(sqlstr, from, to)
+	rows, err := db.QueryContext(ctx, schema(sqlstr), from, to)
+	if err != nil {
+		return nil, logerror(err)
+	}
+	defer rows.Close()
+	// process
+	var res []*OauthToken
+	for rows.Next() {
+		ot := OauthToken{
+			_exists: true,
+		}
+		// scan
+		if err := rows.Scan(
+			&ot.ID,
+			&ot.App,
+			&ot.Type,
+			&ot.GrantType,
+			&ot.ClientID,
+			&ot.ClientSecret,
+			&ot.ClientSecretHash,
+			&ot.Username,
+			&ot.OriginalRefreshToken,
+			&ot.OriginalRefreshTokenHash,
+			&ot.RefreshToken,
+			&ot.RefreshTokenHash,
+			&ot.AccessToken,
+			&ot.AccessTokenHash,
+			&ot.ExpiresAt,
+			&ot.CreatedAt,
+			&ot.UpdatedAt,
+			&ot.CodeExchangeResponseBody,
+			&ot.CodeVerifier,
+			&ot.RefreshTokenExpiresAt,
+			&ot.NrOfSubsequentProviderErrors,
+			&ot.DPoPKey,
+			&ot.Scope,
+			&ot.Audience,
+			&ot.Resource,
+			&ot.GrantedScope,
+			&ot.IDTokenClaims,
+			&ot.Userinfo,
+			&ot.UserinfoFetchedAt,
+			&ot.ExchangeContext,
+			&ot.LastResponseBody,
+			&ot.Namespace,
+		); err != nil {
+			return nil, logerror(err)
+		}
+		res = append(res, &ot)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, logerror(err)
+	}
+	return res, nil
+}
+
+func OauthTokenByAppClientIDClientSecretRefreshTokenOrOriginalRefreshToken(ctx context.Context, db DB, app, namespace, clientID, clientSecret, refreshToken string) (*OauthToken, error) {
+	clientSecretHash := lookupHashes("CS", clientID, clientSecret)
+	refreshTokenHash := lookupHashes("RT", clientID, refreshToken)
+	originalRefreshTokenHash := lookupHashes("ORT", clientID, refreshToken)
 
 	// since the clientID is in the hash, we don't need to query for it separately
 	// query
 	const sqlstr = `SELECT ` +
-		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors ` +
+		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors, dpop_key, scope, audience, resource, granted_scope, id_token_claims, userinfo, userinfo_fetched_at, exchange_context, last_response_body, namespace ` +
 		`FROM oauth_proxy.oauth_tokens ` +
 		`USE INDEX (ot_app_client_id_client_secret_hash) ` +
-		`WHERE app = ? AND client_id = ? AND client_secret_hash = ? ` +
-		`AND (refresh_token_hash = ? OR original_refresh_token_hash = ?) ` +
+		`WHERE app = ? AND namespace = ? AND client_id = ? AND client_secret_hash IN (?, ?) ` +
+		`AND (refresh_token_hash IN (?, ?) OR original_refresh_token_hash IN (?, ?)) ` +
 		`ORDER BY updated_at DESC ` +
 		`LIMIT 1 ` +
 		`FOR UPDATE`
 	// run
-	logf(sqlstr, app, clientID, clientSecretHash, refreshTokenHash, originalRefreshTokenHash)
+	logf(sqlstr, app, namespace, clientID, clientSecretHash[0], clientSecretHash[1], refreshTokenHash[0], refreshTokenHash[1], originalRefreshTokenHash[0], originalRefreshTokenHash[1])
 	ot := OauthToken{
 		_exists: true,
 	}
-	if err := db.QueryRowContext(ctx, sqlstr, app, clientID, clientSecretHash, refreshTokenHash, originalRefreshTokenHash).Scan(
+	if err := db.QueryRowContext(ctx, schema(sqlstr), app, namespace, clientID, clientSecretHash[0], clientSecretHash[1], refreshTokenHash[0], refreshTokenHash[1], originalRefreshTokenHash[0], originalRefreshTokenHash[1]).Scan(
 		&ot.ID,
 		&ot.App,
 		&ot.Type,
@@ -133,30 +220,45 @@ func OauthTokenByAppClientIDClientSecretRefreshTokenOrOriginalRefreshToken(ctx c
 		&ot.CodeVerifier,
 		&ot.RefreshTokenExpiresAt,
 		&ot.NrOfSubsequentProviderErrors,
+		&ot.DPoPKey,
+		&ot.Scope,
+		&ot.Audience,
+		&ot.Resource,
+		&ot.GrantedScope,
+		&ot.IDTokenClaims,
+		&ot.Userinfo,
+		&ot.UserinfoFetchedAt,
+		&ot.ExchangeContext,
+		&ot.LastResponseBody,
+		&ot.Namespace,
 	); err != nil {
 		return nil, logerror(err)
 	}
 	return &ot, nil
 }
 
-func OauthTokenByAppClientIDClientSecretUsername(ctx context.Context, db DB, app, clientID, clientSecret, username string) (*OauthToken, error) {
-	clientSecretHash := NewClientSecretHash(clientID, clientSecret)
+// OauthTokenByAppClientIDClientSecretUsernameScope retrieves the latest
+// password grant token. Tokens requested with a different scope, audience or
+// resource are different tokens.
+func OauthTokenByAppClientIDClientSecretUsernameScope(ctx context.Context, db DB, app, namespace, clientID, clientSecret, username, scope, audience, resource string) (*OauthToken, error) {
+	clientSecretHash := lookupHashes("CS", clientID, clientSecret)
 	// query
 	const sqlstr = `SELECT ` +
-		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors ` +
+		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors, dpop_key, scope, audience, resource, granted_scope, id_token_claims, userinfo, userinfo_fetched_at, exchange_context, last_response_body, namespace ` +
 		`FROM oauth_proxy.oauth_tokens ` +
 		`USE INDEX (ot_app_client_id_client_secret_hash) ` +
-		`WHERE app = ? AND client_id = ? AND client_secret_hash = ? ` +
+		`WHERE app = ? AND namespace = ? AND client_id = ? AND client_secret_hash IN (?, ?) ` +
 		`AND username = ? ` +
+		`AND scope = ? AND audience = ? AND resource = ? ` +
 		`ORDER BY updated_at DESC ` +
 		`LIMIT 1 ` +
 		`FOR UPDATE`
 	// run
-	logf(sqlstr, app, clientID, clientSecretHash, username)
+	logf(sqlstr, app, namespace, clientID, clientSecretHash[0], clientSecretHash[1], username, scope, audience, resource)
 	ot := OauthToken{
 		_exists: true,
 	}
-	if err := db.QueryRowContext(ctx, sqlstr, app, clientID, clientSecretHash, username).Scan(
+	if err := db.QueryRowContext(ctx, schema(sqlstr), app, namespace, clientID, clientSecretHash[0], clientSecretHash[1], username, scope, audience, resource).Scan(
 		&ot.ID,
 		&ot.App,
 		&ot.Type,
@@ -178,29 +280,44 @@ func OauthTokenByAppClientIDClientSecretUsername(ctx context.Context, db DB, app
 		&ot.CodeVerifier,
 		&ot.RefreshTokenExpiresAt,
 		&ot.NrOfSubsequentProviderErrors,
+		&ot.DPoPKey,
+		&ot.Scope,
+		&ot.Audience,
+		&ot.Resource,
+		&ot.GrantedScope,
+		&ot.IDTokenClaims,
+		&ot.Userinfo,
+		&ot.UserinfoFetchedAt,
+		&ot.ExchangeContext,
+		&ot.LastResponseBody,
+		&ot.Namespace,
 	); err != nil {
 		return nil, logerror(err)
 	}
 	return &ot, nil
 }
 
-func OauthTokenByAppClientIDClientSecret(ctx context.Context, db DB, app, clientID, clientSecret string) (*OauthToken, error) {
-	clientSecretHash := NewClientSecretHash(clientID, clientSecret)
+// OauthTokenByAppClientIDClientSecretScope retrieves the latest client
+// credentials token. Tokens requested with a different scope, audience or
+// resource are different tokens.
+func OauthTokenByAppClientIDClientSecretScope(ctx context.Context, db DB, app, namespace, clientID, clientSecret, scope, audience, resource string) (*OauthToken, error) {
+	clientSecretHash := lookupHashes("CS", clientID, clientSecret)
 	// query
 	const sqlstr = `SELECT ` +
-		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors ` +
+		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors, dpop_key, scope, audience, resource, granted_scope, id_token_claims, userinfo, userinfo_fetched_at, exchange_context, last_response_body, namespace ` +
 		`FROM oauth_proxy.oauth_tokens ` +
 		`USE INDEX (ot_app_client_id_client_secret_hash) ` +
-		`WHERE app = ? AND client_id = ? AND client_secret_hash = ? ` +
+		`WHERE app = ? AND namespace = ? AND client_id = ? AND client_secret_hash IN (?, ?) ` +
+		`AND scope = ? AND audience = ? AND resource = ? ` +
 		`ORDER BY updated_at DESC ` +
 		`LIMIT 1 ` +
 		`FOR UPDATE`
 	// run
-	logf(sqlstr, app, clientID, clientSecretHash)
+	logf(sqlstr, app, namespace, clientID, clientSecretHash[0], clientSecretHash[1], scope, audience, resource)
 	ot := OauthToken{
 		_exists: true,
 	}
-	if err := db.QueryRowContext(ctx, sqlstr, app, clientID, clientSecretHash).Scan(
+	if err := db.QueryRowContext(ctx, schema(sqlstr), app, namespace, clientID, clientSecretHash[0], clientSecretHash[1], scope, audience, resource).Scan(
 		&ot.ID,
 		&ot.App,
 		&ot.Type,
@@ -222,6 +339,17 @@ func OauthTokenByAppClientIDClientSecret(ctx context.Context, db DB, app, client
 		&ot.CodeVerifier,
 		&ot.RefreshTokenExpiresAt,
 		&ot.NrOfSubsequentProviderErrors,
+		&ot.DPoPKey,
+		&ot.Scope,
+		&ot.Audience,
+		&ot.Resource,
+		&ot.GrantedScope,
+		&ot.IDTokenClaims,
+		&ot.Userinfo,
+		&ot.UserinfoFetchedAt,
+		&ot.ExchangeContext,
+		&ot.LastResponseBody,
+		&ot.Namespace,
 	); err != nil {
 		return nil, logerror(err)
 	}
@@ -231,22 +359,42 @@ func OauthTokenByAppClientIDClientSecret(ctx context.Context, db DB, app, client
 // OauthTokenByAppRefreshToken retrieves a row from 'oauth_proxy.oauth_tokens' as a [OauthToken].
 //
 // Generated from index 'ot_app_refresh_token'.
-func OauthTokenByAppClientIDRefreshToken(ctx context.Context, db DB, app, clientID, refreshToken string) (*OauthToken, error) {
-	refreshTokenHash := NewRefreshTokenHash(clientID, refreshToken)
+func OauthTokenByAppClientIDRefreshToken(ctx context.Context, db DB, app, namespace, clientID, refreshToken string) (*OauthToken, error) {
+	refreshTokenHash := lookupHashes("RT", clientID, refreshToken)
 
 	// since the clientID is in the hash, we don't need to query for it separately
 	// query
 	const sqlstr = `SELECT ` +
-		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors ` +
+		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors, dpop_key, scope, audience, resource, granted_scope, id_token_claims, userinfo, userinfo_fetched_at, exchange_context, last_response_body, namespace ` +
 		`FROM oauth_proxy.oauth_tokens ` +
-		`WHERE app = ? AND refresh_token_hash = ?`
+		`WHERE app = ? AND namespace = ? AND refresh_token_hash IN (?, ?)`
 	// run
-	logf(sqlstr, app, refreshTokenHash)
+	logf(sqlstr, app, namespace, refreshTokenHash[0], refreshTokenHash[1])
 	ot := OauthToken{
 		_exists: true,
 	}
-	if err := db.QueryRowContext(ctx, sqlstr, app, refreshTokenHash).Scan(&ot.ID, &ot.App, &ot.Type, &ot.GrantType, &ot.ClientID, &ot.ClientSecret, &ot.ClientSecretHash, &ot.Username, &ot.OriginalRefreshToken, &ot.OriginalRefreshTokenHash, &ot.RefreshToken, &ot.RefreshTokenHash, &ot.AccessToken, &ot.AccessTokenHash, &ot.ExpiresAt, &ot.CreatedAt, &ot.UpdatedAt, &ot.CodeExchangeResponseBody, &ot.CodeVerifier, &ot.RefreshTokenExpiresAt, &ot.NrOfSubsequentProviderErrors); err != nil {
+	if err := db.QueryRowContext(ctx, schema(sqlstr), app, namespace, refreshTokenHash[0], refreshTokenHash[1]).Scan(&ot.ID, &ot.App, &ot.Type, &ot.GrantType, &ot.ClientID, &ot.ClientSecret, &ot.ClientSecretHash, &ot.Username, &ot.OriginalRefreshToken, &ot.OriginalRefreshTokenHash, &ot.RefreshToken, &ot.RefreshTokenHash, &ot.AccessToken, &ot.AccessTokenHash, &ot.ExpiresAt, &ot.CreatedAt, &ot.UpdatedAt, &ot.CodeExchangeResponseBody, &ot.CodeVerifier, &ot.RefreshTokenExpiresAt, &ot.NrOfSubsequentProviderErrors, &ot.DPoPKey, &ot.Scope, &ot.Audience, &ot.Resource, &ot.GrantedScope, &ot.IDTokenClaims, &ot.Userinfo, &ot.UserinfoFetchedAt, &ot.ExchangeContext, &ot.LastResponseBody, &ot.Namespace); err != nil {
 		return nil, logerror(err)
 	}
 	return &ot, nil
 }
+
+// SaveUserinfo only updates the userinfo columns so a concurrent token
+// refresh of the same row isn't overwritten
+func (ot *OauthToken) SaveUserinfo(ctx context.Context, db DB) error {
+	// encrypt with the data key of the client
+	db, err := withDataKey(ctx, db, ot)
+	if err != nil {
+		return logerror(err)
+	}
+	// update with primary key
+	const sqlstr = `UPDATE oauth_proxy.oauth_tokens SET ` +
+		`userinfo = ?, userinfo_fetched_at = ? ` +
+		`WHERE id = ?`
+	// run
+	logf(sqlstr, ot.Userinfo, ot.UserinfoFetchedAt, ot.ID)
+	if _, err := db.ExecContext(ctx, schema(sqlstr), ot.Userinfo, ot.UserinfoFetchedAt, ot.ID); err != nil {
+		return logerror(err)
+	}
+	return nil
+}
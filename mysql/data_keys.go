@@ -0,0 +1,80 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/omniboost/oauth-proxy/types"
+)
+
+// InsertIgnore inserts the [OauthDataKey] unless the client already has a
+// data key. Retrieve the data key of the client afterwards to get the one
+// that is stored.
+func (odk *OauthDataKey) InsertIgnore(ctx context.Context, db DB) error {
+	// insert
+	const sqlstr = `INSERT IGNORE INTO oauth_proxy.oauth_data_keys (` +
+		`app, namespace, client_id, key_id, wrapped_key, created_at, updated_at` +
+		`) VALUES (` +
+		`?, ?, ?, ?, ?, ?, ?` +
+		`)`
+	// run
+	logf(sqlstr, odk.App, odk.Namespace, odk.ClientID, odk.KeyID, odk.WrappedKey, odk.CreatedAt, odk.UpdatedAt)
+	if _, err := db.ExecContext(ctx, schema(sqlstr), odk.App, odk.Namespace, odk.ClientID, odk.KeyID, odk.WrappedKey, odk.CreatedAt, odk.UpdatedAt); err != nil {
+		return logerror(err)
+	}
+	return nil
+}
+
+// DeleteOauthTokensByAppNamespaceClientID deletes the tokens of a client.
+func DeleteOauthTokensByAppNamespaceClientID(ctx context.Context, db DB, app, namespace, clientID string) (int64, error) {
+	// delete
+	const sqlstr = `DELETE FROM oauth_proxy.oauth_tokens ` +
+		`WHERE app = ? AND namespace = ? AND client_id = ?`
+	// run
+	logf(sqlstr, app, namespace, clientID)
+	res, err := db.ExecContext(ctx, schema(sqlstr), app, namespace, clientID)
+	if err != nil {
+		return 0, logerror(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, logerror(err)
+	}
+	return n, nil
+}
+
+// encryptingDB encrypts the types.OptionallyEncryptedString arguments of
+// its statements with the data key of a client
+type encryptingDB struct {
+	DB
+	dk *types.DataKey
+}
+
+// withDataKey returns db encrypting the values of the token with the data
+// key of its client when they're envelope encrypted (KEY_PROVIDER). The key
+// provider is only called the first time a process uses the data key
+func withDataKey(ctx context.Context, db DB, ot *OauthToken) (DB, error) {
+	if !types.EnvelopeEncryption() {
+		return db, nil
+	}
+	dk, err := types.DataKeyFor(ctx, types.DataKeyScope{App: ot.App, Namespace: ot.Namespace, ClientID: ot.ClientID})
+	if err != nil {
+		return nil, err
+	}
+	return encryptingDB{DB: db, dk: dk}, nil
+}
+
+func (db encryptingDB) ExecContext(ctx context.Context, sqlstr string, args ...interface{}) (sql.Result, error) {
+	encrypted := make([]interface{}, len(args))
+	for i, arg := range args {
+		encrypted[i] = arg
+		if oes, ok := arg.(types.OptionallyEncryptedString); ok {
+			s, err := oes.EncryptWith(db.dk)
+			if err != nil {
+				return nil, err
+			}
+			encrypted[i] = s
+		}
+	}
+	return db.DB.ExecContext(ctx, sqlstr, encrypted...)
+}
@@ -0,0 +1,95 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// EncryptedOauthTokenColumns are the columns of oauth_tokens that are stored
+// encrypted (types.OptionallyEncryptedString)
+var EncryptedOauthTokenColumns = []string{
+	"client_secret",
+	"original_refresh_token",
+	"refresh_token",
+	"access_token",
+	"code_exchange_response_body",
+	"dpop_key",
+	"id_token_claims",
+	"userinfo",
+	"exchange_context",
+	"last_response_body",
+}
+
+// OauthTokenEncryptedValues are the stored (still encrypted) values of the
+// encrypted columns of a token, in the order of EncryptedOauthTokenColumns.
+// App, Namespace and ClientID select the data key of envelope encryption
+type OauthTokenEncryptedValues struct {
+	ID        int
+	App       string
+	Namespace string
+	ClientID  string
+	Values    []sql.NullString
+}
+
+// OauthTokenEncryptedValuesAfterID retrieves the stored values of the
+// encrypted columns of the next limit tokens after id. The rows are locked
+// until the transaction ends.
+func OauthTokenEncryptedValuesAfterID(ctx context.Context, db DB, id, limit int) ([]*OauthTokenEncryptedValues, error) {
+	// query
+	sqlstr := `SELECT ` +
+		`id, app, namespace, client_id, ` + strings.Join(EncryptedOauthTokenColumns, ", ") + ` ` +
+		`FROM oauth_proxy.oauth_tokens ` +
+		`WHERE id > ? ` +
+		`ORDER BY id ` +
+		`LIMIT ? ` +
+		`FOR UPDATE`
+	// run
+	logf(sqlstr, id, limit)
+	rows, err := db.QueryContext(ctx, schema(sqlstr), id, limit)
+	if err != nil {
+		return nil, logerror(err)
+	}
+	defer rows.Close()
+	// process
+	var res []*OauthTokenEncryptedValues
+	for rows.Next() {
+		ev := OauthTokenEncryptedValues{
+			Values: make([]sql.NullString, len(EncryptedOauthTokenColumns)),
+		}
+		dest := []interface{}{&ev.ID, &ev.App, &ev.Namespace, &ev.ClientID}
+		for i := range ev.Values {
+			dest = append(dest, &ev.Values[i])
+		}
+		// scan
+		if err := rows.Scan(dest...); err != nil {
+			return nil, logerror(err)
+		}
+		res = append(res, &ev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, logerror(err)
+	}
+	return res, nil
+}
+
+// Update stores the values as is, they have to be encrypted already.
+func (ev *OauthTokenEncryptedValues) Update(ctx context.Context, db DB) error {
+	sets := make([]string, len(EncryptedOauthTokenColumns))
+	args := []interface{}{}
+	for i, c := range EncryptedOauthTokenColumns {
+		sets[i] = c + " = ?"
+		args = append(args, ev.Values[i])
+	}
+	args = append(args, ev.ID)
+	// update with primary key
+	sqlstr := `UPDATE oauth_proxy.oauth_tokens SET ` +
+		strings.Join(sets, ", ") + ` ` +
+		`WHERE id = ?`
+	// run
+	logf(sqlstr, args...)
+	if _, err := db.ExecContext(ctx, schema(sqlstr), args...); err != nil {
+		return logerror(err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package mysql
+
+import (
+	"context"
+
+	"github.com/omniboost/oauth-proxy/types"
+)
+
+// OauthTokenHashedValues are the values of a token the lookup hashes are
+// computed from, together with the stored hashes
+type OauthTokenHashedValues struct {
+	ID                       int
+	ClientID                 string
+	ClientSecret             types.OptionallyEncryptedString
+	ClientSecretHash         types.HashedString
+	OriginalRefreshToken     types.OptionallyEncryptedString
+	OriginalRefreshTokenHash types.HashedString
+	RefreshToken             types.OptionallyEncryptedString
+	RefreshTokenHash         types.HashedString
+	AccessToken              types.OptionallyEncryptedString
+	AccessTokenHash          types.HashedString
+}
+
+// OauthTokenHashedValuesAfterID retrieves the hashed values of the next limit
+// tokens after id. The rows are locked until the transaction ends.
+func OauthTokenHashedValuesAfterID(ctx context.Context, db DB, id, limit int) ([]*OauthTokenHashedValues, error) {
+	// query
+	const sqlstr = `SELECT ` +
+		`id, client_id, client_secret, client_secret_hash, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash ` +
+		`FROM oauth_proxy.oauth_tokens ` +
+		`WHERE id > ? ` +
+		`ORDER BY id ` +
+		`LIMIT ? ` +
+		`FOR UPDATE`
+	// run
+	logf(sqlstr, id, limit)
+	rows, err := db.QueryContext(ctx, schema(sqlstr), id, limit)
+	if err != nil {
+		return nil, logerror(err)
+	}
+	defer rows.Close()
+	// process
+	var res []*OauthTokenHashedValues
+	for rows.Next() {
+		var hv OauthTokenHashedValues
+		// scan
+		if err := rows.Scan(&hv.ID, &hv.ClientID, &hv.ClientSecret, &hv.ClientSecretHash, &hv.OriginalRefreshToken, &hv.OriginalRefreshTokenHash, &hv.RefreshToken, &hv.RefreshTokenHash, &hv.AccessToken, &hv.AccessTokenHash); err != nil {
+			return nil, logerror(err)
+		}
+		res = append(res, &hv)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, logerror(err)
+	}
+	return res, nil
+}
+
+// Rehash recomputes the hashes from the values. It reports whether any of
+// the hashes changed.
+func (hv *OauthTokenHashedValues) Rehash() bool {
+	hashes := [4]types.HashedString{
+		NewClientSecretHash(hv.ClientID, string(hv.ClientSecret)),
+		NewOriginalRefreshTokenHash(hv.ClientID, string(hv.OriginalRefreshToken)),
+		NewRefreshTokenHash(hv.ClientID, string(hv.RefreshToken)),
+		NewAccessTokenHash(hv.ClientID, string(hv.AccessToken)),
+	}
+	changed := hashes != [4]types.HashedString{hv.ClientSecretHash, hv.OriginalRefreshTokenHash, hv.RefreshTokenHash, hv.AccessTokenHash}
+	hv.ClientSecretHash, hv.OriginalRefreshTokenHash, hv.RefreshTokenHash, hv.AccessTokenHash = hashes[0], hashes[1], hashes[2], hashes[3]
+	return changed
+}
+
+// Update stores the hashes.
+func (hv *OauthTokenHashedValues) Update(ctx context.Context, db DB) error {
+	// update with primary key
+	const sqlstr = `UPDATE oauth_proxy.oauth_tokens SET ` +
+		`client_secret_hash = ?, original_refresh_token_hash = ?, refresh_token_hash = ?, access_token_hash = ? ` +
+		`WHERE id = ?`
+	// run
+	logf(sqlstr, hv.ClientSecretHash, hv.OriginalRefreshTokenHash, hv.RefreshTokenHash, hv.AccessTokenHash, hv.ID)
+	if _, err := db.ExecContext(ctx, schema(sqlstr), hv.ClientSecretHash, hv.OriginalRefreshTokenHash, hv.RefreshTokenHash, hv.AccessTokenHash, hv.ID); err != nil {
+		return logerror(err)
+	}
+	return nil
+}
@@ -33,6 +33,17 @@ type OauthToken struct {
 	CodeVerifier                 string                          `json:"code_verifier"`                    // code_verifier
 	RefreshTokenExpiresAt        sql.NullTime                    `json:"refresh_token_expires_at"`         // refresh_token_expires_at
 	NrOfSubsequentProviderErrors int                             `json:"nr_of_subsequent_provider_errors"` // nr_of_subsequent_provider_errors
+	DPoPKey                      types.OptionallyEncryptedString `json:"dpop_key"`                         // dpop_key
+	Scope                        string                          `json:"scope"`                            // scope
+	Audience                     string                          `json:"audience"`                         // audience
+	Resource                     string                          `json:"resource"`                         // resource
+	GrantedScope                 string                          `json:"granted_scope"`                    // granted_scope
+	IDTokenClaims                types.OptionallyEncryptedString `json:"id_token_claims"`                  // id_token_claims
+	Userinfo                     types.OptionallyEncryptedString `json:"userinfo"`                         // userinfo
+	UserinfoFetchedAt            sql.NullTime                    `json:"userinfo_fetched_at"`              // userinfo_fetched_at
+	ExchangeContext              types.OptionallyEncryptedString `json:"exchange_context"`                 // exchange_context
+	LastResponseBody             types.OptionallyEncryptedString `json:"last_response_body"`               // last_response_body
+	Namespace                    string                          `json:"namespace"`                        // namespace
 	// xo fields
 	_exists, _deleted bool
 }
@@ -56,15 +67,20 @@ func (ot *OauthToken) Insert(ctx context.Context, db DB) error {
 	case ot._deleted: // deleted
 		return logerror(&ErrInsertFailed{ErrMarkedForDeletion})
 	}
+	// encrypt with the data key of the client
+	db, err := withDataKey(ctx, db, ot)
+	if err != nil {
+		return logerror(err)
+	}
 	// insert (primary key generated and returned by database)
 	const sqlstr = `INSERT INTO oauth_proxy.oauth_tokens (` +
-		`app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors` +
+		`app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors, dpop_key, scope, audience, resource, granted_scope, id_token_claims, userinfo, userinfo_fetched_at, exchange_context, last_response_body, namespace` +
 		`) VALUES (` +
-		`?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?` +
+		`?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?` +
 		`)`
 	// run
-	logf(sqlstr, ot.App, ot.Type, ot.GrantType, ot.ClientID, ot.ClientSecret, ot.ClientSecretHash, ot.Username, ot.OriginalRefreshToken, ot.OriginalRefreshTokenHash, ot.RefreshToken, ot.RefreshTokenHash, ot.AccessToken, ot.AccessTokenHash, ot.ExpiresAt, ot.CreatedAt, ot.UpdatedAt, ot.CodeExchangeResponseBody, ot.CodeVerifier, ot.RefreshTokenExpiresAt, ot.NrOfSubsequentProviderErrors)
-	res, err := db.ExecContext(ctx, sqlstr, ot.App, ot.Type, ot.GrantType, ot.ClientID, ot.ClientSecret, ot.ClientSecretHash, ot.Username, ot.OriginalRefreshToken, ot.OriginalRefreshTokenHash, ot.RefreshToken, ot.RefreshTokenHash, ot.AccessToken, ot.AccessTokenHash, ot.ExpiresAt, ot.CreatedAt, ot.UpdatedAt, ot.CodeExchangeResponseBody, ot.CodeVerifier, ot.RefreshTokenExpiresAt, ot.NrOfSubsequentProviderErrors)
+	logf(sqlstr, ot.App, ot.Type, ot.GrantType, ot.ClientID, ot.ClientSecret, ot.ClientSecretHash, ot.Username, ot.OriginalRefreshToken, ot.OriginalRefreshTokenHash, ot.RefreshToken, ot.RefreshTokenHash, ot.AccessToken, ot.AccessTokenHash, ot.ExpiresAt, ot.CreatedAt, ot.UpdatedAt, ot.CodeExchangeResponseBody, ot.CodeVerifier, ot.RefreshTokenExpiresAt, ot.NrOfSubsequentProviderErrors, ot.DPoPKey, ot.Scope, ot.Audience, ot.Resource, ot.GrantedScope, ot.IDTokenClaims, ot.Userinfo, ot.UserinfoFetchedAt, ot.ExchangeContext, ot.LastResponseBody, ot.Namespace)
+	res, err := db.ExecContext(ctx, schema(sqlstr), ot.App, ot.Type, ot.GrantType, ot.ClientID, ot.ClientSecret, ot.ClientSecretHash, ot.Username, ot.OriginalRefreshToken, ot.OriginalRefreshTokenHash, ot.RefreshToken, ot.RefreshTokenHash, ot.AccessToken, ot.AccessTokenHash, ot.ExpiresAt, ot.CreatedAt, ot.UpdatedAt, ot.CodeExchangeResponseBody, ot.CodeVerifier, ot.RefreshTokenExpiresAt, ot.NrOfSubsequentProviderErrors, ot.DPoPKey, ot.Scope, ot.Audience, ot.Resource, ot.GrantedScope, ot.IDTokenClaims, ot.Userinfo, ot.UserinfoFetchedAt, ot.ExchangeContext, ot.LastResponseBody, ot.Namespace)
 	if err != nil {
 		return logerror(err)
 	}
@@ -88,13 +104,18 @@ func (ot *OauthToken) Update(ctx context.Context, db DB) error {
 		return logerror(&ErrUpdateFailed{ErrMarkedForDeletion})
 	}
 
+	// encrypt with the data key of the client
+	db, err := withDataKey(ctx, db, ot)
+	if err != nil {
+		return logerror(err)
+	}
 	// update with primary key
 	const sqlstr = `UPDATE oauth_proxy.oauth_tokens SET ` +
-		`app = ?, type = ?, grant_type = ?, client_id = ?, client_secret = ?, client_secret_hash = ?, username = ?, original_refresh_token = ?, original_refresh_token_hash = ?, refresh_token = ?, refresh_token_hash = ?, access_token = ?, access_token_hash = ?, expires_at = ?, created_at = ?, updated_at = ?, code_exchange_response_body = ?, code_verifier = ?, refresh_token_expires_at = ?, nr_of_subsequent_provider_errors = ? ` +
+		`app = ?, type = ?, grant_type = ?, client_id = ?, client_secret = ?, client_secret_hash = ?, username = ?, original_refresh_token = ?, original_refresh_token_hash = ?, refresh_token = ?, refresh_token_hash = ?, access_token = ?, access_token_hash = ?, expires_at = ?, created_at = ?, updated_at = ?, code_exchange_response_body = ?, code_verifier = ?, refresh_token_expires_at = ?, nr_of_subsequent_provider_errors = ?, dpop_key = ?, scope = ?, audience = ?, resource = ?, granted_scope = ?, id_token_claims = ?, userinfo = ?, userinfo_fetched_at = ?, exchange_context = ?, last_response_body = ?, namespace = ? ` +
 		`WHERE id = ?`
 	// run
-	logf(sqlstr, ot.App, ot.Type, ot.GrantType, ot.ClientID, ot.ClientSecret, ot.ClientSecretHash, ot.Username, ot.OriginalRefreshToken, ot.OriginalRefreshTokenHash, ot.RefreshToken, ot.RefreshTokenHash, ot.AccessToken, ot.AccessTokenHash, ot.ExpiresAt, ot.CreatedAt, ot.UpdatedAt, ot.CodeExchangeResponseBody, ot.CodeVerifier, ot.RefreshTokenExpiresAt, ot.NrOfSubsequentProviderErrors, ot.ID)
-	if _, err := db.ExecContext(ctx, sqlstr, ot.App, ot.Type, ot.GrantType, ot.ClientID, ot.ClientSecret, ot.ClientSecretHash, ot.Username, ot.OriginalRefreshToken, ot.OriginalRefreshTokenHash, ot.RefreshToken, ot.RefreshTokenHash, ot.AccessToken, ot.AccessTokenHash, ot.ExpiresAt, ot.CreatedAt, ot.UpdatedAt, ot.CodeExchangeResponseBody, ot.CodeVerifier, ot.RefreshTokenExpiresAt, ot.NrOfSubsequentProviderErrors, ot.ID); err != nil {
+	logf(sqlstr, ot.App, ot.Type, ot.GrantType, ot.ClientID, ot.ClientSecret, ot.ClientSecretHash, ot.Username, ot.OriginalRefreshToken, ot.OriginalRefreshTokenHash, ot.RefreshToken, ot.RefreshTokenHash, ot.AccessToken, ot.AccessTokenHash, ot.ExpiresAt, ot.CreatedAt, ot.UpdatedAt, ot.CodeExchangeResponseBody, ot.CodeVerifier, ot.RefreshTokenExpiresAt, ot.NrOfSubsequentProviderErrors, ot.DPoPKey, ot.Scope, ot.Audience, ot.Resource, ot.GrantedScope, ot.IDTokenClaims, ot.Userinfo, ot.UserinfoFetchedAt, ot.ExchangeContext, ot.LastResponseBody, ot.Namespace, ot.ID)
+	if _, err := db.ExecContext(ctx, schema(sqlstr), ot.App, ot.Type, ot.GrantType, ot.ClientID, ot.ClientSecret, ot.ClientSecretHash, ot.Username, ot.OriginalRefreshToken, ot.OriginalRefreshTokenHash, ot.RefreshToken, ot.RefreshTokenHash, ot.AccessToken, ot.AccessTokenHash, ot.ExpiresAt, ot.CreatedAt, ot.UpdatedAt, ot.CodeExchangeResponseBody, ot.CodeVerifier, ot.RefreshTokenExpiresAt, ot.NrOfSubsequentProviderErrors, ot.DPoPKey, ot.Scope, ot.Audience, ot.Resource, ot.GrantedScope, ot.IDTokenClaims, ot.Userinfo, ot.UserinfoFetchedAt, ot.ExchangeContext, ot.LastResponseBody, ot.Namespace, ot.ID); err != nil {
 		return logerror(err)
 	}
 	return nil
@@ -114,17 +135,22 @@ func (ot *OauthToken) Upsert(ctx context.Context, db DB) error {
 	case ot._deleted: // deleted
 		return logerror(&ErrUpsertFailed{ErrMarkedForDeletion})
 	}
+	// encrypt with the data key of the client
+	db, err := withDataKey(ctx, db, ot)
+	if err != nil {
+		return logerror(err)
+	}
 	// upsert
 	const sqlstr = `INSERT INTO oauth_proxy.oauth_tokens (` +
-		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors` +
+		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors, dpop_key, scope, audience, resource, granted_scope, id_token_claims, userinfo, userinfo_fetched_at, exchange_context, last_response_body, namespace` +
 		`) VALUES (` +
-		`?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?` +
+		`?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?` +
 		`)` +
 		` ON DUPLICATE KEY UPDATE ` +
-		`app = VALUES(app), type = VALUES(type), grant_type = VALUES(grant_type), client_id = VALUES(client_id), client_secret = VALUES(client_secret), client_secret_hash = VALUES(client_secret_hash), username = VALUES(username), original_refresh_token = VALUES(original_refresh_token), original_refresh_token_hash = VALUES(original_refresh_token_hash), refresh_token = VALUES(refresh_token), refresh_token_hash = VALUES(refresh_token_hash), access_token = VALUES(access_token), access_token_hash = VALUES(access_token_hash), expires_at = VALUES(expires_at), created_at = VALUES(created_at), updated_at = VALUES(updated_at), code_exchange_response_body = VALUES(code_exchange_response_body), code_verifier = VALUES(code_verifier), refresh_token_expires_at = VALUES(refresh_token_expires_at), nr_of_subsequent_provider_errors = VALUES(nr_of_subsequent_provider_errors)`
+		`app = VALUES(app), type = VALUES(type), grant_type = VALUES(grant_type), client_id = VALUES(client_id), client_secret = VALUES(client_secret), client_secret_hash = VALUES(client_secret_hash), username = VALUES(username), original_refresh_token = VALUES(original_refresh_token), original_refresh_token_hash = VALUES(original_refresh_token_hash), refresh_token = VALUES(refresh_token), refresh_token_hash = VALUES(refresh_token_hash), access_token = VALUES(access_token), access_token_hash = VALUES(access_token_hash), expires_at = VALUES(expires_at), created_at = VALUES(created_at), updated_at = VALUES(updated_at), code_exchange_response_body = VALUES(code_exchange_response_body), code_verifier = VALUES(code_verifier), refresh_token_expires_at = VALUES(refresh_token_expires_at), nr_of_subsequent_provider_errors = VALUES(nr_of_subsequent_provider_errors), dpop_key = VALUES(dpop_key), scope = VALUES(scope), audience = VALUES(audience), resource = VALUES(resource), granted_scope = VALUES(granted_scope), id_token_claims = VALUES(id_token_claims), userinfo = VALUES(userinfo), userinfo_fetched_at = VALUES(userinfo_fetched_at), exchange_context = VALUES(exchange_context), last_response_body = VALUES(last_response_body), namespace = VALUES(namespace)`
 	// run
-	logf(sqlstr, ot.ID, ot.App, ot.Type, ot.GrantType, ot.ClientID, ot.ClientSecret, ot.ClientSecretHash, ot.Username, ot.OriginalRefreshToken, ot.OriginalRefreshTokenHash, ot.RefreshToken, ot.RefreshTokenHash, ot.AccessToken, ot.AccessTokenHash, ot.ExpiresAt, ot.CreatedAt, ot.UpdatedAt, ot.CodeExchangeResponseBody, ot.CodeVerifier, ot.RefreshTokenExpiresAt, ot.NrOfSubsequentProviderErrors)
-	if _, err := db.ExecContext(ctx, sqlstr, ot.ID, ot.App, ot.Type, ot.GrantType, ot.ClientID, ot.ClientSecret, ot.ClientSecretHash, ot.Username, ot.OriginalRefreshToken, ot.OriginalRefreshTokenHash, ot.RefreshToken, ot.RefreshTokenHash, ot.AccessToken, ot.AccessTokenHash, ot.ExpiresAt, ot.CreatedAt, ot.UpdatedAt, ot.CodeExchangeResponseBody, ot.CodeVerifier, ot.RefreshTokenExpiresAt, ot.NrOfSubsequentProviderErrors); err != nil {
+	logf(sqlstr, ot.ID, ot.App, ot.Type, ot.GrantType, ot.ClientID, ot.ClientSecret, ot.ClientSecretHash, ot.Username, ot.OriginalRefreshToken, ot.OriginalRefreshTokenHash, ot.RefreshToken, ot.RefreshTokenHash, ot.AccessToken, ot.AccessTokenHash, ot.ExpiresAt, ot.CreatedAt, ot.UpdatedAt, ot.CodeExchangeResponseBody, ot.CodeVerifier, ot.RefreshTokenExpiresAt, ot.NrOfSubsequentProviderErrors, ot.DPoPKey, ot.Scope, ot.Audience, ot.Resource, ot.GrantedScope, ot.IDTokenClaims, ot.Userinfo, ot.UserinfoFetchedAt, ot.ExchangeContext, ot.LastResponseBody, ot.Namespace)
+	if _, err := db.ExecContext(ctx, schema(sqlstr), ot.ID, ot.App, ot.Type, ot.GrantType, ot.ClientID, ot.ClientSecret, ot.ClientSecretHash, ot.Username, ot.OriginalRefreshToken, ot.OriginalRefreshTokenHash, ot.RefreshToken, ot.RefreshTokenHash, ot.AccessToken, ot.AccessTokenHash, ot.ExpiresAt, ot.CreatedAt, ot.UpdatedAt, ot.CodeExchangeResponseBody, ot.CodeVerifier, ot.RefreshTokenExpiresAt, ot.NrOfSubsequentProviderErrors, ot.DPoPKey, ot.Scope, ot.Audience, ot.Resource, ot.GrantedScope, ot.IDTokenClaims, ot.Userinfo, ot.UserinfoFetchedAt, ot.ExchangeContext, ot.LastResponseBody, ot.Namespace); err != nil {
 		return logerror(err)
 	}
 	// set exists
@@ -145,7 +171,7 @@ func (ot *OauthToken) Delete(ctx context.Context, db DB) error {
 		`WHERE id = ?`
 	// run
 	logf(sqlstr, ot.ID)
-	if _, err := db.ExecContext(ctx, sqlstr, ot.ID); err != nil {
+	if _, err := db.ExecContext(ctx, schema(sqlstr), ot.ID); err != nil {
 		return logerror(err)
 	}
 	// set deleted
@@ -159,7 +185,7 @@ func (ot *OauthToken) Delete(ctx context.Context, db DB) error {
 func OauthTokenByID(ctx context.Context, db DB, id int) (*OauthToken, error) {
 	// query
 	const sqlstr = `SELECT ` +
-		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors ` +
+		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors, dpop_key, scope, audience, resource, granted_scope, id_token_claims, userinfo, userinfo_fetched_at, exchange_context, last_response_body, namespace ` +
 		`FROM oauth_proxy.oauth_tokens ` +
 		`WHERE id = ?`
 	// run
@@ -167,53 +193,19 @@ func OauthTokenByID(ctx context.Context, db DB, id int) (*OauthToken, error) {
 	ot := OauthToken{
 		_exists: true,
 	}
-	if err := db.QueryRowContext(ctx, sqlstr, id).Scan(&ot.ID, &ot.App, &ot.Type, &ot.GrantType, &ot.ClientID, &ot.ClientSecret, &ot.ClientSecretHash, &ot.Username, &ot.OriginalRefreshToken, &ot.OriginalRefreshTokenHash, &ot.RefreshToken, &ot.RefreshTokenHash, &ot.AccessToken, &ot.AccessTokenHash, &ot.ExpiresAt, &ot.CreatedAt, &ot.UpdatedAt, &ot.CodeExchangeResponseBody, &ot.CodeVerifier, &ot.RefreshTokenExpiresAt, &ot.NrOfSubsequentProviderErrors); err != nil {
+	if err := db.QueryRowContext(ctx, schema(sqlstr), id).Scan(&ot.ID, &ot.App, &ot.Type, &ot.GrantType, &ot.ClientID, &ot.ClientSecret, &ot.ClientSecretHash, &ot.Username, &ot.OriginalRefreshToken, &ot.OriginalRefreshTokenHash, &ot.RefreshToken, &ot.RefreshTokenHash, &ot.AccessToken, &ot.AccessTokenHash, &ot.ExpiresAt, &ot.CreatedAt, &ot.UpdatedAt, &ot.CodeExchangeResponseBody, &ot.CodeVerifier, &ot.RefreshTokenExpiresAt, &ot.NrOfSubsequentProviderErrors, &ot.DPoPKey, &ot.Scope, &ot.Audience, &ot.Resource, &ot.GrantedScope, &ot.IDTokenClaims, &ot.Userinfo, &ot.UserinfoFetchedAt, &ot.ExchangeContext, &ot.LastResponseBody, &ot.Namespace); err != nil {
 		return nil, logerror(err)
 	}
 	return &ot, nil
 }
 
-// OauthTokensByAppClientIDClientSecret retrieves a row from 'oauth_proxy.oauth_tokens' as a [OauthToken].
-//
-// Generated from index 'ot_app_client_id_client_secret'.
-func OauthTokensByAppClientIDClientSecret(ctx context.Context, db DB, app, clientID, clientSecret string) ([]*OauthToken, error) {
-	// query
-	const sqlstr = `SELECT ` +
-		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors ` +
-		`FROM oauth_proxy.oauth_tokens ` +
-		`WHERE app = ? AND client_id = ? AND client_secret = ?`
-	// run
-	logf(sqlstr, app, clientID, clientSecret)
-	rows, err := db.QueryContext(ctx, sqlstr, app, clientID, clientSecret)
-	if err != nil {
-		return nil, logerror(err)
-	}
-	defer rows.Close()
-	// process
-	var res []*OauthToken
-	for rows.Next() {
-		ot := OauthToken{
-			_exists: true,
-		}
-		// scan
-		if err := rows.Scan(&ot.ID, &ot.App, &ot.Type, &ot.GrantType, &ot.ClientID, &ot.ClientSecret, &ot.ClientSecretHash, &ot.Username, &ot.OriginalRefreshToken, &ot.OriginalRefreshTokenHash, &ot.RefreshToken, &ot.RefreshTokenHash, &ot.AccessToken, &ot.AccessTokenHash, &ot.ExpiresAt, &ot.CreatedAt, &ot.UpdatedAt, &ot.CodeExchangeResponseBody, &ot.CodeVerifier, &ot.RefreshTokenExpiresAt, &ot.NrOfSubsequentProviderErrors); err != nil {
-			return nil, logerror(err)
-		}
-		res = append(res, &ot)
-	}
-	if err := rows.Err(); err != nil {
-		return nil, logerror(err)
-	}
-	return res, nil
-}
-
 // OauthTokenByAppClientIDClientSecretRefreshToken retrieves a row from 'oauth_proxy.oauth_tokens' as a [OauthToken].
 //
 // Generated from index 'ot_app_client_id_client_secret_refresh_token'.
 func OauthTokenByAppClientIDClientSecretRefreshToken(ctx context.Context, db DB, app, clientID, clientSecret, refreshToken string) (*OauthToken, error) {
 	// query
 	const sqlstr = `SELECT ` +
-		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors ` +
+		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors, dpop_key, scope, audience, resource, granted_scope, id_token_claims, userinfo, userinfo_fetched_at, exchange_context, last_response_body, namespace ` +
 		`FROM oauth_proxy.oauth_tokens ` +
 		`WHERE app = ? AND client_id = ? AND client_secret = ? AND refresh_token = ?`
 	// run
@@ -221,7 +213,7 @@ func OauthTokenByAppClientIDClientSecretRefreshToken(ctx context.Context, db DB,
 	ot := OauthToken{
 		_exists: true,
 	}
-	if err := db.QueryRowContext(ctx, sqlstr, app, clientID, clientSecret, refreshToken).Scan(&ot.ID, &ot.App, &ot.Type, &ot.GrantType, &ot.ClientID, &ot.ClientSecret, &ot.ClientSecretHash, &ot.Username, &ot.OriginalRefreshToken, &ot.OriginalRefreshTokenHash, &ot.RefreshToken, &ot.RefreshTokenHash, &ot.AccessToken, &ot.AccessTokenHash, &ot.ExpiresAt, &ot.CreatedAt, &ot.UpdatedAt, &ot.CodeExchangeResponseBody, &ot.CodeVerifier, &ot.RefreshTokenExpiresAt, &ot.NrOfSubsequentProviderErrors); err != nil {
+	if err := db.QueryRowContext(ctx, schema(sqlstr), app, clientID, clientSecret, refreshToken).Scan(&ot.ID, &ot.App, &ot.Type, &ot.GrantType, &ot.ClientID, &ot.ClientSecret, &ot.ClientSecretHash, &ot.Username, &ot.OriginalRefreshToken, &ot.OriginalRefreshTokenHash, &ot.RefreshToken, &ot.RefreshTokenHash, &ot.AccessToken, &ot.AccessTokenHash, &ot.ExpiresAt, &ot.CreatedAt, &ot.UpdatedAt, &ot.CodeExchangeResponseBody, &ot.CodeVerifier, &ot.RefreshTokenExpiresAt, &ot.NrOfSubsequentProviderErrors, &ot.DPoPKey, &ot.Scope, &ot.Audience, &ot.Resource, &ot.GrantedScope, &ot.IDTokenClaims, &ot.Userinfo, &ot.UserinfoFetchedAt, &ot.ExchangeContext, &ot.LastResponseBody, &ot.Namespace); err != nil {
 		return nil, logerror(err)
 	}
 	return &ot, nil
@@ -233,12 +225,12 @@ func OauthTokenByAppClientIDClientSecretRefreshToken(ctx context.Context, db DB,
 func OauthTokensByAppOriginalRefreshToken(ctx context.Context, db DB, app, originalRefreshToken string) ([]*OauthToken, error) {
 	// query
 	const sqlstr = `SELECT ` +
-		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors ` +
+		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors, dpop_key, scope, audience, resource, granted_scope, id_token_claims, userinfo, userinfo_fetched_at, exchange_context, last_response_body, namespace ` +
 		`FROM oauth_proxy.oauth_tokens ` +
 		`WHERE app = ? AND original_refresh_token = ?`
 	// run
 	logf(sqlstr, app, originalRefreshToken)
-	rows, err := db.QueryContext(ctx, sqlstr, app, originalRefreshToken)
+	rows, err := db.QueryContext(ctx, schema(sqlstr), app, originalRefreshToken)
 	if err != nil {
 		return nil, logerror(err)
 	}
@@ -250,7 +242,7 @@ func OauthTokensByAppOriginalRefreshToken(ctx context.Context, db DB, app, origi
 			_exists: true,
 		}
 		// scan
-		if err := rows.Scan(&ot.ID, &ot.App, &ot.Type, &ot.GrantType, &ot.ClientID, &ot.ClientSecret, &ot.ClientSecretHash, &ot.Username, &ot.OriginalRefreshToken, &ot.OriginalRefreshTokenHash, &ot.RefreshToken, &ot.RefreshTokenHash, &ot.AccessToken, &ot.AccessTokenHash, &ot.ExpiresAt, &ot.CreatedAt, &ot.UpdatedAt, &ot.CodeExchangeResponseBody, &ot.CodeVerifier, &ot.RefreshTokenExpiresAt, &ot.NrOfSubsequentProviderErrors); err != nil {
+		if err := rows.Scan(&ot.ID, &ot.App, &ot.Type, &ot.GrantType, &ot.ClientID, &ot.ClientSecret, &ot.ClientSecretHash, &ot.Username, &ot.OriginalRefreshToken, &ot.OriginalRefreshTokenHash, &ot.RefreshToken, &ot.RefreshTokenHash, &ot.AccessToken, &ot.AccessTokenHash, &ot.ExpiresAt, &ot.CreatedAt, &ot.UpdatedAt, &ot.CodeExchangeResponseBody, &ot.CodeVerifier, &ot.RefreshTokenExpiresAt, &ot.NrOfSubsequentProviderErrors, &ot.DPoPKey, &ot.Scope, &ot.Audience, &ot.Resource, &ot.GrantedScope, &ot.IDTokenClaims, &ot.Userinfo, &ot.UserinfoFetchedAt, &ot.ExchangeContext, &ot.LastResponseBody, &ot.Namespace); err != nil {
 			return nil, logerror(err)
 		}
 		res = append(res, &ot)
@@ -267,7 +259,7 @@ func OauthTokensByAppOriginalRefreshToken(ctx context.Context, db DB, app, origi
 func OauthTokenByAppRefreshToken(ctx context.Context, db DB, app, refreshToken string) (*OauthToken, error) {
 	// query
 	const sqlstr = `SELECT ` +
-		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors ` +
+		`id, app, type, grant_type, client_id, client_secret, client_secret_hash, username, original_refresh_token, original_refresh_token_hash, refresh_token, refresh_token_hash, access_token, access_token_hash, expires_at, created_at, updated_at, code_exchange_response_body, code_verifier, refresh_token_expires_at, nr_of_subsequent_provider_errors, dpop_key, scope, audience, resource, granted_scope, id_token_claims, userinfo, userinfo_fetched_at, exchange_context, last_response_body, namespace ` +
 		`FROM oauth_proxy.oauth_tokens ` +
 		`WHERE app = ? AND refresh_token = ?`
 	// run
@@ -275,7 +267,7 @@ func OauthTokenByAppRefreshToken(ctx context.Context, db DB, app, refreshToken s
 	ot := OauthToken{
 		_exists: true,
 	}
-	if err := db.QueryRowContext(ctx, sqlstr, app, refreshToken).Scan(&ot.ID, &ot.App, &ot.Type, &ot.GrantType, &ot.ClientID, &ot.ClientSecret, &ot.ClientSecretHash, &ot.Username, &ot.OriginalRefreshToken, &ot.OriginalRefreshTokenHash, &ot.RefreshToken, &ot.RefreshTokenHash, &ot.AccessToken, &ot.AccessTokenHash, &ot.ExpiresAt, &ot.CreatedAt, &ot.UpdatedAt, &ot.CodeExchangeResponseBody, &ot.CodeVerifier, &ot.RefreshTokenExpiresAt, &ot.NrOfSubsequentProviderErrors); err != nil {
+	if err := db.QueryRowContext(ctx, schema(sqlstr), app, refreshToken).Scan(&ot.ID, &ot.App, &ot.Type, &ot.GrantType, &ot.ClientID, &ot.ClientSecret, &ot.ClientSecretHash, &ot.Username, &ot.OriginalRefreshToken, &ot.OriginalRefreshTokenHash, &ot.RefreshToken, &ot.RefreshTokenHash, &ot.AccessToken, &ot.AccessTokenHash, &ot.ExpiresAt, &ot.CreatedAt, &ot.UpdatedAt, &ot.CodeExchangeResponseBody, &ot.CodeVerifier, &ot.RefreshTokenExpiresAt, &ot.NrOfSubsequentProviderErrors, &ot.DPoPKey, &ot.Scope, &ot.Audience, &ot.Resource, &ot.GrantedScope, &ot.IDTokenClaims, &ot.Userinfo, &ot.UserinfoFetchedAt, &ot.ExchangeContext, &ot.LastResponseBody, &ot.Namespace); err != nil {
 		return nil, logerror(err)
 	}
 	return &ot, nil
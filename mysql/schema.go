@@ -0,0 +1,39 @@
+package mysql
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// defaultSchema is the schema the queries are written against
+const defaultSchema = "oauth_proxy"
+
+// schemaPattern are the schema names that can be used unescaped in a query
+var schemaPattern = regexp.MustCompile(`^[A-Za-z0-9_$]+$`)
+
+// qualifier replaces the schema in the queries, see SetSchema
+var qualifier = defaultSchema + "."
+
+// SetSchema sets the schema the tables are in. With an empty schema the
+// tables aren't qualified and the database of the connection is used. The
+// schema is quoted, only letters, digits, _ and $ are allowed.
+func SetSchema(schema string) error {
+	if schema == "" {
+		qualifier = ""
+		return nil
+	}
+	if !schemaPattern.MatchString(schema) {
+		return fmt.Errorf("invalid schema %q", schema)
+	}
+	qualifier = "`" + schema + "`."
+	return nil
+}
+
+// schema qualifies the tables of the query with the configured schema.
+func schema(sqlstr string) string {
+	if qualifier == defaultSchema+"." {
+		return sqlstr
+	}
+	return strings.ReplaceAll(sqlstr, defaultSchema+".", qualifier)
+}
@@ -0,0 +1,38 @@
+package mysql
+
+import "testing"
+
+func TestSetSchema(t *testing.T) {
+	t.Cleanup(func() { qualifier = defaultSchema + "." })
+
+	const sqlstr = `SELECT id FROM oauth_proxy.oauth_tokens WHERE id = ?`
+	tests := []struct {
+		schema   string
+		expected string
+	}{
+		{"oauth_proxy", "SELECT id FROM `oauth_proxy`.oauth_tokens WHERE id = ?"},
+		{"tenant_1$", "SELECT id FROM `tenant_1$`.oauth_tokens WHERE id = ?"},
+		{"", "SELECT id FROM oauth_tokens WHERE id = ?"},
+	}
+	for _, tt := range tests {
+		if err := SetSchema(tt.schema); err != nil {
+			t.Fatal(err)
+		}
+		if got := schema(sqlstr); got != tt.expected {
+			t.Errorf("%q: expected %s, got %s", tt.schema, tt.expected, got)
+		}
+	}
+
+	if err := SetSchema("proxy"); err != nil {
+		t.Fatal(err)
+	}
+	for _, invalid := range []string{"oauth-proxy", "oauth proxy", "a.b", "x`; DROP TABLE oauth_tokens; --", "schéma"} {
+		if err := SetSchema(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+		// the valid schema is kept
+		if got := schema(sqlstr); got != "SELECT id FROM `proxy`.oauth_tokens WHERE id = ?" {
+			t.Errorf("%q: expected the previous schema to be kept, got %s", invalid, got)
+		}
+	}
+}
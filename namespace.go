@@ -0,0 +1,65 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/omniboost/oauth-proxy/mysql"
+	"github.com/pkg/errors"
+)
+
+var (
+	// DEFAULT_NAMESPACE is the namespace of requests that don't select one
+	// with the route prefix or their caller. Environments that share a
+	// database should each use their own. Tokens stored before it was set
+	// are in the namespace "" and aren't found anymore until they're moved,
+	// see the README
+	DEFAULT_NAMESPACE = os.Getenv("DEFAULT_NAMESPACE")
+
+	// DATABASE_SCHEMA is the schema the tables are in (oauth_proxy by
+	// default). Set it to "-" to use the database of DATABASE_URL
+	DATABASE_SCHEMA = os.Getenv("DATABASE_SCHEMA")
+)
+
+func init() {
+	var err error
+	switch DATABASE_SCHEMA {
+	case "":
+	case "-":
+		err = mysql.SetSchema("")
+	default:
+		err = mysql.SetSchema(DATABASE_SCHEMA)
+	}
+	if err != nil {
+		panic(fmt.Sprintf("invalid DATABASE_SCHEMA: %v", err))
+	}
+}
+
+// NamespacePrefix is prepended to the provider routes to select a namespace:
+// /ns/staging/exactonline/oauth2/token
+const NamespacePrefix = "/ns/{namespace}"
+
+var namespacePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// namespace determines the namespace of the request: the route prefix, the
+// namespace of the caller or DEFAULT_NAMESPACE. A caller with a namespace
+// can't select another one
+func namespace(r *http.Request, caller *Caller) (string, error) {
+	ns := r.PathValue("namespace")
+	if caller != nil && caller.Namespace != "" {
+		if ns != "" && ns != caller.Namespace {
+			return "", CallerError{Status: http.StatusForbidden, Msg: "caller " + caller.Name + " isn't allowed to use namespace " + ns}
+		}
+		ns = caller.Namespace
+	}
+	if ns == "" {
+		ns = DEFAULT_NAMESPACE
+	}
+
+	if ns != "" && !namespacePattern.MatchString(ns) {
+		return "", errors.Errorf("invalid namespace %q", ns)
+	}
+	return ns, nil
+}
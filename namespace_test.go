@@ -0,0 +1,87 @@
+package oauthproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNamespace(t *testing.T) {
+	cc := testCallers()
+	tests := []struct {
+		name      string
+		route     string
+		caller    *Caller
+		namespace string
+		status    int
+	}{
+		{"default", "", nil, "", 0},
+		{"route", "production", nil, "production", 0},
+		{"caller", "", &cc[1], "staging", 0},
+		{"route of caller", "staging", &cc[1], "staging", 0},
+		{"namespace mismatch", "production", &cc[1], "", http.StatusForbidden},
+		{"caller without namespace", "production", &cc[0], "production", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/exactonline/oauth2/token", nil)
+			r.SetPathValue("namespace", tt.route)
+			ns, err := namespace(r, tt.caller)
+			if tt.status != 0 {
+				ce := CallerError{}
+				if !errors.As(err, &ce) || ce.Status != tt.status {
+					t.Fatalf("expected status %d, got %v", tt.status, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ns != tt.namespace {
+				t.Errorf("expected namespace %q, got %q", tt.namespace, ns)
+			}
+		})
+	}
+}
+
+func TestDefaultNamespace(t *testing.T) {
+	ns := DEFAULT_NAMESPACE
+	t.Cleanup(func() { DEFAULT_NAMESPACE = ns })
+	DEFAULT_NAMESPACE = "production"
+
+	cc := testCallers()
+	tests := []struct {
+		name      string
+		route     string
+		caller    *Caller
+		namespace string
+	}{
+		{"default", "", nil, "production"},
+		{"route", "staging", nil, "staging"},
+		{"caller", "", &cc[1], "staging"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/exactonline/oauth2/token", nil)
+		r.SetPathValue("namespace", tt.route)
+		got, err := namespace(r, tt.caller)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.namespace {
+			t.Errorf("%s: expected namespace %q, got %q", tt.name, tt.namespace, got)
+		}
+	}
+}
+
+func TestInvalidNamespace(t *testing.T) {
+	for _, ns := range []string{"Production", "-staging", "stag ing", "a/b", "ns`; DROP TABLE oauth_tokens; --"} {
+		r := httptest.NewRequest("POST", "/exactonline/oauth2/token", nil)
+		r.SetPathValue("namespace", ns)
+		if _, err := namespace(r, nil); err == nil {
+			t.Errorf("expected %q to be invalid", ns)
+		}
+	}
+}
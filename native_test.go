@@ -0,0 +1,55 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestNativeResponseBody(t *testing.T) {
+	token := &Token{
+		Token:  &oauth2.Token{AccessToken: "NATIVE", Expiry: time.Now().Add(30 * time.Minute)},
+		Native: json.RawMessage(`{"access_token":"NATIVE","expires_in":3600,"x_refresh_token_expires_in":8726400,"nested":{"a":[1,2]}}`),
+	}
+
+	b, err := nativeResponseBody(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]json.RawMessage
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	// only expires_in is recomputed from the expiry of the token
+	var expiresIn int
+	if err := json.Unmarshal(got["expires_in"], &expiresIn); err != nil {
+		t.Fatal(err)
+	}
+	if expiresIn < 1790 || expiresIn > 1800 {
+		t.Errorf("expected the remaining lifetime as expires_in, got %d", expiresIn)
+	}
+
+	expected := map[string]string{
+		"access_token":               `"NATIVE"`,
+		"x_refresh_token_expires_in": `8726400`,
+		"nested":                     `{"a":[1,2]}`,
+	}
+	if len(got) != len(expected)+1 {
+		t.Errorf("expected %d fields, got %s", len(expected)+1, b)
+	}
+	for k, v := range expected {
+		if string(got[k]) != v {
+			t.Errorf("expected %s to be %s as the provider sent it, got %s", k, v, got[k])
+		}
+	}
+
+	// without a stored response the normalized response is used
+	_, err = nativeResponseBody(&Token{Token: &oauth2.Token{}})
+	if err == nil {
+		t.Error("expected an error without a provider response")
+	}
+}
@@ -0,0 +1,52 @@
+package providers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type AdditionalParamsRoundTripper struct {
+	rtp    http.RoundTripper
+	Params url.Values
+}
+
+func NewAdditionalParamsRoundTripper(rtp http.RoundTripper) *AdditionalParamsRoundTripper {
+	return &AdditionalParamsRoundTripper{rtp: rtp}
+}
+
+func (rt *AdditionalParamsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Modify the request
+	// - add params to the form body when the provider didn't set them
+	//   itself
+	if len(rt.Params) == 0 || req.Body == nil ||
+		!strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return rt.rtp.RoundTrip(req)
+	}
+
+	b, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	vals, err := url.ParseQuery(string(b))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, vv := range rt.Params {
+		if vals.Get(k) != "" {
+			continue
+		}
+		vals[k] = vv
+	}
+
+	b = []byte(vals.Encode())
+	r := req.Clone(req.Context())
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	r.ContentLength = int64(len(b))
+	return rt.rtp.RoundTrip(r)
+}
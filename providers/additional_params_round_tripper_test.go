@@ -0,0 +1,48 @@
+package providers_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/omniboost/oauth-proxy/providers"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+func TestAdditionalParamsRoundTripper(t *testing.T) {
+	var form url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"TEST","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer srv.Close()
+
+	rtp := providers.NewAdditionalParamsRoundTripper(http.DefaultTransport)
+	rtp.Params = url.Values{
+		"scope":    {providers.NormalizeList("write read", "read")},
+		"resource": {"https://a.example.com", "https://b.example.com"},
+	}
+
+	config := clientcredentials.Config{ClientID: "id", ClientSecret: "secret", TokenURL: srv.URL}
+	ctx := t.Context()
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: rtp})
+	_, err := config.Token(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if form.Get("scope") != "read write" {
+		t.Errorf("expected scope 'read write', got '%s'", form.Get("scope"))
+	}
+	if len(form["resource"]) != 2 {
+		t.Errorf("expected 2 resources, got %v", form["resource"])
+	}
+	if form.Get("grant_type") != "client_credentials" {
+		t.Errorf("expected grant_type to be kept, got '%s'", form.Get("grant_type"))
+	}
+}
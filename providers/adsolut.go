@@ -39,6 +39,10 @@ func (v Adsolut) Route() string {
 	return "/" + v.name + "/oauth2/token"
 }
 
+func (v Adsolut) AuthURL(params TokenRequestParams) string {
+	return v.oauthConfig().Endpoint.AuthURL
+}
+
 func (v Adsolut) oauthConfig() *oauth2.Config {
 	authURL := "https://login.wolterskluwer.eu/auth/core/connect/authorize"
 	if v.authURL != "" {
@@ -2,7 +2,6 @@ package providers
 
 import (
 	"context"
-	"net/http"
 
 	"golang.org/x/oauth2"
 )
@@ -29,6 +28,19 @@ func (am Amadeus) Route() string {
 	return "/" + am.name + "/OAuth2/RefreshAccessToken"
 }
 
+func (am Amadeus) ContextKeys() []string {
+	return []string{"header:Ocp-Apim-Subscription-Key"}
+}
+
+// Quirks passes the subscription key of the client on to Amadeus
+func (am Amadeus) Quirks(params TokenRequestParams) Quirks {
+	return Quirks{
+		Headers: map[string]string{
+			"Ocp-Apim-Subscription-Key": params.Lookup("header", "Ocp-Apim-Subscription-Key"),
+		},
+	}
+}
+
 func (am Amadeus) oauthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
@@ -58,13 +70,5 @@ func (am Amadeus) TokenSourceAuthorizationCode(ctx context.Context, params Token
 	token := &oauth2.Token{
 		RefreshToken: params.RefreshToken,
 	}
-
-	rtp := NewAdditionalHeadersRoundTripper(http.DefaultTransport)
-	rtp.Headers = map[string]string{
-		"Ocp-Apim-Subscription-Key": params.OriginalRequest.Header.Get("Ocp-Apim-Subscription-Key"),
-	}
-	client := &http.Client{Transport: rtp}
-	ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
-
 	return config.TokenSource(ctx, token)
 }
@@ -28,6 +28,10 @@ func (m Apaleo) Route() string {
 	return "/" + m.name + "/oauth/token"
 }
 
+func (m Apaleo) AuthURL(params TokenRequestParams) string {
+	return m.oauthConfigAuthorizationCode().Endpoint.AuthURL
+}
+
 func (m Apaleo) oauthConfigAuthorizationCode() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
@@ -27,6 +27,10 @@ func (f Asperion) Route() string {
 	return "/" + f.name + "/oauth2/token"
 }
 
+func (f Asperion) AuthURL(params TokenRequestParams) string {
+	return f.oauthConfig().Endpoint.AuthURL
+}
+
 func (f Asperion) oauthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
@@ -34,6 +34,10 @@ func (p Bizcuit) Route() string {
 	return "/" + p.name + "/oauth/token"
 }
 
+func (p Bizcuit) AuthURL(params TokenRequestParams) string {
+	return p.oauthConfig().Endpoint.AuthURL
+}
+
 func (p Bizcuit) oauthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
@@ -39,6 +39,10 @@ func (v BookingExperts) Route() string {
 	return "/" + v.name + "/oauth2/token"
 }
 
+func (v BookingExperts) AuthURL(params TokenRequestParams) string {
+	return v.oauthConfig().Endpoint.AuthURL
+}
+
 func (v BookingExperts) oauthConfig() *oauth2.Config {
 	authURL := ""
 	if v.authURL != "" {
@@ -39,6 +39,10 @@ func (v Chronogolf) Route() string {
 	return "/" + v.name + "/oauth2/token"
 }
 
+func (v Chronogolf) AuthURL(params TokenRequestParams) string {
+	return v.oauthConfig().Endpoint.AuthURL
+}
+
 func (v Chronogolf) oauthConfig() *oauth2.Config {
 	authURL := "https://www.chronogolf.com/oauth/auth"
 	if v.authURL != "" {
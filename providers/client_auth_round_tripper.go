@@ -0,0 +1,156 @@
+package providers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// ParseAuthStyle parses "header", "params" or "auto" (or empty) to an
+// oauth2.AuthStyle
+func ParseAuthStyle(s string) (oauth2.AuthStyle, error) {
+	switch strings.ToLower(s) {
+	case "header":
+		return oauth2.AuthStyleInHeader, nil
+	case "params":
+		return oauth2.AuthStyleInParams, nil
+	case "auto", "":
+		return oauth2.AuthStyleAutoDetect, nil
+	}
+	return oauth2.AuthStyleAutoDetect, errors.Errorf("unknown auth style %s", s)
+}
+
+// FormatAuthStyle is the inverse of ParseAuthStyle
+func FormatAuthStyle(style oauth2.AuthStyle) string {
+	switch style {
+	case oauth2.AuthStyleInHeader:
+		return "header"
+	case oauth2.AuthStyleInParams:
+		return "params"
+	}
+	return "auto"
+}
+
+// ClientAuthRoundTripper puts the client credentials of a token request in
+// the authorization header or in the form body, regardless of the auth style
+// the provider is configured with. With AuthStyleAutoDetect the request is
+// left alone. OnSuccess is called with the auth style of every successful
+// request.
+//
+// A Detected style can be stale, it's only used for the first request: the
+// retry of oauth2's auto detection is sent as the provider sets it.
+// OnInvalidClient is called when the provider rejects the client with the
+// style that was used
+type ClientAuthRoundTripper struct {
+	rtp             http.RoundTripper
+	Style           oauth2.AuthStyle
+	Detected        bool
+	OnSuccess       func(oauth2.AuthStyle)
+	OnInvalidClient func(oauth2.AuthStyle)
+
+	attempts atomic.Int32
+}
+
+func NewClientAuthRoundTripper(rtp http.RoundTripper) *ClientAuthRoundTripper {
+	return &ClientAuthRoundTripper{rtp: rtp}
+}
+
+func (rt *ClientAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost || req.Body == nil ||
+		!strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return rt.rtp.RoundTrip(req)
+	}
+
+	b, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	vals, err := url.ParseQuery(string(b))
+	if err != nil {
+		return nil, err
+	}
+
+	r := req.Clone(req.Context())
+
+	// the credentials as the provider set them
+	clientID, clientSecret, inHeader := r.BasicAuth()
+	if inHeader {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID = vals.Get("client_id")
+		clientSecret = vals.Get("client_secret")
+	}
+
+	style := rt.Style
+	if rt.attempts.Add(1) > 1 && rt.Detected {
+		style = oauth2.AuthStyleAutoDetect
+	}
+
+	if clientID != "" {
+		switch style {
+		case oauth2.AuthStyleInHeader:
+			// client_id is allowed in the body, the secret isn't
+			vals.Del("client_secret")
+			r.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+			inHeader = true
+		case oauth2.AuthStyleInParams:
+			r.Header.Del("Authorization")
+			vals.Set("client_id", clientID)
+			if clientSecret != "" {
+				vals.Set("client_secret", clientSecret)
+			}
+			inHeader = false
+		}
+	}
+
+	b = []byte(vals.Encode())
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	r.ContentLength = int64(len(b))
+
+	resp, err := rt.rtp.RoundTrip(r)
+	if err != nil {
+		return resp, err
+	}
+
+	if rt.OnInvalidClient != nil && clientID != "" && style != oauth2.AuthStyleAutoDetect &&
+		(resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized) {
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(b))
+		if err != nil {
+			return resp, err
+		}
+		if isInvalidClient(b) {
+			rt.OnInvalidClient(style)
+		}
+	}
+
+	if rt.OnSuccess != nil && clientID != "" && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if inHeader {
+			rt.OnSuccess(oauth2.AuthStyleInHeader)
+		} else if vals.Has("client_secret") || vals.Has("client_id") {
+			rt.OnSuccess(oauth2.AuthStyleInParams)
+		}
+	}
+
+	return resp, nil
+}
+
+// isInvalidClient tells if the error response rejects the client
+// credentials
+func isInvalidClient(b []byte) bool {
+	e := struct {
+		Error string `json:"error"`
+	}{}
+	return json.Unmarshal(b, &e) == nil && e.Error == "invalid_client"
+}
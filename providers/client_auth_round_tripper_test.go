@@ -0,0 +1,102 @@
+package providers_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/omniboost/oauth-proxy/providers"
+	"golang.org/x/oauth2"
+)
+
+func TestClientAuthRoundTripper(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); ok {
+			t.Errorf("expected no authorization header")
+		}
+		if r.PostFormValue("client_id") != "client" || r.PostFormValue("client_secret") != "secret" {
+			t.Errorf("expected client credentials in form body")
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"ACCESS","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer srv.Close()
+
+	var detected oauth2.AuthStyle
+	rt := providers.NewClientAuthRoundTripper(http.DefaultTransport)
+	rt.Style = oauth2.AuthStyleInParams
+	rt.OnSuccess = func(style oauth2.AuthStyle) {
+		detected = style
+	}
+
+	config := oauth2.Config{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Endpoint: oauth2.Endpoint{
+			TokenURL:  srv.URL,
+			AuthStyle: oauth2.AuthStyleInHeader,
+		},
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: rt})
+	_, err := config.Exchange(ctx, "CODE")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if detected != oauth2.AuthStyleInParams {
+		t.Errorf("expected params auth style, got %s", providers.FormatAuthStyle(detected))
+	}
+}
+
+func TestClientAuthRoundTripperStaleDetectedStyle(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.Header().Set("Content-Type", "application/json")
+		// the provider only accepts the credentials in the form body
+		if _, _, ok := r.BasicAuth(); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"ACCESS","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer srv.Close()
+
+	var detected, invalid []oauth2.AuthStyle
+	rt := providers.NewClientAuthRoundTripper(http.DefaultTransport)
+	rt.Style = oauth2.AuthStyleInHeader
+	rt.Detected = true
+	rt.OnSuccess = func(style oauth2.AuthStyle) {
+		detected = append(detected, style)
+	}
+	rt.OnInvalidClient = func(style oauth2.AuthStyle) {
+		invalid = append(invalid, style)
+	}
+
+	config := oauth2.Config{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Endpoint: oauth2.Endpoint{
+			TokenURL:  srv.URL,
+			AuthStyle: oauth2.AuthStyleAutoDetect,
+		},
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: rt})
+	_, err := config.Exchange(ctx, "CODE")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attempts != 2 {
+		t.Errorf("expected the retry of auto detection, got %d attempts", attempts)
+	}
+	if len(invalid) != 1 || invalid[0] != oauth2.AuthStyleInHeader {
+		t.Errorf("expected the header auth style to be rejected, got %v", invalid)
+	}
+	if len(detected) != 1 || detected[0] != oauth2.AuthStyleInParams {
+		t.Errorf("expected params auth style to be detected, got %v", detected)
+	}
+}
@@ -30,6 +30,10 @@ func (m Cloudbeds) Route() string {
 	return "/" + m.name + "/oauth2/token"
 }
 
+func (m Cloudbeds) AuthURL(params TokenRequestParams) string {
+	return m.oauthConfig().Endpoint.AuthURL
+}
+
 func (m Cloudbeds) oauthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
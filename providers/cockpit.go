@@ -2,14 +2,13 @@ package providers
 
 import (
 	"context"
-	"net/http"
 
 	"golang.org/x/oauth2"
 )
 
 // Cockpit has a non-standard Token Exchange. Instead of 'x-www-form-urlencoded'
-// they use 'application/json'. The custom NewJSONTokenExchangeClient
-// http.Client works around that
+// they use 'application/json' and the lifetime of the token is returned as
+// 'expires' instead of 'expires_in'. See Quirks()
 type Cockpit struct {
 	name string
 }
@@ -31,6 +30,13 @@ func (m Cockpit) Route() string {
 	return "/" + m.name + "/oauth2/token"
 }
 
+func (m Cockpit) Quirks(params TokenRequestParams) Quirks {
+	return Quirks{
+		Encoding: "json",
+		Rename:   map[string]string{"expires": "expires_in"},
+	}
+}
+
 func (m Cockpit) oauthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
@@ -61,10 +67,5 @@ func (m Cockpit) TokenSourceAuthorizationCode(ctx context.Context, params TokenR
 	token := &oauth2.Token{
 		RefreshToken: params.RefreshToken,
 	}
-
-	rtp := NewJSONTokenExchangeRoundTripper(http.DefaultTransport)
-	client := &http.Client{Transport: rtp}
-	ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
-
 	return config.TokenSource(ctx, token)
 }
@@ -0,0 +1,341 @@
+package providers
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ProviderConfig is a provider definition from the configuration file:
+//
+//	providers:
+//	  - type: exactonline
+//	    name: exactonline.nl
+//	    base_url: https://start.exactonline.nl
+//	  - type: oauth2
+//	    name: acme
+//	    auth_url: https://login.acme.com/authorize
+//	    token_url: https://login.acme.com/token
+//	    auth_style: params
+//	    grants: [authorization_code, client_credentials]
+//	    headers:
+//	      X-Api-Version: "2"
+//	    quirks:
+//	      rename:
+//	        expires: expires_in
+//	  - type: oauth2
+//	    name: acme/{region}
+//	    token_url: https://{{.Region}}.acme.com/token
+//	    vars:
+//	      - name: Region
+//	        from: [path:region, header:X-Acme-Region]
+//	        default: eu
+//
+// A definition with the name of a built-in provider replaces it, disabled
+// removes it
+type ProviderConfig struct {
+	Type        string            `mapstructure:"type" json:"type"`
+	Name        string            `mapstructure:"name" json:"name"`
+	Disabled    bool              `mapstructure:"disabled" json:"disabled"`
+	Route       string            `mapstructure:"route" json:"route"`
+	BaseURL     string            `mapstructure:"base_url" json:"base_url"`
+	AuthURL     string            `mapstructure:"auth_url" json:"auth_url"`
+	TokenURL    string            `mapstructure:"token_url" json:"token_url"`
+	RevokeURL   string            `mapstructure:"revoke_url" json:"revoke_url"`
+	IssuerURL   string            `mapstructure:"issuer_url" json:"issuer_url"`
+	JWKSURL     string            `mapstructure:"jwks_url" json:"jwks_url"`
+	UserInfoURL string            `mapstructure:"userinfo_url" json:"userinfo_url"`
+	AuthStyle   string            `mapstructure:"auth_style" json:"auth_style"`
+	Grants      []string          `mapstructure:"grants" json:"grants"`
+	Headers     map[string]string `mapstructure:"headers" json:"headers"`
+	DPoP        bool              `mapstructure:"dpop" json:"dpop"`
+	Vars        TemplateVars      `mapstructure:"vars" json:"vars"`
+	Quirks      Quirks            `mapstructure:"quirks" json:"quirks"`
+}
+
+// fields returns the (yaml) names of the fields that are set
+func (c ProviderConfig) fields() []string {
+	fields := []string{}
+	add := func(name string, set bool) {
+		if set {
+			fields = append(fields, name)
+		}
+	}
+	add("route", c.Route != "")
+	add("base_url", c.BaseURL != "")
+	add("auth_url", c.AuthURL != "")
+	add("token_url", c.TokenURL != "")
+	add("revoke_url", c.RevokeURL != "")
+	add("issuer_url", c.IssuerURL != "")
+	add("jwks_url", c.JWKSURL != "")
+	add("userinfo_url", c.UserInfoURL != "")
+	add("auth_style", c.AuthStyle != "")
+	add("grants", len(c.Grants) > 0)
+	add("headers", len(c.Headers) > 0)
+	add("dpop", c.DPoP)
+	add("vars", len(c.Vars) > 0)
+	add("quirks", !c.Quirks.IsZero())
+	return fields
+}
+
+func (c ProviderConfig) baseURL() url.URL {
+	u, _ := url.Parse(c.BaseURL)
+	return *u
+}
+
+type providerType struct {
+	fields   []string
+	required []string
+	build    func(ProviderConfig) (Provider, error)
+}
+
+var providerTypes = map[string]providerType{}
+
+// RegisterProviderType makes a provider type available to the configuration.
+// fields are the optional fields the type supports besides type and name
+func RegisterProviderType(name string, fields, required []string, build func(ProviderConfig) (Provider, error)) {
+	providerTypes[name] = providerType{
+		fields:   append(fields, required...),
+		required: required,
+		build:    build,
+	}
+}
+
+func init() {
+	named := func(build func(name string) Provider) func(ProviderConfig) (Provider, error) {
+		return func(c ProviderConfig) (Provider, error) {
+			return build(c.Name), nil
+		}
+	}
+
+	RegisterProviderType("oauth2", []string{"route", "auth_url", "revoke_url", "auth_style", "grants", "headers", "quirks", "dpop", "vars"}, []string{"token_url"}, func(c ProviderConfig) (Provider, error) {
+		style, err := ParseAuthStyle(c.AuthStyle)
+		if err != nil {
+			return nil, err
+		}
+
+		p := NewOAuth2Provider().
+			WithName(c.Name).
+			WithRoute(c.Route).
+			WithAuthURL(c.AuthURL).
+			WithTokenURL(c.TokenURL).
+			WithAuthStyle(style).
+			WithQuirks(c.Quirks).
+			WithHeaders(c.Headers).
+			WithDPoP(c.DPoP).
+			WithTemplateVars(c.Vars)
+		if len(c.Grants) > 0 {
+			p = p.WithGrants(c.Grants...)
+		}
+		if c.RevokeURL != "" {
+			return p.WithRevokeURL(c.RevokeURL), nil
+		}
+		return p, nil
+	})
+	RegisterProviderType("oidc", []string{"dpop"}, []string{"issuer_url"}, func(c ProviderConfig) (Provider, error) {
+		return NewOIDCProvider().WithName(c.Name).WithIssuerURL(c.IssuerURL).WithDPoP(c.DPoP), nil
+	})
+
+	RegisterProviderType("exactonline", nil, []string{"base_url"}, func(c ProviderConfig) (Provider, error) {
+		return NewExactOnline().WithName(c.Name).WithBaseURL(c.baseURL()), nil
+	})
+	RegisterProviderType("lightspeed", nil, []string{"base_url"}, func(c ProviderConfig) (Provider, error) {
+		return NewLightspeed().WithName(c.Name).WithBaseURL(c.baseURL()), nil
+	})
+	RegisterProviderType("lightspeed-retail", nil, []string{"base_url"}, func(c ProviderConfig) (Provider, error) {
+		return NewLightspeedRetail().WithName(c.Name).WithBaseURL(c.baseURL()), nil
+	})
+	RegisterProviderType("bizcuit", nil, []string{"base_url"}, func(c ProviderConfig) (Provider, error) {
+		return NewBizcuit().WithName(c.Name).WithBaseURL(c.baseURL()), nil
+	})
+	RegisterProviderType("myob", []string{"base_url"}, nil, func(c ProviderConfig) (Provider, error) {
+		p := NewMYOB().WithName(c.Name)
+		if c.BaseURL != "" {
+			p = p.WithBaseURL(c.baseURL())
+		}
+		return p, nil
+	})
+	RegisterProviderType("lightspeed-k-series", nil, []string{"auth_url", "token_url"}, func(c ProviderConfig) (Provider, error) {
+		return NewLightspeedKSeries().WithName(c.Name).WithAuthURL(c.AuthURL).WithTokenURL(c.TokenURL), nil
+	})
+	RegisterProviderType("vismaonline", []string{"auth_url", "token_url"}, nil, func(c ProviderConfig) (Provider, error) {
+		return NewVismaOnline().WithName(c.Name).WithAuthURL(c.AuthURL).WithTokenURL(c.TokenURL), nil
+	})
+	RegisterProviderType("visma.net", []string{"auth_url", "token_url"}, nil, func(c ProviderConfig) (Provider, error) {
+		return NewVismaNet().WithName(c.Name).WithAuthURL(c.AuthURL).WithTokenURL(c.TokenURL), nil
+	})
+	RegisterProviderType("adsolut", []string{"auth_url", "token_url"}, nil, func(c ProviderConfig) (Provider, error) {
+		return NewAdsolut().WithName(c.Name).WithAuthURL(c.AuthURL).WithTokenURL(c.TokenURL), nil
+	})
+	RegisterProviderType("chronogolf", []string{"auth_url", "token_url"}, nil, func(c ProviderConfig) (Provider, error) {
+		return NewChronogolf().WithName(c.Name).WithAuthURL(c.AuthURL).WithTokenURL(c.TokenURL), nil
+	})
+	RegisterProviderType("bookingexperts", []string{"auth_url", "token_url"}, nil, func(c ProviderConfig) (Provider, error) {
+		return NewBookingExperts().WithName(c.Name).WithAuthURL(c.AuthURL).WithTokenURL(c.TokenURL), nil
+	})
+	RegisterProviderType("opentable", []string{"auth_url", "token_url"}, nil, func(c ProviderConfig) (Provider, error) {
+		return NewOpenTable().WithName(c.Name).WithAuthURL(c.AuthURL).WithTokenURL(c.TokenURL), nil
+	})
+	RegisterProviderType("shiji", []string{"auth_url"}, []string{"token_url"}, func(c ProviderConfig) (Provider, error) {
+		return NewShiji().WithName(c.Name).WithAuthURL(c.AuthURL).WithTokenURL(c.TokenURL), nil
+	})
+	RegisterProviderType("hia", []string{"auth_url"}, []string{"token_url"}, func(c ProviderConfig) (Provider, error) {
+		return NewHIA().WithName(c.Name).WithAuthURL(c.AuthURL).WithTokenURL(c.TokenURL), nil
+	})
+	RegisterProviderType("datev", []string{"auth_url", "token_url", "revoke_url", "issuer_url", "jwks_url", "userinfo_url"}, nil, func(c ProviderConfig) (Provider, error) {
+		return NewDatev().
+			WithName(c.Name).
+			WithAuthURL(c.AuthURL).
+			WithTokenURL(c.TokenURL).
+			WithRevokeURL(c.RevokeURL).
+			WithIssuerURL(c.IssuerURL).
+			WithRemoteKeysetURL(c.JWKSURL).
+			WithUserInfoURL(c.UserInfoURL), nil
+	})
+
+	RegisterProviderType("quickbooks", nil, nil, named(func(name string) Provider { return NewQuickBooks().WithName(name) }))
+	RegisterProviderType("izettle", nil, nil, named(func(name string) Provider { return NewIzettle().WithName(name) }))
+	RegisterProviderType("minox", nil, nil, named(func(name string) Provider { return NewMinox().WithName(name) }))
+	RegisterProviderType("apaleo", nil, nil, named(func(name string) Provider { return NewApaleo().WithName(name) }))
+	RegisterProviderType("cloudbeds", nil, nil, named(func(name string) Provider { return NewCloudbeds().WithName(name) }))
+	RegisterProviderType("xero", nil, nil, named(func(name string) Provider { return NewXero().WithName(name) }))
+	RegisterProviderType("procountor", nil, nil, named(func(name string) Provider { return NewProcountor().WithName(name) }))
+	RegisterProviderType("apicbase", nil, nil, named(func(name string) Provider { return NewApicbase().WithName(name) }))
+	RegisterProviderType("cockpit", nil, nil, named(func(name string) Provider { return NewCockpit().WithName(name) }))
+	RegisterProviderType("netsuite", nil, nil, named(func(name string) Provider { return NewNetSuite().WithName(name) }))
+	RegisterProviderType("amadeus", nil, nil, named(func(name string) Provider { return NewAmadeus().WithName(name) }))
+	RegisterProviderType("fortnox", nil, nil, named(func(name string) Provider { return NewFortnox().WithName(name) }))
+	RegisterProviderType("asperion", nil, nil, named(func(name string) Provider { return NewAsperion().WithName(name) }))
+	RegisterProviderType("microsoftonline", nil, nil, named(func(name string) Provider { return NewMicrosoftOnline().WithName(name) }))
+	RegisterProviderType("tripleseat", nil, nil, named(func(name string) Provider { return NewTripleseat().WithName(name) }))
+}
+
+// LoadConfigured returns the built-in providers merged with the providers
+// from the configuration. All invalid definitions are reported at once
+func LoadConfigured(configs []ProviderConfig) (Providers, error) {
+	pp := Load()
+
+	msgs := []string{}
+	seen := map[string]bool{}
+	for i, c := range configs {
+		prefix := fmt.Sprintf("providers[%d]", i)
+		if c.Name != "" {
+			prefix = fmt.Sprintf("%s (%s)", prefix, c.Name)
+		}
+
+		if c.Name == "" {
+			msgs = append(msgs, prefix+": name is required")
+			continue
+		}
+		if seen[c.Name] {
+			msgs = append(msgs, prefix+": duplicate name")
+			continue
+		}
+		seen[c.Name] = true
+
+		if c.Disabled {
+			pp = slices.DeleteFunc(pp, func(p Provider) bool { return p.Name() == c.Name })
+			continue
+		}
+
+		p, err := c.build()
+		if err != nil {
+			msgs = append(msgs, prefix+": "+err.Error())
+			continue
+		}
+
+		i := slices.IndexFunc(pp, func(p Provider) bool { return p.Name() == c.Name })
+		if i >= 0 {
+			pp[i] = p
+		} else {
+			pp = append(pp, p)
+		}
+	}
+
+	if len(msgs) > 0 {
+		return nil, errors.Errorf("invalid provider configuration:\n%s", strings.Join(msgs, "\n"))
+	}
+	return pp, nil
+}
+
+// build validates the definition and builds the provider
+func (c ProviderConfig) build() (Provider, error) {
+	t, ok := providerTypes[c.Type]
+	if !ok {
+		types := []string{}
+		for k := range providerTypes {
+			types = append(types, k)
+		}
+		sort.Strings(types)
+		return nil, errors.Errorf("unknown type %q (one of %s)", c.Type, strings.Join(types, ", "))
+	}
+
+	msgs := []string{}
+	for _, f := range c.fields() {
+		if !slices.Contains(t.fields, f) {
+			msgs = append(msgs, fmt.Sprintf("%s isn't supported by type %s", f, c.Type))
+		}
+	}
+	set := c.fields()
+	for _, f := range t.required {
+		if !slices.Contains(set, f) {
+			msgs = append(msgs, fmt.Sprintf("%s is required by type %s", f, c.Type))
+		}
+	}
+
+	urls := map[string]string{
+		"base_url":     c.BaseURL,
+		"auth_url":     c.AuthURL,
+		"token_url":    c.TokenURL,
+		"revoke_url":   c.RevokeURL,
+		"issuer_url":   c.IssuerURL,
+		"jwks_url":     c.JWKSURL,
+		"userinfo_url": c.UserInfoURL,
+	}
+	if err := c.Vars.Validate(c.AuthURL, c.TokenURL, c.RevokeURL); err != nil {
+		msgs = append(msgs, err.Error())
+	}
+	dummy := map[string]string{}
+	for _, v := range c.Vars {
+		dummy[v.Name] = "x"
+	}
+
+	for _, f := range set {
+		u, ok := urls[f]
+		if !ok {
+			continue
+		}
+		// urls can contain template variables
+		if s, err := execute(u, dummy); err == nil {
+			u = s
+		}
+		pu, err := url.Parse(u)
+		if err != nil || (pu.Scheme != "https" && pu.Scheme != "http") || pu.Host == "" {
+			msgs = append(msgs, fmt.Sprintf("%s %q isn't an absolute url", f, u))
+		}
+	}
+
+	if c.Route != "" && !strings.HasPrefix(c.Route, "/") {
+		msgs = append(msgs, fmt.Sprintf("route %q should start with /", c.Route))
+	}
+	if err := c.Quirks.Validate(); err != nil {
+		msgs = append(msgs, err.Error())
+	}
+	if _, err := ParseAuthStyle(c.AuthStyle); err != nil {
+		msgs = append(msgs, err.Error())
+	}
+	for _, g := range c.Grants {
+		if !slices.Contains([]string{"authorization_code", "password", "client_credentials"}, g) {
+			msgs = append(msgs, fmt.Sprintf("unknown grant %q", g))
+		}
+	}
+
+	if len(msgs) > 0 {
+		return nil, errors.New(strings.Join(msgs, ", "))
+	}
+	return t.build(c)
+}
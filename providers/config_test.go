@@ -0,0 +1,104 @@
+package providers_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/omniboost/oauth-proxy/providers"
+	"golang.org/x/oauth2"
+)
+
+func TestLoadConfigured(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Version") != "2" {
+			t.Errorf("expected additional header")
+		}
+		if _, _, ok := r.BasicAuth(); ok {
+			t.Errorf("expected client credentials in form body")
+		}
+		if r.PostFormValue("grant_type") != "client_credentials" {
+			t.Errorf("unexpected grant type %s", r.PostFormValue("grant_type"))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "ACCESS",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	defer srv.Close()
+
+	pp, err := providers.LoadConfigured([]providers.ProviderConfig{
+		{Name: "apaleo", Disabled: true},
+		{
+			Type:      "oauth2",
+			Name:      "acme",
+			TokenURL:  srv.URL + "/token",
+			AuthStyle: "params",
+			Grants:    []string{"client_credentials"},
+			Headers:   map[string]string{"X-Api-Version": "2"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var acme providers.ClientCredentialsProvider
+	for _, p := range pp {
+		if p.Name() == "apaleo" {
+			t.Errorf("expected apaleo to be disabled")
+		}
+		if p.Name() == "acme" {
+			acme = p.(providers.ClientCredentialsProvider)
+		}
+	}
+	if acme == nil {
+		t.Fatal("expected acme provider")
+	}
+
+	// the headers are added by the quirks pipeline, like the token requester
+	// does
+	params := providers.TokenRequestParams{ClientID: "client", ClientSecret: "secret"}
+	rt := providers.NewQuirksRoundTripper(http.DefaultTransport, providers.QuirksFor(acme, params))
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: rt})
+	token, err := acme.TokenSourceClientCredentials(ctx, params).Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "ACCESS" {
+		t.Errorf("unexpected access token %s", token.AccessToken)
+	}
+
+	_, err = acme.(providers.PasswordProvider).TokenSourcePassword(context.Background(), params).Token()
+	if err == nil {
+		t.Errorf("expected password grant to be unsupported")
+	}
+}
+
+func TestLoadConfiguredValidation(t *testing.T) {
+	_, err := providers.LoadConfigured([]providers.ProviderConfig{
+		{Type: "oauth2", Name: "acme"},
+		{Type: "exactonline", Name: "exactonline.nl", BaseURL: "start.exactonline.nl"},
+		{Type: "xero", Name: "xero.com", TokenURL: "https://example.com/token"},
+		{Type: "unknown", Name: "other"},
+	})
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+
+	for _, msg := range []string{
+		"token_url is required by type oauth2",
+		`base_url "start.exactonline.nl" isn't an absolute url`,
+		"token_url isn't supported by type xero",
+		`unknown type "unknown"`,
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expected %q in %s", msg, err)
+		}
+	}
+}
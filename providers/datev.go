@@ -14,6 +14,7 @@ type Datev struct {
 	remoteKeysetURL string
 	issuerURL       string
 	revokeURL       string
+	userInfoURL     string
 }
 
 func NewDatev() *Datev {
@@ -50,6 +51,18 @@ func (v Datev) WithRevokeURL(u string) Datev {
 	return v
 }
 
+func (v Datev) WithUserInfoURL(u string) Datev {
+	v.userInfoURL = u
+	return v
+}
+
+func (v Datev) UserInfoURL(params TokenRequestParams) string {
+	if v.userInfoURL != "" {
+		return v.userInfoURL
+	}
+	return "https://api.datev.de/userinfo"
+}
+
 func (v Datev) RevokeURL() string {
 	return v.revokeURL
 }
@@ -62,6 +75,10 @@ func (v Datev) Route() string {
 	return "/" + v.name + "/oauth2/token"
 }
 
+func (v Datev) AuthURL(params TokenRequestParams) string {
+	return v.oauthConfig().Endpoint.AuthURL
+}
+
 func (v Datev) RevokeRoute() string {
 	return "/" + v.name + "/oauth2/revoke"
 }
@@ -109,7 +126,7 @@ func (v Datev) TokenSourceAuthorizationCode(ctx context.Context, params TokenReq
 }
 
 func (v Datev) IDTokenVerifier(params TokenRequestParams) *oidc.IDTokenVerifier {
-	keySet := oidc.NewRemoteKeySet(context.Background(), v.remoteKeysetURL)
+	keySet := NewCachedKeySet(v.remoteKeysetURL)
 	return oidc.NewVerifier(v.issuerURL, keySet, &oidc.Config{
 		ClientID:             params.ClientID,
 		SupportedSigningAlgs: []string{"RS256"},
@@ -0,0 +1,278 @@
+package providers
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DPoPProvider is implemented by providers whose token endpoint requires
+// DPoP (RFC 9449) proofs and issues sender-constrained tokens
+type DPoPProvider interface {
+	Provider
+	DPoP() bool
+}
+
+// DPoPKey is the key a token lineage is bound to. The proxy owns the key: it
+// signs the proofs sent to the token endpoint and hands the key to clients so
+// they can create matching proofs for API calls
+type DPoPKey struct {
+	key *ecdsa.PrivateKey
+}
+
+type dpopJWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	D   string `json:"d,omitempty"`
+}
+
+func NewDPoPKey() (*DPoPKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &DPoPKey{key: key}, nil
+}
+
+// ParseDPoPKey parses a private JWK as returned by DPoPKey.String()
+func ParseDPoPKey(s string) (*DPoPKey, error) {
+	jwk := dpopJWK{}
+	err := json.Unmarshal([]byte(s), &jwk)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if jwk.Kty != "EC" || jwk.Crv != "P-256" {
+		return nil, errors.Errorf("unsupported DPoP key type %s/%s", jwk.Kty, jwk.Crv)
+	}
+
+	d, err := base64.RawURLEncoding.DecodeString(jwk.D)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	key, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), d)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &DPoPKey{key: key}, nil
+}
+
+// PublicJWK returns the public part of the key as a JWK
+func (k *DPoPKey) PublicJWK() json.RawMessage {
+	b, _ := json.Marshal(k.jwk(false))
+	return b
+}
+
+// PrivateJWK returns the full key, including the private part, as a JWK
+func (k *DPoPKey) PrivateJWK() json.RawMessage {
+	b, _ := json.Marshal(k.jwk(true))
+	return b
+}
+
+// String returns the private JWK, this is the format the key is stored in
+func (k *DPoPKey) String() string {
+	return string(k.PrivateJWK())
+}
+
+// Thumbprint returns the RFC 7638 JWK thumbprint of the key (the "jkt")
+func (k *DPoPKey) Thumbprint() string {
+	jwk := k.jwk(false)
+	// members in lexicographic order, no whitespace
+	s := `{"crv":"` + jwk.Crv + `","kty":"` + jwk.Kty + `","x":"` + jwk.X + `","y":"` + jwk.Y + `"}`
+	sum := sha256.Sum256([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (k *DPoPKey) jwk(private bool) dpopJWK {
+	// uncompressed point: 0x04 || X || Y
+	pub, _ := k.key.PublicKey.Bytes()
+	jwk := dpopJWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(pub[1:33]),
+		Y:   base64.RawURLEncoding.EncodeToString(pub[33:]),
+	}
+	if private {
+		d, _ := k.key.Bytes()
+		jwk.D = base64.RawURLEncoding.EncodeToString(d)
+	}
+	return jwk
+}
+
+// Proof creates a DPoP proof JWT for a request with the http method and url.
+// The nonce is optional and only set when the server demanded one
+func (k *DPoPKey) Proof(method, u, nonce string) (string, error) {
+	return k.proof(method, u, nonce, "")
+}
+
+// proof creates a DPoP proof, accessToken is set when the proof accompanies
+// an access token on a resource request
+func (k *DPoPKey) proof(method, u, nonce, accessToken string) (string, error) {
+	// htu is the url without query and fragment
+	if i := strings.IndexAny(u, "?#"); i != -1 {
+		u = u[:i]
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	header := map[string]any{
+		"typ": "dpop+jwt",
+		"alg": "ES256",
+		"jwk": k.jwk(false),
+	}
+	claims := map[string]any{
+		"jti": base64.RawURLEncoding.EncodeToString(jti),
+		"htm": method,
+		"htu": u,
+		"iat": time.Now().Unix(),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	if accessToken != "" {
+		ath := sha256.Sum256([]byte(accessToken))
+		claims["ath"] = base64.RawURLEncoding.EncodeToString(ath[:])
+	}
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, k.key, digest[:])
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	// JWS ES256 signatures are the fixed size concatenation of r and s
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// dpopNonces remembers the last nonce per host so not every request to the
+// token endpoint has to be retried
+var dpopNonces sync.Map
+
+type DPoPRoundTripper struct {
+	rtp http.RoundTripper
+	key *DPoPKey
+}
+
+func NewDPoPRoundTripper(rtp http.RoundTripper, key *DPoPKey) *DPoPRoundTripper {
+	return &DPoPRoundTripper{rtp: rtp, key: key}
+}
+
+func (rt *DPoPRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the body has to be replayable in case the server demands a nonce
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	resp, err := rt.roundTrip(req, body, rt.nonce(req.URL.Host))
+	if err != nil {
+		return resp, err
+	}
+
+	if !rt.useNonce(resp) {
+		return resp, nil
+	}
+
+	// retry once with the nonce the server handed us
+	resp.Body.Close()
+	return rt.roundTrip(req, body, rt.nonce(req.URL.Host))
+}
+
+func (rt *DPoPRoundTripper) nonce(host string) string {
+	n, _ := dpopNonces.Load(host)
+	s, _ := n.(string)
+	return s
+}
+
+func (rt *DPoPRoundTripper) roundTrip(req *http.Request, body []byte, nonce string) (*http.Response, error) {
+	accessToken, ok := strings.CutPrefix(req.Header.Get("Authorization"), "DPoP ")
+	if !ok {
+		accessToken = ""
+	}
+	proof, err := rt.key.proof(req.Method, req.URL.String(), nonce, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	r := req.Clone(req.Context())
+	r.Header.Set("DPoP", proof)
+	if body != nil {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+
+	resp, err := rt.rtp.RoundTrip(r)
+	if err != nil {
+		return resp, err
+	}
+
+	if n := resp.Header.Get("DPoP-Nonce"); n != "" {
+		dpopNonces.Store(req.URL.Host, n)
+	}
+	return resp, nil
+}
+
+// useNonce checks if the response is a "use_dpop_nonce" error. The response
+// body is restored so it can still be read by the caller
+func (rt *DPoPRoundTripper) useNonce(resp *http.Response) bool {
+	if resp.Header.Get("DPoP-Nonce") == "" {
+		return false
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized &&
+		strings.Contains(resp.Header.Get("WWW-Authenticate"), "use_dpop_nonce") {
+		return true
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		return false
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return false
+	}
+
+	e := struct {
+		Error string `json:"error"`
+	}{}
+	_ = json.Unmarshal(b, &e)
+	return e.Error == "use_dpop_nonce"
+}
@@ -0,0 +1,140 @@
+package providers_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/omniboost/oauth-proxy/providers"
+)
+
+func TestDPoPKeyRoundTrip(t *testing.T) {
+	key, err := providers.NewDPoPKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := providers.ParseDPoPKey(key.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Thumbprint() != key.Thumbprint() {
+		t.Errorf("expected thumbprint %s, got %s", key.Thumbprint(), parsed.Thumbprint())
+	}
+}
+
+func TestDPoPProof(t *testing.T) {
+	key, err := providers.NewDPoPKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proof, err := key.Proof("POST", "https://example.com/token?foo=bar", "NONCE")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, claims := verifyDPoPProof(t, proof)
+	if header["typ"] != "dpop+jwt" {
+		t.Errorf("expected typ dpop+jwt, got %v", header["typ"])
+	}
+	if claims["htu"] != "https://example.com/token" {
+		t.Errorf("expected htu without query, got %v", claims["htu"])
+	}
+	if claims["htm"] != "POST" {
+		t.Errorf("expected htm POST, got %v", claims["htm"])
+	}
+	if claims["nonce"] != "NONCE" {
+		t.Errorf("expected nonce NONCE, got %v", claims["nonce"])
+	}
+}
+
+func TestDPoPRoundTripperNonce(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "grant_type=refresh_token" {
+			t.Errorf("expected body to be replayed, got %s", body)
+		}
+
+		_, claims := verifyDPoPProof(t, r.Header.Get("DPoP"))
+		if claims["nonce"] != "SERVER_NONCE" {
+			w.Header().Set("DPoP-Nonce", "SERVER_NONCE")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"use_dpop_nonce"}`))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"TEST","token_type":"DPoP"}`))
+	}))
+	defer srv.Close()
+
+	key, err := providers.NewDPoPKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: providers.NewDPoPRoundTripper(http.DefaultTransport, key)}
+	resp, err := client.Post(srv.URL, "application/x-www-form-urlencoded", strings.NewReader("grant_type=refresh_token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls, got %d", calls)
+	}
+}
+
+func verifyDPoPProof(t *testing.T, proof string) (map[string]any, map[string]any) {
+	t.Helper()
+
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 parts, got %d", len(parts))
+	}
+
+	header := map[string]any{}
+	claims := map[string]any{}
+	for i, v := range []*map[string]any{&header, &claims} {
+		b, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(b, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jwk := header["jwk"].(map[string]any)
+	x, _ := base64.RawURLEncoding.DecodeString(jwk["x"].(string))
+	y, _ := base64.RawURLEncoding.DecodeString(jwk["y"].(string))
+	pub, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(pub, digest[:], r, s) {
+		t.Fatal("invalid proof signature")
+	}
+
+	return header, claims
+}
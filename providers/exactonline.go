@@ -3,6 +3,7 @@ package providers
 import (
 	"context"
 	"net/url"
+	"time"
 
 	"golang.org/x/oauth2"
 )
@@ -26,6 +27,11 @@ func (eo ExactOnline) WithBaseURL(url url.URL) ExactOnline {
 	return eo
 }
 
+// Quirks: refresh tokens expire after 30 days
+func (eo ExactOnline) Quirks(params TokenRequestParams) Quirks {
+	return Quirks{RefreshTokenLifetime: 30 * 24 * time.Hour}
+}
+
 func (eo ExactOnline) Name() string {
 	return eo.name
 }
@@ -35,6 +41,10 @@ func (eo ExactOnline) Route() string {
 	return "/" + eo.name + "/api/oauth2/token"
 }
 
+func (eo ExactOnline) AuthURL(params TokenRequestParams) string {
+	return eo.oauthConfig().Endpoint.AuthURL
+}
+
 func (eo ExactOnline) oauthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
@@ -0,0 +1,64 @@
+package providers
+
+import (
+	"strings"
+)
+
+// ContextProvider is implemented by providers that need values from the
+// original client request (like headers) to refresh a token
+type ContextProvider interface {
+	Provider
+	ContextKeys() []string
+}
+
+// Lookup returns a value from the request ("header", "query", "path" or
+// "json"). When the request doesn't contain it, the value captured at the
+// code exchange is used
+func (p TokenRequestParams) Lookup(source, key string) string {
+	v := lookupRequest(source, key, p)
+	if v != "" {
+		return v
+	}
+	return p.Context[contextKey(source, key)]
+}
+
+// CaptureContext collects the values of the request a provider needs to
+// refresh the token later on: the redirect_uri, the sources of the template
+// variables and the provider's context keys
+func CaptureContext(p Provider, params TokenRequestParams) map[string]string {
+	keys := []string{}
+	if tp, ok := p.(TemplatedProvider); ok {
+		for _, v := range tp.TemplateVars() {
+			keys = append(keys, v.From...)
+		}
+	}
+	if cp, ok := p.(ContextProvider); ok {
+		keys = append(keys, cp.ContextKeys()...)
+	}
+
+	ctx := map[string]string{}
+	for _, k := range keys {
+		source, key, _ := strings.Cut(k, ":")
+		v := params.Lookup(source, key)
+		if v != "" {
+			ctx[contextKey(source, key)] = v
+		}
+	}
+
+	redirectURL := params.RedirectURL
+	if redirectURL == "" {
+		redirectURL = params.Context["redirect_uri"]
+	}
+	if redirectURL != "" {
+		ctx["redirect_uri"] = redirectURL
+	}
+	return ctx
+}
+
+// contextKey normalizes the key so header names are case insensitive
+func contextKey(source, key string) string {
+	if source == "header" {
+		key = strings.ToLower(key)
+	}
+	return source + ":" + key
+}
@@ -0,0 +1,40 @@
+package providers_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/omniboost/oauth-proxy/providers"
+)
+
+func TestCaptureContext(t *testing.T) {
+	p := providers.NewAmadeus().WithName("amadeus")
+	r := httptest.NewRequest("POST", "/amadeus/OAuth2/AccessToken", nil)
+	r.Header.Set("Ocp-Apim-Subscription-Key", "secret")
+
+	ctx := providers.CaptureContext(p, providers.TokenRequestParams{
+		RedirectURL:     "https://example.com/callback",
+		OriginalRequest: r,
+	})
+	if ctx["header:ocp-apim-subscription-key"] != "secret" {
+		t.Errorf("subscription key not captured: %v", ctx)
+	}
+	if ctx["redirect_uri"] != "https://example.com/callback" {
+		t.Errorf("redirect_uri not captured: %v", ctx)
+	}
+
+	// a refresh without the header uses the captured value
+	params := providers.TokenRequestParams{
+		OriginalRequest: httptest.NewRequest("POST", "/amadeus/OAuth2/RefreshAccessToken", nil),
+		Context:         ctx,
+	}
+	if v := params.Lookup("header", "Ocp-Apim-Subscription-Key"); v != "secret" {
+		t.Errorf("expected captured value, got %q", v)
+	}
+
+	// values in the request take precedence
+	params.OriginalRequest.Header.Set("Ocp-Apim-Subscription-Key", "other")
+	if v := params.Lookup("header", "Ocp-Apim-Subscription-Key"); v != "other" {
+		t.Errorf("expected request value, got %q", v)
+	}
+}
@@ -0,0 +1,35 @@
+package providers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// JWTExpiry returns the exp claim of a JWT access token. The signature isn't
+// verified: the token is only used to know when to refresh it
+func JWTExpiry(accessToken string) (time.Time, bool) {
+	parts := strings.Split(accessToken, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	claims := struct {
+		Exp json.Number `json:"exp"`
+	}{}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return time.Time{}, false
+	}
+
+	exp, err := claims.Exp.Float64()
+	if err != nil || exp <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(exp), 0), true
+}
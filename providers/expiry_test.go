@@ -0,0 +1,30 @@
+package providers_test
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/omniboost/oauth-proxy/providers"
+)
+
+func TestJWTExpiry(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"123","exp":1893456000}`))
+	exp, ok := providers.JWTExpiry("eyJhbGciOiJSUzI1NiJ9." + payload + ".signature")
+	if !ok {
+		t.Fatal("expected expiry from exp claim")
+	}
+	if !exp.Equal(time.Unix(1893456000, 0)) {
+		t.Errorf("unexpected expiry %s", exp)
+	}
+
+	for _, token := range []string{
+		"opaque-token",
+		"eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"123"}`)) + ".signature",
+		"a.b.c",
+	} {
+		if _, ok := providers.JWTExpiry(token); ok {
+			t.Errorf("expected no expiry for %s", token)
+		}
+	}
+}
@@ -28,6 +28,10 @@ func (f Fortnox) Route() string {
 	return "/" + f.name + "/oauth2/token"
 }
 
+func (f Fortnox) AuthURL(params TokenRequestParams) string {
+	return f.oauthConfig().Endpoint.AuthURL
+}
+
 func (f Fortnox) oauthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
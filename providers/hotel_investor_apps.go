@@ -1,9 +1,7 @@
 package providers
 
 import (
-	"bytes"
 	"context"
-	"text/template"
 
 	"github.com/joefitzgerald/passwordcredentials"
 	"golang.org/x/oauth2"
@@ -42,6 +40,14 @@ func (v HIA) Route() string {
 	return "/" + v.name + "/oauth2/token"
 }
 
+func (v HIA) TemplateVars() TemplateVars {
+	return TemplateVars{{
+		Name:     "Subdomain",
+		From:     []string{"path:subdomain"},
+		Required: true,
+	}}
+}
+
 func (v HIA) passwordOauthConfig() *passwordcredentials.Config {
 	tokenURL := "https://{{.Subdomain}}.hotelinvestorapps.com/identity/connect/token"
 	if v.tokenURL != "" {
@@ -81,6 +87,12 @@ func (v HIA) Exchange(ctx context.Context, params TokenRequestParams, opts ...oa
 	config.ClientID = params.ClientID
 	config.ClientSecret = params.ClientSecret
 	config.RedirectURL = params.RedirectURL
+
+	tokenURL, err := v.TemplateVars().Execute(config.Endpoint.TokenURL, params)
+	if err != nil {
+		return nil, err
+	}
+	config.Endpoint.TokenURL = tokenURL
 	return config.Exchange(ctx, params.Code, opts...)
 }
 
@@ -99,12 +111,10 @@ type HIATokenSource struct {
 }
 
 func (v HIATokenSource) Token() (*oauth2.Token, error) {
-	subdomain := v.params.OriginalRequest.PathValue("subdomain")
-
-	buf := bytes.NewBuffer([]byte{})
-	tmpl, _ := template.New("hia_token_url").Parse(v.provider.tokenURL)
-	tmpl.Execute(buf, map[string]any{"Subdomain": subdomain})
-	tokenURL := buf.String()
+	tokenURL, err := v.provider.TemplateVars().Execute(v.provider.passwordOauthConfig().Endpoint.TokenURL, v.params)
+	if err != nil {
+		return nil, err
+	}
 
 	// We have a prior refresh token: get new access token with the refresh
 	// token using the authorization_code grant_type flow
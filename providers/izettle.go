@@ -27,6 +27,10 @@ func (iz Izettle) Route() string {
 	return "/" + iz.name + "/token"
 }
 
+func (iz Izettle) AuthURL(params TokenRequestParams) string {
+	return iz.oauthConfig().Endpoint.AuthURL
+}
+
 func (iz Izettle) oauthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
@@ -0,0 +1,242 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/lytics/logrus"
+	"github.com/pkg/errors"
+)
+
+// ErrKeySetUnavailable is returned when there are no keys to verify a
+// signature with: the JWKS endpoint is unreachable and there's no last known
+// good key set
+var ErrKeySetUnavailable = errors.New("key set unavailable")
+
+type keySetErrKey struct{}
+
+// VerifyIDToken verifies an id token. go-oidc only keeps the message of the
+// error of the key set, it's kept through the context so callers can check
+// for ErrKeySetUnavailable with errors.Is
+func VerifyIDToken(ctx context.Context, verifier *oidc.IDTokenVerifier, rawIDToken string) (*oidc.IDToken, error) {
+	var keySetErr error
+	t, err := verifier.Verify(context.WithValue(ctx, keySetErrKey{}, &keySetErr), rawIDToken)
+	if err != nil && keySetErr != nil {
+		return nil, errors.Wrap(keySetErr, "failed to verify signature")
+	}
+	return t, errors.WithStack(err)
+}
+
+// KeySetStore persists the last known good key set per JWKS url so ID tokens
+// can still be verified during a JWKS outage
+type KeySetStore interface {
+	LoadKeySet(ctx context.Context, jwksURL string) ([]byte, error)
+	SaveKeySet(ctx context.Context, jwksURL string, keySet []byte) error
+}
+
+var (
+	keySets     = map[string]*CachedKeySet{}
+	keySetsMu   sync.Mutex
+	keySetStore KeySetStore
+
+	// KeySetTTL is how long a fetched key set is used before it's refreshed
+	KeySetTTL = time.Hour
+	// KeySetMinRefreshInterval limits refreshes for tokens with an unknown
+	// kid, so a bogus kid can't hammer the JWKS endpoint
+	KeySetMinRefreshInterval = time.Minute
+
+	keySetHTTP = &http.Client{Timeout: 10 * time.Second}
+
+	keySetAlgs = []jose.SignatureAlgorithm{
+		jose.RS256, jose.RS384, jose.RS512,
+		jose.ES256, jose.ES384, jose.ES512,
+		jose.PS256, jose.PS384, jose.PS512,
+		jose.EdDSA,
+	}
+)
+
+// SetKeySetStore sets the store used to persist the last known good key sets
+func SetKeySetStore(store KeySetStore) {
+	keySetsMu.Lock()
+	defer keySetsMu.Unlock()
+	keySetStore = store
+}
+
+func currentKeySetStore() KeySetStore {
+	keySetsMu.Lock()
+	defer keySetsMu.Unlock()
+	return keySetStore
+}
+
+// NewCachedKeySet returns the shared key set for the JWKS url. It implements
+// oidc.KeySet
+func NewCachedKeySet(jwksURL string) *CachedKeySet {
+	keySetsMu.Lock()
+	defer keySetsMu.Unlock()
+
+	ks, ok := keySets[jwksURL]
+	if !ok {
+		ks = &CachedKeySet{url: jwksURL}
+		keySets[jwksURL] = ks
+	}
+	return ks
+}
+
+type CachedKeySet struct {
+	url string
+
+	mu          sync.Mutex
+	keys        jose.JSONWebKeySet
+	fetchedAt   time.Time
+	refreshedAt time.Time
+}
+
+func (ks *CachedKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	payload, err := ks.verifySignature(ctx, jwt)
+	if p, ok := ctx.Value(keySetErrKey{}).(*error); ok && err != nil {
+		*p = err
+	}
+	return payload, err
+}
+
+func (ks *CachedKeySet) verifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt, keySetAlgs)
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed jwt")
+	}
+
+	kid := ""
+	if len(jws.Signatures) > 0 {
+		kid = jws.Signatures[0].Header.KeyID
+	}
+
+	keys, err := ks.keysFor(ctx, kid)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		payload, err := jws.Verify(key)
+		if err == nil {
+			return payload, nil
+		}
+	}
+
+	return nil, errors.New("failed to verify id token signature")
+}
+
+// keysFor returns the keys matching the kid, refreshing the key set when it's
+// expired or when the kid is unknown (key rotation)
+func (ks *CachedKeySet) keysFor(ctx context.Context, kid string) ([]jose.JSONWebKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	expired := time.Since(ks.fetchedAt) > KeySetTTL
+	unknown := len(ks.lookup(kid)) == 0
+	// an empty key set is only loaded again after the interval as well, so
+	// an unreachable endpoint isn't called for every verification
+	if time.Since(ks.refreshedAt) > KeySetMinRefreshInterval {
+		if len(ks.keys.Keys) == 0 {
+			ks.load(ctx)
+		} else if expired || unknown {
+			err := ks.refresh(ctx)
+			if err != nil {
+				// keep using the keys we have
+				logrus.Warnf("couldn't refresh key set %s: %s", ks.url, err)
+			}
+		}
+	}
+
+	if len(ks.keys.Keys) == 0 {
+		return nil, errors.Wrap(ErrKeySetUnavailable, ks.url)
+	}
+
+	keys := ks.lookup(kid)
+	if len(keys) == 0 {
+		return nil, errors.Errorf("no key found for kid %s in %s", kid, ks.url)
+	}
+	return keys, nil
+}
+
+func (ks *CachedKeySet) lookup(kid string) []jose.JSONWebKey {
+	if kid == "" {
+		return ks.keys.Keys
+	}
+	return ks.keys.Key(kid)
+}
+
+// load fetches the key set, falling back on the last known good key set
+func (ks *CachedKeySet) load(ctx context.Context) {
+	err := ks.refresh(ctx)
+	store := currentKeySetStore()
+	if err == nil || store == nil {
+		return
+	}
+
+	logrus.Warnf("couldn't fetch key set %s, using last known good key set: %s", ks.url, err)
+	b, err := store.LoadKeySet(ctx, ks.url)
+	if err != nil {
+		logrus.Warnf("couldn't load last known good key set %s: %s", ks.url, err)
+		return
+	}
+
+	keys := jose.JSONWebKeySet{}
+	err = json.Unmarshal(b, &keys)
+	if err != nil {
+		logrus.Warnf("couldn't decode last known good key set %s: %s", ks.url, err)
+		return
+	}
+	// fetchedAt isn't set so the next request tries the endpoint again
+	ks.keys = keys
+}
+
+func (ks *CachedKeySet) refresh(ctx context.Context) error {
+	ks.refreshedAt = time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.url, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	resp, err := keySetHTTP.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("key set endpoint returned status %d", resp.StatusCode)
+	}
+
+	keys := jose.JSONWebKeySet{}
+	err = json.Unmarshal(b, &keys)
+	if err != nil {
+		return errors.Wrap(err, "failed to decode keys")
+	}
+	if len(keys.Keys) == 0 {
+		return errors.New("key set is empty")
+	}
+
+	ks.keys = keys
+	ks.fetchedAt = time.Now()
+
+	if store := currentKeySetStore(); store != nil {
+		err = store.SaveKeySet(ctx, ks.url, b)
+		if err != nil {
+			logrus.Warnf("couldn't save key set %s: %s", ks.url, err)
+		}
+	}
+
+	return nil
+}
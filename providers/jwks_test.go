@@ -0,0 +1,153 @@
+package providers_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/omniboost/oauth-proxy/providers"
+)
+
+type memoryKeySetStore map[string][]byte
+
+func (s memoryKeySetStore) LoadKeySet(ctx context.Context, jwksURL string) ([]byte, error) {
+	return s[jwksURL], nil
+}
+
+func (s memoryKeySetStore) SaveKeySet(ctx context.Context, jwksURL string, keySet []byte) error {
+	s[jwksURL] = keySet
+	return nil
+}
+
+// setKeySetIntervals overrides KeySetMinRefreshInterval and KeySetTTL for
+// the test
+func setKeySetIntervals(t *testing.T, minRefreshInterval, ttl time.Duration) {
+	interval, keySetTTL := providers.KeySetMinRefreshInterval, providers.KeySetTTL
+	t.Cleanup(func() {
+		providers.KeySetMinRefreshInterval, providers.KeySetTTL = interval, keySetTTL
+	})
+	providers.KeySetMinRefreshInterval, providers.KeySetTTL = minRefreshInterval, ttl
+}
+
+func TestCachedKeySetRotation(t *testing.T) {
+	key1, _ := rsa.GenerateKey(rand.Reader, 2048)
+	key2, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	var current atomic.Value
+	current.Store(jwks(key1, "k1"))
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(current.Load().([]byte))
+	}))
+	defer srv.Close()
+
+	setKeySetIntervals(t, 0, time.Hour)
+	ks := providers.NewCachedKeySet(srv.URL + "/rotation")
+
+	_, err := ks.VerifySignature(context.Background(), signRS256(t, key1, "k1", map[string]any{"sub": "user"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ks.VerifySignature(context.Background(), signRS256(t, key1, "k1", map[string]any{"sub": "user"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 1 {
+		t.Errorf("expected key set to be cached, got %d fetches", fetches)
+	}
+
+	// rotate: unknown kid triggers a refresh
+	current.Store(jwks(key2, "k2"))
+	_, err = ks.VerifySignature(context.Background(), signRS256(t, key2, "k2", map[string]any{"sub": "user"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 2 {
+		t.Errorf("expected key set to be refreshed, got %d fetches", fetches)
+	}
+}
+
+func TestCachedKeySetLastKnownGood(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	jwksURL := srv.URL + "/outage"
+	providers.SetKeySetStore(memoryKeySetStore{jwksURL: jwks(key, "k1")})
+	defer providers.SetKeySetStore(nil)
+
+	ks := providers.NewCachedKeySet(jwksURL)
+	_, err := ks.VerifySignature(context.Background(), signRS256(t, key, "k1", map[string]any{"sub": "user"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no keys at all
+	ks = providers.NewCachedKeySet(srv.URL + "/unavailable")
+	_, err = ks.VerifySignature(context.Background(), signRS256(t, key, "k1", map[string]any{"sub": "user"}))
+	if err == nil {
+		t.Fatal("expected error without keys")
+	}
+}
+
+func TestCachedKeySetUnavailableRefreshInterval(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	setKeySetIntervals(t, time.Hour, time.Hour)
+
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	ks := providers.NewCachedKeySet(srv.URL + "/interval")
+	for i := 0; i < 3; i++ {
+		_, err := ks.VerifySignature(context.Background(), signRS256(t, key, "k1", map[string]any{"sub": "user"}))
+		if !errors.Is(err, providers.ErrKeySetUnavailable) {
+			t.Fatalf("expected ErrKeySetUnavailable, got %v", err)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("expected the endpoint to be called once per interval, got %d fetches", n)
+	}
+}
+
+func TestVerifyIDTokenKeySetUnavailable(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	verifier := oidc.NewVerifier("https://issuer.example.com", providers.NewCachedKeySet(srv.URL+"/jwks"), &oidc.Config{ClientID: "client"})
+	idToken := signRS256(t, key, "k1", map[string]any{
+		"iss": "https://issuer.example.com",
+		"sub": "user",
+		"aud": "client",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	_, err := providers.VerifyIDToken(context.Background(), verifier, idToken)
+	if !errors.Is(err, providers.ErrKeySetUnavailable) {
+		t.Errorf("expected ErrKeySetUnavailable, got %v", err)
+	}
+
+	// an invalid token isn't a key set error
+	_, err = providers.VerifyIDToken(context.Background(), verifier, "invalid")
+	if err == nil || errors.Is(err, providers.ErrKeySetUnavailable) {
+		t.Errorf("expected a verification error, got %v", err)
+	}
+}
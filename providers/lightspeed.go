@@ -34,6 +34,10 @@ func (l Lightspeed) Route() string {
 	return "/" + l.name + "/oauth2/token"
 }
 
+func (l Lightspeed) AuthURL(params TokenRequestParams) string {
+	return l.oauthConfig().Endpoint.AuthURL
+}
+
 func (l Lightspeed) oauthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
@@ -39,6 +39,10 @@ func (l LightspeedKSeries) Route() string {
 	return "/" + l.name + "/oauth2/token"
 }
 
+func (l LightspeedKSeries) AuthURL(params TokenRequestParams) string {
+	return l.oauthConfig().Endpoint.AuthURL
+}
+
 func (l LightspeedKSeries) oauthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
@@ -34,6 +34,10 @@ func (l LightspeedRetail) Route() string {
 	return "/" + l.name + "/oauth2/token"
 }
 
+func (l LightspeedRetail) AuthURL(params TokenRequestParams) string {
+	return l.oauthConfig().Endpoint.AuthURL
+}
+
 func (l LightspeedRetail) oauthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
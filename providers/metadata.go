@@ -0,0 +1,85 @@
+package providers
+
+import (
+	"regexp"
+	"strings"
+)
+
+// AuthURLProvider is implemented by providers with an authorization endpoint
+type AuthURLProvider interface {
+	Provider
+	AuthURL(TokenRequestParams) string
+}
+
+// AuthorizationServerMetadata is the authorization server metadata (RFC 8414)
+// of a proxied provider
+type AuthorizationServerMetadata struct {
+	Issuer                                 string   `json:"issuer"`
+	AuthorizationEndpoint                  string   `json:"authorization_endpoint,omitempty"`
+	TokenEndpoint                          string   `json:"token_endpoint"`
+	RevocationEndpoint                     string   `json:"revocation_endpoint,omitempty"`
+	ResponseTypesSupported                 []string `json:"response_types_supported"`
+	GrantTypesSupported                    []string `json:"grant_types_supported"`
+	TokenEndpointAuthMethodsSupported      []string `json:"token_endpoint_auth_methods_supported"`
+	RevocationEndpointAuthMethodsSupported []string `json:"revocation_endpoint_auth_methods_supported,omitempty"`
+}
+
+var routeWildcard = regexp.MustCompile(`\{(\w+)(\.\.\.)?\}`)
+
+// Metadata builds the authorization server metadata of the provider. The
+// token and revoke endpoints are the proxy's routes, the authorization
+// endpoint is the upstream one (the proxy doesn't handle authorization
+// requests). Wildcards in the routes are filled in from the original request
+func Metadata(p Provider, baseURL string, params TokenRequestParams) AuthorizationServerMetadata {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	resolve := func(route string) string {
+		if params.OriginalRequest == nil {
+			return route
+		}
+		return routeWildcard.ReplaceAllStringFunc(route, func(s string) string {
+			name := routeWildcard.FindStringSubmatch(s)[1]
+			return params.OriginalRequest.PathValue(name)
+		})
+	}
+
+	md := AuthorizationServerMetadata{
+		Issuer:                            baseURL + resolve("/"+p.Name()),
+		TokenEndpoint:                     baseURL + resolve(p.Route()),
+		ResponseTypesSupported:            []string{},
+		GrantTypesSupported:               []string{},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post"},
+	}
+
+	grants := []string{}
+	if _, ok := p.(AuthorizationCodeProvider); ok {
+		grants = append(grants, "authorization_code")
+	}
+	if _, ok := p.(PasswordProvider); ok {
+		grants = append(grants, "password")
+	}
+	if _, ok := p.(ClientCredentialsProvider); ok {
+		grants = append(grants, "client_credentials")
+	}
+	if g, ok := p.(GrantTypesProvider); ok {
+		grants = g.GrantTypes()
+	}
+
+	for _, grant := range grants {
+		md.GrantTypesSupported = append(md.GrantTypesSupported, grant)
+		if grant == "authorization_code" {
+			md.ResponseTypesSupported = append(md.ResponseTypesSupported, "code")
+			md.GrantTypesSupported = append(md.GrantTypesSupported, "refresh_token")
+		}
+	}
+
+	if a, ok := p.(AuthURLProvider); ok {
+		md.AuthorizationEndpoint = a.AuthURL(params)
+	}
+
+	if r, ok := p.(RevokeProvider); ok {
+		md.RevocationEndpoint = baseURL + resolve(r.RevokeRoute())
+		md.RevocationEndpointAuthMethodsSupported = md.TokenEndpointAuthMethodsSupported
+	}
+
+	return md
+}
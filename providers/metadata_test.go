@@ -0,0 +1,33 @@
+package providers_test
+
+import (
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/omniboost/oauth-proxy/providers"
+)
+
+func TestMetadata(t *testing.T) {
+	r := httptest.NewRequest("GET", "/.well-known/oauth-authorization-server/microsoftonline/contoso", nil)
+	r.SetPathValue("tenant", "contoso")
+
+	provider := providers.NewMicrosoftOnline().WithName("microsoftonline/{tenant}")
+	md := providers.Metadata(provider, "https://proxy.example.com/", providers.TokenRequestParams{OriginalRequest: r})
+
+	if md.Issuer != "https://proxy.example.com/microsoftonline/contoso" {
+		t.Errorf("unexpected issuer %s", md.Issuer)
+	}
+	if md.TokenEndpoint != "https://proxy.example.com/microsoftonline/contoso/oauth2/token" {
+		t.Errorf("unexpected token endpoint %s", md.TokenEndpoint)
+	}
+	if md.AuthorizationEndpoint != "https://login.microsoftonline.com/contoso/oauth2/v2.0/authorize" {
+		t.Errorf("unexpected authorization endpoint %s", md.AuthorizationEndpoint)
+	}
+	if !slices.Contains(md.GrantTypesSupported, "refresh_token") {
+		t.Errorf("expected refresh_token grant, got %v", md.GrantTypesSupported)
+	}
+	if md.RevocationEndpoint != "" {
+		t.Errorf("expected no revocation endpoint, got %s", md.RevocationEndpoint)
+	}
+}
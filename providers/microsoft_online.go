@@ -1,9 +1,7 @@
 package providers
 
 import (
-	"bytes"
 	"context"
-	"text/template"
 
 	"golang.org/x/oauth2"
 )
@@ -30,6 +28,27 @@ func (f MicrosoftOnline) Route() string {
 	return "/" + f.name + "/oauth2/token"
 }
 
+func (f MicrosoftOnline) AuthURL(params TokenRequestParams) string {
+	u, err := f.TemplateVars().Execute(f.oauthConfig().Endpoint.AuthURL, params)
+	if err != nil {
+		return ""
+	}
+	return u
+}
+
+func (f MicrosoftOnline) TemplateVars() TemplateVars {
+	return TemplateVars{{
+		Name:    "Tenant",
+		From:    []string{"path:tenant"},
+		Default: "common",
+		Pattern: `^[A-Za-z0-9][A-Za-z0-9._-]*$`,
+	}}
+}
+
+func (f MicrosoftOnline) UserInfoURL(params TokenRequestParams) string {
+	return "https://graph.microsoft.com/oidc/userinfo"
+}
+
 func (f MicrosoftOnline) oauthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
@@ -50,15 +69,11 @@ func (f MicrosoftOnline) Exchange(ctx context.Context, params TokenRequestParams
 	config.ClientSecret = params.ClientSecret
 	config.RedirectURL = params.RedirectURL
 
-	tenant := params.OriginalRequest.PathValue("tenant")
-	if tenant == "" {
-		tenant = "common"
+	tokenURL, err := f.TemplateVars().Execute(config.Endpoint.TokenURL, params)
+	if err != nil {
+		return nil, err
 	}
-
-	buf := bytes.NewBuffer([]byte{})
-	tmpl, _ := template.New("microsoft_token_url").Parse(config.Endpoint.TokenURL)
-	tmpl.Execute(buf, map[string]any{"Tenant": tenant})
-	config.Endpoint.TokenURL = buf.String()
+	config.Endpoint.TokenURL = tokenURL
 
 	return config.Exchange(ctx, params.Code, opts...)
 }
@@ -72,14 +87,10 @@ func (f MicrosoftOnline) TokenSourceAuthorizationCode(ctx context.Context, param
 		RefreshToken: params.RefreshToken,
 	}
 
-	tenant := params.OriginalRequest.PathValue("tenant")
-	if tenant == "" {
-		tenant = "common"
+	tokenURL, err := f.TemplateVars().Execute(config.Endpoint.TokenURL, params)
+	if err != nil {
+		return errorTokenSource{err: err}
 	}
-
-	buf := bytes.NewBuffer([]byte{})
-	tmpl, _ := template.New("microsoft_token_url").Parse(config.Endpoint.TokenURL)
-	tmpl.Execute(buf, map[string]any{"Tenant": tenant})
-	config.Endpoint.TokenURL = buf.String()
+	config.Endpoint.TokenURL = tokenURL
 	return config.TokenSource(ctx, token)
 }
@@ -27,6 +27,10 @@ func (m Minox) Route() string {
 	return "/" + m.name + "/oauth/token"
 }
 
+func (m Minox) AuthURL(params TokenRequestParams) string {
+	return m.oauthConfig().Endpoint.AuthURL
+}
+
 func (m Minox) oauthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
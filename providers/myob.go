@@ -34,6 +34,10 @@ func (m MYOB) Route() string {
 	return "/" + m.name + "/oauth2/token"
 }
 
+func (m MYOB) AuthURL(params TokenRequestParams) string {
+	return m.oauthConfig().Endpoint.AuthURL
+}
+
 func (m MYOB) oauthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
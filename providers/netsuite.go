@@ -2,11 +2,8 @@ package providers
 
 import (
 	"context"
-	"encoding/json"
 	"net/url"
-	"strings"
 
-	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
 )
 
@@ -32,6 +29,10 @@ func (ns NetSuite) Route() string {
 	return "/" + ns.name + "/oauth2/v1/token"
 }
 
+func (ns NetSuite) AuthURL(params TokenRequestParams) string {
+	return ns.oauthConfig().Endpoint.AuthURL
+}
+
 func (ns NetSuite) oauthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
@@ -45,22 +46,23 @@ func (ns NetSuite) oauthConfig() *oauth2.Config {
 	}
 }
 
+func (ns NetSuite) TemplateVars() TemplateVars {
+	return TemplateVars{{
+		Name:     "account_id",
+		From:     []string{"json:company", "query:company"},
+		Required: true,
+		Replace:  map[string]string{"_": "-"},
+	}}
+}
+
 func (ns NetSuite) Exchange(ctx context.Context, params TokenRequestParams, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
-	company := ""
-	err := json.Unmarshal(params.Raw["company"], &company)
+	config := ns.oauthConfig()
+	tokenURL, err := ns.TemplateVars().Execute(config.Endpoint.TokenURL, params)
 	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-
-	// also try query params
-	if company == "" {
-		company = params.OriginalRequest.URL.Query().Get("company")
+		return nil, err
 	}
 
-	company = strings.Replace(company, "_", "-", -1)
-
-	config := ns.oauthConfig()
-	config.Endpoint.TokenURL = strings.Replace(config.Endpoint.TokenURL, "{{.account_id}}", company, -1)
+	config.Endpoint.TokenURL = tokenURL
 	config.ClientID = params.ClientID
 	config.ClientSecret = params.ClientSecret
 	config.RedirectURL = params.RedirectURL
@@ -68,18 +70,13 @@ func (ns NetSuite) Exchange(ctx context.Context, params TokenRequestParams, opts
 }
 
 func (ns NetSuite) TokenSourceAuthorizationCode(ctx context.Context, params TokenRequestParams) oauth2.TokenSource {
-	company := ""
-	_ = json.Unmarshal(params.Raw["company"], &company)
-
-	// also try query params
-	if company == "" {
-		company = params.OriginalRequest.URL.Query().Get("company")
+	config := ns.oauthConfig()
+	tokenURL, err := ns.TemplateVars().Execute(config.Endpoint.TokenURL, params)
+	if err != nil {
+		return errorTokenSource{err: err}
 	}
 
-	company = strings.Replace(company, "_", "-", -1)
-
-	config := ns.oauthConfig()
-	config.Endpoint.TokenURL = strings.Replace(config.Endpoint.TokenURL, "{{.account_id}}", company, -1)
+	config.Endpoint.TokenURL = tokenURL
 	config.ClientID = params.ClientID
 	config.ClientSecret = params.ClientSecret
 	config.RedirectURL = params.RedirectURL
@@ -0,0 +1,255 @@
+package providers
+
+import (
+	"context"
+	"slices"
+
+	"github.com/joefitzgerald/passwordcredentials"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// GrantTypesProvider is implemented by providers that only support some of
+// the grant types they implement
+type GrantTypesProvider interface {
+	Provider
+	GrantTypes() []string
+}
+
+// OAuth2Provider is a standard OAuth2 provider without quirks. It's used for
+// providers defined in the configuration
+type OAuth2Provider struct {
+	name      string
+	route     string
+	authURL   string
+	tokenURL  string
+	authStyle oauth2.AuthStyle
+	grants    []string
+	quirks    Quirks
+	dpop      bool
+	vars      TemplateVars
+}
+
+func NewOAuth2Provider() *OAuth2Provider {
+	return &OAuth2Provider{
+		grants: []string{"authorization_code"},
+	}
+}
+
+func (p OAuth2Provider) WithName(name string) OAuth2Provider {
+	p.name = name
+	return p
+}
+
+func (p OAuth2Provider) WithRoute(route string) OAuth2Provider {
+	p.route = route
+	return p
+}
+
+func (p OAuth2Provider) WithAuthURL(u string) OAuth2Provider {
+	p.authURL = u
+	return p
+}
+
+func (p OAuth2Provider) WithTokenURL(u string) OAuth2Provider {
+	p.tokenURL = u
+	return p
+}
+
+func (p OAuth2Provider) WithAuthStyle(style oauth2.AuthStyle) OAuth2Provider {
+	p.authStyle = style
+	return p
+}
+
+func (p OAuth2Provider) WithGrants(grants ...string) OAuth2Provider {
+	p.grants = grants
+	return p
+}
+
+// WithHeaders adds headers to the token requests
+func (p OAuth2Provider) WithHeaders(headers map[string]string) OAuth2Provider {
+	if len(headers) == 0 {
+		return p
+	}
+	h := map[string]string{}
+	for k, v := range p.quirks.Headers {
+		h[k] = v
+	}
+	for k, v := range headers {
+		h[k] = v
+	}
+	p.quirks.Headers = h
+	return p
+}
+
+// WithQuirks sets the deviations of the token endpoint from the spec
+func (p OAuth2Provider) WithQuirks(quirks Quirks) OAuth2Provider {
+	p.quirks = quirks
+	return p
+}
+
+// WithTemplateVars sets the variables that can be used in the endpoint urls
+func (p OAuth2Provider) WithTemplateVars(vars TemplateVars) OAuth2Provider {
+	p.vars = vars
+	return p
+}
+
+func (p OAuth2Provider) WithDPoP(dpop bool) OAuth2Provider {
+	p.dpop = dpop
+	return p
+}
+
+// WithRevokeURL returns the provider with token revocation
+func (p OAuth2Provider) WithRevokeURL(u string) RevocableOAuth2Provider {
+	return RevocableOAuth2Provider{OAuth2Provider: p, revokeURL: u}
+}
+
+func (p OAuth2Provider) Name() string {
+	return p.name
+}
+
+func (p OAuth2Provider) Route() string {
+	if p.route != "" {
+		return p.route
+	}
+	return "/" + p.name + "/oauth2/token"
+}
+
+func (p OAuth2Provider) AuthURL(params TokenRequestParams) string {
+	u, err := p.vars.Execute(p.authURL, params)
+	if err != nil {
+		return ""
+	}
+	return u
+}
+
+func (p OAuth2Provider) TemplateVars() TemplateVars {
+	return p.vars
+}
+
+func (p OAuth2Provider) GrantTypes() []string {
+	return p.grants
+}
+
+func (p OAuth2Provider) Quirks(params TokenRequestParams) Quirks {
+	return p.quirks
+}
+
+func (p OAuth2Provider) DPoP() bool {
+	return p.dpop
+}
+
+func (p OAuth2Provider) oauthConfig(params TokenRequestParams) (*oauth2.Config, error) {
+	tokenURL, err := p.vars.Execute(p.tokenURL, params)
+	if err != nil {
+		return nil, err
+	}
+
+	return &oauth2.Config{
+		RedirectURL:  "",
+		ClientID:     "",
+		ClientSecret: "",
+		Scopes:       []string{},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   p.AuthURL(params),
+			TokenURL:  tokenURL,
+			AuthStyle: p.authStyle,
+		},
+	}, nil
+}
+
+func (p OAuth2Provider) Exchange(ctx context.Context, params TokenRequestParams, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	if err := p.supports("authorization_code"); err != nil {
+		return nil, err
+	}
+
+	config, err := p.oauthConfig(params)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientID = params.ClientID
+	config.ClientSecret = params.ClientSecret
+	config.RedirectURL = params.RedirectURL
+	return config.Exchange(ctx, params.Code, opts...)
+}
+
+func (p OAuth2Provider) TokenSourceAuthorizationCode(ctx context.Context, params TokenRequestParams) oauth2.TokenSource {
+	if err := p.supports("authorization_code"); err != nil {
+		return errorTokenSource{err: err}
+	}
+
+	config, err := p.oauthConfig(params)
+	if err != nil {
+		return errorTokenSource{err: err}
+	}
+	config.ClientID = params.ClientID
+	config.ClientSecret = params.ClientSecret
+	config.RedirectURL = params.RedirectURL
+	token := &oauth2.Token{
+		RefreshToken: params.RefreshToken,
+	}
+	return config.TokenSource(ctx, token)
+}
+
+func (p OAuth2Provider) TokenSourcePassword(ctx context.Context, params TokenRequestParams) oauth2.TokenSource {
+	if err := p.supports("password"); err != nil {
+		return errorTokenSource{err: err}
+	}
+
+	config, err := p.oauthConfig(params)
+	if err != nil {
+		return errorTokenSource{err: err}
+	}
+
+	pc := &passwordcredentials.Config{
+		ClientID:     params.ClientID,
+		ClientSecret: params.ClientSecret,
+		Username:     params.Username,
+		Password:     params.Password,
+		Scopes:       []string{},
+		Endpoint:     config.Endpoint,
+	}
+	return pc.TokenSource(ctx)
+}
+
+func (p OAuth2Provider) TokenSourceClientCredentials(ctx context.Context, params TokenRequestParams) oauth2.TokenSource {
+	if err := p.supports("client_credentials"); err != nil {
+		return errorTokenSource{err: err}
+	}
+
+	config, err := p.oauthConfig(params)
+	if err != nil {
+		return errorTokenSource{err: err}
+	}
+
+	cc := &clientcredentials.Config{
+		ClientID:     params.ClientID,
+		ClientSecret: params.ClientSecret,
+		Scopes:       []string{},
+		TokenURL:     config.Endpoint.TokenURL,
+		AuthStyle:    config.Endpoint.AuthStyle,
+	}
+	return cc.TokenSource(ctx)
+}
+
+func (p OAuth2Provider) supports(grant string) error {
+	if slices.Contains(p.grants, grant) {
+		return nil
+	}
+	return errors.Errorf("provider %s doesn't support the %s grant", p.name, grant)
+}
+
+// RevocableOAuth2Provider is an OAuth2Provider with a revocation endpoint
+type RevocableOAuth2Provider struct {
+	OAuth2Provider
+	revokeURL string
+}
+
+func (p RevocableOAuth2Provider) RevokeRoute() string {
+	return "/" + p.name + "/oauth2/revoke"
+}
+
+func (p RevocableOAuth2Provider) RevokeURL() string {
+	return p.revokeURL
+}
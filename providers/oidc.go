@@ -0,0 +1,306 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/joefitzgerald/passwordcredentials"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// OIDCProvider is a generic provider that gets its endpoints from the
+// issuer's discovery document (.well-known/openid-configuration)
+type OIDCProvider struct {
+	name      string
+	issuerURL string
+	dpop      bool
+}
+
+func NewOIDCProvider() *OIDCProvider {
+	return &OIDCProvider{}
+}
+
+func (p OIDCProvider) WithName(name string) OIDCProvider {
+	p.name = name
+	return p
+}
+
+func (p OIDCProvider) WithIssuerURL(u string) OIDCProvider {
+	p.issuerURL = u
+	return p
+}
+
+func (p OIDCProvider) WithDPoP(dpop bool) OIDCProvider {
+	p.dpop = dpop
+	return p
+}
+
+func (p OIDCProvider) Name() string {
+	return p.name
+}
+
+func (p OIDCProvider) IssuerURL() string {
+	return p.issuerURL
+}
+
+func (p OIDCProvider) Route() string {
+	return "/" + p.name + "/oauth2/token"
+}
+
+func (p OIDCProvider) RevokeRoute() string {
+	return "/" + p.name + "/oauth2/revoke"
+}
+
+func (p OIDCProvider) RevokeURL() string {
+	d, err := p.Discovery()
+	if err != nil {
+		return ""
+	}
+	return d.RevocationEndpoint
+}
+
+func (p OIDCProvider) AuthURL(params TokenRequestParams) string {
+	d, err := p.Discovery()
+	if err != nil {
+		return ""
+	}
+	return d.AuthorizationEndpoint
+}
+
+func (p OIDCProvider) UserInfoURL(params TokenRequestParams) string {
+	d, err := p.Discovery()
+	if err != nil {
+		return ""
+	}
+	return d.UserinfoEndpoint
+}
+
+func (p OIDCProvider) DPoP() bool {
+	return p.dpop
+}
+
+func (p OIDCProvider) Discovery() (OIDCDiscovery, error) {
+	return discover(p.issuerURL)
+}
+
+func (p OIDCProvider) oauthConfig() (*oauth2.Config, error) {
+	d, err := p.Discovery()
+	if err != nil {
+		return nil, err
+	}
+
+	return &oauth2.Config{
+		RedirectURL:  "",
+		ClientID:     "",
+		ClientSecret: "",
+		Scopes:       []string{},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   d.AuthorizationEndpoint,
+			TokenURL:  d.TokenEndpoint,
+			AuthStyle: d.AuthStyle(),
+		},
+	}, nil
+}
+
+func (p OIDCProvider) Exchange(ctx context.Context, params TokenRequestParams, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	config, err := p.oauthConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.ClientID = params.ClientID
+	config.ClientSecret = params.ClientSecret
+	config.RedirectURL = params.RedirectURL
+	return config.Exchange(ctx, params.Code, opts...)
+}
+
+func (p OIDCProvider) TokenSourceAuthorizationCode(ctx context.Context, params TokenRequestParams) oauth2.TokenSource {
+	config, err := p.oauthConfig()
+	if err != nil {
+		return errorTokenSource{err: err}
+	}
+	config.ClientID = params.ClientID
+	config.ClientSecret = params.ClientSecret
+	config.RedirectURL = params.RedirectURL
+	token := &oauth2.Token{
+		RefreshToken: params.RefreshToken,
+	}
+	return config.TokenSource(ctx, token)
+}
+
+func (p OIDCProvider) TokenSourceClientCredentials(ctx context.Context, params TokenRequestParams) oauth2.TokenSource {
+	config, err := p.oauthConfig()
+	if err != nil {
+		return errorTokenSource{err: err}
+	}
+
+	cc := &clientcredentials.Config{
+		ClientID:     params.ClientID,
+		ClientSecret: params.ClientSecret,
+		Scopes:       []string{},
+		TokenURL:     config.Endpoint.TokenURL,
+		AuthStyle:    config.Endpoint.AuthStyle,
+	}
+	return cc.TokenSource(ctx)
+}
+
+func (p OIDCProvider) TokenSourcePassword(ctx context.Context, params TokenRequestParams) oauth2.TokenSource {
+	config, err := p.oauthConfig()
+	if err != nil {
+		return errorTokenSource{err: err}
+	}
+
+	pc := &passwordcredentials.Config{
+		ClientID:     params.ClientID,
+		ClientSecret: params.ClientSecret,
+		Username:     params.Username,
+		Password:     params.Password,
+		Scopes:       []string{},
+		Endpoint:     config.Endpoint,
+	}
+	return pc.TokenSource(ctx)
+}
+
+func (p OIDCProvider) IDTokenVerifier(params TokenRequestParams) *oidc.IDTokenVerifier {
+	d, err := p.Discovery()
+	if err != nil {
+		// nothing verifies without keys
+		d = OIDCDiscovery{Issuer: p.issuerURL}
+	}
+
+	algs := d.IDTokenSigningAlgValuesSupported
+	if len(algs) == 0 {
+		algs = []string{oidc.RS256}
+	}
+
+	keySet := NewCachedKeySet(d.JWKSURI)
+	return oidc.NewVerifier(d.Issuer, keySet, &oidc.Config{
+		ClientID:             params.ClientID,
+		SupportedSigningAlgs: algs,
+	})
+}
+
+// OIDCDiscovery is the part of the OpenID Provider Metadata the proxy uses
+type OIDCDiscovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+}
+
+// AuthStyle derives the client authentication style from the supported
+// token endpoint auth methods. When omitted the default is
+// client_secret_basic
+func (d OIDCDiscovery) AuthStyle() oauth2.AuthStyle {
+	methods := d.TokenEndpointAuthMethodsSupported
+	if len(methods) == 0 || slices.Contains(methods, "client_secret_basic") {
+		return oauth2.AuthStyleInHeader
+	}
+	if slices.Contains(methods, "client_secret_post") {
+		return oauth2.AuthStyleInParams
+	}
+	return oauth2.AuthStyleAutoDetect
+}
+
+// discovery documents are cached per issuer so the provider itself can stay a
+// plain value
+var (
+	discoveries   = map[string]*oidcDiscoveryCacheEntry{}
+	discoveriesMu sync.Mutex
+	discoveryTTL  = time.Hour
+	discoveryHTTP = &http.Client{Timeout: 10 * time.Second}
+)
+
+// oidcDiscoveryCacheEntry is locked while its document is fetched so a slow
+// issuer only blocks the requests for that issuer
+type oidcDiscoveryCacheEntry struct {
+	mu        sync.Mutex
+	discovery OIDCDiscovery
+	fetchedAt time.Time
+}
+
+func discover(issuerURL string) (OIDCDiscovery, error) {
+	discoveriesMu.Lock()
+	entry, ok := discoveries[issuerURL]
+	if !ok {
+		entry = &oidcDiscoveryCacheEntry{}
+		discoveries[issuerURL] = entry
+	}
+	discoveriesMu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if !entry.fetchedAt.IsZero() && time.Since(entry.fetchedAt) < discoveryTTL {
+		return entry.discovery, nil
+	}
+
+	d, err := fetchDiscovery(issuerURL)
+	if err != nil {
+		if !entry.fetchedAt.IsZero() {
+			// keep using the old document while the issuer is unreachable
+			return entry.discovery, nil
+		}
+		return d, err
+	}
+
+	entry.discovery = d
+	entry.fetchedAt = time.Now()
+	return d, nil
+}
+
+func fetchDiscovery(issuerURL string) (OIDCDiscovery, error) {
+	d := OIDCDiscovery{}
+
+	resp, err := discoveryHTTP.Get(strings.TrimSuffix(issuerURL, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return d, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return d, errors.WithStack(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return d, errors.Errorf("discovery document of %s returned status %d", issuerURL, resp.StatusCode)
+	}
+
+	err = json.Unmarshal(b, &d)
+	if err != nil {
+		return d, errors.WithStack(err)
+	}
+
+	if d.Issuer != issuerURL {
+		return d, errors.Errorf("issuer %s in discovery document doesn't match %s", d.Issuer, issuerURL)
+	}
+	if d.TokenEndpoint == "" {
+		return d, errors.Errorf("discovery document of %s has no token_endpoint", issuerURL)
+	}
+
+	return d, nil
+}
+
+// errorTokenSource is returned when a token source can't be created, the
+// error surfaces when the token is requested
+type errorTokenSource struct {
+	err error
+}
+
+func (ts errorTokenSource) Token() (*oauth2.Token, error) {
+	return nil, ts.err
+}
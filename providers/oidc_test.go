@@ -0,0 +1,151 @@
+package providers_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/omniboost/oauth-proxy/providers"
+)
+
+func TestOIDCProvider(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                srv.URL,
+			"authorization_endpoint":                srv.URL + "/authorize",
+			"token_endpoint":                        srv.URL + "/token",
+			"revocation_endpoint":                   srv.URL + "/revoke",
+			"jwks_uri":                              srv.URL + "/jwks",
+			"token_endpoint_auth_methods_supported": []string{"client_secret_basic"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwks(key, "test"))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, ok := r.BasicAuth(); !ok || id != "client" || secret != "secret" {
+			t.Errorf("expected client credentials in authorization header")
+		}
+
+		idToken := signRS256(t, key, "test", map[string]any{
+			"iss":   srv.URL,
+			"sub":   "user",
+			"aud":   "client",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"iat":   time.Now().Unix(),
+			"email": "user@example.com",
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  "ACCESS",
+			"refresh_token": "REFRESH",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+			"id_token":      idToken,
+		})
+	})
+	srv = httptest.NewServer(mux)
+	defer srv.Close()
+
+	provider := providers.NewOIDCProvider().
+		WithName("oidc").
+		WithIssuerURL(srv.URL)
+
+	if provider.RevokeURL() != srv.URL+"/revoke" {
+		t.Errorf("expected revoke url from discovery, got %s", provider.RevokeURL())
+	}
+
+	params := providers.TokenRequestParams{ClientID: "client", ClientSecret: "secret", Code: "CODE"}
+	token, err := provider.Exchange(context.Background(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idToken, err := provider.IDTokenVerifier(params).Verify(context.Background(), token.Extra("id_token").(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idToken.Subject != "user" {
+		t.Errorf("expected subject user, got %s", idToken.Subject)
+	}
+}
+
+func TestOIDCDiscoveryPerIssuer(t *testing.T) {
+	release := make(chan struct{})
+	var slow *httptest.Server
+	slow = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		json.NewEncoder(w).Encode(map[string]any{"issuer": slow.URL, "token_endpoint": slow.URL + "/token"})
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	var fast *httptest.Server
+	fast = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"issuer": fast.URL, "token_endpoint": fast.URL + "/token"})
+	}))
+	defer fast.Close()
+
+	go providers.NewOIDCProvider().WithIssuerURL(slow.URL).Discovery()
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := providers.NewOIDCProvider().WithIssuerURL(fast.URL).Discovery()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("discovery of an issuer waited for another issuer")
+	}
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+
+	h, _ := json.Marshal(map[string]any{"alg": "RS256", "kid": kid, "typ": "JWT"})
+	c, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func jwks(key *rsa.PrivateKey, kid string) []byte {
+	b, _ := json.Marshal(map[string]any{
+		"keys": []map[string]any{{
+			"kty": "RSA",
+			"kid": kid,
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+	return b
+}
@@ -27,6 +27,10 @@ func (m Procountor) Route() string {
 	return "/" + m.name + "/oauth/token"
 }
 
+func (m Procountor) AuthURL(params TokenRequestParams) string {
+	return m.oauthConfig().Endpoint.AuthURL
+}
+
 func (m Procountor) oauthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
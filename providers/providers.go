@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
 
 	"golang.org/x/oauth2"
 )
@@ -32,6 +34,12 @@ type ClientCredentialsProvider interface {
 	TokenSourceClientCredentials(context.Context, TokenRequestParams) oauth2.TokenSource
 }
 
+// UserInfoProvider is implemented by providers with an OIDC userinfo endpoint
+type UserInfoProvider interface {
+	Provider
+	UserInfoURL(TokenRequestParams) string
+}
+
 type RevokeProvider interface {
 	Name() string
 	RevokeRoute() string
@@ -159,6 +167,7 @@ func Load() Providers {
 			WithTokenURL("https://sandbox-api.datev.de/token").
 			WithRemoteKeysetURL("https://sandbox-api.datev.de/certs").
 			WithIssuerURL("https://login.datev.de/openidsandbox").
+			WithUserInfoURL("https://sandbox-api.datev.de/userinfo").
 			WithRevokeURL("https://sandbox-api.datev.de/revoke"),
 		NewBookingExperts().
 			WithName("bookingexperts"),
@@ -194,7 +203,39 @@ type TokenRequestParams struct {
 	GrantType    string
 	Username     string
 	Password     string
+	// Scope, Audience and Resource are space separated and normalized with
+	// NormalizeList so they can be used in the token lookup
+	Scope    string
+	Audience string
+	Resource string
+	// DPoPKey is the key the token lineage is bound to, only set for
+	// providers that require DPoP
+	DPoPKey *DPoPKey
+	// Context holds the values of the original code exchange request
+	// (source:key => value) so refreshes without them still work
+	Context map[string]string
+	// Namespace isolates the tokens of environments that share a database,
+	// it's part of every token lookup
+	Namespace string
 
 	Raw             map[string]json.RawMessage
 	OriginalRequest *http.Request
 }
+
+// NormalizeList turns (space separated) values into a sorted, deduplicated
+// and space separated string. "b a" and "a b a" both become "a b"
+func NormalizeList(vv ...string) string {
+	seen := map[string]bool{}
+	list := []string{}
+	for _, v := range vv {
+		for _, f := range strings.Fields(v) {
+			if seen[f] {
+				continue
+			}
+			seen[f] = true
+			list = append(list, f)
+		}
+	}
+	sort.Strings(list)
+	return strings.Join(list, " ")
+}
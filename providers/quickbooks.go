@@ -29,6 +29,10 @@ func (qb QuickBooks) Route() string {
 	return "/" + qb.name + "/oauth2/v1/tokens/bearer"
 }
 
+func (qb QuickBooks) AuthURL(params TokenRequestParams) string {
+	return qb.oauthConfig().Endpoint.AuthURL
+}
+
 func (qb QuickBooks) oauthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
@@ -0,0 +1,214 @@
+package providers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Quirks describe how the token endpoint of a provider deviates from RFC
+// 6749. They're applied to every token request and response:
+//
+//	encoding: json          send the request body as json instead of a form
+//	headers:                additional request headers
+//	token_path: data.token  the token fields are nested in the response
+//	rename:                 rename response fields (expires: expires_in)
+//	numbers: [expires_in]   coerce string values to numbers
+//	token_lifetime: 1h      lifetime of tokens without expires_in (and that
+//	                        aren't JWTs with an exp claim)
+//	refresh_token_lifetime: 720h
+//	                        lifetime of refresh tokens without
+//	                        refresh_token_expires_in
+type Quirks struct {
+	Encoding  string            `mapstructure:"encoding" json:"encoding"`
+	Headers   map[string]string `mapstructure:"headers" json:"headers"`
+	TokenPath string            `mapstructure:"token_path" json:"token_path"`
+	Rename    map[string]string `mapstructure:"rename" json:"rename"`
+	Numbers   []string          `mapstructure:"numbers" json:"numbers"`
+
+	TokenLifetime        time.Duration `mapstructure:"token_lifetime" json:"token_lifetime"`
+	RefreshTokenLifetime time.Duration `mapstructure:"refresh_token_lifetime" json:"refresh_token_lifetime"`
+}
+
+// QuirksProvider is implemented by providers with a non-standard token
+// endpoint. params can be used for headers that depend on the request
+type QuirksProvider interface {
+	Provider
+	Quirks(params TokenRequestParams) Quirks
+}
+
+// QuirksFor returns the quirks of a provider, if any
+func QuirksFor(p Provider, params TokenRequestParams) Quirks {
+	if qp, ok := p.(QuirksProvider); ok {
+		return qp.Quirks(params)
+	}
+	return Quirks{}
+}
+
+func (q Quirks) IsZero() bool {
+	return q.Encoding == "" && len(q.Headers) == 0 && q.TokenPath == "" && len(q.Rename) == 0 && len(q.Numbers) == 0 &&
+		q.TokenLifetime == 0 && q.RefreshTokenLifetime == 0
+}
+
+func (q Quirks) Validate() error {
+	switch q.Encoding {
+	case "", "form", "json":
+	default:
+		return errors.Errorf("unknown encoding %q (form or json)", q.Encoding)
+	}
+	if q.TokenLifetime < 0 {
+		return errors.Errorf("invalid token_lifetime %s", q.TokenLifetime)
+	}
+	if q.RefreshTokenLifetime < 0 {
+		return errors.Errorf("invalid refresh_token_lifetime %s", q.RefreshTokenLifetime)
+	}
+	if q.TokenPath != "" && strings.Contains("."+q.TokenPath+".", "..") {
+		return errors.Errorf("invalid token_path %q", q.TokenPath)
+	}
+	return nil
+}
+
+// EncodeRequest adds the headers and re-encodes the form body of a token
+// request
+func (q Quirks) EncodeRequest(req *http.Request) error {
+	for k, v := range q.Headers {
+		if v != "" {
+			req.Header.Set(k, v)
+		}
+	}
+
+	if q.Encoding != "json" || !isFormRequest(req) {
+		return nil
+	}
+
+	b, err := io.ReadAll(req.Body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Body.Close()
+
+	form, err := url.ParseQuery(string(b))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	v := map[string]string{}
+	for k := range form {
+		v[k] = form.Get(k)
+	}
+
+	b, err = json.Marshal(v)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.ContentLength = int64(len(b))
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	return nil
+}
+
+// NormalizeResponse turns a (successful) token response into a standard
+// one. Bodies that aren't json objects are returned as is
+func (q Quirks) NormalizeResponse(b []byte) ([]byte, error) {
+	if q.TokenPath == "" && len(q.Rename) == 0 && len(q.Numbers) == 0 {
+		return b, nil
+	}
+
+	m := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return b, nil
+	}
+
+	if q.TokenPath != "" {
+		nested := m
+		for _, k := range strings.Split(q.TokenPath, ".") {
+			n := map[string]json.RawMessage{}
+			if err := json.Unmarshal(nested[k], &n); err != nil {
+				return nil, errors.Errorf("token_path %s not found in response", q.TokenPath)
+			}
+			nested = n
+		}
+		for k, v := range nested {
+			m[k] = v
+		}
+	}
+
+	for from, to := range q.Rename {
+		v, ok := m[from]
+		if !ok {
+			continue
+		}
+		delete(m, from)
+		if _, ok := m[to]; !ok {
+			m[to] = v
+		}
+	}
+
+	for _, k := range q.Numbers {
+		var s string
+		if err := json.Unmarshal(m[k], &s); err != nil {
+			continue
+		}
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			m[k] = json.RawMessage(s)
+		}
+	}
+
+	return json.Marshal(m)
+}
+
+// QuirksRoundTripper applies the quirks of a provider to the token requests
+type QuirksRoundTripper struct {
+	rtp    http.RoundTripper
+	Quirks Quirks
+}
+
+func NewQuirksRoundTripper(rtp http.RoundTripper, quirks Quirks) *QuirksRoundTripper {
+	return &QuirksRoundTripper{rtp: rtp, Quirks: quirks}
+}
+
+func (rt *QuirksRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// only token requests (form posts) get their response normalized, not
+	// userinfo calls and the like
+	token := isFormRequest(req)
+
+	req = req.Clone(req.Context())
+	err := rt.Quirks.EncodeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := rt.rtp.RoundTrip(req)
+	if err != nil || !token || resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp, err
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	b, err = rt.Quirks.NormalizeResponse(b)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	resp.ContentLength = int64(len(b))
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
+
+func isFormRequest(req *http.Request) bool {
+	return req.Method == http.MethodPost && req.Body != nil &&
+		strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+}
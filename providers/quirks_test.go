@@ -0,0 +1,84 @@
+package providers_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/omniboost/oauth-proxy/providers"
+	"golang.org/x/oauth2"
+)
+
+func TestQuirksNormalizeResponse(t *testing.T) {
+	tests := map[string]providers.Quirks{
+		"cockpit": providers.QuirksFor(providers.NewCockpit().WithName("cockpit"), providers.TokenRequestParams{}),
+		"nested": {
+			TokenPath: "data.token",
+			Numbers:   []string{"expires_in"},
+		},
+	}
+
+	for name, q := range tests {
+		t.Run(name, func(t *testing.T) {
+			b, err := os.ReadFile(filepath.Join("testdata", "quirks", name+".response.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := os.ReadFile(filepath.Join("testdata", "quirks", name+".normalized.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err = q.NormalizeResponse(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got, want any
+			json.Unmarshal(b, &got)
+			json.Unmarshal(expected, &want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("unexpected response %s", b)
+			}
+		})
+	}
+}
+
+func TestQuirksRoundTripper(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("expected json body, got %s", r.Header.Get("Content-Type"))
+		}
+		body := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["grant_type"] != "refresh_token" || body["refresh_token"] != "rt" {
+			t.Errorf("unexpected body %v", body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		f, _ := os.Open(filepath.Join("testdata", "quirks", "cockpit.response.json"))
+		defer f.Close()
+		io.Copy(w, f)
+	}))
+	defer ts.Close()
+
+	q := providers.QuirksFor(providers.NewCockpit().WithName("cockpit"), providers.TokenRequestParams{})
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: ts.URL, AuthStyle: oauth2.AuthStyleInParams}}
+	rt := providers.NewQuirksRoundTripper(http.DefaultTransport, q)
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: rt})
+	token, err := config.TokenSource(ctx, &oauth2.Token{RefreshToken: "rt"}).Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Expiry.IsZero() {
+		t.Errorf("expected expiry from expires")
+	}
+	if token.AccessToken != "at" {
+		t.Errorf("unexpected access token %s", token.AccessToken)
+	}
+}
@@ -1,9 +1,7 @@
 package providers
 
 import (
-	"bytes"
 	"context"
-	"text/template"
 
 	"github.com/joefitzgerald/passwordcredentials"
 	"golang.org/x/oauth2"
@@ -42,6 +40,14 @@ func (v Shiji) Route() string {
 	return "/" + v.name + "/oauth2/token"
 }
 
+func (v Shiji) TemplateVars() TemplateVars {
+	return TemplateVars{{
+		Name:    "Region",
+		From:    []string{"path:region"},
+		Default: "eu1",
+	}}
+}
+
 func (v Shiji) passwordOauthConfig() *passwordcredentials.Config {
 	tokenURL := "https://eu1.api.uat.development.abovecloud.io/connect/token"
 	if v.tokenURL != "" {
@@ -81,6 +87,12 @@ func (v Shiji) Exchange(ctx context.Context, params TokenRequestParams, opts ...
 	config.ClientID = params.ClientID
 	config.ClientSecret = params.ClientSecret
 	config.RedirectURL = params.RedirectURL
+
+	tokenURL, err := v.TemplateVars().Execute(config.Endpoint.TokenURL, params)
+	if err != nil {
+		return nil, err
+	}
+	config.Endpoint.TokenURL = tokenURL
 	return config.Exchange(ctx, params.Code, opts...)
 }
 
@@ -99,16 +111,11 @@ type ShijiTokenSource struct {
 }
 
 func (v ShijiTokenSource) Token() (*oauth2.Token, error) {
-	region := v.params.OriginalRequest.PathValue("region")
-	if region == "" {
-		region = "eu1"
+	tokenURL, err := v.provider.TemplateVars().Execute(v.provider.passwordOauthConfig().Endpoint.TokenURL, v.params)
+	if err != nil {
+		return nil, err
 	}
 
-	buf := bytes.NewBuffer([]byte{})
-	tmpl, _ := template.New("shiji_token_url").Parse(v.provider.tokenURL)
-	tmpl.Execute(buf, map[string]any{"Region": region})
-	tokenURL := buf.String()
-
 	// We have a prior refresh token: get new access token with the refresh
 	// token using the authorization_code grant_type flow
 	if v.params.RefreshToken != "" {
@@ -0,0 +1,203 @@
+package providers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// TemplatedProvider is implemented by multi-tenant providers whose endpoint
+// urls contain template variables ({{.Tenant}})
+type TemplatedProvider interface {
+	Provider
+	TemplateVars() TemplateVars
+}
+
+// TemplateVar is a variable that can be used in the endpoint urls of a
+// provider. The value is looked up in the sources in order:
+//
+//	path:tenant      path value of the route ({tenant})
+//	query:company    query parameter
+//	json:company     field of the (json or form) request body
+//	header:X-Region  request header
+//
+// When a refresh request doesn't contain the value, the value captured at
+// the code exchange is used (see CaptureContext).
+//
+// The resolved value has to match Pattern (letters, digits, - and _ by
+// default) so it can't change the host or path of the url
+type TemplateVar struct {
+	Name     string            `mapstructure:"name" json:"name"`
+	From     []string          `mapstructure:"from" json:"from"`
+	Default  string            `mapstructure:"default" json:"default"`
+	Required bool              `mapstructure:"required" json:"required"`
+	Pattern  string            `mapstructure:"pattern" json:"pattern"`
+	Replace  map[string]string `mapstructure:"replace" json:"replace"`
+}
+
+type TemplateVars []TemplateVar
+
+var defaultTemplatePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// TemplateError is returned when a template variable is missing or invalid
+type TemplateError struct {
+	Var     string
+	Msg     string
+	Missing bool
+}
+
+func (e TemplateError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Var, e.Msg)
+}
+
+func (v TemplateVar) pattern() (*regexp.Regexp, error) {
+	if v.Pattern == "" {
+		return defaultTemplatePattern, nil
+	}
+	return regexp.Compile(v.Pattern)
+}
+
+// Validate checks the variable definitions and that the templates only use
+// defined variables
+func (vv TemplateVars) Validate(templates ...string) error {
+	data := map[string]string{}
+	for _, v := range vv {
+		if v.Name == "" {
+			return errors.New("template variable without name")
+		}
+		if len(v.From) == 0 && v.Default == "" {
+			return errors.Errorf("template variable %s needs a source or a default", v.Name)
+		}
+		for _, f := range v.From {
+			source, key, ok := strings.Cut(f, ":")
+			if !ok || key == "" {
+				return errors.Errorf("template variable %s: invalid source %q", v.Name, f)
+			}
+			switch source {
+			case "path", "query", "json", "header":
+			default:
+				return errors.Errorf("template variable %s: unknown source %q", v.Name, source)
+			}
+		}
+		if _, err := v.pattern(); err != nil {
+			return errors.Wrapf(err, "template variable %s", v.Name)
+		}
+		data[v.Name] = "x"
+	}
+
+	for _, t := range templates {
+		_, err := execute(t, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Resolve looks up the values of the variables in the request
+func (vv TemplateVars) Resolve(params TokenRequestParams) (map[string]string, error) {
+	data := map[string]string{}
+	for _, v := range vv {
+		value := ""
+		for _, f := range v.From {
+			source, key, _ := strings.Cut(f, ":")
+			value = params.Lookup(source, key)
+			if value != "" {
+				break
+			}
+		}
+		if value == "" {
+			value = v.Default
+		}
+
+		if value == "" {
+			if v.Required {
+				return nil, TemplateError{Var: v.Name, Msg: fmt.Sprintf("missing (%s)", strings.Join(v.From, ", ")), Missing: true}
+			}
+			data[v.Name] = ""
+			continue
+		}
+
+		for old, new := range v.Replace {
+			value = strings.ReplaceAll(value, old, new)
+		}
+
+		re, err := v.pattern()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if !re.MatchString(value) {
+			return nil, TemplateError{Var: v.Name, Msg: fmt.Sprintf("%q doesn't match %s", value, re)}
+		}
+		data[v.Name] = value
+	}
+	return data, nil
+}
+
+// Execute resolves the variables and executes the url template
+func (vv TemplateVars) Execute(tmpl string, params TokenRequestParams) (string, error) {
+	if !strings.Contains(tmpl, "{{") {
+		return tmpl, nil
+	}
+
+	data, err := vv.Resolve(params)
+	if err != nil {
+		return "", err
+	}
+	return execute(tmpl, data)
+}
+
+func execute(tmpl string, data map[string]string) (string, error) {
+	t, err := template.New("url").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid url template %s", tmpl)
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	err = t.Execute(buf, data)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid url template %s", tmpl)
+	}
+	return buf.String(), nil
+}
+
+func lookupRequest(source, key string, params TokenRequestParams) string {
+	switch source {
+	case "json":
+		raw, ok := params.Raw[key]
+		if !ok {
+			return ""
+		}
+		var v any
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return ""
+		}
+		switch v := v.(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		return ""
+	}
+
+	r := params.OriginalRequest
+	if r == nil {
+		return ""
+	}
+	switch source {
+	case "path":
+		return r.PathValue(key)
+	case "query":
+		return r.URL.Query().Get(key)
+	case "header":
+		return r.Header.Get(key)
+	}
+	return ""
+}
@@ -0,0 +1,58 @@
+package providers_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/omniboost/oauth-proxy/providers"
+)
+
+func TestTemplateVars(t *testing.T) {
+	vars := providers.TemplateVars{{
+		Name:     "account_id",
+		From:     []string{"json:company", "query:company"},
+		Required: true,
+		Replace:  map[string]string{"_": "-"},
+	}}
+	tmpl := "https://{{.account_id}}.suitetalk.api.netsuite.com/token"
+
+	r := httptest.NewRequest("POST", "/netsuite/oauth2/v1/token?company=123_SB1", nil)
+	u, err := vars.Execute(tmpl, providers.TokenRequestParams{OriginalRequest: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != "https://123-SB1.suitetalk.api.netsuite.com/token" {
+		t.Errorf("unexpected url %s", u)
+	}
+
+	params := providers.TokenRequestParams{
+		OriginalRequest: httptest.NewRequest("POST", "/netsuite/oauth2/v1/token", nil),
+		Raw:             map[string]json.RawMessage{"company": json.RawMessage(`1234567`)},
+	}
+	u, err = vars.Execute(tmpl, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != "https://1234567.suitetalk.api.netsuite.com/token" {
+		t.Errorf("expected json numbers without exponent, got %s", u)
+	}
+
+	params.Raw = map[string]json.RawMessage{"company": json.RawMessage(`"evil.com/x"`)}
+	_, err = vars.Execute(tmpl, params)
+	if !errors.As(err, &providers.TemplateError{}) {
+		t.Errorf("expected template error for invalid characters, got %v", err)
+	}
+
+	params.Raw = nil
+	_, err = vars.Execute(tmpl, params)
+	if !errors.As(err, &providers.TemplateError{}) {
+		t.Errorf("expected template error for missing value, got %v", err)
+	}
+
+	err = vars.Validate("https://{{.Region}}.example.com")
+	if err == nil {
+		t.Errorf("expected undefined variable to be invalid")
+	}
+}
@@ -32,6 +32,10 @@ func (t Tripleseat) Route() string {
 	return "/" + t.name + "/oauth2/token"
 }
 
+func (t Tripleseat) AuthURL(params TokenRequestParams) string {
+	return t.oauthConfig().Endpoint.AuthURL
+}
+
 func (t Tripleseat) oauthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
@@ -39,6 +39,10 @@ func (v VismaNet) Route() string {
 	return "/" + v.name + "/oauth2/token"
 }
 
+func (v VismaNet) AuthURL(params TokenRequestParams) string {
+	return v.oauthConfig().Endpoint.AuthURL
+}
+
 func (v VismaNet) oauthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
@@ -39,6 +39,10 @@ func (v VismaOnline) Route() string {
 	return "/" + v.name + "/oauth2/token"
 }
 
+func (v VismaOnline) AuthURL(params TokenRequestParams) string {
+	return v.oauthConfig().Endpoint.AuthURL
+}
+
 func (v VismaOnline) oauthConfig() *oauth2.Config {
 	authURL := "https://identity.vismaonline.com/connect/authorize"
 	if v.authURL != "" {
@@ -3,6 +3,7 @@ package providers
 import (
 	"context"
 	"net/url"
+	"time"
 
 	"golang.org/x/oauth2"
 )
@@ -21,6 +22,11 @@ func (x Xero) WithName(name string) Xero {
 	return x
 }
 
+// Quirks: refresh tokens expire after 60 days
+func (x Xero) Quirks(params TokenRequestParams) Quirks {
+	return Quirks{RefreshTokenLifetime: 60 * 24 * time.Hour}
+}
+
 func (x Xero) Name() string {
 	return x.name
 }
@@ -29,6 +35,10 @@ func (x Xero) Route() string {
 	return "/" + x.name + "/connect/token"
 }
 
+func (x Xero) AuthURL(params TokenRequestParams) string {
+	return x.oauthConfig().Endpoint.AuthURL
+}
+
 func (x Xero) oauthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		RedirectURL:  "",
@@ -0,0 +1,55 @@
+package redact
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/lytics/logrus"
+)
+
+// Request returns the log fields of a request with the secrets masked. The
+// body is read and replaced so it can still be used
+func Request(r *http.Request) logrus.Fields {
+	fields := logrus.Fields{
+		"method":  r.Method,
+		"url":     URL(r.URL),
+		"headers": Header(r.Header),
+	}
+	if r.Host != "" {
+		fields["host"] = r.Host
+	}
+	if body := readBody(&r.Body); body != nil {
+		fields["body"] = Body(r.Header.Get("Content-Type"), body)
+	}
+	return fields
+}
+
+// Response returns the log fields of a response with the secrets masked. The
+// body is read and replaced so it can still be used
+func Response(res *http.Response) logrus.Fields {
+	fields := logrus.Fields{
+		"status":  res.StatusCode,
+		"headers": Header(res.Header),
+	}
+	if res.Request != nil {
+		fields["url"] = URL(res.Request.URL)
+	}
+	if body := readBody(&res.Body); body != nil {
+		fields["body"] = Body(res.Header.Get("Content-Type"), body)
+	}
+	return fields
+}
+
+func readBody(body *io.ReadCloser) []byte {
+	if *body == nil || *body == http.NoBody {
+		return nil
+	}
+	b, err := io.ReadAll(*body)
+	(*body).Close()
+	*body = io.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return nil
+	}
+	return b
+}
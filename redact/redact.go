@@ -0,0 +1,198 @@
+// Package redact masks secrets (client secrets, tokens, codes, passwords and
+// credentials in headers) before requests, responses and errors end up in
+// the logs or in Sentry. A masked value shows a short hash prefix so the same
+// secret can still be correlated across log lines
+package redact
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/omniboost/oauth-proxy/types"
+)
+
+// Keys are the (lowercase) form and json fields that hold secrets
+var Keys = map[string]bool{
+	"access_token":           true,
+	"actor_token":            true,
+	"api_key":                true,
+	"assertion":              true,
+	"client_assertion":       true,
+	"client_secret":          true,
+	"code":                   true,
+	"code_verifier":          true,
+	"dpop_jwk":               true,
+	"id_token":               true,
+	"original_refresh_token": true,
+	"password":               true,
+	"refresh_token":          true,
+	"secret":                 true,
+	"subject_token":          true,
+	"token":                  true,
+}
+
+// Headers are the (canonical) headers that hold credentials
+var Headers = map[string]bool{
+	"Authorization":           true,
+	"Proxy-Authorization":     true,
+	"Cookie":                  true,
+	"Set-Cookie":              true,
+	"Dpop":                    true,
+	"X-Api-Key":               true,
+	"X-Oauth-Proxy-Signature": true,
+}
+
+// IsSecret reports whether a form or json field holds a secret
+func IsSecret(key string) bool {
+	return Keys[strings.ToLower(key)]
+}
+
+// masked matches the values returned by Secret
+var masked = regexp.MustCompile(`^\[redacted:[0-9a-f]{8}\]$`)
+
+// Secret masks a value: [redacted:1a2b3c4d]. Masked values are returned as
+// is so masking twice keeps the hash of the secret
+func Secret(value string) string {
+	if value == "" || masked.MatchString(value) {
+		return value
+	}
+	return "[redacted:" + Hash(value) + "]"
+}
+
+// Hash returns a short hash prefix of a value to correlate it without
+// exposing it. It's an HMAC with HASH_KEY when it's set so low entropy
+// secrets (passwords) can't be guessed from it
+func Hash(value string) string {
+	var sum []byte
+	if len(types.HashKey) > 0 {
+		mac := hmac.New(sha256.New, types.HashKey)
+		mac.Write([]byte(value))
+		sum = mac.Sum(nil)
+	} else {
+		s := sha256.Sum256([]byte(value))
+		sum = s[:]
+	}
+	return hex.EncodeToString(sum[:4])
+}
+
+// Header returns a copy of the headers with the credentials masked. The
+// scheme of the Authorization header is kept
+func Header(h http.Header) http.Header {
+	c := h.Clone()
+	for k, vv := range c {
+		if !Headers[http.CanonicalHeaderKey(k)] {
+			continue
+		}
+		for i, v := range vv {
+			if scheme, cred, ok := strings.Cut(v, " "); ok && (k == "Authorization" || k == "Proxy-Authorization") {
+				vv[i] = scheme + " " + Secret(cred)
+				continue
+			}
+			vv[i] = Secret(v)
+		}
+	}
+	return c
+}
+
+// Values returns a copy of the form values with the secrets masked
+func Values(values url.Values) url.Values {
+	c := url.Values{}
+	for k, vv := range values {
+		for _, v := range vv {
+			if IsSecret(k) {
+				v = Secret(v)
+			}
+			c.Add(k, v)
+		}
+	}
+	return c
+}
+
+// URL masks the secrets in the query of the url
+func URL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	c := *u
+	if c.RawQuery != "" {
+		c.RawQuery = Values(c.Query()).Encode()
+	}
+	return c.String()
+}
+
+// JSON masks the secrets in a json document. Invalid json is masked
+// completely
+func JSON(b []byte) []byte {
+	var v interface{}
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return []byte(Secret(string(b)))
+	}
+	b, _ = json.Marshal(jsonValue(v))
+	return b
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, vv := range v {
+			if s, ok := vv.(string); ok && IsSecret(k) {
+				v[k] = Secret(s)
+				continue
+			}
+			if IsSecret(k) && vv != nil {
+				b, _ := json.Marshal(vv)
+				v[k] = Secret(string(b))
+				continue
+			}
+			v[k] = jsonValue(vv)
+		}
+	case []interface{}:
+		for i, vv := range v {
+			v[i] = jsonValue(vv)
+		}
+	}
+	return v
+}
+
+// Body masks the secrets in a form or json body. Other bodies are replaced
+// by their size
+func Body(contentType string, b []byte) string {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return ""
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(b))
+		if err == nil {
+			return Values(values).Encode()
+		}
+	case strings.HasSuffix(mediaType, "json") || b[0] == '{' || b[0] == '[':
+		return string(JSON(b))
+	}
+	return "[" + mediaType + " body, " + strconv.Itoa(len(b)) + " bytes]"
+}
+
+// Args masks the values that are stored encrypted in query arguments
+func Args(args []interface{}) []interface{} {
+	c := make([]interface{}, len(args))
+	for i, a := range args {
+		if s, ok := a.(types.OptionallyEncryptedString); ok {
+			a = Secret(string(s))
+		}
+		c[i] = a
+	}
+	return c
+}
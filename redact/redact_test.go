@@ -0,0 +1,99 @@
+package redact_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/omniboost/oauth-proxy/redact"
+)
+
+func TestRequest(t *testing.T) {
+	body := "grant_type=refresh_token&client_id=abc&client_secret=s3cr3t&refresh_token=rt-123"
+	r := httptest.NewRequest("POST", "/exactonline/oauth2/token?code=xyz&state=1", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", "Basic YWJjOnMzY3IzdA==")
+
+	fields := redact.Request(r)
+	for k, v := range fields {
+		s := toString(v)
+		for _, secret := range []string{"s3cr3t", "rt-123", "xyz", "YWJjOnMzY3IzdA=="} {
+			if strings.Contains(s, secret) {
+				t.Errorf("%s contains %s: %s", k, secret, s)
+			}
+		}
+	}
+	if !strings.Contains(fields["body"].(string), "client_id=abc") {
+		t.Errorf("expected client_id to be kept: %s", fields["body"])
+	}
+	if got := fields["headers"].(http.Header).Get("Authorization"); !strings.HasPrefix(got, "Basic [redacted:") {
+		t.Errorf("expected the scheme to be kept: %s", got)
+	}
+
+	// the body can still be read
+	b, _ := io.ReadAll(r.Body)
+	if string(b) != body {
+		t.Errorf("body wasn't restored: %s", b)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	b := redact.JSON([]byte(`{"access_token":"at-1","expires_in":3600,"nested":{"id_token":"eyJ"},"dpop_jwk":{"d":"private"}}`))
+	for _, secret := range []string{"at-1", "eyJ", "private"} {
+		if strings.Contains(string(b), secret) {
+			t.Errorf("json contains %s: %s", secret, b)
+		}
+	}
+	if !strings.Contains(string(b), `"expires_in":3600`) {
+		t.Errorf("expected other fields to be kept: %s", b)
+	}
+
+	if redact.Secret("at-1") != redact.Secret("at-1") || redact.Secret("at-1") == redact.Secret("at-2") {
+		t.Errorf("expected the hash prefix to correlate")
+	}
+	if redact.Secret(redact.Secret("at-1")) != redact.Secret("at-1") {
+		t.Errorf("expected masked values to be kept")
+	}
+}
+
+func TestSentryEvent(t *testing.T) {
+	event := &sentry.Event{
+		Request: &sentry.Request{
+			Data:    `{"client_secret":"s3cr3t"}`,
+			Headers: map[string]string{"Authorization": "Bearer at-1", "Content-Type": "application/json"},
+		},
+		Tags:  map[string]string{"RefreshToken": redact.Secret("rt-123"), "Provider": "xero"},
+		Extra: map[string]interface{}{"CodeVerifier": "cv"},
+	}
+	event = redact.SentryEvent(event, nil)
+
+	s := event.Request.Data + event.Request.Headers["Authorization"] + event.Tags["RefreshToken"] + toString(event.Extra["CodeVerifier"])
+	for _, secret := range []string{"s3cr3t", "at-1", "rt-123", "cv"} {
+		if strings.Contains(s, secret) {
+			t.Errorf("event contains %s: %s", secret, s)
+		}
+	}
+	if event.Tags["RefreshToken"] != redact.Secret("rt-123") {
+		t.Errorf("expected masked tags to keep their hash, got %s", event.Tags["RefreshToken"])
+	}
+	if event.Tags["Provider"] != "xero" {
+		t.Errorf("expected other tags to be kept")
+	}
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case http.Header:
+		s := ""
+		for _, vv := range v {
+			s += strings.Join(vv, ",")
+		}
+		return s
+	}
+	return ""
+}
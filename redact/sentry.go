@@ -0,0 +1,78 @@
+package redact
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// SentryEvent masks the secrets in the request, tags, extras and breadcrumbs
+// of an event. Use it as sentry.ClientOptions.BeforeSend
+func SentryEvent(event *sentry.Event, hint *sentry.EventHint) *sentry.Event {
+	if event == nil {
+		return nil
+	}
+
+	if r := event.Request; r != nil {
+		h := http.Header{}
+		for k, v := range r.Headers {
+			h.Set(k, v)
+		}
+		h = Header(h)
+		for k := range r.Headers {
+			r.Headers[k] = h.Get(k)
+		}
+		if values, err := url.ParseQuery(r.QueryString); err == nil {
+			r.QueryString = Values(values).Encode()
+		}
+		if u, err := url.Parse(r.URL); err == nil {
+			r.URL = URL(u)
+		}
+		if r.Cookies != "" {
+			r.Cookies = Secret(r.Cookies)
+		}
+		if r.Data != "" {
+			contentType := r.Headers["Content-Type"]
+			r.Data = Body(contentType, []byte(r.Data))
+		}
+	}
+
+	for k, v := range event.Tags {
+		if isSecretName(k) {
+			event.Tags[k] = Secret(v)
+		}
+	}
+	for k, v := range event.Extra {
+		if s, ok := v.(string); ok && isSecretName(k) {
+			event.Extra[k] = Secret(s)
+		}
+	}
+	for _, b := range event.Breadcrumbs {
+		for k, v := range b.Data {
+			if s, ok := v.(string); ok && isSecretName(k) {
+				b.Data[k] = Secret(s)
+			}
+		}
+	}
+	return event
+}
+
+// isSecretName also matches CamelCase names (ClientSecret, RefreshToken)
+func isSecretName(name string) bool {
+	if IsSecret(name) {
+		return true
+	}
+	snake := strings.Builder{}
+	for i, c := range name {
+		if c >= 'A' && c <= 'Z' {
+			if i > 0 {
+				snake.WriteByte('_')
+			}
+			c += 'a' - 'A'
+		}
+		snake.WriteRune(c)
+	}
+	return IsSecret(snake.String())
+}
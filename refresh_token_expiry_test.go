@@ -0,0 +1,137 @@
+package oauthproxy
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/omniboost/oauth-proxy/mysql"
+	"github.com/omniboost/oauth-proxy/providers"
+	"golang.org/x/oauth2"
+)
+
+// namedOnly is a provider without quirks
+type namedOnly struct {
+	providers.Provider
+}
+
+func TestEnsureRefreshTokenExpiry(t *testing.T) {
+	stored := time.Now().Add(10 * 24 * time.Hour).Truncate(time.Second)
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name     string
+		provider providers.Provider
+		extra    map[string]interface{}
+		dbToken  mysql.OauthToken
+		expected time.Duration
+		keeps    bool
+	}{
+		{name: "number", provider: namedOnly{}, extra: map[string]interface{}{"refresh_token_expires_in": float64(3600)}, expected: time.Hour},
+		{name: "string", provider: namedOnly{}, extra: map[string]interface{}{"refresh_token_expires_in": "7200"}, expected: 2 * time.Hour},
+		{name: "x_ number", provider: namedOnly{}, extra: map[string]interface{}{"x_refresh_token_expires_in": float64(8726400)}, expected: 101 * day},
+		{name: "x_ string", provider: namedOnly{}, extra: map[string]interface{}{"x_refresh_token_expires_in": "86400"}, expected: day},
+		{name: "response before default", provider: providers.NewExactOnline(), extra: map[string]interface{}{"refresh_token_expires_in": float64(3600)}, expected: time.Hour},
+		{name: "exact online default", provider: providers.NewExactOnline(), expected: 30 * day},
+		{name: "xero default", provider: providers.NewXero(), expected: 60 * day},
+		{name: "invalid falls back to default", provider: providers.NewXero(), extra: map[string]interface{}{"refresh_token_expires_in": "soon"}, expected: 60 * day},
+		{name: "no default", provider: namedOnly{}},
+		{
+			name:     "not rotated keeps its expiry",
+			provider: providers.NewExactOnline(),
+			dbToken:  mysql.OauthToken{RefreshToken: "REFRESH", RefreshTokenExpiresAt: sql.NullTime{Time: stored, Valid: true}},
+			keeps:    true,
+		},
+		{
+			name:     "rotated gets a new expiry",
+			provider: providers.NewExactOnline(),
+			dbToken:  mysql.OauthToken{RefreshToken: "PREVIOUS", RefreshTokenExpiresAt: sql.NullTime{Time: stored, Valid: true}},
+			expected: 30 * day,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &TokenRequester{provider: tt.provider}
+			token := &Token{Token: (&oauth2.Token{RefreshToken: "REFRESH"}).WithExtra(tt.extra)}
+			tr.ensureRefreshTokenExpiry(token, &tt.dbToken, providers.TokenRequestParams{})
+
+			switch {
+			case tt.keeps:
+				if !token.RefreshTokenExpiry.Equal(stored) {
+					t.Errorf("expected the stored expiry %s, got %s", stored, token.RefreshTokenExpiry)
+				}
+			case tt.expected == 0:
+				if !token.RefreshTokenExpiry.IsZero() {
+					t.Errorf("expected no expiry, got %s", token.RefreshTokenExpiry)
+				}
+			default:
+				if d := time.Until(token.RefreshTokenExpiry); d > tt.expected || d < tt.expected-time.Minute {
+					t.Errorf("expected an expiry in %s, got %s", tt.expected, d)
+				}
+			}
+		})
+	}
+
+	// without a refresh token there's nothing to expire
+	tr := &TokenRequester{provider: providers.NewXero()}
+	token := &Token{Token: &oauth2.Token{}}
+	tr.ensureRefreshTokenExpiry(token, &mysql.OauthToken{}, providers.TokenRequestParams{})
+	if !token.RefreshTokenExpiry.IsZero() {
+		t.Errorf("expected no expiry without a refresh token, got %s", token.RefreshTokenExpiry)
+	}
+}
+
+func TestSeconds(t *testing.T) {
+	tests := []struct {
+		v        interface{}
+		expected int64
+		ok       bool
+	}{
+		{float64(3600), 3600, true},
+		{"3600", 3600, true},
+		{json.Number("3600"), 3600, true},
+		{float64(0), 0, false},
+		{"-1", -1, false},
+		{"3600.5", 0, false},
+		{"", 0, false},
+		{nil, 0, false},
+		{true, 0, false},
+	}
+
+	for _, tt := range tests {
+		secs, ok := seconds(tt.v)
+		if ok != tt.ok || (ok && secs != tt.expected) {
+			t.Errorf("seconds(%#v): expected %d, %t, got %d, %t", tt.v, tt.expected, tt.ok, secs, ok)
+		}
+	}
+}
+
+func TestExpiringHandlerDays(t *testing.T) {
+	token := ADMIN_TOKEN
+	t.Cleanup(func() { ADMIN_TOKEN = token })
+	ADMIN_TOKEN = "ADMIN"
+
+	s := &Server{}
+	for _, days := range []string{"-1", "seven", "1.5"} {
+		r := httptest.NewRequest(http.MethodGet, ExpiringRoute+"?days="+days, nil)
+		r.Header.Set("Authorization", "Bearer ADMIN")
+		w := httptest.NewRecorder()
+		s.NewExpiringHandler()(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("days=%s: expected %d, got %d", days, http.StatusBadRequest, w.Code)
+		}
+	}
+
+	// not an admin: the endpoint doesn't exist
+	r := httptest.NewRequest(http.MethodGet, ExpiringRoute+"?days=-1", nil)
+	r.Header.Set("Authorization", "Bearer OTHER")
+	w := httptest.NewRecorder()
+	s.NewExpiringHandler()(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected %d for a non-admin, got %d", http.StatusNotFound, w.Code)
+	}
+}
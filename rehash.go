@@ -0,0 +1,47 @@
+package oauthproxy
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/omniboost/oauth-proxy/mysql"
+	"github.com/omniboost/oauth-proxy/types"
+	"github.com/pkg/errors"
+)
+
+// RehashResult counts the tokens whose lookup hashes were recomputed
+type RehashResult struct {
+	Batch
+	Current  int `json:"current"`
+	Rehashed int `json:"rehashed"`
+}
+
+// Rehash recomputes the lookup hashes of the tokens after afterID with
+// HASH_KEY. Every batch is a transaction, progress is called after every
+// batch. With dryRun nothing is changed, only counted. Once every token is
+// rehashed the legacy lookups can be disabled (HASH_LEGACY_LOOKUPS=false)
+func Rehash(ctx context.Context, db *sql.DB, afterID, batchSize int, dryRun bool, progress func(RehashResult)) (RehashResult, error) {
+	result := RehashResult{Batch: Batch{LastID: afterID}}
+	if len(types.HashKey) == 0 {
+		return result, errors.New("HASH_KEY is not set")
+	}
+
+	job := batchJob[RehashResult, *mysql.OauthTokenHashedValues]{
+		load: mysql.OauthTokenHashedValuesAfterID,
+		id:   func(row *mysql.OauthTokenHashedValues) int { return row.ID },
+		process: func(ctx context.Context, trx *sql.Tx, counts *RehashResult, row *mysql.OauthTokenHashedValues) error {
+			if !row.Rehash() {
+				counts.Current++
+				return nil
+			}
+			counts.Rehashed++
+			if dryRun {
+				return nil
+			}
+			return errors.WithStack(row.Update(ctx, trx))
+		},
+		batch: func(r *RehashResult) *Batch { return &r.Batch },
+	}
+	err := job.run(ctx, db, &result, batchSize, dryRun, progress)
+	return result, err
+}
@@ -0,0 +1,87 @@
+package oauthproxy
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/omniboost/oauth-proxy/mysql"
+	"github.com/omniboost/oauth-proxy/types"
+	"github.com/pkg/errors"
+)
+
+// RekeyResult counts the encrypted values by the key they were stored with
+type RekeyResult struct {
+	Batch
+	Current   int `json:"current"`
+	Previous  int `json:"previous"`
+	Plaintext int `json:"plaintext"`
+	Unknown   int `json:"unknown"`
+	// OtherCipher counts the values with the current key but not the
+	// current cipher (APP_CIPHER)
+	OtherCipher int `json:"other_cipher"`
+	Rekeyed     int `json:"rekeyed"`
+}
+
+// Rekey re-encrypts the encrypted columns of the tokens after afterID with
+// the current APP_KEY and APP_CIPHER: values encrypted with a previous key or
+// another cipher and values that are still stored in plaintext. Values encrypted with an unknown key are
+// left alone. With a KEY_PROVIDER values are encrypted with the data key of
+// their client, data keys wrapped with an old key-encryption key are wrapped
+// again. Every batch is a transaction, progress is called after every
+// batch. With dryRun nothing is changed, only counted
+func Rekey(ctx context.Context, db *sql.DB, afterID, batchSize int, dryRun bool, progress func(RekeyResult)) (RekeyResult, error) {
+	result := RekeyResult{Batch: Batch{LastID: afterID}}
+	job := batchJob[RekeyResult, *mysql.OauthTokenEncryptedValues]{
+		load: mysql.OauthTokenEncryptedValuesAfterID,
+		id:   func(row *mysql.OauthTokenEncryptedValues) int { return row.ID },
+		process: func(ctx context.Context, trx *sql.Tx, counts *RekeyResult, row *mysql.OauthTokenEncryptedValues) error {
+			return rekeyRow(ctx, trx, counts, row, dryRun)
+		},
+		batch: func(r *RekeyResult) *Batch { return &r.Batch },
+	}
+	err := job.run(ctx, db, &result, batchSize, dryRun, progress)
+	return result, err
+}
+
+func rekeyRow(ctx context.Context, trx *sql.Tx, counts *RekeyResult, row *mysql.OauthTokenEncryptedValues, dryRun bool) error {
+	changed := false
+	for i, v := range row.Values {
+		switch types.EncryptionState(v.String) {
+		case types.KeyStateEmpty:
+			continue
+		case types.KeyStateCurrent:
+			counts.Current++
+			continue
+		case types.KeyStatePrevious:
+			counts.Previous++
+		case types.KeyStateOtherCipher:
+			counts.OtherCipher++
+		case types.KeyStatePlaintext:
+			counts.Plaintext++
+		case types.KeyStateUnknown:
+			counts.Unknown++
+			continue
+		}
+
+		counts.Rekeyed++
+		if dryRun {
+			// re-encrypting can store a data key
+			continue
+		}
+
+		scope := types.DataKeyScope{App: row.App, Namespace: row.Namespace, ClientID: row.ClientID}
+		s, err := types.Reencrypt(ctx, v.String, scope)
+		if err != nil {
+			return errors.Wrapf(err, "token %d: %s", row.ID, mysql.EncryptedOauthTokenColumns[i])
+		}
+		if s != v.String {
+			row.Values[i] = sql.NullString{String: s, Valid: true}
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	return errors.WithStack(row.Update(ctx, trx))
+}
@@ -0,0 +1,75 @@
+package oauthproxy_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	oauthproxy "github.com/omniboost/oauth-proxy"
+	"github.com/omniboost/oauth-proxy/mysql"
+)
+
+func TestRekeyBatches(t *testing.T) {
+	ctx := context.Background()
+
+	var afterID int
+	err := dbh.QueryRow("SELECT COALESCE(MAX(id), 0) FROM oauth_tokens").Scan(&afterID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lastID int
+	for i := 0; i < 5; i++ {
+		ot := &mysql.OauthToken{
+			App:         "REKEY",
+			Type:        "Bearer",
+			GrantType:   "client_credentials",
+			ClientID:    "rekey_" + strconv.Itoa(i),
+			AccessToken: "ACCESS",
+			CreatedAt:   time.Now(),
+			UpdatedAt:   time.Now(),
+		}
+		if err := ot.Insert(ctx, dbh); err != nil {
+			t.Fatal(err)
+		}
+		lastID = ot.ID
+	}
+	// stored before encryption was enabled
+	_, err = dbh.Exec("UPDATE oauth_tokens SET access_token = 'PLAIN' WHERE id = ?", lastID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var progress []oauthproxy.RekeyResult
+	result, err := oauthproxy.Rekey(ctx, dbh, afterID, 2, true, func(r oauthproxy.RekeyResult) {
+		progress = append(progress, r)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(progress) != 3 || progress[0].Rows != 2 || progress[1].Rows != 4 {
+		t.Fatalf("expected progress after every batch of 2, got %+v", progress)
+	}
+	if result.Rows != 5 || result.LastID != lastID || result.Plaintext != 1 || result.Rekeyed != 1 {
+		t.Errorf("expected 5 rows up to %d with 1 value to re-encrypt, got %+v", lastID, result)
+	}
+
+	// resume after the first batch
+	result, err = oauthproxy.Rekey(ctx, dbh, progress[0].LastID, 2, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != 3 || result.LastID != lastID || result.Rekeyed != 1 {
+		t.Errorf("expected the remaining 3 rows with 1 value re-encrypted, got %+v", result)
+	}
+
+	// the batches were committed
+	result, err = oauthproxy.Rekey(ctx, dbh, afterID, 2, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != 5 || result.Plaintext != 0 || result.Rekeyed != 0 {
+		t.Errorf("expected every value to be re-encrypted, got %+v", result)
+	}
+}
@@ -0,0 +1,180 @@
+package oauthproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/lytics/logrus"
+	"github.com/omniboost/oauth-proxy/providers"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+var (
+	// ADMIN_TOKEN enables the admin endpoints. Requests have to send it as
+	// a bearer token
+	ADMIN_TOKEN = os.Getenv("ADMIN_TOKEN")
+)
+
+const ReloadRoute = "/admin/reload"
+
+// ReloadResult lists the providers that were changed by a reload
+type ReloadResult struct {
+	Added     []string `json:"added"`
+	Changed   []string `json:"changed"`
+	Removed   []string `json:"removed"`
+	Unchanged int      `json:"unchanged"`
+}
+
+// Reload re-reads the configuration and swaps the providers, the callers and
+// the router. Requesters of unchanged providers keep running (and keep their
+// queue), requesters of changed and removed providers are drained and
+// stopped. When the configuration is invalid the current providers are kept
+func (s *Server) Reload() (ReloadResult, error) {
+	result := ReloadResult{
+		Added:   []string{},
+		Changed: []string{},
+		Removed: []string{},
+	}
+
+	if viper.ConfigFileUsed() != "" {
+		err := viper.ReadInConfig()
+		if err != nil {
+			return result, errors.WithStack(err)
+		}
+	}
+
+	pp, err := s.NewProviders()
+	if err != nil {
+		return result, err
+	}
+
+	cc, err := s.NewCallers()
+	if err != nil {
+		return result, err
+	}
+
+	s.mu.Lock()
+
+	current := map[string]providers.Provider{}
+	for _, p := range s.providers {
+		current[p.Name()] = p
+	}
+
+	requesters := map[string]*TokenRequester{}
+	revokers := map[string]*TokenRevoker{}
+	stale := []interface{ Stop() }{}
+
+	oldRequesters, oldRevokers := s.tokenRequesters, s.tokenRevokers
+	s.tokenRequesters, s.tokenRevokers = requesters, revokers
+
+	for _, p := range pp {
+		old, ok := current[p.Name()]
+		if ok && fingerprint(old) == fingerprint(p) {
+			result.Unchanged++
+			if tr, ok := oldRequesters[p.Name()]; ok {
+				requesters[p.Name()] = tr
+			}
+			if tr, ok := oldRevokers[p.Name()]; ok {
+				revokers[p.Name()] = tr
+			}
+			continue
+		}
+
+		if ok {
+			result.Changed = append(result.Changed, p.Name())
+		} else {
+			result.Added = append(result.Added, p.Name())
+		}
+		s.startProvider(p)
+	}
+
+	for name, tr := range oldRequesters {
+		if requesters[name] != tr {
+			stale = append(stale, tr)
+		}
+	}
+	for name, tr := range oldRevokers {
+		if revokers[name] != tr {
+			stale = append(stale, tr)
+		}
+	}
+	for name := range current {
+		if _, ok := requesters[name]; !ok {
+			result.Removed = append(result.Removed, name)
+		}
+	}
+
+	s.providers = pp
+	s.callers = cc
+	s.router = s.newRouter(pp)
+	s.mu.Unlock()
+
+	// requests that are already queued are still handled
+	wg := sync.WaitGroup{}
+	for _, tr := range stale {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tr.Stop()
+		}()
+	}
+	wg.Wait()
+
+	logrus.Infof("reloaded providers: added %v, changed %v, removed %v", result.Added, result.Changed, result.Removed)
+	return result, nil
+}
+
+// fingerprint identifies the configuration of a provider
+func fingerprint(p providers.Provider) string {
+	return fmt.Sprintf("%T:%+v", p, p)
+}
+
+func (s *Server) NewReloadHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.isAdmin(r) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		result, err := s.Reload()
+		if err != nil {
+			sentry.CaptureException(err)
+			s.ErrorResponse(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		encoder := json.NewEncoder(w)
+		encoder.Encode(result)
+	}
+}
+
+// isAdmin checks the bearer token against ADMIN_TOKEN or whether the caller
+// is an admin. Without ADMIN_TOKEN and admin callers the admin endpoints are
+// disabled
+func (s *Server) isAdmin(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok && ADMIN_TOKEN != "" && subtle.ConstantTimeCompare([]byte(token), []byte(ADMIN_TOKEN)) == 1 {
+		return true
+	}
+
+	caller, err := s.authenticate(r)
+	if err != nil || caller == nil || !caller.Admin {
+		return false
+	}
+	logrus.WithField("caller", caller.Name).Infof("admin request %s", r.URL.Path)
+	return true
+}
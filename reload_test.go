@@ -0,0 +1,146 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/omniboost/oauth-proxy/providers"
+	"github.com/spf13/viper"
+	"github.com/xo/dburl"
+)
+
+func TestReload(t *testing.T) {
+	db, err := dburl.Open(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the token endpoint blocks until released so a request stays queued on
+	// the requester of the changed provider
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "ACCESS",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	defer srv.Close()
+
+	provider := func(name, tokenURL string) map[string]any {
+		return map[string]any{
+			"type":       "oauth2",
+			"name":       name,
+			"token_url":  tokenURL,
+			"auth_style": "params",
+			"grants":     []string{"client_credentials"},
+		}
+	}
+	t.Cleanup(func() { viper.Set("providers", nil) })
+
+	viper.Set("providers", []map[string]any{
+		provider("reload-unchanged", srv.URL+"/token"),
+		provider("reload-changed", srv.URL+"/token"),
+		provider("reload-removed", srv.URL+"/token"),
+	})
+	s := &Server{db: db}
+	pp, err := s.NewProviders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetProviders(pp)
+	defer func() {
+		for _, tr := range s.tokenRequesters {
+			tr.Stop()
+		}
+		for _, tr := range s.tokenRevokers {
+			tr.Stop()
+		}
+	}()
+
+	old := maps.Clone(s.tokenRequesters)
+
+	requested := make(chan error, 1)
+	go func() {
+		_, err := old["reload-changed"].Request(providers.TokenRequestParams{
+			ClientID:     "reload",
+			ClientSecret: "reload",
+			GrantType:    "client_credentials",
+		})
+		requested <- err
+	}()
+	<-received
+
+	viper.Set("providers", []map[string]any{
+		provider("reload-unchanged", srv.URL+"/token"),
+		provider("reload-changed", srv.URL+"/v2/token"),
+		provider("reload-added", srv.URL+"/token"),
+	})
+	reloaded := make(chan ReloadResult, 1)
+	go func() {
+		result, err := s.Reload()
+		if err != nil {
+			t.Error(err)
+		}
+		reloaded <- result
+	}()
+
+	select {
+	case <-reloaded:
+		t.Fatal("expected the reload to wait for the queued request")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-requested; err != nil {
+		t.Errorf("expected the queued request to be handled, got %s", err)
+	}
+	result := <-reloaded
+
+	if len(result.Added) != 1 || result.Added[0] != "reload-added" {
+		t.Errorf("expected reload-added to be added, got %v", result.Added)
+	}
+	if len(result.Changed) != 1 || result.Changed[0] != "reload-changed" {
+		t.Errorf("expected reload-changed to be changed, got %v", result.Changed)
+	}
+	if len(result.Removed) != 1 || result.Removed[0] != "reload-removed" {
+		t.Errorf("expected reload-removed to be removed, got %v", result.Removed)
+	}
+	if unchanged := len(providers.Load()) + 1; result.Unchanged != unchanged {
+		t.Errorf("expected %d unchanged providers, got %d", unchanged, result.Unchanged)
+	}
+
+	if s.tokenRequesters["reload-unchanged"] != old["reload-unchanged"] {
+		t.Errorf("expected the requester of an unchanged provider to be kept")
+	}
+	if s.tokenRequesters["reload-changed"] == old["reload-changed"] {
+		t.Errorf("expected a new requester for a changed provider")
+	}
+	if _, ok := s.tokenRequesters["reload-removed"]; ok {
+		t.Errorf("expected no requester for a removed provider")
+	}
+
+	for _, name := range []string{"reload-changed", "reload-removed"} {
+		select {
+		case <-old[name].done:
+		default:
+			t.Errorf("expected the requester of %s to be stopped", name)
+		}
+	}
+	select {
+	case <-old["reload-unchanged"].done:
+		t.Errorf("expected the requester of reload-unchanged to keep running")
+	default:
+	}
+}
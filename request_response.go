@@ -18,10 +18,29 @@ type TokenRequestBody struct {
 	GrantType    string
 	Username     string
 	Password     string
+	Scope        StringList
+	Audience     StringList
+	Resource     StringList
 
 	RawMessages
 }
 
+// StringList accepts both a single string and an array of strings
+type StringList []string
+
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*l = StringList{s}
+		return nil
+	}
+
+	var ss []string
+	err := json.Unmarshal(data, &ss)
+	*l = ss
+	return err
+}
+
 func (rb *TokenRequestBody) UnmarshalJSON(data []byte) error {
 	err := json.Unmarshal(data, &rb.RawMessages)
 	if err != nil {
@@ -35,6 +54,9 @@ func (rb *TokenRequestBody) UnmarshalJSON(data []byte) error {
 		"code":          &rb.Code,
 		"redirect_uri":  &rb.RedirectURL,
 		"code_verifier": &rb.CodeVerifier,
+		"scope":         &rb.Scope,
+		"audience":      &rb.Audience,
+		"resource":      &rb.Resource,
 	}
 
 	for k, v := range mappings {
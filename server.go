@@ -3,6 +3,8 @@ package oauthproxy
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
@@ -11,11 +13,12 @@ import (
 	"log"
 	"mime"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
@@ -26,10 +29,40 @@ import (
 	"github.com/lytics/logrus"
 	"github.com/omniboost/oauth-proxy/mysql"
 	"github.com/omniboost/oauth-proxy/providers"
+	"github.com/omniboost/oauth-proxy/redact"
+	"github.com/omniboost/oauth-proxy/tracing"
+	"github.com/omniboost/oauth-proxy/types"
 	"github.com/pkg/errors"
+	"github.com/spf13/viper"
 	"github.com/xo/dburl"
 )
 
+var (
+	// BASE_URL is the public url of the proxy, used in the authorization
+	// server metadata. Defaults to the scheme and host of the request
+	BASE_URL = os.Getenv("BASE_URL")
+
+	// TRUST_FORWARDED_HEADERS uses X-Forwarded-Proto and X-Forwarded-Host for
+	// the default BASE_URL. Only set it when the proxy is behind a reverse
+	// proxy that sets (or strips) these headers
+	TRUST_FORWARDED_HEADERS = os.Getenv("TRUST_FORWARDED_HEADERS") == "true"
+
+	// TLS_CERT_FILE and TLS_KEY_FILE make the proxy serve https. Client
+	// certificates (see Caller) are requested and, with TLS_CLIENT_CA_FILE,
+	// verified
+	TLS_CERT_FILE      = os.Getenv("TLS_CERT_FILE")
+	TLS_KEY_FILE       = os.Getenv("TLS_KEY_FILE")
+	TLS_CLIENT_CA_FILE = os.Getenv("TLS_CLIENT_CA_FILE")
+)
+
+const (
+	// ResponseModeHeader selects the format of the token response. With
+	// "native" the response of the provider is returned as is, only
+	// expires_in is recomputed
+	ResponseModeHeader = "X-Oauth-Proxy-Response-Mode"
+	ResponseModeNative = "native"
+)
+
 func NewServer() (*Server, error) {
 	s := &Server{}
 
@@ -39,96 +72,192 @@ func NewServer() (*Server, error) {
 	}
 	s.SetDB(db)
 
-	s.SetHTTP(s.NewHTTP())
+	srv, err := s.NewHTTP()
+	if err != nil {
+		return s, errors.WithStack(err)
+	}
+	s.SetHTTP(srv)
 
 	// providers depends on db
-	s.SetProviders(s.NewProviders())
+	pp, err := s.NewProviders()
+	if err != nil {
+		return s, errors.WithStack(err)
+	}
+	s.SetProviders(pp)
 
-	// router depends on providers
-	s.SetRouter(s.NewRouter())
+	cc, err := s.NewCallers()
+	if err != nil {
+		return s, errors.WithStack(err)
+	}
+	s.SetCallers(cc)
 
 	// set default http client
 	s.client = s.NewClient()
 
+	// the router logs to loki
+	if GRAFANA_LOKI_URL != "" {
+		s.loki = NewLokiShipper(s.client)
+		s.loki.Start()
+	}
+
+	// router depends on providers
+	s.SetRouter(s.NewRouter())
+
 	return s, nil
 }
 
 type Server struct {
 	port int
 
+	// mu guards the router, providers and their requesters so they can be
+	// swapped on reload
+	mu              sync.RWMutex
 	router          *http.ServeMux
 	http            *http.Server
 	db              *sql.DB
 	providers       providers.Providers
 	tokenRequesters map[string]*TokenRequester
 	tokenRevokers   map[string]*TokenRevoker
+	callers         Callers
 	client          *http.Client
+	loki            *LokiShipper
 }
 
-func (s *Server) NewHTTP() *http.Server {
+func (s *Server) NewHTTP() (*http.Server, error) {
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	return &http.Server{
 		Addr: s.Addr(),
 		// Good practice to set timeouts to avoid Slowloris attacks.
 		WriteTimeout: time.Second * 15,
 		ReadTimeout:  time.Second * 15,
 		IdleTimeout:  time.Second * 60,
-		Handler:      s.router, // Pass our instance of gorilla/mux in.
+		Handler:      s, // Pass our instance of gorilla/mux in.
+		TLSConfig:    tlsConfig,
+	}, nil
+}
+
+// newTLSConfig requests client certificates. Without TLS_CLIENT_CA_FILE they
+// aren't verified and callers can only be matched by fingerprint
+func newTLSConfig() (*tls.Config, error) {
+	if TLS_CERT_FILE == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequestClientCert,
+	}
+	if TLS_CLIENT_CA_FILE != "" {
+		pem, err := os.ReadFile(TLS_CLIENT_CA_FILE)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates in %s", TLS_CLIENT_CA_FILE)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
 	}
+	return config, nil
 }
 
 func (s *Server) SetHTTP(http *http.Server) {
 	s.http = http
 }
 
-func (s *Server) NewProviders() providers.Providers {
-	return providers.Load()
+// NewProviders returns the built-in providers merged with the providers
+// defined in the configuration file (providers key)
+func (s *Server) NewProviders() (providers.Providers, error) {
+	configs := []providers.ProviderConfig{}
+	err := viper.UnmarshalKey("providers", &configs)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid provider configuration")
+	}
+	return providers.LoadConfigured(configs)
 }
 
 func (s *Server) SetProviders(pp providers.Providers) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.providers = pp
 
 	s.tokenRequesters = map[string]*TokenRequester{}
 	s.tokenRevokers = map[string]*TokenRevoker{}
 	for _, provider := range pp {
-		_, isAuthorizationCodeProvider := provider.(providers.AuthorizationCodeProvider)
-		_, isPasswordProvider := provider.(providers.PasswordProvider)
-		_, isClientCredentialsProvider := provider.(providers.ClientCredentialsProvider)
+		s.startProvider(provider)
+	}
+}
 
-		// if no token requester is implemented, just log a warning
-		if !isAuthorizationCodeProvider && !isPasswordProvider && !isClientCredentialsProvider {
-			logrus.Warnf("Provider %s doesn't implement a token requester", provider.Name())
-		}
+// startProvider starts the token requester (and revoker) of the provider
+func (s *Server) startProvider(provider providers.Provider) {
+	_, isAuthorizationCodeProvider := provider.(providers.AuthorizationCodeProvider)
+	_, isPasswordProvider := provider.(providers.PasswordProvider)
+	_, isClientCredentialsProvider := provider.(providers.ClientCredentialsProvider)
 
-		// register the thing
-		tr := NewTokenRequester(s.db, provider)
-		s.tokenRequesters[provider.Name()] = tr
-		tr.Start()
+	// if no token requester is implemented, just log a warning
+	if !isAuthorizationCodeProvider && !isPasswordProvider && !isClientCredentialsProvider {
+		logrus.Warnf("Provider %s doesn't implement a token requester", provider.Name())
+	}
 
-		if i, ok := provider.(providers.RevokeProvider); ok {
-			tr := NewTokenRevoker(s.db, i)
-			s.tokenRevokers[i.Name()] = tr
-			tr.Start()
-		}
+	// register the thing
+	tr := NewTokenRequester(s.db, provider)
+	s.tokenRequesters[provider.Name()] = tr
+	tr.Start()
+
+	if i, ok := provider.(providers.RevokeProvider); ok {
+		tr := NewTokenRevoker(s.db, i)
+		s.tokenRevokers[i.Name()] = tr
+		tr.Start()
 	}
 }
 
 func (s *Server) NewRouter() *http.ServeMux {
-	r := http.NewServeMux()
-
-	for _, prov := range s.providers {
-		r.Handle(prov.Route(), s.logToGrafana(s.NewProviderTokenHandler(prov)))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.newRouter(s.providers)
+}
 
-		if i, ok := prov.(providers.RevokeProvider); ok {
-			logrus.Debugf("Adding revoke route for provider %s", prov.Name())
-			r.HandleFunc(i.RevokeRoute(), s.NewProviderRevokeHandler(i))
+func (s *Server) newRouter(pp providers.Providers) *http.ServeMux {
+	r := http.NewServeMux()
+	r.Handle(ReloadRoute, s.logToGrafana("reload", "", s.NewReloadHandler()))
+	r.Handle(ExpiringRoute, s.logToGrafana("expiring", "", s.NewExpiringHandler()))
+	// scrapes aren't logged
+	r.HandleFunc(MetricsRoute, s.NewMetricsHandler())
+
+	for _, prov := range pp {
+		// the same routes select a namespace with the prefix
+		for _, prefix := range []string{"", NamespacePrefix} {
+			r.Handle(prefix+prov.Route(), s.logToGrafana("token", prov.Name(), instrument(prov.Name(), "token", s.NewProviderTokenHandler(prov))))
+			r.Handle(prefix+IdentityRoute(prov), s.logToGrafana("identity", prov.Name(), instrument(prov.Name(), "identity", s.NewProviderIdentityHandler(prov))))
+
+			if i, ok := prov.(providers.RevokeProvider); ok {
+				logrus.Debugf("Adding revoke route for provider %s", prov.Name())
+				r.Handle(prefix+i.RevokeRoute(), s.logToGrafana("revoke", prov.Name(), instrument(prov.Name(), "revoke", s.NewProviderRevokeHandler(i))))
+			}
 		}
+		r.Handle(MetadataRoute(prov), s.logToGrafana("metadata", prov.Name(), s.NewProviderMetadataHandler(prov)))
 	}
 	return r
 }
 
 func (s *Server) SetRouter(r *http.ServeMux) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.router = r
-	s.http.Handler = r
+	s.http.Handler = s
+}
+
+// ServeHTTP dispatches to the current router
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	router := s.router
+	s.mu.RUnlock()
+	router.ServeHTTP(w, r)
 }
 
 func (s *Server) SetPort(port int) {
@@ -151,7 +280,7 @@ func (s *Server) NewDB() (*sql.DB, error) {
 	// we need to add a newline because logrus uses a line-based reader,
 	// and if a log is not terminated with a newline it will not be printed.
 	mysql.SetLogger(func(s string, v ...interface{}) {
-		sf := fmt.Sprintf(s, v...)
+		sf := fmt.Sprintf(s, redact.Args(v)...)
 		if !strings.HasSuffix(sf, "\n") {
 			sf = sf + "\n"
 		}
@@ -168,11 +297,25 @@ func (s *Server) NewDB() (*sql.DB, error) {
 	})
 
 	db.SetMaxOpenConns(1)
+
+	if types.EnvelopeEncryption() {
+		// data keys are loaded while a token transaction holds the
+		// connection of db
+		keys, err := dburl.Open(os.Getenv("DATABASE_URL"))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		keys.SetMaxOpenConns(1)
+		types.SetDataKeyStore(NewDBDataKeyStore(keys))
+	}
 	return db, errors.WithStack(err)
 }
 
 func (s *Server) SetDB(db *sql.DB) {
 	s.db = db
+
+	// keep the last known good JWKS key sets for ID token verification
+	providers.SetKeySetStore(NewDBKeySetStore(db))
 }
 
 func (s *Server) Start() error {
@@ -184,7 +327,7 @@ func (s *Server) Start() error {
 }
 
 func (s *Server) StartLambda() error {
-	lambda.Start(httpadapter.NewV2(s.router).ProxyWithContext)
+	lambda.Start(httpadapter.NewV2(s).ProxyWithContext)
 	return nil
 }
 
@@ -192,7 +335,7 @@ func (s *Server) StartLocal() error {
 	errChan := make(chan error, 1)
 	// run our server in a goroutine so that it doesn't block.
 	go func() {
-		if err := s.http.ListenAndServe(); err != nil {
+		if err := s.listenAndServe(); err != nil {
 			log.Println(err)
 			sentry.CaptureException(err)
 			errChan <- err
@@ -204,6 +347,20 @@ func (s *Server) StartLocal() error {
 	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
 	signal.Notify(signalChan, os.Interrupt)
 
+	// reload the providers on SIGHUP
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	defer signal.Stop(reloadChan)
+	go func() {
+		for range reloadChan {
+			_, err := s.Reload()
+			if err != nil {
+				logrus.Errorf("couldn't reload providers: %s", err)
+				sentry.CaptureException(err)
+			}
+		}
+	}()
+
 	// block until we receive a signal or error a select statement blocks until
 	// at least one of it’s cases can proceed
 	select {
@@ -223,6 +380,13 @@ func (s *Server) StartLocal() error {
 	return s.Stop()
 }
 
+func (s *Server) listenAndServe() error {
+	if TLS_CERT_FILE != "" {
+		return s.http.ListenAndServeTLS(TLS_CERT_FILE, TLS_KEY_FILE)
+	}
+	return s.http.ListenAndServe()
+}
+
 func (s *Server) Stop() error {
 	log.Println("shutting down")
 
@@ -242,13 +406,70 @@ func (s *Server) Stop() error {
 	// <-ctx.Done() if your application should wait for other services
 	// to finalize based on context cancellation.
 	go s.http.Shutdown(ctx)
+	s.mu.RLock()
 	for _, tr := range s.tokenRequesters {
 		tr.Stop()
 	}
+	for _, tr := range s.tokenRevokers {
+		tr.Stop()
+	}
+	s.mu.RUnlock()
+
+	// push the logs of the last requests
+	if s.loki != nil {
+		s.loki.Stop()
+	}
 	<-ctx.Done()
 	return nil
 }
 
+// authorizeRequest authenticates the caller of a request to a provider,
+// parses the request with params and checks that the caller is allowed to use
+// the client in the namespace of the request. The request log and the Sentry
+// scope are tagged with them. When ok is false the error response has been
+// written
+func (s *Server) authorizeRequest(w http.ResponseWriter, r *http.Request, provider string, params func() (clientID, grantType string, err error)) (caller *Caller, ns string, logger *logrus.Entry, ok bool) {
+	caller, err := s.authenticate(r)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"provider": provider, "correlation_id": tracing.CorrelationID(r.Context())}).Warnf("caller not authenticated: %s", err)
+		s.ErrorResponse(w, err)
+		return nil, "", nil, false
+	}
+
+	clientID, grantType, err := params()
+	if err != nil {
+		s.ErrorResponse(w, err)
+		return nil, "", nil, false
+	}
+
+	ns, err = namespace(r, caller)
+	if err != nil {
+		s.ErrorResponse(w, err)
+		return nil, "", nil, false
+	}
+	logRequest(r.Context(), func(l *requestLog) {
+		l.grantType = grantType
+		l.clientID = clientID
+	})
+
+	logger = logrus.WithFields(logrus.Fields{"caller": callerName(caller), "namespace": ns, "provider": provider, "client_id": clientID, "correlation_id": tracing.CorrelationID(r.Context())})
+	err = authorize(caller, provider, clientID)
+	if err != nil {
+		logger.Warn(err)
+		s.ErrorResponse(w, err)
+		return nil, "", nil, false
+	}
+
+	sentry.ConfigureScope(func(scope *sentry.Scope) {
+		scope.SetTag("Caller", callerName(caller))
+		scope.SetTag("CorrelationID", tracing.CorrelationID(r.Context()))
+		scope.SetTag("Namespace", ns)
+		scope.SetTag("Provider", provider)
+		scope.SetTag("ClientID", clientID)
+	})
+	return caller, ns, logger, true
+}
+
 func (s *Server) NewProviderTokenHandler(provider providers.Provider) http.HandlerFunc {
 	// - parse json inline
 	// - strip out refresh and access token, grant_type, client_id and
@@ -288,32 +509,33 @@ func (s *Server) NewProviderTokenHandler(provider providers.Provider) http.Handl
 				gwCtx.RequestID, gwCtx.APIID, gwCtx.Stage, gwCtx.HTTP.SourceIP)
 		}
 
-		b, err := httputil.DumpRequest(r, true)
-		logrus.Debug("Server incoming request:")
-		for _, s := range strings.Split(string(b), "\r\n") {
-			logrus.Debug(s)
-		}
-		if err != nil {
-			sentry.CaptureException(err)
-			s.ErrorResponse(w, err)
-			return
-		}
+		var trp providers.TokenRequestParams
+		_, ns, logger, ok := s.authorizeRequest(w, r, provider.Name(), func() (string, string, error) {
+			logrus.WithFields(redact.Request(r)).Debug("Server incoming request")
 
-		trp, err := s.GetTokenRequestParamsFromRequest(r)
-		if err != nil {
-			sentry.CaptureException(err)
-			s.ErrorResponse(w, err)
+			var err error
+			trp, err = s.GetTokenRequestParamsFromRequest(r)
+			if err != nil {
+				sentry.CaptureException(err)
+			}
+			return trp.ClientID, grantTypeLabel(trp), err
+		})
+		if !ok {
 			return
 		}
+		trp.Namespace = ns
+		logger.Info("token request")
 
 		sentry.ConfigureScope(func(scope *sentry.Scope) {
-			scope.SetTag("Provider", provider.Name())
-			scope.SetTag("ClientID", trp.ClientID)
-			scope.SetExtra("ClientSecret", trp.ClientSecret)
-			scope.SetTag("RefreshToken", trp.RefreshToken)
-			scope.SetExtra("Code", trp.Code)
+			scope.SetTag("GrantType", trp.GrantType)
+			// only a hash prefix of the secrets, for correlation
+			scope.SetExtra("ClientSecret", redact.Secret(trp.ClientSecret))
+			scope.SetTag("RefreshToken", redact.Secret(trp.RefreshToken))
+			scope.SetExtra("Code", redact.Secret(trp.Code))
 			scope.SetExtra("RedirectURL", trp.RedirectURL)
-			scope.SetExtra("CodeVerifier", trp.CodeVerifier)
+			scope.SetExtra("Scope", trp.Scope)
+			scope.SetExtra("Audience", trp.Audience)
+			scope.SetExtra("Resource", trp.Resource)
 		})
 
 		// use reqBody.RefreshToken, reqBody.ClientID & reqBody.ClientSecret to
@@ -338,6 +560,16 @@ func (s *Server) NewProviderTokenHandler(provider providers.Provider) http.Handl
 
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 
+		if strings.EqualFold(r.Header.Get(ResponseModeHeader), ResponseModeNative) {
+			native, err := nativeResponseBody(token)
+			if err == nil {
+				rsp.Write(native)
+				logger.WithField("body", string(redact.JSON(native))).Debug("Server outgoing native response")
+				return
+			}
+			logrus.Warnf("couldn't create native response, falling back to normalized response: %s", err)
+		}
+
 		// get the response headers
 		// w.Header().Write(&buf)
 
@@ -350,17 +582,139 @@ func (s *Server) NewProviderTokenHandler(provider providers.Provider) http.Handl
 			RawMessages:  token.Raw,
 		}
 
+		if !token.RefreshTokenExpiry.IsZero() {
+			responseBody.RawMessages["refresh_token_expires_in"], _ = json.Marshal(int(time.Until(token.RefreshTokenExpiry).Seconds()))
+		}
+
+		// granted scope, can be narrower than the requested scope
+		if token.Scope != "" {
+			responseBody.RawMessages["scope"], _ = json.Marshal(token.Scope)
+		}
+
+		// sender-constrained token: the client needs the key to create
+		// its own DPoP proofs for API calls
+		if token.DPoPKey != nil {
+			responseBody.RawMessages["dpop_jkt"], _ = json.Marshal(token.DPoPKey.Thumbprint())
+			responseBody.RawMessages["dpop_jwk"] = token.DPoPKey.PrivateJWK()
+		}
+
 		// stream response body
 		encoder := json.NewEncoder(rsp)
 		encoder.Encode(responseBody)
 
-		logrus.Debug("Server outgoing response:")
-		for _, s := range strings.Split(buf.String(), "\r\n") {
-			logrus.Debug(s)
+		logger.WithField("body", string(redact.JSON(buf.Bytes()))).Debug("Server outgoing response")
+	}
+}
+
+// IdentityRoute returns the route that exposes the identity (id_token claims
+// and userinfo) of a token lineage
+func IdentityRoute(provider providers.Provider) string {
+	return "/" + provider.Name() + "/oauth2/identity"
+}
+
+func (s *Server) NewProviderIdentityHandler(provider providers.Provider) http.HandlerFunc {
+	// - accepts the same request as the token endpoint
+	// - retrieves a valid token (refreshing it if needed)
+	// - returns the stored id_token claims and the (cached) userinfo
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		var trp providers.TokenRequestParams
+		_, ns, logger, ok := s.authorizeRequest(w, r, provider.Name(), func() (string, string, error) {
+			var err error
+			trp, err = s.GetTokenRequestParamsFromRequest(r)
+			if err != nil {
+				sentry.CaptureException(err)
+			}
+			return trp.ClientID, grantTypeLabel(trp), err
+		})
+		if !ok {
+			return
+		}
+		trp.Namespace = ns
+		logger.Info("identity request")
+
+		token, err := s.RequestToken(provider, trp)
+		if err != nil {
+			sentry.CaptureException(err)
+			s.ErrorResponse(w, err)
+			return
+		}
+
+		tr, ok := s.tokenRequester(provider.Name())
+		if !ok {
+			err := errors.Errorf("Token requester for provider %s doesn't exist", provider.Name())
+			sentry.CaptureException(err)
+			s.ErrorResponse(w, err)
+			return
+		}
+
+		identity, err := tr.Identity(token, trp)
+		if err != nil {
+			sentry.CaptureException(err)
+			s.ErrorResponse(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		encoder := json.NewEncoder(w)
+		encoder.Encode(identity)
+	}
+}
+
+// MetadataRoute is the authorization server metadata (RFC 8414) route of the
+// provider
+func MetadataRoute(provider providers.Provider) string {
+	return "/.well-known/oauth-authorization-server/" + provider.Name()
+}
+
+func (s *Server) NewProviderMetadataHandler(provider providers.Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
 		}
+
+		params := providers.TokenRequestParams{OriginalRequest: r}
+		md := providers.Metadata(provider, s.BaseURL(r), params)
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		// the urls depend on the host of the request
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Vary", "Host, X-Forwarded-Host, X-Forwarded-Proto")
+		encoder := json.NewEncoder(w)
+		encoder.Encode(md)
 	}
 }
 
+// BaseURL returns the public url of the proxy: BASE_URL or the scheme and host
+// of the request, taken from the forwarded headers with
+// TRUST_FORWARDED_HEADERS
+func (s *Server) BaseURL(r *http.Request) string {
+	if BASE_URL != "" {
+		return strings.TrimSuffix(BASE_URL, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	if !TRUST_FORWARDED_HEADERS {
+		return scheme + "://" + host
+	}
+
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+	if h := r.Header.Get("X-Forwarded-Host"); h != "" {
+		host = strings.TrimSpace(strings.Split(h, ",")[0])
+	}
+	return scheme + "://" + host
+}
+
 func (s *Server) NewProviderRevokeHandler(provider providers.RevokeProvider) http.HandlerFunc {
 	// - https://datatracker.ietf.org/doc/html/rfc7009
 	// - get token & type from request
@@ -382,21 +736,20 @@ func (s *Server) NewProviderRevokeHandler(provider providers.RevokeProvider) htt
 				gwCtx.RequestID, gwCtx.APIID, gwCtx.Stage, gwCtx.HTTP.SourceIP)
 		}
 
-		b, err := httputil.DumpRequest(r, true)
-		logrus.Debug("Server revoke incoming request:")
-		logrus.Debug(string(b))
-		if err != nil {
-			s.ErrorResponse(w, err)
-			return
-		}
+		var rrp TokenRevokeParams
+		_, ns, logger, ok := s.authorizeRequest(w, r, provider.Name(), func() (string, string, error) {
+			logrus.WithFields(redact.Request(r)).Debug("Server revoke incoming request")
 
-		rrp, err := s.GetTokenRevokeParamsFromRequest(r)
-		if err != nil {
-			s.ErrorResponse(w, err)
+			var err error
+			rrp, err = s.GetTokenRevokeParamsFromRequest(r)
+			return rrp.ClientID, "", err
+		})
+		if !ok {
 			return
 		}
+		rrp.Namespace = ns
 
-		logrus.Debug("Revoking token")
+		logger.Info("Revoking token")
 		resp, err := s.RevokeToken(provider, rrp)
 		if err != nil {
 			s.ErrorResponse(w, err)
@@ -426,10 +779,7 @@ func (s *Server) NewProviderRevokeHandler(provider providers.RevokeProvider) htt
 		// everything went well, make sure to set status code 200
 		w.WriteHeader(http.StatusOK)
 
-		logrus.Debug("Server outgoing response (without headers for now):")
-		for s := range strings.SplitSeq(buf.String(), "\r\n") {
-			logrus.Debug(s)
-		}
+		logger.WithField("body", redact.Body(resp.Header.Get("Content-Type"), buf.Bytes())).Debug("Server outgoing revoke response")
 	}
 }
 
@@ -444,12 +794,21 @@ func (s *Server) NewClient() *http.Client {
 }
 
 func (s *Server) ErrorResponse(w http.ResponseWriter, err error) {
-	w.WriteHeader(http.StatusBadRequest)
+	status, code := http.StatusBadRequest, "invalid_request"
+	cerr := CallerError{}
+	if errors.As(err, &cerr) {
+		status, code = cerr.Status, "access_denied"
+		if status == http.StatusUnauthorized {
+			code = "unauthorized_client"
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
 
 	// fake original oauth token response
 	errorResponse := ErrorResponse{
-		Error:            "invalid_request",
+		Error:            code,
 		ErrorDescription: strings.TrimPrefix(fmt.Sprint(err), "oauth2: "),
 		ErrorURI:         "",
 	}
@@ -463,25 +822,42 @@ func (s *Server) ErrorResponse(w http.ResponseWriter, err error) {
 		logrus.Error(err)
 	}
 
-	logrus.Debug("Server outgoing response (without headers for now):")
-	for _, s := range strings.Split(buf.String(), "\r\n") {
-		logrus.Debug(s)
-	}
+	logrus.WithFields(logrus.Fields{"status": status, "body": buf.String()}).Debug("Server outgoing error response")
 }
 
 func (s *Server) RequestToken(provider providers.Provider, params providers.TokenRequestParams) (*Token, error) {
-	tr, ok := s.tokenRequesters[provider.Name()]
+	tr, ok := s.tokenRequester(provider.Name())
 	if !ok {
 		// this should not happen because all tokenrequesters are loaded when
 		// Server.SetProviders() is called
 		return nil, errors.Errorf("Token requester for provider %s doesn't exist", provider.Name())
 	}
 
+	// reject invalid routing parameters before they end up in a url
+	if tp, ok := provider.(providers.TemplatedProvider); ok {
+		_, err := tp.TemplateVars().Resolve(params)
+		// refreshes can use the values stored at the code exchange
+		terr := providers.TemplateError{}
+		missing := errors.As(err, &terr) && terr.Missing && params.RefreshToken != ""
+		if err != nil && !missing {
+			return nil, err
+		}
+	}
+
 	return tr.Request(params)
 }
 
+func (s *Server) tokenRequester(name string) (*TokenRequester, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tr, ok := s.tokenRequesters[name]
+	return tr, ok
+}
+
 func (s *Server) RevokeToken(provider providers.RevokeProvider, params TokenRevokeParams) (*http.Response, error) {
+	s.mu.RLock()
 	tr, ok := s.tokenRevokers[provider.Name()]
+	s.mu.RUnlock()
 	if !ok {
 		// this should not happen because all tokenrequesters are loaded when
 		// Server.SetProviders() is called
@@ -597,6 +973,9 @@ func (s *Server) GetTokenRequestParamsFromFormRequest(r *http.Request) (provider
 		GrantType:       vals.Get("grant_type"),
 		Username:        vals.Get("username"),
 		Password:        vals.Get("password"),
+		Scope:           providers.NormalizeList(vals["scope"]...),
+		Audience:        providers.NormalizeList(vals["audience"]...),
+		Resource:        providers.NormalizeList(vals["resource"]...),
 		Raw:             raw,
 		OriginalRequest: r,
 	}
@@ -646,7 +1025,31 @@ func (s *Server) GetTokenRequestParamsFromJSONRequest(r *http.Request) (provider
 		GrantType:       reqBody.GrantType,
 		Username:        reqBody.Username,
 		Password:        reqBody.Password,
+		Scope:           providers.NormalizeList(reqBody.Scope...),
+		Audience:        providers.NormalizeList(reqBody.Audience...),
+		Resource:        providers.NormalizeList(reqBody.Resource...),
 		Raw:             reqBody.RawMessages,
 		OriginalRequest: r,
 	}, nil
 }
+
+// nativeResponseBody returns the latest response of the provider with the
+// remaining lifetime of the token as expires_in
+func nativeResponseBody(token *Token) ([]byte, error) {
+	if len(token.Native) == 0 {
+		return nil, errors.New("no provider response stored")
+	}
+
+	var native RawMessages
+	err := json.Unmarshal(token.Native, &native)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	native["expires_in"], err = json.Marshal(int(time.Until(token.Expiry).Seconds()))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	b, err := json.Marshal(native)
+	return append(b, '\n'), errors.WithStack(err)
+}
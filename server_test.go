@@ -0,0 +1,64 @@
+package oauthproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizeRequest(t *testing.T) {
+	s := &Server{callers: testCallers()}
+	params := func(clientID string, err error) func() (string, string, error) {
+		return func() (string, string, error) {
+			return clientID, "refresh_token", err
+		}
+	}
+
+	tests := []struct {
+		name      string
+		key       string
+		route     string
+		params    func() (string, string, error)
+		status    int
+		namespace string
+	}{
+		{"allowed", "billing-key", "", params("client-1", nil), 0, ""},
+		{"namespace of the route", "billing-key", "production", params("client-1", nil), 0, "production"},
+		{"not authenticated", "", "", params("client-1", nil), http.StatusUnauthorized, ""},
+		{"invalid params", "billing-key", "", params("", errors.New("invalid grant_type")), http.StatusBadRequest, ""},
+		{"invalid namespace", "billing-key", "Production", params("client-1", nil), http.StatusBadRequest, ""},
+		{"other client", "billing-key", "", params("client-2", nil), http.StatusForbidden, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/exactonline/oauth2/token", nil)
+			r.SetPathValue("namespace", tt.route)
+			if tt.key != "" {
+				r.Header.Set(APIKeyHeader, tt.key)
+			}
+			w := httptest.NewRecorder()
+
+			caller, ns, logger, ok := s.authorizeRequest(w, r, "exactonline", tt.params)
+			if tt.status != 0 {
+				if ok || w.Code != tt.status {
+					t.Errorf("expected status %d, got %d (ok: %t)", tt.status, w.Code, ok)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("expected the request to be allowed, got %d: %s", w.Code, w.Body)
+			}
+			if caller == nil || caller.Name != "billing" {
+				t.Errorf("expected caller billing, got %v", caller)
+			}
+			if ns != tt.namespace {
+				t.Errorf("expected namespace %q, got %q", tt.namespace, ns)
+			}
+			if logger.Data["client_id"] != "client-1" || logger.Data["caller"] != "billing" {
+				t.Errorf("expected the logger to have the caller and client, got %v", logger.Data)
+			}
+		})
+	}
+}
@@ -2,11 +2,28 @@ package oauthproxy
 
 import (
 	"encoding/json"
+	"time"
 
+	"github.com/omniboost/oauth-proxy/providers"
 	"golang.org/x/oauth2"
 )
 
 type Token struct {
 	*oauth2.Token
+	// Raw is the (normalized) latest response of the provider
 	Raw map[string]json.RawMessage
+	// Native is the latest response of the provider as it was sent
+	Native json.RawMessage
+	// RefreshTokenExpiry is when the refresh token expires, zero when unknown
+	RefreshTokenExpiry time.Time
+	// Scope is the scope granted by the provider
+	Scope string
+	// IDTokenClaims are the claims of the verified id_token, if any
+	IDTokenClaims json.RawMessage
+	// DPoPKey is the key a sender-constrained token is bound to
+	DPoPKey *providers.DPoPKey
+
+	// cached is set when the token was still valid and served from the
+	// database
+	cached bool
 }
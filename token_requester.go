@@ -4,33 +4,53 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
-	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/lytics/logrus"
 	"github.com/omniboost/oauth-proxy/mysql"
 	"github.com/omniboost/oauth-proxy/providers"
+	"github.com/omniboost/oauth-proxy/redact"
+	"github.com/omniboost/oauth-proxy/tracing"
 	"github.com/omniboost/oauth-proxy/types"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2"
 )
 
+var (
+	// OIDC_STRICT_VERIFICATION makes id_token verification fail when there are
+	// no keys to verify it with (JWKS outage without a last known good key
+	// set)
+	OIDC_STRICT_VERIFICATION = os.Getenv("OIDC_STRICT_VERIFICATION") == "true"
+
+	// DEFAULT_TOKEN_LIFETIME is the lifetime of tokens the provider doesn't
+	// return an expiry for (1h by default)
+	DEFAULT_TOKEN_LIFETIME = os.Getenv("DEFAULT_TOKEN_LIFETIME")
+)
+
 func NewTokenRequester(db *sql.DB, provider providers.Provider) *TokenRequester {
 	// Create a new context
 	ctx := context.Background()
 	// Create a new context, with its cancellation function
 	// from the original context
-	// ctx, cancel := context.WithCancel(ctx)
+	ctx, cancel := context.WithCancel(ctx)
 
 	return &TokenRequester{
 		db:       db,
 		provider: provider,
 		requests: make(chan TokenRequest, 2),
 		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
 		// tokenChans: []chan *oauth2.Token{},
 		// errChans:   []chan error{},
 	}
@@ -41,10 +61,25 @@ type TokenRequester struct {
 	provider providers.Provider
 	requests chan TokenRequest
 	ctx      context.Context
+	cancel   context.CancelFunc
+
+	// mu guards stopped: requests are only queued while the requester is
+	// running
+	mu      sync.RWMutex
+	stopped bool
+	started bool
+	done    chan struct{}
+
+	authStyles clientAuthStyles
 }
 
 func (tr *TokenRequester) Start() {
+	tr.mu.Lock()
+	tr.started = true
+	tr.mu.Unlock()
+
 	go func() {
+		defer close(tr.done)
 		tr.Listen()
 	}()
 }
@@ -55,16 +90,17 @@ func (tr *TokenRequester) Listen() {
 	for {
 		select {
 		case request := <-tr.requests:
-			if request.params.Code != "" {
-				token, err := tr.CodeExchange(request)
-				tr.handleResults(request, token, err)
-			} else {
-				token, err := tr.TokenRefresh(request)
-				tr.handleResults(request, token, err)
-			}
+			tr.handle(request)
 		case <-tr.ctx.Done():
-			fmt.Println("done")
-			return
+			// finish the queued requests
+			for {
+				select {
+				case request := <-tr.requests:
+					tr.handle(request)
+				default:
+					return
+				}
+			}
 			// default:
 			// 	fmt.Println("default")
 			// 	return
@@ -72,6 +108,48 @@ func (tr *TokenRequester) Listen() {
 	}
 }
 
+func (tr *TokenRequester) handle(request TokenRequest) {
+	queueDepth.WithLabelValues(tr.provider.Name(), "token").Dec()
+	queueWait.WithLabelValues(tr.provider.Name(), "token").Observe(time.Since(request.queued).Seconds())
+	request.queueSpan.End()
+
+	grantType := grantTypeLabel(request.params)
+	ctx, span := tracing.Start(tr.requestContext(request.params), "token request",
+		attribute.String("oauth_proxy.provider", tr.provider.Name()),
+		attribute.String("oauth_proxy.grant_type", grantType),
+	)
+	// the db queries and provider calls are part of this span
+	if request.params.OriginalRequest != nil {
+		request.params.OriginalRequest = request.params.OriginalRequest.WithContext(ctx)
+	}
+
+	start := time.Now()
+	tr.loadAuthStyle(request.params.ClientID)
+	var token *Token
+	var err error
+	outcome := "refreshed"
+	if request.params.Code != "" {
+		outcome = "exchanged"
+		token, err = tr.CodeExchange(request)
+	} else {
+		token, err = tr.TokenRefresh(request)
+	}
+
+	if err != nil {
+		outcome = "error"
+	} else if token != nil && token.cached {
+		outcome = "cached"
+	}
+	tokenRequests.WithLabelValues(tr.provider.Name(), grantType, outcome).Inc()
+	tokenDuration.WithLabelValues(tr.provider.Name(), grantType).Observe(time.Since(start).Seconds())
+	span.SetAttributes(attribute.String("oauth_proxy.outcome", outcome))
+	tracing.End(span, err)
+	logRequest(ctx, func(l *requestLog) { l.outcome = outcome })
+
+	tr.handleResults(request, token, err)
+	tr.saveAuthStyle(request.params.ClientID)
+}
+
 func (tr *TokenRequester) CodeExchange(req TokenRequest) (*Token, error) {
 	// for this to work the provider has to support the 'Authorization Code'
 	// grant
@@ -82,57 +160,47 @@ func (tr *TokenRequester) CodeExchange(req TokenRequest) (*Token, error) {
 
 	// exchange code for token and save new token in db
 	params := req.params
-	logrus.Debugf("new code exchange request received (%s)", params.Code)
+	tr.logger(params).Debug("new code exchange request received")
 
 	opts := []oauth2.AuthCodeOption{}
 	if params.CodeVerifier != "" {
 		opts = append(opts, oauth2.SetAuthURLParam("code_verifier", params.CodeVerifier))
 	}
 
+	// a new lineage starts: bind it to a new key if the provider requires
+	// DPoP
+	err := tr.ensureDPoPKey(&params)
+	if err != nil {
+		return nil, err
+	}
+
 	// custom http client
-	client := &http.Client{}
-	rt := NewRoundTripperWithSave(http.DefaultTransport)
-	client.Transport = rt
-	ctx := context.WithValue(context.TODO(), oauth2.HTTPClient, client)
+	rt := NewRoundTripperWithSave(newProviderTransport(tr.provider.Name(), "token", grantTypeLabel(params)))
+	client := tr.providerClient(params, rt)
+	ctx := context.WithValue(tr.requestContext(params), oauth2.HTTPClient, client)
 	t, err := provider.Exchange(ctx, params, opts...)
-	token := &Token{Token: t, Raw: map[string]json.RawMessage{}}
+	token := &Token{Token: t, Raw: map[string]json.RawMessage{}, DPoPKey: params.DPoPKey}
 	if err != nil {
-		e := errors.Wrapf(err, "something went wrong exchanging code (%s)", params.Code)
+		e := errors.Wrapf(err, "something went wrong exchanging code (%s)", redact.Secret(params.Code))
 		return token, e
 	}
 
 	// check id token if present
-	idToken, ok := t.Extra("id_token").(string)
-	if ok {
-		if v, ok := provider.(interface {
-			IDTokenVerifier(providers.TokenRequestParams) *oidc.IDTokenVerifier
-		}); ok {
-			_, err := v.IDTokenVerifier(params).Verify(context.Background(), idToken)
-			if err != nil {
-				if strings.Contains(err.Error(), "failed to decode keys") {
-					// do nothing
-				} else {
-					return token, errors.WithStack(err)
-				}
-			}
-		}
+	token.IDTokenClaims, err = tr.VerifyIDToken(t, params)
+	if err != nil {
+		return token, errors.WithStack(err)
 	}
 
-	logrus.Debugf("saving new token to database (%s)", token.RefreshToken)
+	tr.logger(params).Debug("saving new token to database")
 
 	// params.RefreshToken is used for looking up the entry in the mysql. Make sure
 	// it's not empty after a first time code exchange
 	params.RefreshToken = token.RefreshToken
 
-	b, err := io.ReadAll(rt.LastResponseBody())
-	if err != nil {
-		return token, errors.WithStack(err)
-	}
-
 	// Add raw response body to token
-	err = json.Unmarshal(b, &token.Raw)
+	err = tr.setResponseBody(token, rt)
 	if err != nil {
-		return token, errors.WithStack(err)
+		return token, err
 	}
 
 	_, err = tr.SaveAuthorizationToken(tr.db, token, params)
@@ -146,7 +214,7 @@ func (tr *TokenRequester) CodeExchange(req TokenRequest) (*Token, error) {
 func (tr *TokenRequester) IncrementNrOfSubsequentProviderErrors(db mysql.DB, token *mysql.OauthToken) error {
 	token.NrOfSubsequentProviderErrors++
 	token.UpdatedAt = time.Now()
-	return token.Save(context.Background(), db)
+	return token.Save(context.Background(), observeDB(db))
 }
 
 func (tr *TokenRequester) TokenRefreshAuthorizationCode(req TokenRequest) (*Token, error) {
@@ -157,7 +225,7 @@ func (tr *TokenRequester) TokenRefreshAuthorizationCode(req TokenRequest) (*Toke
 		return nil, errors.New("refresh token is empty")
 	}
 
-	logrus.Debugf("new token refresh request received (%s)", params.RefreshToken)
+	tr.logger(params).Debug("new token refresh request received")
 
 	trx, err := tr.db.Begin()
 	if err != nil {
@@ -175,19 +243,19 @@ func (tr *TokenRequester) TokenRefreshAuthorizationCode(req TokenRequest) (*Toke
 	dbToken, err := tr.AuthorizationTokenFromDB(trx, params)
 	if errors.Cause(err) == sql.ErrNoRows {
 		// no results in db: request new token
-		logrus.Debugf("couldn't find refresh token in database, requesting new token (%s)", params.RefreshToken)
+		tr.logger(params).Debug("couldn't find refresh token in database, requesting new token")
 		token, err = tr.fetchAndSaveNewAuthorizationToken(trx, params)
 		if err != nil {
 			return token, errors.WithStack(err)
 		}
 
-		logrus.Debugf("sending new token to requester (%s)", params.RefreshToken)
+		tr.logger(params).Debug("sending new token to requester")
 		return token, errors.WithStack(err)
 	} else if err != nil {
-		e := errors.Wrapf(err, "error retrieving token from database (%s): %s", params.RefreshToken, err)
+		e := errors.Wrapf(err, "error retrieving token from database (%s): %s", redact.Secret(params.RefreshToken), err)
 		return token, e
 	} else {
-		logrus.Debugf("found existing token in database (%s)", params.RefreshToken)
+		tr.logger(params).WithField("lineage_id", dbToken.ID).Debug("found existing token in database")
 	}
 
 	// existing token, check if still valid
@@ -198,19 +266,16 @@ func (tr *TokenRequester) TokenRefreshAuthorizationCode(req TokenRequest) (*Toke
 
 	if token.Valid() {
 		// token is valid, use that
-		logrus.Debugf("token valid until: %s", token.Expiry.String())
-		logrus.Debugf("sending existing token to requester (%s)", params.RefreshToken)
+		tr.logger(params).Debugf("token valid until: %s", token.Expiry.String())
+		tr.logger(params).Debug("sending existing token to requester")
+		token.cached = true
 		return token, errors.WithStack(err)
 	}
 
-	logrus.Debugf("token (%s) isn't valid anymore, fetching new token", params.RefreshToken)
-	logrus.Debugf("using latest refresh token (%s) to request new token", params.RefreshToken)
+	tr.logger(params).Debug("token isn't valid anymore, fetching new token")
+	tr.logger(params).Debug("using latest refresh token to request new token")
 
-	params.RefreshToken = token.RefreshToken
-	// if now code_verifier is sent, use the one used last time
-	if params.CodeVerifier == "" && dbToken.CodeVerifier != "" {
-		params.CodeVerifier = dbToken.CodeVerifier
-	}
+	params = tr.refreshParams(params, token, dbToken)
 	token, err = tr.fetchAndSaveNewAuthorizationToken(trx, params)
 	if err != nil {
 		// check if we could find the token from the request in the db
@@ -226,7 +291,7 @@ func (tr *TokenRequester) TokenRefreshAuthorizationCode(req TokenRequest) (*Toke
 	}
 
 	// existing token, not valid
-	logrus.Debugf("sending new token to requester (%s)", params.RefreshToken)
+	tr.logger(params).Debug("sending new token to requester")
 	return token, errors.WithStack(err)
 }
 
@@ -250,7 +315,7 @@ func (tr *TokenRequester) TokenRefreshPassword(req TokenRequest) (*Token, error)
 		return nil, errors.New("password is empty")
 	}
 
-	logrus.Debugf("new password token refresh request received (%s)", params.Username)
+	tr.logger(params).Debug("new password token refresh request received")
 
 	trx, err := tr.db.Begin()
 	if err != nil {
@@ -268,19 +333,19 @@ func (tr *TokenRequester) TokenRefreshPassword(req TokenRequest) (*Token, error)
 	dbToken, err := tr.PasswordTokenFromDB(trx, params)
 	if errors.Cause(err) == sql.ErrNoRows {
 		// no results in db: request new token
-		logrus.Debugf("couldn't find refresh token in database, requesting new token (%s)", params.Username)
+		tr.logger(params).Debug("couldn't find refresh token in database, requesting new token")
 		token, err = tr.fetchAndSaveNewPasswordToken(trx, params)
 		if err != nil {
 			return token, errors.WithStack(err)
 		}
 
-		logrus.Debugf("sending new token to requester (%s)", params.RefreshToken)
+		tr.logger(params).Debug("sending new token to requester")
 		return token, errors.WithStack(err)
 	} else if err != nil {
 		e := errors.Wrapf(err, "error retrieving token from database (%s): %s", params.Username, err)
 		return token, e
 	} else {
-		logrus.Debugf("found existing token in database (%s)", params.RefreshToken)
+		tr.logger(params).WithField("lineage_id", dbToken.ID).Debug("found existing token in database")
 	}
 
 	// existing token, check if still valid
@@ -291,19 +356,16 @@ func (tr *TokenRequester) TokenRefreshPassword(req TokenRequest) (*Token, error)
 
 	if token.Valid() {
 		// token is valid, use that
-		logrus.Debugf("token valid until: %s", token.Expiry.String())
-		logrus.Debugf("sending existing token to requester (%s)", params.Username)
+		tr.logger(params).Debugf("token valid until: %s", token.Expiry.String())
+		tr.logger(params).Debug("sending existing token to requester")
+		token.cached = true
 		return token, errors.WithStack(err)
 	}
 
-	logrus.Debugf("token (%s) isn't valid anymore, fetching new token", params.Username)
-	logrus.Debugf("using latest refresh token (%s) to request new token", params.Username)
+	tr.logger(params).Debug("token isn't valid anymore, fetching new token")
+	tr.logger(params).Debug("using latest refresh token to request new token")
 
-	params.RefreshToken = token.RefreshToken
-	// if now code_verifier is sent, use the one used last time
-	if params.CodeVerifier == "" && dbToken.CodeVerifier != "" {
-		params.CodeVerifier = dbToken.CodeVerifier
-	}
+	params = tr.refreshParams(params, token, dbToken)
 	token, err = tr.fetchAndSaveNewPasswordToken(trx, params)
 	if err != nil {
 		// check if we could find the token from the request in the db
@@ -319,7 +381,7 @@ func (tr *TokenRequester) TokenRefreshPassword(req TokenRequest) (*Token, error)
 	}
 
 	// existing token, not valid
-	logrus.Debugf("sending new token to requester (%s)", params.Username)
+	tr.logger(params).Debug("sending new token to requester")
 	return token, errors.WithStack(err)
 }
 
@@ -328,7 +390,7 @@ func (tr *TokenRequester) TokenRefreshClientCredentials(req TokenRequest) (*Toke
 	token := &Token{}
 	params := req.params
 
-	logrus.Debugf("new client_credentials token refresh request received (%s:%s)", params.ClientID, params.ClientSecret)
+	tr.logger(params).Debug("new client_credentials token refresh request received")
 
 	trx, err := tr.db.Begin()
 	if err != nil {
@@ -346,19 +408,19 @@ func (tr *TokenRequester) TokenRefreshClientCredentials(req TokenRequest) (*Toke
 	dbToken, err := tr.ClientCredentialsTokenFromDB(trx, params)
 	if errors.Cause(err) == sql.ErrNoRows {
 		// no results in db: request new token
-		logrus.Debugf("couldn't find access token in database, requesting new token")
+		tr.logger(params).Debug("couldn't find access token in database, requesting new token")
 		token, err = tr.fetchAndSaveNewClientCredentialsToken(trx, params)
 		if err != nil {
 			return token, errors.WithStack(err)
 		}
 
-		logrus.Debugf("sending new token to requester (%s)", token.AccessToken)
+		tr.logger(params).Debug("sending new token to requester")
 		return token, errors.WithStack(err)
 	} else if err != nil {
 		e := errors.Wrapf(err, "error retrieving token from database: %s", err)
 		return token, e
 	} else {
-		logrus.Debugf("found existing token in database (%s)", dbToken.AccessToken)
+		tr.logger(params).WithField("lineage_id", dbToken.ID).Debug("found existing token in database")
 	}
 
 	// existing token, check if still valid
@@ -369,18 +431,15 @@ func (tr *TokenRequester) TokenRefreshClientCredentials(req TokenRequest) (*Toke
 
 	if token.Valid() {
 		// token is valid, use that
-		logrus.Debugf("token valid until: %s", token.Expiry.String())
-		logrus.Debugf("sending existing token to requester (%s)", token.AccessToken)
+		tr.logger(params).Debugf("token valid until: %s", token.Expiry.String())
+		tr.logger(params).Debug("sending existing token to requester")
+		token.cached = true
 		return token, errors.WithStack(err)
 	}
 
-	logrus.Debugf("token (%s) isn't valid anymore, fetching new token", token.AccessToken)
+	tr.logger(params).Debug("token isn't valid anymore, fetching new token")
 
-	params.RefreshToken = token.RefreshToken
-	// if now code_verifier is sent, use the one used last time
-	if params.CodeVerifier == "" && dbToken.CodeVerifier != "" {
-		params.CodeVerifier = dbToken.CodeVerifier
-	}
+	params = tr.refreshParams(params, token, dbToken)
 	token, err = tr.fetchAndSaveNewClientCredentialsToken(trx, params)
 	if err != nil {
 		// check if we could find the token from the request in the db
@@ -396,17 +455,39 @@ func (tr *TokenRequester) TokenRefreshClientCredentials(req TokenRequest) (*Toke
 	}
 
 	// existing token, not valid
-	logrus.Debugf("sending new token to requester (%s)", params.Username)
+	tr.logger(params).Debug("sending new token to requester")
 	return token, errors.WithStack(err)
 }
 
+// Stop stops accepting requests and blocks until the queued requests are
+// handled
 func (tr *TokenRequester) Stop() {
-	// ??
+	tr.mu.Lock()
+	if tr.stopped {
+		tr.mu.Unlock()
+		return
+	}
+	tr.stopped = true
+	started := tr.started
+	tr.mu.Unlock()
+
+	tr.cancel()
+	if started {
+		<-tr.done
+	}
 }
 
 func (tr *TokenRequester) Request(params providers.TokenRequestParams) (*Token, error) {
 	request := tr.NewTokenRequest(params)
+
+	tr.mu.RLock()
+	if tr.stopped {
+		tr.mu.RUnlock()
+		return nil, errors.Errorf("token requester for provider %s is stopped", tr.provider.Name())
+	}
+	queueDepth.WithLabelValues(tr.provider.Name(), "token").Inc()
 	tr.requests <- request
+	tr.mu.RUnlock()
 
 	// block on both channels
 	result := <-request.result
@@ -415,114 +496,105 @@ func (tr *TokenRequester) Request(params providers.TokenRequestParams) (*Token,
 }
 
 func (tr *TokenRequester) NewTokenRequest(params providers.TokenRequestParams) TokenRequest {
+	_, span := tracing.Start(tr.requestContext(params), "token queue wait",
+		attribute.String("oauth_proxy.provider", tr.provider.Name()),
+	)
 	return TokenRequest{
-		params: params,
-		result: make(chan TokenRequestResult, 1),
+		params:    params,
+		queued:    time.Now(),
+		queueSpan: span,
+		result:    make(chan TokenRequestResult, 1),
 	}
 }
 
-func (tr *TokenRequester) FetchNewTokenAuthorizationCode(params providers.TokenRequestParams) (*oauth2.Token, error) {
+func (tr *TokenRequester) FetchNewTokenAuthorizationCode(params providers.TokenRequestParams, rtp http.RoundTripper) (*oauth2.Token, error) {
 	prov, ok := tr.provider.(providers.AuthorizationCodeProvider)
 	if !ok {
 		return nil, errors.Errorf("Provider '%s' doesn't support authorization code grant", tr.provider.Name())
 	}
 
 	// retrieve new token
-	logrus.Debugf("requesting new token with the following params :%+v", params)
-	token, err := prov.TokenSourceAuthorizationCode(context.Background(), params).Token()
-	if err != nil {
-		return token, errors.WithStack(err)
-	}
-
-	// verify id_token
-	err = tr.VerifyIDToken(token, params)
-	if err != nil {
-		return token, errors.WithStack(err)
-	}
-
-	return token, nil
+	tr.logger(params).Debug("requesting new token")
+	ctx := context.WithValue(tr.requestContext(params), oauth2.HTTPClient, tr.providerClient(params, rtp))
+	token, err := prov.TokenSourceAuthorizationCode(ctx, params).Token()
+	return token, errors.WithStack(err)
 }
 
-func (tr *TokenRequester) FetchNewTokenPassword(params providers.TokenRequestParams) (*oauth2.Token, error) {
+func (tr *TokenRequester) FetchNewTokenPassword(params providers.TokenRequestParams, rtp http.RoundTripper) (*oauth2.Token, error) {
 	prov, ok := tr.provider.(providers.PasswordProvider)
 	if !ok {
 		return nil, errors.Errorf("Provider '%s' doesn't support password grant", tr.provider.Name())
 	}
 
 	// retrieve new token
-	logrus.Debugf("requesting new token with the following params :%+v", params)
-	token, err := prov.TokenSourcePassword(context.Background(), params).Token()
-	if err != nil {
-		return token, errors.WithStack(err)
-	}
-
-	// verify id_token
-	err = tr.VerifyIDToken(token, params)
-	if err != nil {
-		return token, errors.WithStack(err)
-	}
-
-	return token, nil
+	tr.logger(params).Debug("requesting new token")
+	ctx := context.WithValue(tr.requestContext(params), oauth2.HTTPClient, tr.providerClient(params, rtp))
+	token, err := prov.TokenSourcePassword(ctx, params).Token()
+	return token, errors.WithStack(err)
 }
 
-func (tr *TokenRequester) FetchNewTokenClientCredentials(params providers.TokenRequestParams) (*oauth2.Token, error) {
+func (tr *TokenRequester) FetchNewTokenClientCredentials(params providers.TokenRequestParams, rtp http.RoundTripper) (*oauth2.Token, error) {
 	prov, ok := tr.provider.(providers.ClientCredentialsProvider)
 	if !ok {
 		return nil, errors.Errorf("Provider '%s' doesn't support client credentials grant", tr.provider.Name())
 	}
 
 	// retrieve new token
-	logrus.Debugf("requesting new token with the following params :%+v", params)
-	token, err := prov.TokenSourceClientCredentials(context.Background(), params).Token()
-	if err != nil {
-		return token, errors.WithStack(err)
-	}
-
-	// verify id_token
-	err = tr.VerifyIDToken(token, params)
-	if err != nil {
-		return token, errors.WithStack(err)
-	}
-
-	return token, nil
+	tr.logger(params).Debug("requesting new token")
+	ctx := context.WithValue(tr.requestContext(params), oauth2.HTTPClient, tr.providerClient(params, rtp))
+	token, err := prov.TokenSourceClientCredentials(ctx, params).Token()
+	return token, errors.WithStack(err)
 }
 
-func (tr *TokenRequester) VerifyIDToken(token *oauth2.Token, params providers.TokenRequestParams) error {
+// VerifyIDToken verifies the id_token if present and returns its claims. No
+// claims are returned when there's no id_token or it couldn't be verified
+func (tr *TokenRequester) VerifyIDToken(token *oauth2.Token, params providers.TokenRequestParams) (json.RawMessage, error) {
 	// check id token if present
 	idToken, ok := token.Extra("id_token").(string)
-	if ok {
-		if v, ok := tr.provider.(interface {
-			IDTokenVerifier(providers.TokenRequestParams) *oidc.IDTokenVerifier
-		}); ok {
-			_, err := v.IDTokenVerifier(params).Verify(context.Background(), idToken)
-			if err != nil {
-				if strings.Contains(err.Error(), "failed to decode keys") {
-					// do nothing
-				} else {
-					return errors.WithStack(err)
-				}
-			}
+	if !ok {
+		return nil, nil
+	}
+
+	v, ok := tr.provider.(interface {
+		IDTokenVerifier(providers.TokenRequestParams) *oidc.IDTokenVerifier
+	})
+	if !ok {
+		return nil, nil
+	}
+
+	t, err := providers.VerifyIDToken(tr.requestContext(params), v.IDTokenVerifier(params), idToken)
+	if err != nil {
+		// without any keys the id_token can't be verified, only fail on that
+		// in strict mode
+		if !OIDC_STRICT_VERIFICATION && errors.Is(err, providers.ErrKeySetUnavailable) {
+			tr.logger(params).Warnf("couldn't verify id_token: %s", err)
+			return nil, nil
 		}
+		return nil, errors.WithStack(err)
 	}
 
-	return nil
+	claims := json.RawMessage{}
+	err = t.Claims(&claims)
+	return claims, errors.WithStack(err)
 }
 
 func (tr *TokenRequester) AuthorizationTokenFromDB(db mysql.DB, params providers.TokenRequestParams) (*mysql.OauthToken, error) {
 	// first check if there's an entry with the current refresh token
-	dbToken, err := mysql.OauthTokenByAppClientIDClientSecretRefreshTokenOrOriginalRefreshToken(context.Background(), db, tr.provider.Name(), params.ClientID, params.ClientSecret, params.RefreshToken)
+	// scope isn't part of the lookup: a refresh token is a single lineage
+	// and splitting it up per scope would break refresh token rotation
+	dbToken, err := mysql.OauthTokenByAppClientIDClientSecretRefreshTokenOrOriginalRefreshToken(tr.requestContext(params), observeDB(db), tr.provider.Name(), params.Namespace, params.ClientID, params.ClientSecret, params.RefreshToken)
 	return dbToken, errors.WithStack(err)
 }
 
 func (tr *TokenRequester) PasswordTokenFromDB(db mysql.DB, params providers.TokenRequestParams) (*mysql.OauthToken, error) {
 	// first check if there's an entry with the current refresh token
-	dbToken, err := mysql.OauthTokenByAppClientIDClientSecretUsername(context.Background(), db, tr.provider.Name(), params.ClientID, params.ClientSecret, params.Username)
+	dbToken, err := mysql.OauthTokenByAppClientIDClientSecretUsernameScope(tr.requestContext(params), observeDB(db), tr.provider.Name(), params.Namespace, params.ClientID, params.ClientSecret, params.Username, params.Scope, params.Audience, params.Resource)
 	return dbToken, errors.WithStack(err)
 }
 
 func (tr *TokenRequester) ClientCredentialsTokenFromDB(db mysql.DB, params providers.TokenRequestParams) (*mysql.OauthToken, error) {
 	// first check if there's an entry with the current refresh token
-	dbToken, err := mysql.OauthTokenByAppClientIDClientSecret(context.Background(), db, tr.provider.Name(), params.ClientID, params.ClientSecret)
+	dbToken, err := mysql.OauthTokenByAppClientIDClientSecretScope(tr.requestContext(params), observeDB(db), tr.provider.Name(), params.Namespace, params.ClientID, params.ClientSecret, params.Scope, params.Audience, params.Resource)
 	return dbToken, errors.WithStack(err)
 }
 
@@ -536,14 +608,43 @@ func (tr *TokenRequester) DBTokenToOauth2Token(dbToken *mysql.OauthToken) (*Toke
 			RefreshToken: string(dbToken.RefreshToken),
 			Expiry:       dbToken.ExpiresAt.Time,
 		},
-		Raw: map[string]json.RawMessage{},
+		Raw:   map[string]json.RawMessage{},
+		Scope: dbToken.GrantedScope,
 	}
 
-	if dbToken.CodeExchangeResponseBody == "" {
-		token.Raw = map[string]json.RawMessage{}
-	} else {
-		err = json.Unmarshal([]byte(dbToken.CodeExchangeResponseBody), &token.Raw)
+	if dbToken.RefreshTokenExpiresAt.Valid {
+		token.RefreshTokenExpiry = dbToken.RefreshTokenExpiresAt.Time
+	}
+
+	if dbToken.IDTokenClaims != "" {
+		token.IDTokenClaims = json.RawMessage(dbToken.IDTokenClaims)
+	}
+
+	if dbToken.DPoPKey != "" {
+		token.DPoPKey, err = providers.ParseDPoPKey(string(dbToken.DPoPKey))
+		if err != nil {
+			return token, errors.WithStack(err)
+		}
 	}
+
+	// rows from before the latest response was stored only have the
+	// response of the code exchange
+	b := []byte(dbToken.LastResponseBody)
+	if len(b) == 0 {
+		b = []byte(dbToken.CodeExchangeResponseBody)
+	}
+	if len(b) == 0 {
+		return token, nil
+	}
+
+	token.Native = json.RawMessage(b)
+	// the response is stored as the provider sent it, the quirks don't
+	// depend on the request when normalizing
+	b, err = providers.QuirksFor(tr.provider, providers.TokenRequestParams{}).NormalizeResponse(b)
+	if err != nil {
+		return token, err
+	}
+	err = json.Unmarshal(b, &token.Raw)
 	return token, errors.WithStack(err)
 }
 
@@ -568,6 +669,7 @@ func (tr *TokenRequester) SaveAuthorizationToken(db mysql.DB, token *Token, para
 		if errors.Cause(err) == sql.ErrNoRows {
 			dbToken = &mysql.OauthToken{
 				App:                          tr.provider.Name(),
+				Namespace:                    params.Namespace,
 				Type:                         token.Type(),
 				GrantType:                    params.GrantType,
 				ClientID:                     params.ClientID,
@@ -580,33 +682,16 @@ func (tr *TokenRequester) SaveAuthorizationToken(db mysql.DB, token *Token, para
 				CodeExchangeResponseBody:     types.OptionallyEncryptedString(b),
 				CodeVerifier:                 params.CodeVerifier,
 				NrOfSubsequentProviderErrors: 0,
+				Scope:                        params.Scope,
+				Audience:                     params.Audience,
+				Resource:                     params.Resource,
 			}
 		} else {
 			return mysql.OauthToken{}, errors.WithStack(err)
 		}
 	}
 
-	if dbToken.ID != 0 {
-		logrus.Debugf("found and existing token with id %d", dbToken.ID)
-	} else {
-		logrus.Debugf("New token")
-	}
-
-	// Cockpit workaround
-	e := token.Extra("expires")
-	secs, ok := e.(float64)
-	if token.Expiry.IsZero() && ok {
-		token.Expiry = time.Now().Add(time.Duration(secs) * time.Second)
-	}
-
-	// update only changes
-	dbToken.RefreshToken = types.OptionallyEncryptedString(token.RefreshToken)
-	dbToken.RefreshTokenHash = mysql.NewRefreshTokenHash(dbToken.ClientID, token.RefreshToken)
-	dbToken.AccessToken = types.OptionallyEncryptedString(token.AccessToken)
-	dbToken.AccessTokenHash = mysql.NewAccessTokenHash(dbToken.ClientID, token.AccessToken)
-	dbToken.ExpiresAt = sql.NullTime{Time: token.Expiry, Valid: true}
-	dbToken.UpdatedAt = time.Now()
-	return *dbToken, dbToken.Save(context.Background(), db)
+	return tr.saveDBToken(db, dbToken, token, params)
 }
 
 func (tr *TokenRequester) SavePasswordToken(db mysql.DB, token *Token, params providers.TokenRequestParams) (mysql.OauthToken, error) {
@@ -630,6 +715,7 @@ func (tr *TokenRequester) SavePasswordToken(db mysql.DB, token *Token, params pr
 		if errors.Cause(err) == sql.ErrNoRows {
 			dbToken = &mysql.OauthToken{
 				App:                      tr.provider.Name(),
+				Namespace:                params.Namespace,
 				Type:                     token.Type(),
 				GrantType:                params.GrantType,
 				ClientID:                 params.ClientID,
@@ -641,33 +727,16 @@ func (tr *TokenRequester) SavePasswordToken(db mysql.DB, token *Token, params pr
 				CreatedAt:                time.Now(),
 				CodeExchangeResponseBody: types.OptionallyEncryptedString(b),
 				CodeVerifier:             params.CodeVerifier,
+				Scope:                    params.Scope,
+				Audience:                 params.Audience,
+				Resource:                 params.Resource,
 			}
 		} else {
 			return mysql.OauthToken{}, errors.WithStack(err)
 		}
 	}
 
-	if dbToken.ID != 0 {
-		logrus.Debugf("found and existing token with id %d", dbToken.ID)
-	} else {
-		logrus.Debugf("New token")
-	}
-
-	// Cockpit workaround
-	e := token.Extra("expires")
-	secs, ok := e.(float64)
-	if token.Expiry.IsZero() && ok {
-		token.Expiry = time.Now().Add(time.Duration(secs) * time.Second)
-	}
-
-	// update only changes
-	dbToken.RefreshToken = types.OptionallyEncryptedString(token.RefreshToken)
-	dbToken.RefreshTokenHash = mysql.NewRefreshTokenHash(dbToken.ClientID, token.RefreshToken)
-	dbToken.AccessToken = types.OptionallyEncryptedString(token.AccessToken)
-	dbToken.AccessTokenHash = mysql.NewAccessTokenHash(dbToken.ClientID, token.AccessToken)
-	dbToken.ExpiresAt = sql.NullTime{Time: token.Expiry, Valid: true}
-	dbToken.UpdatedAt = time.Now()
-	return *dbToken, dbToken.Save(context.Background(), db)
+	return tr.saveDBToken(db, dbToken, token, params)
 }
 
 func (tr *TokenRequester) SaveClientCredentialsToken(db mysql.DB, token *Token, params providers.TokenRequestParams) (mysql.OauthToken, error) {
@@ -685,6 +754,7 @@ func (tr *TokenRequester) SaveClientCredentialsToken(db mysql.DB, token *Token,
 		if errors.Cause(err) == sql.ErrNoRows {
 			dbToken = &mysql.OauthToken{
 				App:                      tr.provider.Name(),
+				Namespace:                params.Namespace,
 				Type:                     token.Type(),
 				GrantType:                params.GrantType,
 				ClientID:                 params.ClientID,
@@ -696,33 +766,120 @@ func (tr *TokenRequester) SaveClientCredentialsToken(db mysql.DB, token *Token,
 				CreatedAt:                time.Now(),
 				CodeExchangeResponseBody: types.OptionallyEncryptedString(b),
 				CodeVerifier:             params.CodeVerifier,
+				Scope:                    params.Scope,
+				Audience:                 params.Audience,
+				Resource:                 params.Resource,
 			}
 		} else {
 			return mysql.OauthToken{}, errors.WithStack(err)
 		}
 	}
 
-	if dbToken.ID != 0 {
-		logrus.Debugf("found and existing token with id %d", dbToken.ID)
-	} else {
-		logrus.Debugf("New token")
+	return tr.saveDBToken(db, dbToken, token, params)
+}
+
+// providerClient returns the http client used to call the provider's token
+// endpoint
+func (tr *TokenRequester) providerClient(params providers.TokenRequestParams, rtp http.RoundTripper) *http.Client {
+	if q := providers.QuirksFor(tr.provider, params); !q.IsZero() {
+		rtp = providers.NewQuirksRoundTripper(rtp, q)
 	}
+	rtp = tr.clientAuthRoundTripper(params, rtp)
 
-	// Cockpit workaround
-	e := token.Extra("expires")
-	secs, ok := e.(float64)
-	if token.Expiry.IsZero() && ok {
-		token.Expiry = time.Now().Add(time.Duration(secs) * time.Second)
+	vals := url.Values{}
+	if params.Scope != "" {
+		vals.Set("scope", params.Scope)
+	}
+	// audience and resource (RFC 8707) can be repeated
+	for _, v := range strings.Fields(params.Audience) {
+		vals.Add("audience", v)
+	}
+	for _, v := range strings.Fields(params.Resource) {
+		vals.Add("resource", v)
+	}
+	if len(vals) > 0 {
+		p := providers.NewAdditionalParamsRoundTripper(rtp)
+		p.Params = vals
+		rtp = p
 	}
 
-	// update only changes
-	dbToken.RefreshToken = types.OptionallyEncryptedString(token.RefreshToken)
-	dbToken.RefreshTokenHash = mysql.NewRefreshTokenHash(dbToken.ClientID, token.RefreshToken)
-	dbToken.AccessToken = types.OptionallyEncryptedString(token.AccessToken)
-	dbToken.AccessTokenHash = mysql.NewAccessTokenHash(dbToken.ClientID, token.AccessToken)
-	dbToken.ExpiresAt = sql.NullTime{Time: token.Expiry, Valid: true}
-	dbToken.UpdatedAt = time.Now()
-	return *dbToken, dbToken.Save(context.Background(), db)
+	if params.DPoPKey != nil {
+		rtp = providers.NewDPoPRoundTripper(rtp, params.DPoPKey)
+	}
+	return &http.Client{Transport: rtp}
+}
+
+// grantedScope returns the scope the provider granted. When the provider
+// doesn't return a scope, the requested scope was granted (RFC 6749 5.1)
+func (tr *TokenRequester) grantedScope(token *Token, dbToken *mysql.OauthToken) string {
+	if s, ok := token.Extra("scope").(string); ok && s != "" {
+		return providers.NormalizeList(s)
+	}
+	return dbToken.Scope
+}
+
+// logger returns a logger with the fields of the request, secrets are
+// redacted
+func (tr *TokenRequester) logger(params providers.TokenRequestParams) *logrus.Entry {
+	fields := logrus.Fields{
+		"provider":   tr.provider.Name(),
+		"client_id":  params.ClientID,
+		"grant_type": params.GrantType,
+	}
+	if params.Namespace != "" {
+		fields["namespace"] = params.Namespace
+	}
+	if params.Username != "" {
+		fields["username"] = params.Username
+	}
+	if params.RefreshToken != "" {
+		fields["refresh_token"] = redact.Secret(params.RefreshToken)
+	}
+	if id := tracing.CorrelationID(tr.requestContext(params)); id != "" {
+		fields["correlation_id"] = id
+	}
+	return logrus.WithFields(fields)
+}
+
+// requestContext returns the context of the request the params belong to
+// (for the trace and correlation id). It isn't canceled when the caller goes
+// away: a token that's refreshed at the provider has to be saved
+func (tr *TokenRequester) requestContext(params providers.TokenRequestParams) context.Context {
+	if params.OriginalRequest == nil {
+		return context.Background()
+	}
+	return context.WithoutCancel(params.OriginalRequest.Context())
+}
+
+// grantTypeLabel is the grant type of a request as it's used in the metrics
+func grantTypeLabel(params providers.TokenRequestParams) string {
+	switch {
+	case params.Code != "":
+		return "authorization_code"
+	case params.GrantType == "password", params.GrantType == "client_credentials":
+		return params.GrantType
+	}
+	return "refresh_token"
+}
+
+// ensureDPoPKey generates a new DPoP key when the provider requires
+// sender-constrained tokens and the lineage isn't bound to a key yet
+func (tr *TokenRequester) ensureDPoPKey(params *providers.TokenRequestParams) error {
+	if params.DPoPKey != nil {
+		return nil
+	}
+
+	p, ok := tr.provider.(providers.DPoPProvider)
+	if !ok || !p.DPoP() {
+		return nil
+	}
+
+	key, err := providers.NewDPoPKey()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	params.DPoPKey = key
+	return nil
 }
 
 func (tr *TokenRequester) handleResults(request TokenRequest, token *Token, err error) {
@@ -734,17 +891,37 @@ func (tr *TokenRequester) handleResults(request TokenRequest, token *Token, err
 }
 
 func (tr *TokenRequester) fetchAndSaveNewAuthorizationToken(db mysql.DB, params providers.TokenRequestParams) (*Token, error) {
-	t, err := tr.FetchNewTokenAuthorizationCode(params)
-	token := &Token{Token: t, Raw: map[string]json.RawMessage{}}
+	err := tr.ensureDPoPKey(&params)
+	if err != nil {
+		return nil, err
+	}
+
+	rt := NewRoundTripperWithSave(newProviderTransport(tr.provider.Name(), "token", grantTypeLabel(params)))
+	t, err := tr.FetchNewTokenAuthorizationCode(params, rt)
+	token := &Token{Token: t, Raw: map[string]json.RawMessage{}, DPoPKey: params.DPoPKey}
+	if err != nil {
+		e := errors.Wrapf(err, "something went wrong fetching new token (%s): %s", redact.Secret(params.RefreshToken), err)
+		return token, e
+	}
+
+	// verify id_token
+	token.IDTokenClaims, err = tr.VerifyIDToken(t, params)
 	if err != nil {
-		e := errors.Wrapf(err, "something went wrong fetching new token (%s): %s", params.RefreshToken, err)
+		e := errors.Wrapf(err, "something went wrong verifying the id_token: %s", err)
 		return token, e
 	}
 
-	logrus.Debugf("saving new token to database (%s)", params.RefreshToken)
+	// keep the latest response of the provider, not all fields end up in
+	// oauth2.Token
+	err = tr.setResponseBody(token, rt)
+	if err != nil {
+		tr.logger(params).Warnf("couldn't read token response: %s", err)
+	}
+
+	tr.logger(params).Debug("saving new token to database")
 	_, err = tr.SaveAuthorizationToken(db, token, params)
 	if err != nil {
-		e := errors.Wrapf(err, "something went wrong saving a new token to the database (%s): %s", params.RefreshToken, err)
+		e := errors.Wrapf(err, "something went wrong saving a new token to the database (%s): %s", redact.Secret(params.RefreshToken), err)
 		return token, e
 	}
 
@@ -752,14 +929,34 @@ func (tr *TokenRequester) fetchAndSaveNewAuthorizationToken(db mysql.DB, params
 }
 
 func (tr *TokenRequester) fetchAndSaveNewPasswordToken(db mysql.DB, params providers.TokenRequestParams) (*Token, error) {
-	t, err := tr.FetchNewTokenPassword(params)
-	token := &Token{Token: t, Raw: map[string]json.RawMessage{}}
+	err := tr.ensureDPoPKey(&params)
+	if err != nil {
+		return nil, err
+	}
+
+	rt := NewRoundTripperWithSave(newProviderTransport(tr.provider.Name(), "token", grantTypeLabel(params)))
+	t, err := tr.FetchNewTokenPassword(params, rt)
+	token := &Token{Token: t, Raw: map[string]json.RawMessage{}, DPoPKey: params.DPoPKey}
 	if err != nil {
 		e := errors.Wrapf(err, "something went wrong fetching new token (%s): %s", params.Username, err)
 		return token, e
 	}
 
-	logrus.Debugf("saving new token to database (%s)", params.Username)
+	// verify id_token
+	token.IDTokenClaims, err = tr.VerifyIDToken(t, params)
+	if err != nil {
+		e := errors.Wrapf(err, "something went wrong verifying the id_token: %s", err)
+		return token, e
+	}
+
+	// keep the latest response of the provider, not all fields end up in
+	// oauth2.Token
+	err = tr.setResponseBody(token, rt)
+	if err != nil {
+		tr.logger(params).Warnf("couldn't read token response: %s", err)
+	}
+
+	tr.logger(params).Debug("saving new token to database")
 	_, err = tr.SavePasswordToken(db, token, params)
 	if err != nil {
 		e := errors.Wrapf(err, "something went wrong saving a new token to the database (%s): %s", params.Username, err)
@@ -770,17 +967,37 @@ func (tr *TokenRequester) fetchAndSaveNewPasswordToken(db mysql.DB, params provi
 }
 
 func (tr *TokenRequester) fetchAndSaveNewClientCredentialsToken(db mysql.DB, params providers.TokenRequestParams) (*Token, error) {
-	t, err := tr.FetchNewTokenClientCredentials(params)
-	token := &Token{Token: t, Raw: map[string]json.RawMessage{}}
+	err := tr.ensureDPoPKey(&params)
+	if err != nil {
+		return nil, err
+	}
+
+	rt := NewRoundTripperWithSave(newProviderTransport(tr.provider.Name(), "token", grantTypeLabel(params)))
+	t, err := tr.FetchNewTokenClientCredentials(params, rt)
+	token := &Token{Token: t, Raw: map[string]json.RawMessage{}, DPoPKey: params.DPoPKey}
 	if err != nil {
 		e := errors.Wrapf(err, "something went wrong fetching new token: %s", err)
 		return token, e
 	}
 
-	logrus.Debugf("saving new token to database (%s)", token.AccessToken)
+	// verify id_token
+	token.IDTokenClaims, err = tr.VerifyIDToken(t, params)
+	if err != nil {
+		e := errors.Wrapf(err, "something went wrong verifying the id_token: %s", err)
+		return token, e
+	}
+
+	// keep the latest response of the provider, not all fields end up in
+	// oauth2.Token
+	err = tr.setResponseBody(token, rt)
+	if err != nil {
+		tr.logger(params).Warnf("couldn't read token response: %s", err)
+	}
+
+	tr.logger(params).Debug("saving new token to database")
 	_, err = tr.SaveClientCredentialsToken(db, token, params)
 	if err != nil {
-		e := errors.Wrapf(err, "something went wrong saving a new token to the database (%s): %s", token.AccessToken, err)
+		e := errors.Wrapf(err, "something went wrong saving a new token to the database (%s): %s", redact.Secret(token.AccessToken), err)
 		return token, e
 	}
 
@@ -788,11 +1005,178 @@ func (tr *TokenRequester) fetchAndSaveNewClientCredentialsToken(db mysql.DB, par
 }
 
 type TokenRequest struct {
-	params providers.TokenRequestParams
-	result chan TokenRequestResult
+	params    providers.TokenRequestParams
+	queued    time.Time
+	queueSpan trace.Span
+	result    chan TokenRequestResult
 }
 
 type TokenRequestResult struct {
 	token *Token
 	err   error
 }
+
+// refreshParams fills in the params of a refresh request from the stored
+// lineage: the latest refresh token, the code_verifier and the context of the
+// code exchange and the DPoP key the lineage is bound to
+func (tr *TokenRequester) refreshParams(params providers.TokenRequestParams, token *Token, dbToken *mysql.OauthToken) providers.TokenRequestParams {
+	params.RefreshToken = token.RefreshToken
+	// if now code_verifier is sent, use the one used last time
+	if params.CodeVerifier == "" && dbToken.CodeVerifier != "" {
+		params.CodeVerifier = dbToken.CodeVerifier
+	}
+	// keep using the key the lineage is bound to
+	params.DPoPKey = token.DPoPKey
+
+	// fill in what the original code exchange request had
+	if dbToken.ExchangeContext == "" {
+		return params
+	}
+
+	ec := map[string]string{}
+	err := json.Unmarshal([]byte(dbToken.ExchangeContext), &ec)
+	if err != nil {
+		tr.logger(params).WithField("lineage_id", dbToken.ID).Warnf("invalid exchange context: %s", err)
+		return params
+	}
+
+	params.Context = ec
+	if params.RedirectURL == "" {
+		params.RedirectURL = ec["redirect_uri"]
+	}
+	return params
+}
+
+// saveDBToken saves the new token of the lineage, the same way for every
+// grant type: only what changed is updated and the context of the request
+// the provider needs for later refreshes is captured
+func (tr *TokenRequester) saveDBToken(db mysql.DB, dbToken *mysql.OauthToken, token *Token, params providers.TokenRequestParams) (mysql.OauthToken, error) {
+	if dbToken.ID != 0 {
+		tr.logger(params).WithField("lineage_id", dbToken.ID).Debug("found an existing token")
+	} else {
+		tr.logger(params).Debug("new token")
+	}
+
+	tr.ensureExpiry(token, params)
+	tr.ensureRefreshTokenExpiry(token, dbToken, params)
+
+	// update only changes
+	dbToken.RefreshToken = types.OptionallyEncryptedString(token.RefreshToken)
+	dbToken.RefreshTokenHash = mysql.NewRefreshTokenHash(dbToken.ClientID, token.RefreshToken)
+	dbToken.AccessToken = types.OptionallyEncryptedString(token.AccessToken)
+	dbToken.AccessTokenHash = mysql.NewAccessTokenHash(dbToken.ClientID, token.AccessToken)
+	dbToken.ExpiresAt = sql.NullTime{Time: token.Expiry, Valid: true}
+	if !token.RefreshTokenExpiry.IsZero() {
+		dbToken.RefreshTokenExpiresAt = sql.NullTime{Time: token.RefreshTokenExpiry, Valid: true}
+	}
+	if token.DPoPKey != nil {
+		dbToken.DPoPKey = types.OptionallyEncryptedString(token.DPoPKey.String())
+	}
+	if len(token.IDTokenClaims) > 0 {
+		dbToken.IDTokenClaims = types.OptionallyEncryptedString(token.IDTokenClaims)
+	}
+	if len(token.Native) > 0 {
+		dbToken.LastResponseBody = types.OptionallyEncryptedString(token.Native)
+	}
+	if ec := providers.CaptureContext(tr.provider, params); len(ec) > 0 {
+		b, err := json.Marshal(ec)
+		if err != nil {
+			return mysql.OauthToken{}, errors.WithStack(err)
+		}
+		dbToken.ExchangeContext = types.OptionallyEncryptedString(b)
+	}
+	token.Scope = tr.grantedScope(token, dbToken)
+	dbToken.GrantedScope = token.Scope
+	dbToken.UpdatedAt = time.Now()
+	return *dbToken, dbToken.Save(tr.requestContext(params), observeDB(db))
+}
+
+// ensureExpiry sets the expiry of tokens the provider didn't return an
+// expires_in for. Otherwise oauth2 considers them valid forever. The exp claim
+// of a JWT access token is used, then the provider's default lifetime and
+// then DEFAULT_TOKEN_LIFETIME
+func (tr *TokenRequester) ensureExpiry(token *Token, params providers.TokenRequestParams) {
+	if !token.Expiry.IsZero() {
+		return
+	}
+
+	if exp, ok := providers.JWTExpiry(token.AccessToken); ok {
+		token.Expiry = exp
+		return
+	}
+
+	lifetime := providers.QuirksFor(tr.provider, params).TokenLifetime
+	if lifetime <= 0 {
+		lifetime = defaultTokenLifetime()
+	}
+	token.Expiry = time.Now().Add(lifetime)
+}
+
+// ensureRefreshTokenExpiry sets when the refresh token expires: from
+// (x_)refresh_token_expires_in in the response or the provider's default
+// refresh token lifetime. A refresh token that isn't rotated keeps its expiry
+func (tr *TokenRequester) ensureRefreshTokenExpiry(token *Token, dbToken *mysql.OauthToken, params providers.TokenRequestParams) {
+	if token.RefreshToken == "" {
+		return
+	}
+
+	for _, k := range []string{"refresh_token_expires_in", "x_refresh_token_expires_in"} {
+		if secs, ok := seconds(token.Extra(k)); ok {
+			token.RefreshTokenExpiry = time.Now().Add(time.Duration(secs) * time.Second)
+			return
+		}
+	}
+
+	if string(dbToken.RefreshToken) == token.RefreshToken && dbToken.RefreshTokenExpiresAt.Valid {
+		token.RefreshTokenExpiry = dbToken.RefreshTokenExpiresAt.Time
+		return
+	}
+
+	lifetime := providers.QuirksFor(tr.provider, params).RefreshTokenLifetime
+	if lifetime > 0 {
+		token.RefreshTokenExpiry = time.Now().Add(lifetime)
+	}
+}
+
+// seconds converts a (json) number or numeric string to seconds
+func seconds(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return int64(v), v > 0
+	case string:
+		secs, err := strconv.ParseInt(v, 10, 64)
+		return secs, err == nil && secs > 0
+	case json.Number:
+		secs, err := v.Int64()
+		return secs, err == nil && secs > 0
+	}
+	return 0, false
+}
+
+func defaultTokenLifetime() time.Duration {
+	lifetime, err := time.ParseDuration(DEFAULT_TOKEN_LIFETIME)
+	if err != nil || lifetime <= 0 {
+		return time.Hour
+	}
+	return lifetime
+}
+
+// setResponseBody adds the response body of the provider to the token: as the
+// provider sent it (Native) and normalized (Raw)
+func (tr *TokenRequester) setResponseBody(token *Token, rt *RoundTripperWithSave) error {
+	if rt.LastResponseBody() == nil {
+		return nil
+	}
+
+	b, err := io.ReadAll(rt.LastResponseBody())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	token.Native = json.RawMessage(b)
+
+	b, err = providers.QuirksFor(tr.provider, providers.TokenRequestParams{}).NormalizeResponse(b)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(json.Unmarshal(b, &token.Raw))
+}
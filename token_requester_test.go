@@ -4,7 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -13,6 +16,7 @@ import (
 	"github.com/omniboost/oauth-proxy/mysql"
 	"github.com/omniboost/oauth-proxy/providers"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/oauth2"
 )
 
@@ -110,7 +114,7 @@ func TestTokenRequester(t *testing.T) {
 		return
 	}
 
-	tokens, err := mysql.OauthTokensByAppClientIDAccessToken(context.Background(), dbh, provider.Name(), "TEST", "TEST")
+	tokens, err := mysql.OauthTokensByAppClientIDAccessToken(context.Background(), dbh, provider.Name(), "", "TEST", "TEST")
 	if err != nil {
 		t.Error(err)
 		return
@@ -237,3 +241,247 @@ func TestTokenRefreshParallel(t *testing.T) {
 		}
 	}
 }
+
+type TokenURLProvider struct {
+	MockProvider
+	tokenURL string
+}
+
+func (v TokenURLProvider) Name() string {
+	return "TOKEN_URL"
+}
+
+func (v TokenURLProvider) TokenSourceAuthorizationCode(ctx context.Context, params providers.TokenRequestParams) oauth2.TokenSource {
+	config := &oauth2.Config{
+		ClientID:     params.ClientID,
+		ClientSecret: params.ClientSecret,
+		Endpoint:     oauth2.Endpoint{TokenURL: v.tokenURL, AuthStyle: oauth2.AuthStyleInParams},
+	}
+	return config.TokenSource(ctx, &oauth2.Token{RefreshToken: params.RefreshToken})
+}
+
+func TestTokenRefreshLastResponseBody(t *testing.T) {
+	const body = `{"access_token":"LAST_RESPONSE","token_type":"bearer","expires_in":3600,"refresh_token":"LAST_RESPONSE_REFRESH","tenant":{"id":42}}`
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	tr := oauthproxy.NewTokenRequester(dbh, TokenURLProvider{tokenURL: srv.URL})
+	params := providers.TokenRequestParams{
+		ClientID:     "TEST_LAST_RESPONSE",
+		ClientSecret: "TEST_LAST_RESPONSE",
+		RefreshToken: "TEST_LAST_RESPONSE",
+	}
+	expired := oauthproxy.Token{
+		Token: &oauth2.Token{
+			AccessToken:  "TEST_LAST_RESPONSE",
+			RefreshToken: "TEST_LAST_RESPONSE",
+			Expiry:       time.Now().Add(-time.Hour),
+			TokenType:    "Bearer",
+		},
+		Raw: map[string]json.RawMessage{},
+	}
+	_, err := tr.SaveAuthorizationToken(dbh, &expired, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// refresh: the response of the provider is stored
+	token, err := tr.TokenRefresh(tr.NewTokenRequest(params))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(token.Native) != body {
+		t.Errorf("expected the response of the provider, got %s", token.Native)
+	}
+
+	params.RefreshToken = "LAST_RESPONSE_REFRESH"
+	dbToken, err := tr.AuthorizationTokenFromDB(dbh, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dbToken.LastResponseBody) != body {
+		t.Errorf("expected last_response_body to be stored, got %s", dbToken.LastResponseBody)
+	}
+
+	// cached: the stored response ends up in the response body
+	token, err = tr.TokenRefresh(tr.NewTokenRequest(params))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected the cached token, got %d provider calls", calls.Load())
+	}
+	if string(token.Native) != body {
+		t.Errorf("expected the stored response, got %s", token.Native)
+	}
+
+	b, err := json.Marshal(oauthproxy.TokenResponseBody{
+		TokenType:    token.TokenType,
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		RawMessages:  token.Raw,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rsp map[string]json.RawMessage
+	if err := json.Unmarshal(b, &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if string(rsp["tenant"]) != `{"id":42}` {
+		t.Errorf("expected the fields of the stored response in the response body, got %s", b)
+	}
+	if string(rsp["access_token"]) != `"LAST_RESPONSE"` {
+		t.Errorf("expected the access token of the refresh, got %s", b)
+	}
+}
+
+// tokenRequests returns the token requests counted for the outcome
+func tokenRequests(t *testing.T, provider, outcome string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != "oauth_proxy_token_requests_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["provider"] == provider && labels["grant_type"] == "refresh_token" && labels["outcome"] == outcome {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestTokenRequestOutcomes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"OUTCOME","token_type":"bearer","expires_in":3600,"refresh_token":"OUTCOME_REFRESH"}`))
+	}))
+	defer srv.Close()
+
+	provider := TokenURLProvider{tokenURL: srv.URL}
+	tr := oauthproxy.NewTokenRequester(dbh, provider)
+	tr.Start()
+	defer tr.Stop()
+
+	params := providers.TokenRequestParams{
+		ClientID:     "TEST_OUTCOME",
+		ClientSecret: "TEST_OUTCOME",
+		RefreshToken: "TEST_OUTCOME",
+	}
+	expired := oauthproxy.Token{
+		Token: &oauth2.Token{
+			AccessToken:  "TEST_OUTCOME",
+			RefreshToken: "TEST_OUTCOME",
+			Expiry:       time.Now().Add(-time.Hour),
+			TokenType:    "Bearer",
+		},
+		Raw: map[string]json.RawMessage{},
+	}
+	_, err := tr.SaveAuthorizationToken(dbh, &expired, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outcomes := func() [3]float64 {
+		return [3]float64{
+			tokenRequests(t, provider.Name(), "refreshed"),
+			tokenRequests(t, provider.Name(), "cached"),
+			tokenRequests(t, provider.Name(), "error"),
+		}
+	}
+	expectOutcome := func(before [3]float64, i int, outcome string) {
+		t.Helper()
+		after := outcomes()
+		for j := range after {
+			expected := before[j]
+			if j == i {
+				expected++
+			}
+			if after[j] != expected {
+				t.Errorf("expected the request to be counted as %s, got %v -> %v", outcome, before, after)
+				return
+			}
+		}
+	}
+
+	// expired: refreshed at the provider
+	before := outcomes()
+	if _, err := tr.Request(params); err != nil {
+		t.Fatal(err)
+	}
+	expectOutcome(before, 0, "refreshed")
+
+	// valid: from the database
+	params.RefreshToken = "OUTCOME_REFRESH"
+	before = outcomes()
+	if _, err := tr.Request(params); err != nil {
+		t.Fatal(err)
+	}
+	expectOutcome(before, 1, "cached")
+
+	params.RefreshToken = ""
+	before = outcomes()
+	if _, err := tr.Request(params); err == nil {
+		t.Fatal("expected an error without a refresh token")
+	}
+	expectOutcome(before, 2, "error")
+}
+
+func TestTokenNamespaces(t *testing.T) {
+	tr := oauthproxy.NewTokenRequester(dbh, NewMockProvider())
+	params := providers.TokenRequestParams{
+		ClientID:     "TEST_NAMESPACES",
+		ClientSecret: "TEST_NAMESPACES",
+		RefreshToken: "TEST_NAMESPACES",
+	}
+
+	// the same refresh token in two environments sharing the database
+	for _, ns := range []string{"staging", "production"} {
+		params.Namespace = ns
+		token := oauthproxy.Token{
+			Token: &oauth2.Token{
+				AccessToken:  "ACCESS_" + ns,
+				RefreshToken: "TEST_NAMESPACES",
+				Expiry:       time.Now().Add(time.Hour),
+				TokenType:    "Bearer",
+			},
+			Raw: map[string]json.RawMessage{},
+		}
+		_, err := tr.SaveAuthorizationToken(dbh, &token, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, ns := range []string{"staging", "production"} {
+		params.Namespace = ns
+		dbToken, err := tr.AuthorizationTokenFromDB(dbh, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dbToken.Namespace != ns || string(dbToken.AccessToken) != "ACCESS_"+ns {
+			t.Errorf("expected the token of %s, got %s of %q", ns, dbToken.AccessToken, dbToken.Namespace)
+		}
+	}
+
+	// tokens of a namespace aren't found without it
+	params.Namespace = ""
+	_, err := tr.AuthorizationTokenFromDB(dbh, params)
+	if errors.Cause(err) != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows outside the namespaces, got %v", err)
+	}
+}
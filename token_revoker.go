@@ -3,15 +3,18 @@ package oauthproxy
 import (
 	"context"
 	"database/sql"
-	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/omniboost/oauth-proxy/mysql"
 	"github.com/omniboost/oauth-proxy/providers"
+	"github.com/omniboost/oauth-proxy/tracing"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2"
 )
 
@@ -20,13 +23,15 @@ func NewTokenRevoker(db *sql.DB, provider providers.RevokeProvider) *TokenRevoke
 	ctx := context.Background()
 	// Create a new context, with its cancellation function
 	// from the original context
-	// ctx, cancel := context.WithCancel(ctx)
+	ctx, cancel := context.WithCancel(ctx)
 
 	return &TokenRevoker{
 		db:       db,
 		provider: provider,
 		requests: make(chan RevokeRequest, 2),
 		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
 		// tokenChans: []chan *oauth2.Token{},
 		// errChans:   []chan error{},
 	}
@@ -37,25 +42,60 @@ type TokenRevoker struct {
 	provider providers.RevokeProvider
 	requests chan RevokeRequest
 	ctx      context.Context
+	cancel   context.CancelFunc
+
+	mu      sync.RWMutex
+	stopped bool
+	started bool
+	done    chan struct{}
 }
 
 func (tr *TokenRevoker) Start() {
+	tr.mu.Lock()
+	tr.started = true
+	tr.mu.Unlock()
+
 	go func() {
+		defer close(tr.done)
 		tr.Listen()
 	}()
 }
 
+// Stop stops accepting requests and blocks until the queued requests are
+// handled
+func (tr *TokenRevoker) Stop() {
+	tr.mu.Lock()
+	if tr.stopped {
+		tr.mu.Unlock()
+		return
+	}
+	tr.stopped = true
+	started := tr.started
+	tr.mu.Unlock()
+
+	tr.cancel()
+	if started {
+		<-tr.done
+	}
+}
+
 func (tr *TokenRevoker) Listen() {
 	// saving the token to a tokens map[string]*oauth2.Token based on the
 	// parameters for the db query could make it faster?
 	for {
 		select {
 		case request := <-tr.requests:
-			resp, err := tr.revoke(request)
-			tr.handleResults(request, resp, err)
+			tr.handle(request)
 		case <-tr.ctx.Done():
-			fmt.Println("done")
-			return
+			// finish the queued requests
+			for {
+				select {
+				case request := <-tr.requests:
+					tr.handle(request)
+				default:
+					return
+				}
+			}
 			// default:
 			// 	fmt.Println("default")
 			// 	return
@@ -63,9 +103,41 @@ func (tr *TokenRevoker) Listen() {
 	}
 }
 
+func (tr *TokenRevoker) handle(request RevokeRequest) {
+	queueDepth.WithLabelValues(tr.provider.Name(), "revoke").Dec()
+	queueWait.WithLabelValues(tr.provider.Name(), "revoke").Observe(time.Since(request.queued).Seconds())
+	request.queueSpan.End()
+
+	hint := tokenTypeHintLabel(request.params.TokenTypeHint)
+	ctx, span := tracing.Start(tr.requestContext(request.params), "revoke request",
+		attribute.String("oauth_proxy.provider", tr.provider.Name()),
+		attribute.String("oauth_proxy.token_type_hint", hint),
+	)
+
+	resp, err := tr.revoke(ctx, request)
+	outcome := "success"
+	if err != nil || resp.StatusCode != http.StatusOK {
+		outcome = "error"
+	}
+	revocations.WithLabelValues(tr.provider.Name(), hint, outcome).Inc()
+	span.SetAttributes(attribute.String("oauth_proxy.outcome", outcome))
+	tracing.End(span, err)
+	logRequest(ctx, func(l *requestLog) { l.outcome = outcome })
+
+	tr.handleResults(request, resp, err)
+}
+
 func (tr *TokenRevoker) Revoke(params TokenRevokeParams) (*http.Response, error) {
 	request := tr.NewTokenRevoke(params)
+
+	tr.mu.RLock()
+	if tr.stopped {
+		tr.mu.RUnlock()
+		return nil, errors.Errorf("token revoker for provider %s is stopped", tr.provider.Name())
+	}
+	queueDepth.WithLabelValues(tr.provider.Name(), "revoke").Inc()
 	tr.requests <- request
+	tr.mu.RUnlock()
 
 	// block on both channels
 	result := <-request.result
@@ -73,7 +145,7 @@ func (tr *TokenRevoker) Revoke(params TokenRevokeParams) (*http.Response, error)
 	return result.response, errors.WithStack(result.err)
 }
 
-func (tr *TokenRevoker) revoke(request RevokeRequest) (*http.Response, error) {
+func (tr *TokenRevoker) revoke(ctx context.Context, request RevokeRequest) (*http.Response, error) {
 	i, ok := tr.provider.(providers.RevokeProvider)
 	if !ok {
 		return nil, errors.Errorf("provider %s does not implement RevokeRoute", tr.provider.Name())
@@ -81,16 +153,25 @@ func (tr *TokenRevoker) revoke(request RevokeRequest) (*http.Response, error) {
 
 	// custom http client
 	client := &http.Client{}
-	rt := NewRoundTripperWithSave(http.DefaultTransport)
+	rt := NewRoundTripperWithSave(newProviderTransport(tr.provider.Name(), "revoke", ""))
 	client.Transport = rt
-	ctx := context.WithValue(context.TODO(), oauth2.HTTPClient, client)
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
 
 	data := url.Values{
 		"token":           []string{request.params.Token},
 		"token_type_hint": []string{request.params.TokenTypeHint},
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.RevokeURL(), strings.NewReader(data.Encode()))
+	revokeURL := i.RevokeURL()
+	if tp, ok := tr.provider.(providers.TemplatedProvider); ok {
+		var err error
+		revokeURL, err = tp.TemplateVars().Execute(revokeURL, providers.TokenRequestParams{OriginalRequest: request.params.Request})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, revokeURL, strings.NewReader(data.Encode()))
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -107,17 +188,17 @@ func (tr *TokenRevoker) revoke(request RevokeRequest) (*http.Response, error) {
 
 	if resp.StatusCode == http.StatusOK && request.params.Token != "" {
 		if request.params.TokenTypeHint == "refresh_token" {
-			token, err := mysql.OauthTokenByAppClientIDRefreshToken(ctx, tr.db, tr.provider.Name(), request.params.ClientID, request.params.Token)
+			token, err := mysql.OauthTokenByAppClientIDRefreshToken(ctx, observeDB(tr.db), tr.provider.Name(), request.params.Namespace, request.params.ClientID, request.params.Token)
 			if token != nil {
 				expiresAt := time.Now()
 				token.RefreshTokenExpiresAt = sql.NullTime{Time: expiresAt, Valid: true}
-				err = token.Save(ctx, tr.db)
+				err = token.Save(ctx, observeDB(tr.db))
 				if err != nil {
 					return nil, errors.WithStack(err)
 				}
 			}
 		} else if request.params.TokenTypeHint == "access_token" {
-			tokens, err := mysql.OauthTokensByAppClientIDAccessToken(ctx, tr.db, tr.provider.Name(), request.params.ClientID, request.params.Token)
+			tokens, err := mysql.OauthTokensByAppClientIDAccessToken(ctx, observeDB(tr.db), tr.provider.Name(), request.params.Namespace, request.params.ClientID, request.params.Token)
 			if err != nil {
 				return nil, errors.WithStack(err)
 			}
@@ -126,7 +207,7 @@ func (tr *TokenRevoker) revoke(request RevokeRequest) (*http.Response, error) {
 			for _, t := range tokens {
 				expiresAt := time.Now()
 				t.ExpiresAt = sql.NullTime{Time: expiresAt, Valid: true}
-				err := t.Save(ctx, tr.db)
+				err := t.Save(ctx, observeDB(tr.db))
 				if err != nil {
 					return nil, errors.WithStack(err)
 				}
@@ -146,8 +227,10 @@ func (tr *TokenRevoker) handleResults(request RevokeRequest, resp *http.Response
 }
 
 type RevokeRequest struct {
-	params TokenRevokeParams
-	result chan TokenRevokeResult
+	params    TokenRevokeParams
+	queued    time.Time
+	queueSpan trace.Span
+	result    chan TokenRevokeResult
 }
 
 type TokenRevokeResult struct {
@@ -158,6 +241,7 @@ type TokenRevokeResult struct {
 type TokenRevokeParams struct {
 	ClientID     string `schema:"client_id"`
 	ClientSecret string `schema:"client_secret"`
+	Namespace    string `schema:"-"`
 
 	Token         string `schema:"token"`
 	TokenTypeHint string `schema:"token_type_hint"`
@@ -165,8 +249,30 @@ type TokenRevokeParams struct {
 }
 
 func (tr *TokenRevoker) NewTokenRevoke(params TokenRevokeParams) RevokeRequest {
+	_, span := tracing.Start(tr.requestContext(params), "revoke queue wait",
+		attribute.String("oauth_proxy.provider", tr.provider.Name()),
+	)
 	return RevokeRequest{
-		params: params,
-		result: make(chan TokenRevokeResult, 1),
+		params:    params,
+		queued:    time.Now(),
+		queueSpan: span,
+		result:    make(chan TokenRevokeResult, 1),
+	}
+}
+
+// requestContext returns the context of the revoke request, see
+// TokenRequester.requestContext
+func (tr *TokenRevoker) requestContext(params TokenRevokeParams) context.Context {
+	if params.Request == nil {
+		return context.Background()
+	}
+	return context.WithoutCancel(params.Request.Context())
+}
+
+// tokenTypeHintLabel is the token type hint as it's used in the metrics
+func tokenTypeHintLabel(hint string) string {
+	if hint == "refresh_token" || hint == "access_token" {
+		return hint
 	}
+	return "unknown"
 }
@@ -0,0 +1,134 @@
+// Package tracing sets up OpenTelemetry tracing. Spans are exported with
+// OTLP over http when OTEL_EXPORTER_OTLP_ENDPOINT (or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT) is set, the other OTEL_* variables are
+// picked up by the exporter. Without an endpoint the trace context of callers
+// is still propagated and used as correlation id
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// CorrelationIDHeader carries the correlation id. A valid id sent by the
+// caller is used, otherwise it's the trace id. It's echoed in every response
+const CorrelationIDHeader = "X-Correlation-Id"
+
+// Tracer creates the spans of the proxy
+var Tracer = otel.Tracer("github.com/omniboost/oauth-proxy")
+
+var correlationIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type correlationIDKey struct{}
+
+// Enabled reports whether an OTLP endpoint is configured
+func Enabled() bool {
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Init sets the W3C trace context propagator and, when an endpoint is
+// configured, the OTLP exporter. The returned function flushes the spans
+// and stops the exporter
+func Init(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !Enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "oauth-proxy")),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// lambda freezes between invocations: don't batch
+	processor := sdktrace.NewBatchSpanProcessor(exporter)
+	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != "" {
+		processor = sdktrace.NewSimpleSpanProcessor(exporter)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Handler starts a span for every request, continuing the trace of the
+// caller, and sets the correlation id
+func Handler(operation string, h http.Handler, attrs ...attribute.KeyValue) http.Handler {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		id := r.Header.Get(CorrelationIDHeader)
+		if !correlationIDPattern.MatchString(id) {
+			id = newCorrelationID(ctx)
+		}
+
+		span := trace.SpanFromContext(ctx)
+		span.SetAttributes(attribute.String("oauth_proxy.correlation_id", id))
+		w.Header().Set(CorrelationIDHeader, id)
+
+		ctx = context.WithValue(ctx, correlationIDKey{}, id)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+	return otelhttp.NewHandler(inner, operation, otelhttp.WithSpanOptions(trace.WithAttributes(attrs...)))
+}
+
+// CorrelationID returns the correlation id of the request the context
+// belongs to
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+// Start starts a span when the context is part of a trace, so background
+// work doesn't start new traces
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return Tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records the error, if any, and ends the span
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func newCorrelationID(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		return sc.TraceID().String()
+	}
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
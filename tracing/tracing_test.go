@@ -0,0 +1,94 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/omniboost/oauth-proxy/tracing"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestHandler(t *testing.T) {
+	// collector stand-in
+	var mu sync.Mutex
+	spans := map[string]*tracepb.Span{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		req := &coltracepb.ExportTraceServiceRequest{}
+		err := proto.Unmarshal(b, req)
+		if err != nil {
+			t.Error(err)
+		}
+
+		mu.Lock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					// the spans of the first request
+					if spans[s.Name] == nil {
+						spans[s.Name] = s
+					}
+				}
+			}
+		}
+		mu.Unlock()
+
+		b, _ = proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(b)
+	}))
+	defer collector.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	shutdown, err := tracing.Init(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := tracing.Handler("token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := tracing.Start(r.Context(), "provider token")
+		tracing.End(span, nil)
+	}))
+
+	r := httptest.NewRequest("POST", "/xero/oauth2/token", nil)
+	r.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if id := w.Header().Get(tracing.CorrelationIDHeader); id != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected the trace id as correlation id, got %s", id)
+	}
+
+	// a correlation id of the caller is kept
+	r = httptest.NewRequest("POST", "/xero/oauth2/token", nil)
+	r.Header.Set(tracing.CorrelationIDHeader, "job-42")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if id := w.Header().Get(tracing.CorrelationIDHeader); id != "job-42" {
+		t.Errorf("expected the correlation id of the caller, got %s", id)
+	}
+
+	err = shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	server, child := spans["token"], spans["provider token"]
+	if server == nil || child == nil {
+		t.Fatalf("expected the handler and provider spans, got %v", spans)
+	}
+	if hex.EncodeToString(server.TraceId) != "4bf92f3577b34da6a3ce929d0e0e4736" || hex.EncodeToString(server.ParentSpanId) != "00f067aa0ba902b7" {
+		t.Errorf("expected the handler span to continue the trace of the caller")
+	}
+	if hex.EncodeToString(child.ParentSpanId) != hex.EncodeToString(server.SpanId) {
+		t.Errorf("expected the provider span to be a child of the handler span")
+	}
+}
@@ -2,6 +2,7 @@ package types
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
@@ -18,23 +19,77 @@ import (
 	jsoniter "github.com/json-iterator/go"
 )
 
-// We only support AES-256-CBC for now
-// OptionallyEncryptedString mimics Laravel's encrypted string format
+// OptionallyEncryptedString mimics Laravel's encrypted string format. New
+// values are encrypted with APP_CIPHER (aes-256-cbc or aes-256-gcm), both
+// formats can be decrypted. With a KEY_PROVIDER new values are envelope
+// encrypted with the data key of their client instead (see envelope.go)
+
+const (
+	CipherAES256CBC = "aes-256-cbc"
+	CipherAES256GCM = "aes-256-gcm"
+)
 
 var AppKey []byte
 
+// Cipher is used to encrypt new values (APP_CIPHER, aes-256-cbc by default)
+var Cipher = CipherAES256CBC
+
+// PreviousKeys are tried when a value can't be decrypted with AppKey. Like
+// Laravel they're read from APP_PREVIOUS_KEYS (comma separated) so APP_KEY
+// can be rotated
+var PreviousKeys [][]byte
+
 func init() {
-	key := os.Getenv("APP_KEY")
-	if strings.HasPrefix(key, "base64:") {
-		AppKey, _ = base64.StdEncoding.DecodeString(strings.TrimPrefix(key, "base64:"))
-	} else {
-		AppKey = []byte(key)
+	if uri := os.Getenv("KEY_PROVIDER"); uri != "" {
+		kp, err := NewKeyProvider(uri)
+		if err != nil {
+			panic(fmt.Sprintf("invalid KEY_PROVIDER: %v", err))
+		}
+		keyProvider = kp
 	}
-	if len(AppKey) == 0 {
+
+	// with a key provider APP_KEY is only needed to read existing values
+	AppKey = parseKey(os.Getenv("APP_KEY"))
+	if len(AppKey) == 0 && keyProvider == nil {
 		panic("APP_KEY environment variable is not set")
 	}
+
+	if c := strings.ToLower(os.Getenv("APP_CIPHER")); c != "" {
+		if c != CipherAES256CBC && c != CipherAES256GCM {
+			panic(fmt.Sprintf("unsupported APP_CIPHER %s", c))
+		}
+		Cipher = c
+	}
+
+	for _, key := range strings.Split(os.Getenv("APP_PREVIOUS_KEYS"), ",") {
+		if k := parseKey(strings.TrimSpace(key)); len(k) > 0 {
+			PreviousKeys = append(PreviousKeys, k)
+		}
+	}
 }
 
+func parseKey(key string) []byte {
+	if strings.HasPrefix(key, "base64:") {
+		k, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(key, "base64:"))
+		return k
+	}
+	return []byte(key)
+}
+
+// KeyState tells how a stored value is encrypted
+type KeyState string
+
+const (
+	KeyStateEmpty     KeyState = "empty"
+	KeyStatePlaintext KeyState = "plaintext"
+	KeyStateCurrent   KeyState = "current"
+	KeyStatePrevious  KeyState = "previous"
+	KeyStateUnknown   KeyState = "unknown"
+	// KeyStateOtherCipher is a value encrypted with the current key but not
+	// with the current cipher
+	KeyStateOtherCipher KeyState = "other_cipher"
+)
+
 type OptionallyEncryptedString string
 
 type optionallyEncryptedStringInternal struct {
@@ -42,6 +97,14 @@ type optionallyEncryptedStringInternal struct {
 	Value string `json:"value"`
 	Mac   string `json:"mac"`
 	Tag   string `json:"tag"`
+
+	// envelope encryption: the id of the data key in the DataKeyStore
+	DataKeyID int `json:"dkid,omitempty"`
+
+	// envelope encryption before data keys were kept in the DataKeyStore:
+	// the id of the key-encryption key and the wrapped data key
+	KeyID   string `json:"kid,omitempty"`
+	DataKey string `json:"dk,omitempty"`
 }
 
 var newIV = func() string {
@@ -52,11 +115,26 @@ var newIV = func() string {
 	return base64.StdEncoding.EncodeToString(iv)
 }
 
+var newNonce = func() []byte {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Sprintf("failed to generate nonce: %v", err))
+	}
+	return nonce
+}
+
 func encryptString(plain string) (string, error) {
 	if plain == "" {
 		return "", nil
 	}
 
+	if keyProvider != nil {
+		return "", errors.New("envelope encryption needs the data key of the client, see EncryptWith")
+	}
+	if Cipher == CipherAES256GCM {
+		return encryptStringGCM(plain)
+	}
+
 	inner := optionallyEncryptedStringInternal{
 		IV: newIV(),
 	}
@@ -86,8 +164,46 @@ func encryptString(plain string) (string, error) {
 	return base64.StdEncoding.EncodeToString(j), nil
 }
 
+// encryptStringGCM encrypts like Laravel does with aes-256-gcm: the
+// authentication tag is in tag and there's no mac
+func encryptStringGCM(plain string) (string, error) {
+	aead, err := newGCM(AppKey)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := newNonce()
+	sealed := aead.Seal(nil, nonce, []byte(plain), nil)
+	ciphertext, tag := sealed[:len(sealed)-aead.Overhead()], sealed[len(sealed)-aead.Overhead():]
+
+	inner := optionallyEncryptedStringInternal{
+		IV:    base64.StdEncoding.EncodeToString(nonce),
+		Value: base64.StdEncoding.EncodeToString(ciphertext),
+		Mac:   "", // Not used in GCM mode
+		Tag:   base64.StdEncoding.EncodeToString(tag),
+	}
+
+	j, err := jsoniter.Marshal(inner)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(j), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
 func hashString(iv, value string) string {
-	h := hmac.New(sha256.New, AppKey)
+	return hashStringWithKey(AppKey, iv, value)
+}
+
+func hashStringWithKey(key []byte, iv, value string) string {
+	h := hmac.New(sha256.New, key)
 	h.Write(append([]byte(iv), []byte(value)...))
 	return hex.EncodeToString(h.Sum(nil))
 }
@@ -103,48 +219,114 @@ func PKCS5Trimming(encrypt []byte) []byte {
 	return encrypt[:len(encrypt)-int(padding)]
 }
 
-func decryptString(encrypted string) (string, error) {
-	if encrypted == "" {
-		return "", nil
-	}
-
-	var inner optionallyEncryptedStringInternal
+// parseEncrypted decodes the Laravel payload. ok is false when the value isn't
+// encrypted
+func parseEncrypted(encrypted string) (inner optionallyEncryptedStringInternal, ok bool) {
 	decoded, err := base64.StdEncoding.DecodeString(encrypted)
 	if err != nil {
-		// if it's not base64, return as is
-		return encrypted, nil
+		// if it's not base64, it's not encrypted
+		return inner, false
 	}
 	if err := jsoniter.Unmarshal(decoded, &inner); err != nil {
-		// if it's not json, return as is
-		return encrypted, nil
+		// if it's not json, it's not encrypted
+		return inner, false
 	}
-	if inner.IV == "" || inner.Value == "" || inner.Mac == "" {
-		// if any field is missing, return as is
-		return encrypted, nil
+	if inner.IV == "" || inner.Value == "" || (inner.Mac == "" && inner.Tag == "") {
+		// if any field is missing, it's not encrypted
+		return inner, false
 	}
+	return inner, true
+}
 
-	expectedMac := hashString(inner.IV, inner.Value)
-	if !hmac.Equal([]byte(expectedMac), []byte(inner.Mac)) {
-		return "", errors.New("invalid MAC for encrypted string")
+func (inner optionallyEncryptedStringInternal) cipher() string {
+	if inner.Mac == "" {
+		return CipherAES256GCM
 	}
+	return CipherAES256CBC
+}
 
+// decryptWithKeys decrypts the payload with the current key or one of the
+// previous keys. The state tells which one it was
+func decryptWithKeys(inner optionallyEncryptedStringInternal) (string, KeyState, error) {
+	if inner.DataKeyID != 0 || inner.DataKey != "" {
+		return decryptEnvelope(inner)
+	}
+
+	for i, key := range append([][]byte{AppKey}, PreviousKeys...) {
+		if len(key) == 0 {
+			continue
+		}
+		plain, ok, err := decryptWithKey(inner, key)
+		if err != nil {
+			return "", KeyStateUnknown, err
+		}
+		if !ok {
+			continue
+		}
+
+		switch {
+		case i > 0:
+			return plain, KeyStatePrevious, nil
+		case inner.cipher() != Cipher || keyProvider != nil:
+			// not envelope encrypted while there is a key provider
+			return plain, KeyStateOtherCipher, nil
+		}
+		return plain, KeyStateCurrent, nil
+	}
+
+	if inner.cipher() == CipherAES256GCM {
+		return "", KeyStateUnknown, errors.New("invalid tag for encrypted string")
+	}
+	return "", KeyStateUnknown, errors.New("invalid MAC for encrypted string")
+}
+
+// decryptWithKey decrypts the payload, ok is false when it wasn't encrypted
+// with key
+func decryptWithKey(inner optionallyEncryptedStringInternal, key []byte) (string, bool, error) {
 	iv, err := base64.StdEncoding.DecodeString(inner.IV)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
 	ciphertext, err := base64.StdEncoding.DecodeString(inner.Value)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
-	block, err := aes.NewCipher(AppKey)
+	if inner.cipher() == CipherAES256GCM {
+		tag, err := base64.StdEncoding.DecodeString(inner.Tag)
+		if err != nil {
+			return "", false, err
+		}
+
+		aead, err := newGCM(key)
+		if err != nil {
+			// a key of another length can't be the right one
+			return "", false, nil
+		}
+		if len(iv) != aead.NonceSize() {
+			return "", false, errors.New("invalid iv for encrypted string")
+		}
+
+		plaintext, err := aead.Open(nil, iv, append(ciphertext, tag...), nil)
+		if err != nil {
+			return "", false, nil
+		}
+		return string(plaintext), true, nil
+	}
+
+	expectedMac := hashStringWithKey(key, inner.IV, inner.Value)
+	if !hmac.Equal([]byte(expectedMac), []byte(inner.Mac)) {
+		return "", false, nil
+	}
+
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
 	if len(ciphertext)%block.BlockSize() != 0 {
-		return "", errors.New("ciphertext is not a multiple of the block size")
+		return "", false, errors.New("ciphertext is not a multiple of the block size")
 	}
 
 	mode := cipher.NewCBCDecrypter(block, iv)
@@ -153,7 +335,69 @@ func decryptString(encrypted string) (string, error) {
 
 	decrypted := string(PKCS5Trimming(plaintext))
 
-	return decrypted, nil
+	return decrypted, true, nil
+}
+
+// EncryptionState tells if a stored value is encrypted with the current key
+// and cipher, a previous key, an unknown key or isn't encrypted at all
+func EncryptionState(stored string) KeyState {
+	if stored == "" {
+		return KeyStateEmpty
+	}
+	inner, ok := parseEncrypted(stored)
+	if !ok {
+		return KeyStatePlaintext
+	}
+	_, state, _ := decryptWithKeys(inner)
+	return state
+}
+
+// Reencrypt decrypts a stored value (with any of the keys) and encrypts it
+// with the current key and cipher. With a KEY_PROVIDER the value is
+// encrypted with the data key of scope, when it already is the data key is
+// wrapped with the current key-encryption key and the value is returned as
+// is
+func Reencrypt(ctx context.Context, stored string, scope DataKeyScope) (string, error) {
+	if keyProvider == nil {
+		plain, err := decryptString(stored)
+		if err != nil {
+			return "", err
+		}
+		return encryptString(plain)
+	}
+
+	if inner, ok := parseEncrypted(stored); ok && inner.DataKeyID != 0 {
+		dk, err := dataKeyByID(inner.DataKeyID)
+		if err != nil {
+			return "", err
+		}
+		return stored, rewrapDataKey(ctx, dk)
+	}
+
+	plain, err := decryptString(stored)
+	if err != nil {
+		return "", err
+	}
+	dk, err := DataKeyFor(ctx, scope)
+	if err != nil {
+		return "", err
+	}
+	return OptionallyEncryptedString(plain).EncryptWith(dk)
+}
+
+func decryptString(encrypted string) (string, error) {
+	if encrypted == "" {
+		return "", nil
+	}
+
+	inner, ok := parseEncrypted(encrypted)
+	if !ok {
+		// return as is
+		return encrypted, nil
+	}
+
+	plain, _, err := decryptWithKeys(inner)
+	return plain, err
 }
 
 func (oes *OptionallyEncryptedString) Scan(value interface{}) error {
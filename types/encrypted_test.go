@@ -1,8 +1,12 @@
 package types
 
 import (
+	"context"
+	"encoding/base64"
 	"strings"
 	"testing"
+
+	jsoniter "github.com/json-iterator/go"
 )
 
 func Test_encryptString(t *testing.T) {
@@ -97,3 +101,98 @@ func Test_decryptString(t *testing.T) {
 		})
 	}
 }
+
+func TestPreviousKeys(t *testing.T) {
+	appKey, previousKeys := AppKey, PreviousKeys
+	defer func() {
+		AppKey, PreviousKeys = appKey, previousKeys
+	}()
+
+	AppKey = []byte("00000000000000000000000000000000")
+	PreviousKeys = nil
+	encrypted, err := encryptString("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rotate
+	AppKey = []byte("11111111111111111111111111111111")
+	if _, err := decryptString(encrypted); err == nil {
+		t.Fatal("expected invalid MAC without previous keys")
+	}
+
+	PreviousKeys = [][]byte{[]byte("00000000000000000000000000000000")}
+	got, err := decryptString(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "secret" {
+		t.Errorf("decryptString() got = %v, want secret", got)
+	}
+	if state := EncryptionState(encrypted); state != KeyStatePrevious {
+		t.Errorf("EncryptionState() got = %v, want %v", state, KeyStatePrevious)
+	}
+
+	reencrypted, err := Reencrypt(context.Background(), encrypted, DataKeyScope{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := EncryptionState(reencrypted); state != KeyStateCurrent {
+		t.Errorf("EncryptionState() got = %v, want %v", state, KeyStateCurrent)
+	}
+	if state := EncryptionState("plain"); state != KeyStatePlaintext {
+		t.Errorf("EncryptionState() got = %v, want %v", state, KeyStatePlaintext)
+	}
+}
+
+func TestGCM(t *testing.T) {
+	appKey, cipher := AppKey, Cipher
+	defer func() {
+		AppKey, Cipher = appKey, cipher
+	}()
+	AppKey = []byte("00000000000000000000000000000000")
+
+	Cipher = CipherAES256CBC
+	cbc, err := encryptString("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Cipher = CipherAES256GCM
+	gcm, err := encryptString("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inner, ok := parseEncrypted(gcm)
+	if !ok {
+		t.Fatal("expected an encrypted payload")
+	}
+	if inner.Mac != "" || inner.Tag == "" {
+		t.Errorf("expected a tag and no mac, got %+v", inner)
+	}
+
+	// old CBC values remain readable
+	for _, encrypted := range []string{cbc, gcm} {
+		got, err := decryptString(encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "secret" {
+			t.Errorf("decryptString() got = %v, want secret", got)
+		}
+	}
+	if state := EncryptionState(cbc); state != KeyStateOtherCipher {
+		t.Errorf("EncryptionState() got = %v, want %v", state, KeyStateOtherCipher)
+	}
+	if state := EncryptionState(gcm); state != KeyStateCurrent {
+		t.Errorf("EncryptionState() got = %v, want %v", state, KeyStateCurrent)
+	}
+
+	// tampering is detected
+	inner.Tag = "AAAAAAAAAAAAAAAAAAAAAA=="
+	j, _ := jsoniter.Marshal(inner)
+	if _, err := decryptString(base64.StdEncoding.EncodeToString(j)); err == nil {
+		t.Error("expected an error for an invalid tag")
+	}
+}
@@ -0,0 +1,364 @@
+package types
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+var (
+	// keyProvider enables envelope encryption: the values of a client are
+	// encrypted with the data key of that client (DataKeyScope), the data
+	// key is wrapped by a key-encryption key of the provider
+	// (KEY_PROVIDER). The wrapped data keys are kept in the DataKeyStore,
+	// apart from the values. Deleting the data key of a client shreds all
+	// of its values
+	keyProvider KeyProvider
+
+	// dataKeyStore keeps the wrapped data keys
+	dataKeyStore DataKeyStore
+
+	keyProviderTimeout = 10 * time.Second
+)
+
+// ErrNoDataKey is returned by a DataKeyStore when the data key doesn't exist
+var ErrNoDataKey = errors.New("data key doesn't exist")
+
+// DataKeyScope are the values that share a data key: the tokens of a client
+// of a provider (app) in a namespace
+type DataKeyScope struct {
+	App       string
+	Namespace string
+	ClientID  string
+}
+
+// StoredDataKey is the data key of scope wrapped with the key-encryption key
+// KeyID
+type StoredDataKey struct {
+	ID      int
+	Scope   DataKeyScope
+	KeyID   string
+	Wrapped []byte
+}
+
+// DataKeyStore keeps the wrapped data keys
+type DataKeyStore interface {
+	DataKey(ctx context.Context, id int) (StoredDataKey, error)
+	DataKeyByScope(ctx context.Context, scope DataKeyScope) (StoredDataKey, error)
+	// CreateDataKey stores the data key of scope. When the scope got a
+	// data key in the meantime that one is returned instead
+	CreateDataKey(ctx context.Context, scope DataKeyScope, keyID string, wrapped []byte) (StoredDataKey, error)
+	// UpdateDataKey stores the data key wrapped with another
+	// key-encryption key
+	UpdateDataKey(ctx context.Context, dk StoredDataKey) error
+}
+
+// SetKeyProvider enables envelope encryption for new values. With nil new
+// values are encrypted with APP_KEY again
+func SetKeyProvider(kp KeyProvider) {
+	dataKeys.mu.Lock()
+	defer dataKeys.mu.Unlock()
+	keyProvider = kp
+	dataKeys.reset()
+}
+
+// SetDataKeyStore sets the store of the data keys, envelope encryption
+// needs one
+func SetDataKeyStore(store DataKeyStore) {
+	dataKeys.mu.Lock()
+	defer dataKeys.mu.Unlock()
+	dataKeyStore = store
+	dataKeys.reset()
+}
+
+// EnvelopeEncryption tells if new values are envelope encrypted. They're
+// encrypted with EncryptWith and the data key of their client
+func EnvelopeEncryption() bool {
+	return keyProvider != nil
+}
+
+// DataKey is an unwrapped data key
+type DataKey struct {
+	id    int
+	scope DataKeyScope
+	keyID string
+	plain []byte
+}
+
+// dataKeyCache keeps the unwrapped data keys, so the key provider is only
+// called the first time a process uses a data key
+type dataKeyCache struct {
+	mu      sync.Mutex
+	byID    map[int]*DataKey
+	byScope map[DataKeyScope]*DataKey
+	// unwrapped are the data keys of values that carry their own wrapped
+	// data key, from before data keys were kept in the DataKeyStore
+	unwrapped map[string][]byte
+}
+
+var dataKeys = &dataKeyCache{}
+
+func init() {
+	dataKeys.reset()
+}
+
+func (c *dataKeyCache) reset() {
+	c.byID = map[int]*DataKey{}
+	c.byScope = map[DataKeyScope]*DataKey{}
+	c.unwrapped = map[string][]byte{}
+}
+
+func (c *dataKeyCache) add(dk *DataKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// keep the cache bounded
+	if len(c.byID) >= 10000 {
+		c.byID = map[int]*DataKey{}
+		c.byScope = map[DataKeyScope]*DataKey{}
+	}
+	c.byID[dk.id] = dk
+	c.byScope[dk.scope] = dk
+}
+
+// ForgetDataKey removes the data key of scope from the cache of this
+// process. Other processes keep using a deleted data key until they restart
+func ForgetDataKey(scope DataKeyScope) {
+	dataKeys.mu.Lock()
+	defer dataKeys.mu.Unlock()
+	if dk, ok := dataKeys.byScope[scope]; ok {
+		delete(dataKeys.byID, dk.id)
+		delete(dataKeys.byScope, scope)
+	}
+}
+
+// DataKeyFor returns the data key of scope, a new one the first time the
+// scope is used
+func DataKeyFor(ctx context.Context, scope DataKeyScope) (*DataKey, error) {
+	if keyProvider == nil {
+		return nil, errors.New("envelope encryption needs a KEY_PROVIDER")
+	}
+	if dataKeyStore == nil {
+		return nil, errors.New("envelope encryption needs a data key store")
+	}
+
+	dataKeys.mu.Lock()
+	dk, ok := dataKeys.byScope[scope]
+	dataKeys.mu.Unlock()
+	if ok {
+		return dk, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, keyProviderTimeout)
+	defer cancel()
+	stored, err := dataKeyStore.DataKeyByScope(ctx, scope)
+	switch {
+	case errors.Is(err, ErrNoDataKey):
+		dk, err = createDataKey(ctx, scope)
+	case err == nil:
+		dk, err = unwrapDataKey(ctx, stored)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dataKeys.add(dk)
+	return dk, nil
+}
+
+// createDataKey generates, wraps and stores the data key of scope
+func createDataKey(ctx context.Context, scope DataKeyScope) (*DataKey, error) {
+	plain := make([]byte, 32)
+	if _, err := rand.Read(plain); err != nil {
+		return nil, err
+	}
+
+	keyID := keyProvider.KeyID()
+	wrapped, err := keyProvider.WrapKey(ctx, keyID, plain)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := dataKeyStore.CreateDataKey(ctx, scope, keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(stored.Wrapped, wrapped) {
+		// another process created the data key first
+		return unwrapDataKey(ctx, stored)
+	}
+	return &DataKey{id: stored.ID, scope: scope, keyID: keyID, plain: plain}, nil
+}
+
+func unwrapDataKey(ctx context.Context, stored StoredDataKey) (*DataKey, error) {
+	plain, err := keyProvider.UnwrapKey(ctx, stored.KeyID, stored.Wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return &DataKey{id: stored.ID, scope: stored.Scope, keyID: stored.KeyID, plain: plain}, nil
+}
+
+// dataKeyByID returns the data key a value was encrypted with
+func dataKeyByID(id int) (*DataKey, error) {
+	if keyProvider == nil {
+		return nil, errors.New("value is envelope encrypted but there's no KEY_PROVIDER")
+	}
+	if dataKeyStore == nil {
+		return nil, errors.New("value is envelope encrypted but there's no data key store")
+	}
+
+	dataKeys.mu.Lock()
+	dk, ok := dataKeys.byID[id]
+	dataKeys.mu.Unlock()
+	if ok {
+		return dk, nil
+	}
+
+	// values are decrypted while they're scanned, there's no context
+	ctx, cancel := context.WithTimeout(context.Background(), keyProviderTimeout)
+	defer cancel()
+	stored, err := dataKeyStore.DataKey(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("data key %d: %w", id, err)
+	}
+	dk, err = unwrapDataKey(ctx, stored)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKeys.add(dk)
+	return dk, nil
+}
+
+// rewrapDataKey wraps the data key with the current key-encryption key, the
+// values encrypted with it don't change
+func rewrapDataKey(ctx context.Context, dk *DataKey) error {
+	keyID := keyProvider.KeyID()
+	if dk.keyID == keyID {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, keyProviderTimeout)
+	defer cancel()
+	wrapped, err := keyProvider.WrapKey(ctx, keyID, dk.plain)
+	if err != nil {
+		return err
+	}
+	err = dataKeyStore.UpdateDataKey(ctx, StoredDataKey{ID: dk.id, Scope: dk.scope, KeyID: keyID, Wrapped: wrapped})
+	if err != nil {
+		return err
+	}
+
+	dataKeys.add(&DataKey{id: dk.id, scope: dk.scope, keyID: keyID, plain: dk.plain})
+	return nil
+}
+
+// EncryptWith encrypts with aes-256-gcm and the data key of the client of
+// the value. Only the id of the data key is part of the payload
+func (oes OptionallyEncryptedString) EncryptWith(dk *DataKey) (string, error) {
+	if oes == "" {
+		return "", nil
+	}
+
+	aead, err := newGCM(dk.plain)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := newNonce()
+	sealed := aead.Seal(nil, nonce, []byte(oes), nil)
+	ciphertext, tag := sealed[:len(sealed)-aead.Overhead()], sealed[len(sealed)-aead.Overhead():]
+
+	inner := optionallyEncryptedStringInternal{
+		IV:        base64.StdEncoding.EncodeToString(nonce),
+		Value:     base64.StdEncoding.EncodeToString(ciphertext),
+		Tag:       base64.StdEncoding.EncodeToString(tag),
+		DataKeyID: dk.id,
+	}
+
+	j, err := jsoniter.Marshal(inner)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(j), nil
+}
+
+// decryptEnvelope decrypts an envelope encrypted payload
+func decryptEnvelope(inner optionallyEncryptedStringInternal) (string, KeyState, error) {
+	key, keyID, err := envelopeKey(inner)
+	if err != nil {
+		return "", KeyStateUnknown, err
+	}
+
+	plain, ok, err := decryptWithKey(inner, key)
+	if err != nil {
+		return "", KeyStateUnknown, err
+	}
+	if !ok {
+		return "", KeyStateUnknown, errors.New("invalid tag for encrypted string")
+	}
+
+	if keyID != keyProvider.KeyID() || inner.DataKeyID == 0 {
+		return plain, KeyStatePrevious, nil
+	}
+	return plain, KeyStateCurrent, nil
+}
+
+// envelopeKey returns the data key of the payload and the id of the
+// key-encryption key it's wrapped with
+func envelopeKey(inner optionallyEncryptedStringInternal) ([]byte, string, error) {
+	if inner.DataKeyID != 0 {
+		dk, err := dataKeyByID(inner.DataKeyID)
+		if err != nil {
+			return nil, "", err
+		}
+		return dk.plain, dk.keyID, nil
+	}
+
+	key, err := unwrapInlineDataKey(inner.KeyID, inner.DataKey)
+	return key, inner.KeyID, err
+}
+
+// unwrapInlineDataKey returns the data key of a value that carries its own
+// wrapped data key. Those values are re-encrypted with the data key of their
+// client by rekey
+func unwrapInlineDataKey(keyID, wrapped string) ([]byte, error) {
+	if keyProvider == nil {
+		return nil, errors.New("value is envelope encrypted but there's no KEY_PROVIDER")
+	}
+
+	cacheKey := keyID + ":" + wrapped
+	dataKeys.mu.Lock()
+	plain, ok := dataKeys.unwrapped[cacheKey]
+	dataKeys.mu.Unlock()
+	if ok {
+		return plain, nil
+	}
+
+	w, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), keyProviderTimeout)
+	defer cancel()
+	plain, err = keyProvider.UnwrapKey(ctx, keyID, w)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKeys.mu.Lock()
+	// keep the cache bounded
+	if len(dataKeys.unwrapped) >= 1000 {
+		dataKeys.unwrapped = map[string][]byte{}
+	}
+	dataKeys.unwrapped[cacheKey] = plain
+	dataKeys.mu.Unlock()
+	return plain, nil
+}
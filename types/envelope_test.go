@@ -0,0 +1,372 @@
+package types
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func writeKeyFile(t *testing.T, current string, keys ...string) string {
+	file := map[string]interface{}{"current": current, "keys": map[string]string{}}
+	for _, id := range keys {
+		file["keys"].(map[string]string)[id] = strings.Repeat(id[:1], 32)
+	}
+	b, _ := json.Marshal(file)
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// memoryDataKeyStore keeps the data keys like the database does
+type memoryDataKeyStore struct {
+	mu   sync.Mutex
+	keys map[int]StoredDataKey
+	ids  map[DataKeyScope]int
+}
+
+func newMemoryDataKeyStore() *memoryDataKeyStore {
+	return &memoryDataKeyStore{keys: map[int]StoredDataKey{}, ids: map[DataKeyScope]int{}}
+}
+
+func (s *memoryDataKeyStore) DataKey(ctx context.Context, id int) (StoredDataKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dk, ok := s.keys[id]
+	if !ok {
+		return dk, ErrNoDataKey
+	}
+	return dk, nil
+}
+
+func (s *memoryDataKeyStore) DataKeyByScope(ctx context.Context, scope DataKeyScope) (StoredDataKey, error) {
+	s.mu.Lock()
+	id, ok := s.ids[scope]
+	s.mu.Unlock()
+	if !ok {
+		return StoredDataKey{}, ErrNoDataKey
+	}
+	return s.DataKey(ctx, id)
+}
+
+func (s *memoryDataKeyStore) CreateDataKey(ctx context.Context, scope DataKeyScope, keyID string, wrapped []byte) (StoredDataKey, error) {
+	s.mu.Lock()
+	if _, ok := s.ids[scope]; !ok {
+		id := len(s.keys) + 1
+		s.keys[id] = StoredDataKey{ID: id, Scope: scope, KeyID: keyID, Wrapped: wrapped}
+		s.ids[scope] = id
+	}
+	s.mu.Unlock()
+	return s.DataKeyByScope(ctx, scope)
+}
+
+func (s *memoryDataKeyStore) UpdateDataKey(ctx context.Context, dk StoredDataKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[dk.ID] = dk
+	return nil
+}
+
+func (s *memoryDataKeyStore) delete(scope DataKeyScope) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, s.ids[scope])
+	delete(s.ids, scope)
+}
+
+func useDataKeyStore(t *testing.T, store DataKeyStore) {
+	kp, s := keyProvider, dataKeyStore
+	t.Cleanup(func() {
+		SetKeyProvider(kp)
+		SetDataKeyStore(s)
+	})
+	SetDataKeyStore(store)
+}
+
+func encryptWithDataKey(t *testing.T, scope DataKeyScope, plain string) string {
+	t.Helper()
+	dk, err := DataKeyFor(context.Background(), scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := OptionallyEncryptedString(plain).EncryptWith(dk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encrypted
+}
+
+func TestEnvelopeFileKeyProvider(t *testing.T) {
+	store := newMemoryDataKeyStore()
+	useDataKeyStore(t, store)
+
+	kp, err := NewFileKeyProvider(writeKeyFile(t, "a", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetKeyProvider(kp)
+
+	if _, err := encryptString("secret"); err == nil {
+		t.Error("expected an error when encrypting without a data key")
+	}
+
+	customer := DataKeyScope{App: "exactonline", ClientID: "customer"}
+	other := DataKeyScope{App: "exactonline", ClientID: "other"}
+	encrypted := encryptWithDataKey(t, customer, "secret")
+	otherEncrypted := encryptWithDataKey(t, other, "other secret")
+	inner, _ := parseEncrypted(encrypted)
+	if inner.DataKeyID == 0 || inner.DataKey != "" || inner.KeyID != "" || inner.Mac != "" {
+		t.Errorf("expected an envelope payload with the id of the data key, got %+v", inner)
+	}
+
+	// rotate the key-encryption key
+	kp, err = NewFileKeyProvider(writeKeyFile(t, "b", "a", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetKeyProvider(kp)
+	got, err := decryptString(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "secret" {
+		t.Errorf("decryptString() got = %v, want secret", got)
+	}
+	if state := EncryptionState(encrypted); state != KeyStatePrevious {
+		t.Errorf("EncryptionState() got = %v, want %v", state, KeyStatePrevious)
+	}
+
+	// only the data key is wrapped again, the value stays the same
+	reencrypted, err := Reencrypt(context.Background(), encrypted, customer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reencrypted != encrypted {
+		t.Error("expected the value not to change")
+	}
+	if dk := store.keys[inner.DataKeyID]; dk.KeyID != "b" {
+		t.Errorf("expected the data key to be wrapped with b, got %s", dk.KeyID)
+	}
+	if state := EncryptionState(encrypted); state != KeyStateCurrent {
+		t.Errorf("EncryptionState() got = %v, want %v", state, KeyStateCurrent)
+	}
+
+	// deleting the data key of the customer shreds its values only
+	store.delete(customer)
+	ForgetDataKey(customer)
+	if _, err := decryptString(encrypted); !errors.Is(err, ErrNoDataKey) {
+		t.Errorf("expected ErrNoDataKey after deleting the data key, got %v", err)
+	}
+	if got, err := decryptString(otherEncrypted); err != nil || got != "other secret" {
+		t.Errorf("expected the values of other clients to stay readable, got %q, %v", got, err)
+	}
+}
+
+func TestEnvelopeHTTPKeyProvider(t *testing.T) {
+	store := newMemoryDataKeyStore()
+	useDataKeyStore(t, store)
+
+	// local stand-in for a KMS
+	fkp, err := NewFileKeyProvider(writeKeyFile(t, "k", "k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wraps, unwraps := 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		req := struct {
+			KeyID      string `json:"key_id"`
+			Plaintext  []byte `json:"plaintext"`
+			Ciphertext []byte `json:"ciphertext"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		switch r.URL.Path {
+		case "/wrap":
+			wraps++
+			b, err := fkp.WrapKey(r.Context(), req.KeyID, req.Plaintext)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string][]byte{"ciphertext": b})
+		case "/unwrap":
+			unwraps++
+			b, err := fkp.UnwrapKey(r.Context(), req.KeyID, req.Ciphertext)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string][]byte{"plaintext": b})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	SetKeyProvider(NewHTTPKeyProvider(ts.URL, "k", "token"))
+	customer := DataKeyScope{App: "xero", Namespace: "staging", ClientID: "customer"}
+	values := []string{}
+	for _, plain := range []string{"one", "two", "three"} {
+		values = append(values, encryptWithDataKey(t, customer, plain))
+	}
+	// the values of a client share its data key
+	if wraps != 1 {
+		t.Errorf("expected a single data key for the client, got %d wraps", wraps)
+	}
+	encryptWithDataKey(t, DataKeyScope{App: "xero", ClientID: "customer"}, "four")
+	if wraps != 2 {
+		t.Errorf("expected a data key per namespace, got %d wraps", wraps)
+	}
+
+	// a new process unwraps the data key once
+	SetKeyProvider(NewHTTPKeyProvider(ts.URL, "k", "token"))
+	for i, plain := range []string{"one", "two", "three"} {
+		got, err := decryptString(values[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != plain {
+			t.Errorf("decryptString() got = %v, want %v", got, plain)
+		}
+	}
+	encryptWithDataKey(t, customer, "five")
+	if wraps != 2 || unwraps != 1 {
+		t.Errorf("expected the data key to be unwrapped once, got %d wraps and %d unwraps", wraps, unwraps)
+	}
+
+	SetKeyProvider(NewHTTPKeyProvider(ts.URL, "k", "wrong"))
+	if _, err := decryptString(values[0]); err == nil {
+		t.Error("expected an error when the key provider refuses")
+	}
+}
+
+func TestEnvelopeInlineDataKey(t *testing.T) {
+	useDataKeyStore(t, newMemoryDataKeyStore())
+
+	kp, err := NewFileKeyProvider(writeKeyFile(t, "a", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetKeyProvider(kp)
+
+	// a value that carries its own wrapped data key
+	plain := []byte(strings.Repeat("d", 32))
+	wrapped, err := kp.WrapKey(context.Background(), "a", plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, _ := newGCM(plain)
+	nonce := newNonce()
+	sealed := aead.Seal(nil, nonce, []byte("secret"), nil)
+	j, _ := json.Marshal(optionallyEncryptedStringInternal{
+		IV:      base64.StdEncoding.EncodeToString(nonce),
+		Value:   base64.StdEncoding.EncodeToString(sealed[:len(sealed)-aead.Overhead()]),
+		Tag:     base64.StdEncoding.EncodeToString(sealed[len(sealed)-aead.Overhead():]),
+		KeyID:   "a",
+		DataKey: base64.StdEncoding.EncodeToString(wrapped),
+	})
+	encrypted := base64.StdEncoding.EncodeToString(j)
+
+	if got, err := decryptString(encrypted); err != nil || got != "secret" {
+		t.Fatalf("decryptString() got = %q, %v, want secret", got, err)
+	}
+	if state := EncryptionState(encrypted); state != KeyStatePrevious {
+		t.Errorf("EncryptionState() got = %v, want %v", state, KeyStatePrevious)
+	}
+
+	reencrypted, err := Reencrypt(context.Background(), encrypted, DataKeyScope{App: "xero", ClientID: "customer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inner, _ := parseEncrypted(reencrypted); inner.DataKeyID == 0 || inner.DataKey != "" {
+		t.Errorf("expected the value to use the data key of the client, got %+v", inner)
+	}
+	if state := EncryptionState(reencrypted); state != KeyStateCurrent {
+		t.Errorf("EncryptionState() got = %v, want %v", state, KeyStateCurrent)
+	}
+}
+
+func TestNewKeyProvider(t *testing.T) {
+	t.Setenv("KEY_PROVIDER_KEY_ID", "")
+	if _, err := NewKeyProvider("https://kms.example.com/v1"); err == nil {
+		t.Error("expected an error without KEY_PROVIDER_KEY_ID")
+	}
+
+	t.Setenv("KEY_PROVIDER_KEY_ID", "k")
+	if _, err := NewKeyProvider("https://kms.example.com/v1"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncryptedValuesFitColumns(t *testing.T) {
+	useDataKeyStore(t, newMemoryDataKeyStore())
+	appKey, cipher := AppKey, Cipher
+	defer func() {
+		AppKey, Cipher = appKey, cipher
+	}()
+	AppKey = []byte("00000000000000000000000000000000")
+
+	kp, err := NewFileKeyProvider(writeKeyFile(t, "2024-01", "2024-01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the sizes of the columns in assets/empty.mysql.sql
+	tests := []struct {
+		name   string
+		length int
+		column int
+	}{
+		{"short client secret", 8, 65535},
+		{"client secret", 40, 65535},
+		{"long client secret", 128, 65535},
+		{"refresh token", 64, 2048},
+		{"long refresh token", 512, 2048},
+		{"jwt access token", 4096, 8192},
+	}
+
+	formats := []struct {
+		name   string
+		cipher string
+		kp     KeyProvider
+	}{
+		{CipherAES256CBC, CipherAES256CBC, nil},
+		{CipherAES256GCM, CipherAES256GCM, nil},
+		{"envelope", CipherAES256GCM, kp},
+	}
+
+	scope := DataKeyScope{App: "exactonline", ClientID: "customer"}
+	for _, tt := range tests {
+		plain := strings.Repeat("x", tt.length)
+		for _, f := range formats {
+			Cipher = f.cipher
+			SetKeyProvider(f.kp)
+			var encrypted string
+			var err error
+			if f.kp != nil {
+				encrypted = encryptWithDataKey(t, scope, plain)
+			} else {
+				encrypted, err = encryptString(plain)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(encrypted) > tt.column {
+				t.Errorf("%s encrypted with %s is %d characters, the column fits %d", tt.name, f.name, len(encrypted), tt.column)
+			}
+		}
+	}
+}
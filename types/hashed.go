@@ -1,10 +1,14 @@
 package types
 
 import (
+	"bytes"
+	"crypto/hmac"
 	"crypto/sha256"
 	"database/sql/driver"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"os"
 	"strings"
 )
 
@@ -12,26 +16,76 @@ type HashedString struct {
 	hash string
 }
 
+// HashKey is the secret the lookup hashes are computed with (HMAC-SHA256).
+// It's read from HASH_KEY and has to be different from APP_KEY. Without it
+// the hashes are plain SHA-256
+var HashKey []byte
+
+// LegacyHashLookups makes lookups try the plain SHA-256 hash as well, for
+// rows that weren't rehashed with HASH_KEY yet. Disable it with
+// HASH_LEGACY_LOOKUPS=false once all rows are rehashed
+var LegacyHashLookups = true
+
+func init() {
+	HashKey = parseKey(os.Getenv("HASH_KEY"))
+	if len(HashKey) > 0 && bytes.Equal(HashKey, AppKey) {
+		panic("HASH_KEY has to be different from APP_KEY")
+	}
+	LegacyHashLookups = os.Getenv("HASH_LEGACY_LOOKUPS") != "false"
+}
+
 // NewHashedString creates a new HashedString from the provided value(s).
 // If multiple strings are provided, they are concatenated with a '|' separator
 // before hashing. An empty input results in an empty HashedString.
 func NewHashedString(value ...string) HashedString {
-	if len(value) == 0 {
+	fullString := joinHashed(value)
+	if fullString == "" {
 		return HashedString{hash: ""}
 	}
-	fullString := ""
-	for _, v := range value {
-		fullString += v + "|"
+
+	if len(HashKey) == 0 {
+		return newLegacyHashedString(fullString)
 	}
-	fullString = strings.TrimSuffix(fullString, "|")
+
+	h := hmac.New(sha256.New, HashKey)
+	h.Write([]byte(fullString))
+	return HashedString{hash: hex.EncodeToString(h.Sum(nil))}
+}
+
+// NewLegacyHashedString creates the plain SHA-256 HashedString the values
+// were hashed with before HASH_KEY
+func NewLegacyHashedString(value ...string) HashedString {
+	fullString := joinHashed(value)
 	if fullString == "" {
 		return HashedString{hash: ""}
 	}
+	return newLegacyHashedString(fullString)
+}
+
+// NewLookupHashedStrings returns the hashes to look a value up with: the
+// current one and, during the migration to HASH_KEY, the legacy one. There
+// are always two so queries can use a fixed number of parameters
+func NewLookupHashedStrings(value ...string) [2]HashedString {
+	current := NewHashedString(value...)
+	if !LegacyHashLookups {
+		return [2]HashedString{current, current}
+	}
+	return [2]HashedString{current, NewLegacyHashedString(value...)}
+}
 
+func newLegacyHashedString(fullString string) HashedString {
 	hashed := sha256.Sum256([]byte(fullString))
 	return HashedString{hash: fmt.Sprintf("%x", hashed[:])}
 }
 
+func joinHashed(value []string) string {
+	fullString := ""
+	for _, v := range value {
+		fullString += v + "|"
+	}
+	return strings.TrimSuffix(fullString, "|")
+}
+
 func (oes HashedString) String() string {
 	return oes.hash
 }
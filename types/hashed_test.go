@@ -0,0 +1,41 @@
+package types
+
+import "testing"
+
+func TestHashKey(t *testing.T) {
+	defer func(key []byte, legacy bool) {
+		HashKey, LegacyHashLookups = key, legacy
+	}(HashKey, LegacyHashLookups)
+
+	HashKey = nil
+	legacy := NewHashedString("AT", "client", "token")
+	if legacy != NewLegacyHashedString("AT", "client", "token") {
+		t.Fatalf("expected plain sha256 without HASH_KEY")
+	}
+
+	HashKey = []byte("0123456789abcdefghijklmnopqrstuv")
+	keyed := NewHashedString("AT", "client", "token")
+	if keyed == legacy || len(keyed.String()) != 64 {
+		t.Fatalf("expected a different hmac of the same length, got %s", keyed)
+	}
+
+	HashKey = []byte("vutsrqponmlkjihgfedcba9876543210")
+	if NewHashedString("AT", "client", "token") == keyed {
+		t.Errorf("expected the hash to depend on HASH_KEY")
+	}
+
+	LegacyHashLookups = true
+	lookup := NewLookupHashedStrings("AT", "client", "token")
+	if lookup[1] != legacy {
+		t.Errorf("expected the legacy hash to be looked up")
+	}
+	LegacyHashLookups = false
+	lookup = NewLookupHashedStrings("AT", "client", "token")
+	if lookup[0] != lookup[1] || lookup[1] == legacy {
+		t.Errorf("expected only the keyed hash to be looked up")
+	}
+
+	if NewHashedString() != (HashedString{}) || NewHashedString("") != (HashedString{}) {
+		t.Errorf("expected empty hash for empty input")
+	}
+}
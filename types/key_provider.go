@@ -0,0 +1,197 @@
+package types
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// KeyProvider wraps and unwraps data keys with a key-encryption key. The
+// key-encryption keys never leave the provider (a key file or a KMS)
+type KeyProvider interface {
+	// KeyID returns the id of the key-encryption key new data keys are
+	// wrapped with
+	KeyID() string
+	WrapKey(ctx context.Context, keyID string, dataKey []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// NewKeyProvider creates the key provider from KEY_PROVIDER:
+//
+//	file:/etc/oauth-proxy/keys.json  local key file
+//	https://kms.example.com/v1       KMS-style http api
+func NewKeyProvider(uri string) (KeyProvider, error) {
+	if path, ok := strings.CutPrefix(uri, "file:"); ok {
+		return NewFileKeyProvider(strings.TrimPrefix(path, "//"))
+	}
+	if strings.HasPrefix(uri, "https://") || strings.HasPrefix(uri, "http://") {
+		keyID := os.Getenv("KEY_PROVIDER_KEY_ID")
+		if keyID == "" {
+			return nil, errors.New("KEY_PROVIDER_KEY_ID is required for an http key provider")
+		}
+		return NewHTTPKeyProvider(uri, keyID, os.Getenv("KEY_PROVIDER_TOKEN")), nil
+	}
+	return nil, fmt.Errorf("unsupported key provider %s", uri)
+}
+
+// FileKeyProvider reads the key-encryption keys from a json file:
+//
+//	{"current": "2024-01", "keys": {"2024-01": "base64:...", "2023-06": "base64:..."}}
+//
+// To rotate add a new key and make it current. Removing a key makes all data
+// wrapped with it unreadable
+type FileKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := struct {
+		Current string            `json:"current"`
+		Keys    map[string]string `json:"keys"`
+	}{}
+	err = json.Unmarshal(b, &file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key file %s: %w", path, err)
+	}
+
+	kp := &FileKeyProvider{current: file.Current, keys: map[string][]byte{}}
+	for id, k := range file.Keys {
+		key := parseKey(k)
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %s in %s isn't 32 bytes", id, path)
+		}
+		kp.keys[id] = key
+	}
+	if _, ok := kp.keys[kp.current]; !ok {
+		return nil, fmt.Errorf("current key %q isn't in %s", kp.current, path)
+	}
+	return kp, nil
+}
+
+func (kp *FileKeyProvider) KeyID() string {
+	return kp.current
+}
+
+func (kp *FileKeyProvider) WrapKey(ctx context.Context, keyID string, dataKey []byte) ([]byte, error) {
+	aead, err := kp.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, []byte(keyID)), nil
+}
+
+func (kp *FileKeyProvider) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	aead, err := kp.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("invalid wrapped key")
+	}
+	nonce, ciphertext := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(keyID))
+}
+
+func (kp *FileKeyProvider) aead(keyID string) (cipher.AEAD, error) {
+	key, ok := kp.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", keyID)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// HTTPKeyProvider wraps and unwraps data keys with a KMS-style http api:
+//
+//	POST {url}/wrap    {"key_id": "...", "plaintext": "<base64>"}  => {"ciphertext": "<base64>"}
+//	POST {url}/unwrap  {"key_id": "...", "ciphertext": "<base64>"} => {"plaintext": "<base64>"}
+//
+// The token is sent as a bearer token
+type HTTPKeyProvider struct {
+	url    string
+	keyID  string
+	token  string
+	Client *http.Client
+}
+
+func NewHTTPKeyProvider(url, keyID, token string) *HTTPKeyProvider {
+	return &HTTPKeyProvider{
+		url:    strings.TrimSuffix(url, "/"),
+		keyID:  keyID,
+		token:  token,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (kp *HTTPKeyProvider) KeyID() string {
+	return kp.keyID
+}
+
+func (kp *HTTPKeyProvider) WrapKey(ctx context.Context, keyID string, dataKey []byte) ([]byte, error) {
+	resp := struct {
+		Ciphertext []byte `json:"ciphertext"`
+	}{}
+	err := kp.post(ctx, "/wrap", map[string]interface{}{"key_id": keyID, "plaintext": dataKey}, &resp)
+	return resp.Ciphertext, err
+}
+
+func (kp *HTTPKeyProvider) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	resp := struct {
+		Plaintext []byte `json:"plaintext"`
+	}{}
+	err := kp.post(ctx, "/unwrap", map[string]interface{}{"key_id": keyID, "ciphertext": wrapped}, &resp)
+	return resp.Plaintext, err
+}
+
+func (kp *HTTPKeyProvider) post(ctx context.Context, path string, body interface{}, v interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, kp.url+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if kp.token != "" {
+		req.Header.Set("Authorization", "Bearer "+kp.token)
+	}
+
+	resp, err := kp.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("key provider %s returned %s: %s", path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}